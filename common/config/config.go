@@ -1,80 +1,367 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+type ServerConfig struct {
+	Host            string        `yaml:"host" env:"HOST" flag:"host" usage:"address the HTTP server listens on"`
+	ReadTimeout     time.Duration `yaml:"read_timeout" env:"SERVER_READ_TIMEOUT" flag:"server-read-timeout" usage:"maximum duration for reading a request"`
+	WriteTimeout    time.Duration `yaml:"write_timeout" env:"SERVER_WRITE_TIMEOUT" flag:"server-write-timeout" usage:"maximum duration for writing a response"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout" env:"SERVER_IDLE_TIMEOUT" flag:"server-idle-timeout" usage:"maximum keep-alive idle duration"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SERVER_SHUTDOWN_TIMEOUT" flag:"server-shutdown-timeout" usage:"grace period for in-flight requests on shutdown"`
+	QueryTimeout    time.Duration `yaml:"query_timeout" env:"SERVER_QUERY_TIMEOUT" flag:"server-query-timeout" usage:"deadline for read-only routes"`
+	MutationTimeout time.Duration `yaml:"mutation_timeout" env:"SERVER_MUTATION_TIMEOUT" flag:"server-mutation-timeout" usage:"deadline for routes that create or change data"`
+	MaxBodyBytes    int64         `yaml:"max_body_bytes" env:"SERVER_MAX_BODY_BYTES" flag:"server-max-body-bytes" usage:"maximum request body size"`
+	IdempotencyTTL  time.Duration `yaml:"idempotency_ttl" env:"SERVER_IDEMPOTENCY_TTL" flag:"server-idempotency-ttl" usage:"how long responses are kept for replay under an Idempotency-Key"`
+	ErrorFormat     string        `yaml:"error_format" env:"SERVER_ERROR_FORMAT" flag:"server-error-format" usage:"error body format: problem (RFC 7807) or legacy"`
+}
+
+type CORSConfig struct {
+	AllowedOrigins   []string      `yaml:"allowed_origins" env:"CORS_ALLOWED_ORIGINS" flag:"cors-allowed-origins" usage:"comma separated origins allowed to call the API, * for any (empty disables CORS)"`
+	AllowedMethods   []string      `yaml:"allowed_methods" env:"CORS_ALLOWED_METHODS" flag:"cors-allowed-methods" usage:"comma separated methods allowed in preflight requests"`
+	AllowedHeaders   []string      `yaml:"allowed_headers" env:"CORS_ALLOWED_HEADERS" flag:"cors-allowed-headers" usage:"comma separated request headers allowed in preflight requests"`
+	ExposedHeaders   []string      `yaml:"exposed_headers" env:"CORS_EXPOSED_HEADERS" flag:"cors-exposed-headers" usage:"comma separated response headers readable by the browser"`
+	AllowCredentials bool          `yaml:"allow_credentials" env:"CORS_ALLOW_CREDENTIALS" flag:"cors-allow-credentials" usage:"allow cookies and authorization headers"`
+	MaxAge           time.Duration `yaml:"max_age" env:"CORS_MAX_AGE" flag:"cors-max-age" usage:"how long browsers may cache preflight responses"`
+}
+
+type ValidationConfig struct {
+	AllowedImageHosts []string `yaml:"allowed_image_hosts" env:"VALIDATION_ALLOWED_IMAGE_HOSTS" flag:"validation-allowed-image-hosts" usage:"comma separated hosts product images may be served from, *.example.com for subdomains (empty allows any)"`
+}
+
+type MoneyConfig struct {
+	DefaultCurrency string `yaml:"default_currency" env:"MONEY_DEFAULT_CURRENCY" flag:"money-default-currency" usage:"ISO 4217 currency of price filters without a currency, that exchange rates are quoted against, and of prices migrated from the old float column"`
+}
+
+type DatabaseConfig struct {
+	Name            string        `yaml:"name" env:"DATABASE_NAME" flag:"database-name" usage:"database name"`
+	User            string        `yaml:"user" env:"DATABASE_USER" flag:"database-user" usage:"database user"`
+	Password        Secret        `yaml:"password" env:"DATABASE_PASSWORD" flag:"database-password" usage:"database password"`
+	Host            string        `yaml:"host" env:"DATABASE_HOST" flag:"database-host" usage:"database host"`
+	Port            int           `yaml:"port" env:"DATABASE_PORT" flag:"database-port" usage:"database port"`
+	TimeZone        string        `yaml:"timezone" env:"TZ" flag:"database-timezone" usage:"session time zone"`
+	SSLMode         string        `yaml:"sslmode" env:"DATABASE_SSLMODE" flag:"database-sslmode" usage:"disable, allow, prefer, require, verify-ca or verify-full"`
+	SSLRootCert     string        `yaml:"sslrootcert" env:"DATABASE_SSLROOTCERT" flag:"database-sslrootcert" usage:"path to the CA certificate"`
+	SSLCert         string        `yaml:"sslcert" env:"DATABASE_SSLCERT" flag:"database-sslcert" usage:"path to the client certificate"`
+	SSLKey          string        `yaml:"sslkey" env:"DATABASE_SSLKEY" flag:"database-sslkey" usage:"path to the client certificate key"`
+	MaxOpenConns    int           `yaml:"max_open_conns" env:"DATABASE_MAX_OPEN_CONNS" flag:"database-max-open-conns" usage:"maximum open connections (0 is unlimited)"`
+	MaxIdleConns    int           `yaml:"max_idle_conns" env:"DATABASE_MAX_IDLE_CONNS" flag:"database-max-idle-conns" usage:"maximum idle connections"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" env:"DATABASE_CONN_MAX_LIFETIME" flag:"database-conn-max-lifetime" usage:"maximum lifetime of a connection (0 is unlimited)"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time" env:"DATABASE_CONN_MAX_IDLE_TIME" flag:"database-conn-max-idle-time" usage:"maximum idle time of a connection (0 is unlimited)"`
+}
+
+type RedisConfig struct {
+	Host     string        `yaml:"host" env:"REDIS_HOST" flag:"redis-host" usage:"redis address"`
+	Password Secret        `yaml:"password" env:"REDIS_PASSWORD" flag:"redis-password" usage:"redis password"`
+	DB       int           `yaml:"db" env:"REDIS_DB" flag:"redis-db" usage:"redis database index"`
+	Timeout  time.Duration `yaml:"timeout" env:"REDIS_TIMEOUT" flag:"redis-timeout" usage:"timeout for cache operations"`
+}
+
+type RabbitMQConfig struct {
+	Host           Secret `yaml:"host" env:"RABBITMQ_HOST" flag:"rabbitmq-host" usage:"AMQP URL"`
+	Queue          string `yaml:"queue" env:"RABBITMQ_QUEUE" flag:"rabbitmq-queue" usage:"queue for product creation messages"`
+	LowStockQueue  string `yaml:"low_stock_queue" env:"RABBITMQ_LOW_STOCK_QUEUE" flag:"rabbitmq-low-stock-queue" usage:"queue for low stock events"`
+	EventsExchange string `yaml:"events_exchange" env:"RABBITMQ_EVENTS_EXCHANGE" flag:"rabbitmq-events-exchange" usage:"fanout exchange for product events"`
+}
+
 type AWSConfig struct {
-	AccessKey string
-	SecretKey string
-	Region string
-	BucketName string
+	AccessKey  Secret `yaml:"access_key_id" env:"AWS_ACCESS_KEY_ID" flag:"aws-access-key-id" usage:"AWS access key ID"`
+	SecretKey  Secret `yaml:"secret_access_key" env:"AWS_SECRET_ACCESS_KEY" flag:"aws-secret-access-key" usage:"AWS secret access key"`
+	Region     string `yaml:"region" env:"AWS_BUCKET_REGION" flag:"aws-region" usage:"region of the S3 bucket"`
+	BucketName string `yaml:"bucket_name" env:"S3_BUCKET_NAME" flag:"s3-bucket-name" usage:"S3 bucket for compressed images"`
+}
+
+type AdminConfig struct {
+	Host  string `yaml:"host" env:"ADMIN_HOST" flag:"admin-host" usage:"address of the admin listener for health checks"`
+	Token Secret `yaml:"token" env:"ADMIN_TOKEN" flag:"admin-token" usage:"bearer token for admin only API operations (empty disables them)"`
+}
+
+type PricingConfig struct {
+	ScheduleInterval time.Duration `yaml:"schedule_interval" env:"PRICING_SCHEDULE_INTERVAL" flag:"pricing-schedule-interval" usage:"how often scheduled price changes are started and ended (0 disables it)"`
+	BatchSize        int           `yaml:"batch_size" env:"PRICING_BATCH_SIZE" flag:"pricing-batch-size" usage:"scheduled price changes applied per transaction"`
+}
+
+type InventoryConfig struct {
+	ReservationTTL    time.Duration `yaml:"reservation_ttl" env:"INVENTORY_RESERVATION_TTL" flag:"inventory-reservation-ttl" usage:"how long a reservation holds stock when it does not ask for a TTL"`
+	MaxReservationTTL time.Duration `yaml:"max_reservation_ttl" env:"INVENTORY_MAX_RESERVATION_TTL" flag:"inventory-max-reservation-ttl" usage:"longest TTL a reservation may ask for"`
+	ExpiryInterval    time.Duration `yaml:"expiry_interval" env:"INVENTORY_EXPIRY_INTERVAL" flag:"inventory-expiry-interval" usage:"how often expired reservations release their stock (0 disables it)"`
+	BatchSize         int           `yaml:"batch_size" env:"INVENTORY_BATCH_SIZE" flag:"inventory-batch-size" usage:"expired reservations released per transaction"`
+}
+
+type ImportsConfig struct {
+	MaxBytes     int64         `yaml:"max_bytes" env:"IMPORTS_MAX_BYTES" flag:"imports-max-bytes" usage:"largest accepted import upload"`
+	MaxRows      int           `yaml:"max_rows" env:"IMPORTS_MAX_ROWS" flag:"imports-max-rows" usage:"most products an import may hold"`
+	BatchSize    int           `yaml:"batch_size" env:"IMPORTS_BATCH_SIZE" flag:"imports-batch-size" usage:"import rows processed per transaction"`
+	PollInterval time.Duration `yaml:"poll_interval" env:"IMPORTS_POLL_INTERVAL" flag:"imports-poll-interval" usage:"how often pending imports are looked for (0 disables processing them)"`
+	ClaimTimeout time.Duration `yaml:"claim_timeout" env:"IMPORTS_CLAIM_TIMEOUT" flag:"imports-claim-timeout" usage:"how long a running import may go without progress before another worker takes it over"`
+}
+
+type ExportsConfig struct {
+	Timeout      time.Duration `yaml:"timeout" env:"EXPORTS_TIMEOUT" flag:"exports-timeout" usage:"deadline of an export streamed in the response"`
+	BatchSize    int           `yaml:"batch_size" env:"EXPORTS_BATCH_SIZE" flag:"exports-batch-size" usage:"products fetched from the export cursor at a time"`
+	PollInterval time.Duration `yaml:"poll_interval" env:"EXPORTS_POLL_INTERVAL" flag:"exports-poll-interval" usage:"how often pending background exports are looked for (0 disables processing them)"`
+	ClaimTimeout time.Duration `yaml:"claim_timeout" env:"EXPORTS_CLAIM_TIMEOUT" flag:"exports-claim-timeout" usage:"how long a running export may go without progress before another worker takes it over"`
+	Prefix       string        `yaml:"prefix" env:"EXPORTS_PREFIX" flag:"exports-prefix" usage:"key prefix of background exports in the S3 bucket"`
+	URLExpiry    time.Duration `yaml:"url_expiry" env:"EXPORTS_URL_EXPIRY" flag:"exports-url-expiry" usage:"how long the download links of background exports stay valid"`
+}
+
+type FeedsConfig struct {
+	Queue      string        `yaml:"queue" env:"FEEDS_QUEUE" flag:"feeds-queue" usage:"queue of product events that keep feeds up to date"`
+	Prefetch   int           `yaml:"prefetch" env:"FEEDS_PREFETCH" flag:"feeds-prefetch" usage:"product events a replica takes from the feeds queue before acknowledging them"`
+	ProductURL string        `yaml:"product_url" env:"FEEDS_PRODUCT_URL" flag:"feeds-product-url" usage:"storefront link of a product, with {product_id} in it (empty disables feeds)"`
+	SellerURL  string        `yaml:"seller_url" env:"FEEDS_SELLER_URL" flag:"feeds-seller-url" usage:"storefront link of a seller, with {user_id} in it"`
+	Title      string        `yaml:"title" env:"FEEDS_TITLE" flag:"feeds-title" usage:"title of the feeds"`
+	BatchSize  int           `yaml:"batch_size" env:"FEEDS_BATCH_SIZE" flag:"feeds-batch-size" usage:"products rendered at a time when a feed is first built"`
+	Timeout    time.Duration `yaml:"timeout" env:"FEEDS_TIMEOUT" flag:"feeds-timeout" usage:"deadline of a feed request, which builds the seller's feeds the first time"`
+	MaxAge     time.Duration `yaml:"max_age" env:"FEEDS_MAX_AGE" flag:"feeds-max-age" usage:"how long clients and proxies may cache a feed"`
+}
+
+type StreamConfig struct {
+	Queue     string        `yaml:"queue" env:"STREAM_QUEUE" flag:"stream-queue" usage:"queue of product events appended to the event stream"`
+	Prefetch  int           `yaml:"prefetch" env:"STREAM_PREFETCH" flag:"stream-prefetch" usage:"product events a replica takes from the stream queue before acknowledging them"`
+	Key       string        `yaml:"key" env:"STREAM_KEY" flag:"stream-key" usage:"redis stream the events of the SSE endpoints are read from"`
+	MaxLen    int64         `yaml:"max_len" env:"STREAM_MAX_LEN" flag:"stream-max-len" usage:"about how many events the stream keeps for clients resuming with Last-Event-ID"`
+	Heartbeat time.Duration `yaml:"heartbeat" env:"STREAM_HEARTBEAT" flag:"stream-heartbeat" usage:"how often idle event streams send a comment to keep the connection open"`
+	Buffer    int           `yaml:"buffer" env:"STREAM_BUFFER" flag:"stream-buffer" usage:"events queued for a slow client before its stream is closed"`
+}
+
+type BatchConfig struct {
+	MaxIds      int `yaml:"max_ids" env:"BATCH_MAX_IDS" flag:"batch-max-ids" usage:"most products a batch fetch may ask for"`
+	MaxProducts int `yaml:"max_products" env:"BATCH_MAX_PRODUCTS" flag:"batch-max-products" usage:"most products a batch create may hold"`
+}
+
+type PurgeConfig struct {
+	Retention time.Duration `yaml:"retention" env:"PURGE_RETENTION" flag:"purge-retention" usage:"how long soft-deleted products are kept before they are purged"`
+	Interval  time.Duration `yaml:"interval" env:"PURGE_INTERVAL" flag:"purge-interval" usage:"how often the purge job runs (0 disables it)"`
+	BatchSize int           `yaml:"batch_size" env:"PURGE_BATCH_SIZE" flag:"purge-batch-size" usage:"products purged per transaction"`
+}
+
+type HealthConfig struct {
+	Timeout        time.Duration `yaml:"timeout" env:"HEALTH_TIMEOUT" flag:"health-timeout" usage:"timeout for each dependency check"`
+	MaxConsumerLag int           `yaml:"max_consumer_lag" env:"HEALTH_MAX_CONSUMER_LAG" flag:"health-max-consumer-lag" usage:"queued messages above which the consumer is not ready (0 disables)"`
+}
+
+type TracingConfig struct {
+	Exporter    string  `yaml:"exporter" env:"TRACING_EXPORTER" flag:"tracing-exporter" usage:"none, stdout or otlp"`
+	Endpoint    string  `yaml:"endpoint" env:"TRACING_ENDPOINT" flag:"tracing-endpoint" usage:"OTLP/HTTP collector host:port"`
+	Insecure    bool    `yaml:"insecure" env:"TRACING_INSECURE" flag:"tracing-insecure" usage:"send OTLP over plain HTTP"`
+	SampleRatio float64 `yaml:"sample_ratio" env:"TRACING_SAMPLE_RATIO" flag:"tracing-sample-ratio" usage:"fraction of new traces to sample"`
+}
+
+type LoggingConfig struct {
+	Level  string `yaml:"level" env:"LOG_LEVEL" flag:"log-level" usage:"trace, debug, info, warn, error, fatal or panic"`
+	Format string `yaml:"format" env:"LOG_FORMAT" flag:"log-format" usage:"json or text"`
+}
+
+type SecretsConfig struct {
+	RefreshInterval time.Duration `yaml:"refresh_interval" env:"SECRETS_REFRESH_INTERVAL" flag:"secrets-refresh-interval" usage:"how often secrets are re-read from their provider"`
 }
 
 type Config struct {
-	Host string
-	SDN string
-	Redis string
-	RabbitMQHost string
-	RabbitMQQueue string
-	AWS AWSConfig
+	Server     ServerConfig     `yaml:"server"`
+	CORS       CORSConfig       `yaml:"cors"`
+	Validation ValidationConfig `yaml:"validation"`
+	Money      MoneyConfig      `yaml:"money"`
+	Database   DatabaseConfig   `yaml:"database"`
+	Redis      RedisConfig      `yaml:"redis"`
+	RabbitMQ   RabbitMQConfig   `yaml:"rabbitmq"`
+	AWS        AWSConfig        `yaml:"aws"`
+	Secrets    SecretsConfig    `yaml:"secrets"`
+	Admin      AdminConfig      `yaml:"admin"`
+	Pricing    PricingConfig    `yaml:"pricing"`
+	Inventory  InventoryConfig  `yaml:"inventory"`
+	Imports    ImportsConfig    `yaml:"imports"`
+	Exports    ExportsConfig    `yaml:"exports"`
+	Feeds      FeedsConfig      `yaml:"feeds"`
+	Batch      BatchConfig      `yaml:"batch"`
+	Stream     StreamConfig     `yaml:"stream"`
+	Purge      PurgeConfig      `yaml:"purge"`
+	Health     HealthConfig     `yaml:"health"`
+	Tracing    TracingConfig    `yaml:"tracing"`
+	Logging    LoggingConfig    `yaml:"logging"`
+
+	// secretFiles maps secret keys to the files they were loaded from.
+	secretFiles map[string]string
 }
 
-func LoadConfig(withoutHost bool, withS3 bool) *Config {
-	host := os.Getenv("HOST")
-	if !withoutHost && len(host) < 1 {
-		logrus.Fatal("HOST is not declared")
-	}
+type Options struct {
+	WithoutHost bool
+	WithS3      bool
+}
 
-	databaseName := os.Getenv("DATABASE_NAME")
-	databaseUser := os.Getenv("DATABASE_USER")
-	databasePassword := os.Getenv("DATABASE_PASSWORD")
-	databaseHost := os.Getenv("DATABASE_HOST")
-	databasePort := os.Getenv("DATABASE_PORT")
-	timezone := os.Getenv("TZ")
-	if len(databaseName) < 1 || len(databaseUser) < 1 || len(databasePassword) < 1 || len(databaseHost) < 1 || len(databasePort) < 1 || len(timezone) < 1 {
-		logrus.Fatal("Please provide database configuration")
+func defaults() *Config {
+	return &Config{
+		Server: ServerConfig{
+			ReadTimeout:     10 * time.Second,
+			WriteTimeout:    30 * time.Second,
+			IdleTimeout:     2 * time.Minute,
+			ShutdownTimeout: 5 * time.Second,
+			QueryTimeout:    5 * time.Second,
+			MutationTimeout: 15 * time.Second,
+			MaxBodyBytes:    1 << 20,
+			IdempotencyTTL:  24 * time.Hour,
+			ErrorFormat:     "problem",
+		},
+		CORS: CORSConfig{
+			AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+			AllowedHeaders: []string{"Content-Type", "Authorization", "X-Request-ID", "Idempotency-Key", "If-Match", "If-None-Match", "Last-Event-ID"},
+			ExposedHeaders: []string{"X-Request-ID", "Idempotent-Replayed", "ETag", "Location"},
+			MaxAge:         10 * time.Minute,
+		},
+		Money: MoneyConfig{
+			DefaultCurrency: "USD",
+		},
+		Database: DatabaseConfig{
+			SSLMode:         "disable",
+			MaxOpenConns:    25,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: 30 * time.Minute,
+			ConnMaxIdleTime: 5 * time.Minute,
+		},
+		Redis: RedisConfig{
+			Timeout: time.Second,
+		},
+		RabbitMQ: RabbitMQConfig{
+			LowStockQueue:  "low_stock",
+			EventsExchange: "product_events",
+		},
+		Secrets: SecretsConfig{
+			RefreshInterval: 5 * time.Minute,
+		},
+		Admin: AdminConfig{
+			Host: ":8001",
+		},
+		Pricing: PricingConfig{
+			ScheduleInterval: time.Minute,
+			BatchSize:        100,
+		},
+		Inventory: InventoryConfig{
+			ReservationTTL:    15 * time.Minute,
+			MaxReservationTTL: 24 * time.Hour,
+			ExpiryInterval:    time.Minute,
+			BatchSize:         100,
+		},
+		Imports: ImportsConfig{
+			MaxBytes:     32 << 20,
+			MaxRows:      50000,
+			BatchSize:    200,
+			PollInterval: 5 * time.Second,
+			ClaimTimeout: 5 * time.Minute,
+		},
+		Exports: ExportsConfig{
+			Timeout:      10 * time.Minute,
+			BatchSize:    500,
+			PollInterval: 5 * time.Second,
+			ClaimTimeout: 5 * time.Minute,
+			Prefix:       "exports/",
+			URLExpiry:    time.Hour,
+		},
+		Feeds: FeedsConfig{
+			Queue:     "product_feeds",
+			Prefetch:  10,
+			Title:     "Products",
+			BatchSize: 500,
+			Timeout:   time.Minute,
+			MaxAge:    15 * time.Minute,
+		},
+		Batch: BatchConfig{
+			MaxIds:      100,
+			MaxProducts: 50,
+		},
+		Stream: StreamConfig{
+			Queue:     "product_stream",
+			Prefetch:  10,
+			Key:       "product_events",
+			MaxLen:    1000,
+			Heartbeat: 15 * time.Second,
+			Buffer:    64,
+		},
+		Purge: PurgeConfig{
+			Retention: 30 * 24 * time.Hour,
+			Interval:  time.Hour,
+			BatchSize: 100,
+		},
+		Health: HealthConfig{
+			Timeout: 2 * time.Second,
+		},
+		Logging: LoggingConfig{
+			Level:  "info",
+			Format: "json",
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			Endpoint:    "localhost:4318",
+			SampleRatio: 1,
+		},
+		secretFiles: make(map[string]string),
 	}
-	
-	sdn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=disable TimeZone=%s", databaseHost, databaseUser, databasePassword, databaseName, databasePort, timezone)
+}
 
-	redisHost := os.Getenv("REDIS_HOST")
-	if len(redisHost) < 1 {
-		logrus.Fatal("REDIS_HOST is not declared")
+// DSN builds the libpq connection string for gorm's postgres driver. The
+// password is left out; it is supplied per connection by the secret provider.
+func (d DatabaseConfig) DSN() string {
+	params := [][2]string{
+		{"host", d.Host},
+		{"user", d.User},
+		{"dbname", d.Name},
+		{"port", fmt.Sprint(d.Port)},
+		{"sslmode", d.SSLMode},
+		{"sslrootcert", d.SSLRootCert},
+		{"sslcert", d.SSLCert},
+		{"sslkey", d.SSLKey},
+		{"TimeZone", d.TimeZone},
 	}
 
-	rabbitMqHost := os.Getenv("RABBITMQ_HOST")
-	if len(rabbitMqHost) < 1 {
-		logrus.Fatal("RABBITMQ_HOST is not declared")
+	parts := make([]string, 0, len(params))
+	for _, param := range params {
+		if param[1] == "" {
+			continue
+		}
+		parts = append(parts, param[0]+"="+quoteDSNValue(param[1]))
 	}
+	return strings.Join(parts, " ")
+}
 
-	rabbitMqQueue := os.Getenv("RABBITMQ_QUEUE")
-	if len(rabbitMqQueue) < 1 {
-		logrus.Fatal("RABBITMQ_QUEUE is not declared")
+func quoteDSNValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, ` '\`) {
+		return value
 	}
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+// LoadConfig loads the configuration from the config file, environment and
+// command line flags, in increasing order of precedence. Every validation
+// problem is reported before exiting. It also serves the `config print`
+// subcommand.
+func LoadConfig(withoutHost bool, withS3 bool) *Config {
+	opts := Options{WithoutHost: withoutHost, WithS3: withS3}
+	args := os.Args[1:]
 
-	awsAccessKey := os.Getenv("AWS_ACCESS_KEY_ID")
-	awsSecretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
-	awsRegion := os.Getenv("AWS_BUCKET_REGION")
-	s3BucketName := os.Getenv("S3_BUCKET_NAME")
-	if withS3 && (len(awsAccessKey) < 1 || len(awsSecretKey) < 1 || len(awsRegion) < 1 || len(s3BucketName) < 1) {
-		logrus.Fatal("Please provide AWS S3 configuration")
+	if len(args) >= 2 && args[0] == "config" && args[1] == "print" {
+		os.Exit(runPrint(args[2:], opts, os.Stdout, os.Stderr))
 	}
 
-	return &Config{
-		Host: host,
-		SDN: sdn,
-		Redis: redisHost,
-		RabbitMQHost: rabbitMqHost,
-		RabbitMQQueue: rabbitMqQueue,
-		AWS: AWSConfig{
-			AccessKey: awsAccessKey,
-			SecretKey: awsSecretKey,
-			Region: awsRegion,
-			BucketName: s3BucketName,
-		},
+	logrus.AddHook(redactor)
+
+	conf, err := Load(args, opts)
+	if err != nil {
+		var problems Problems
+		if errors.As(err, &problems) {
+			for _, problem := range problems {
+				logrus.Error(problem)
+			}
+			logrus.Fatalf("Invalid configuration: %d problem(s) found", len(problems))
+		}
+		logrus.Fatalf("Failed to load configuration: %s", err.Error())
 	}
-}
\ No newline at end of file
+	return conf
+}
@@ -0,0 +1,202 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// field is a leaf of the Config struct together with the names it can be
+// set by in each layer.
+type field struct {
+	key    string
+	env    string
+	flag   string
+	usage  string
+	secret bool
+	value  reflect.Value
+}
+
+func fields(v reflect.Value, prefix string) []field {
+	var result []field
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		key := sf.Tag.Get("yaml")
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct && sf.Type != reflect.TypeOf(time.Duration(0)) {
+			result = append(result, fields(fv, key)...)
+			continue
+		}
+
+		result = append(result, field{
+			key:    key,
+			env:    sf.Tag.Get("env"),
+			flag:   sf.Tag.Get("flag"),
+			usage:  sf.Tag.Get("usage"),
+			secret: sf.Type == reflect.TypeOf(Secret("")),
+			value:  fv,
+		})
+	}
+	return result
+}
+
+func secretFields(c *Config) []field {
+	var result []field
+	for _, f := range fields(reflect.ValueOf(c).Elem(), "") {
+		if f.secret {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+func setField(v reflect.Value, raw string) error {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a valid duration", raw)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items).Convert(v.Type()))
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a valid integer", raw)
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a valid number", raw)
+		}
+		v.SetFloat(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a valid boolean", raw)
+		}
+		v.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// Load builds the configuration from defaults, the YAML config file
+// (--config or CONFIG_FILE), environment variables and flags, each layer
+// overriding the previous one. Every environment variable also has a _FILE
+// variant naming a file to read the value from. When the result is invalid the returned error
+// is a Problems listing everything that needs fixing, and the partially
+// loaded configuration is returned alongside it.
+func Load(args []string, opts Options) (*Config, error) {
+	return load(flag.NewFlagSet(os.Args[0], flag.ContinueOnError), args, opts)
+}
+
+func load(fs *flag.FlagSet, args []string, opts Options) (*Config, error) {
+	conf := defaults()
+	all := fields(reflect.ValueOf(conf).Elem(), "")
+
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML config file")
+	flagValues := make(map[string]string)
+	for _, f := range all {
+		name := f.flag
+		fs.Func(name, f.usage, func(raw string) error {
+			flagValues[name] = raw
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	var problems Problems
+
+	if *configFile != "" {
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(conf); err != nil && !errors.Is(err, io.EOF) {
+			problems = append(problems, fmt.Sprintf("config file %s: %s", *configFile, err.Error()))
+		}
+	}
+
+	for _, f := range all {
+		raw, ok := os.LookupEnv(f.env)
+		path, fromFile := os.LookupEnv(f.env + "_FILE")
+		if fromFile && path != "" {
+			if ok && raw != "" {
+				problems = append(problems, fmt.Sprintf("%s: set only one of %s and %s_FILE", f.key, f.env, f.env))
+				continue
+			}
+			secret, err := readSecretFile(path)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s (env %s_FILE): %s", f.key, f.env, err.Error()))
+				continue
+			}
+			raw, ok = secret.Reveal(), true
+			conf.secretFiles[f.key] = path
+		}
+		if !ok || raw == "" {
+			continue
+		}
+		if err := setField(f.value, raw); err != nil {
+			problems = append(problems, fmt.Sprintf("%s (env %s): %s", f.key, f.env, err.Error()))
+		}
+	}
+
+	for _, f := range all {
+		raw, ok := flagValues[f.flag]
+		if !ok {
+			continue
+		}
+		if err := setField(f.value, raw); err != nil {
+			problems = append(problems, fmt.Sprintf("%s (flag --%s): %s", f.key, f.flag, err.Error()))
+		}
+	}
+
+	for _, f := range secretFields(conf) {
+		redactor.add(Secret(f.value.String()))
+	}
+
+	problems = append(problems, conf.validate(opts)...)
+	if len(problems) > 0 {
+		return conf, problems
+	}
+	return conf, nil
+}
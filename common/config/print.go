@@ -0,0 +1,77 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// toYAML encodes the configuration in struct order. Secrets are only
+// written in plain text when reveal is set.
+func toYAML(v reflect.Value, reveal bool) (*yaml.Node, error) {
+	if v.Kind() == reflect.Struct && v.Type() != reflect.TypeOf(time.Duration(0)) {
+		node := &yaml.Node{Kind: yaml.MappingNode}
+		for i := 0; i < v.NumField(); i++ {
+			sf := v.Type().Field(i)
+			if !sf.IsExported() {
+				continue
+			}
+			child, err := toYAML(v.Field(i), reveal)
+			if err != nil {
+				return nil, err
+			}
+			key := &yaml.Node{Kind: yaml.ScalarNode, Value: sf.Tag.Get("yaml")}
+			node.Content = append(node.Content, key, child)
+		}
+		return node, nil
+	}
+
+	value := v.Interface()
+	if secret, ok := value.(Secret); ok && reveal {
+		value = secret.Reveal()
+	}
+	node := &yaml.Node{}
+	if err := node.Encode(value); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// runPrint implements `config print [--redacted] [flags]`. The effective
+// configuration is printed even when it is invalid, followed by the
+// validation problems.
+func runPrint(args []string, opts Options, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("config print", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	redacted := fs.Bool("redacted", false, "replace secrets with "+redactedValue)
+
+	conf, err := load(fs, args, opts)
+	var problems Problems
+	if err != nil && !errors.As(err, &problems) {
+		fmt.Fprintf(stderr, "Failed to load configuration: %s\n", err.Error())
+		return 1
+	}
+
+	node, err := toYAML(reflect.ValueOf(conf).Elem(), !*redacted)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to print configuration: %s\n", err.Error())
+		return 1
+	}
+	out, err := yaml.Marshal(node)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to print configuration: %s\n", err.Error())
+		return 1
+	}
+	stdout.Write(out)
+
+	if len(problems) > 0 {
+		fmt.Fprintf(stderr, "\nInvalid configuration:\n%s\n", problems.Error())
+		return 1
+	}
+	return 0
+}
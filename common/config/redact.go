@@ -0,0 +1,70 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// secretRedactor is a logrus hook that scrubs every known secret value from
+// log messages and fields, as a last line of defence for secrets that end up
+// inside error strings returned by third-party libraries.
+type secretRedactor struct {
+	mu     sync.RWMutex
+	values map[string]struct{}
+}
+
+var redactor = &secretRedactor{values: make(map[string]struct{})}
+
+func (r *secretRedactor) add(secret Secret) {
+	// Very short values would redact unrelated text.
+	if len(secret) < 4 {
+		return
+	}
+	r.mu.Lock()
+	r.values[secret.Reveal()] = struct{}{}
+	r.mu.Unlock()
+}
+
+func (r *secretRedactor) scrub(s string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for value := range r.values {
+		s = strings.ReplaceAll(s, value, redactedValue)
+	}
+	return s
+}
+
+func (r *secretRedactor) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (r *secretRedactor) Fire(entry *logrus.Entry) error {
+	entry.Message = r.scrub(entry.Message)
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			entry.Data[key] = r.scrub(v)
+		case error:
+			entry.Data[key] = r.scrub(v.Error())
+		case fmt.Stringer:
+			entry.Data[key] = r.scrub(v.String())
+		}
+	}
+	return nil
+}
+
+// RedactError returns err with every known secret value removed from its
+// message, for errors that are returned to callers rather than logged.
+func RedactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	scrubbed := redactor.scrub(err.Error())
+	if scrubbed == err.Error() {
+		return err
+	}
+	return fmt.Errorf("%s", scrubbed)
+}
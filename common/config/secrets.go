@@ -0,0 +1,169 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redactedValue = "[REDACTED]"
+
+// Secret holds a credential. It formats, marshals and logs as [REDACTED];
+// the plain value is only available through Reveal.
+type Secret string
+
+func (s Secret) Reveal() string {
+	return string(s)
+}
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return redactedValue
+}
+
+func (s Secret) GoString() string {
+	return s.String()
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s Secret) MarshalYAML() (interface{}, error) {
+	return s.String(), nil
+}
+
+// Secret keys understood by the providers, matching the config file keys.
+const (
+	DatabasePassword   = "database.password"
+	RedisPassword      = "redis.password"
+	RabbitMQURL        = "rabbitmq.host"
+	AWSAccessKeyID     = "aws.access_key_id"
+	AWSSecretAccessKey = "aws.secret_access_key"
+	AdminToken         = "admin.token"
+)
+
+// SecretProvider resolves the current value of a secret. Implementations
+// may fetch from an external store; callers ask again whenever they need a
+// fresh credential, so rotated values take effect without a restart.
+type SecretProvider interface {
+	Secret(ctx context.Context, key string) (Secret, error)
+}
+
+// StaticProvider serves the secrets loaded at startup.
+type StaticProvider map[string]Secret
+
+func (p StaticProvider) Secret(ctx context.Context, key string) (Secret, error) {
+	secret, ok := p[key]
+	if !ok {
+		return "", fmt.Errorf("secret %s is not configured", key)
+	}
+	return secret, nil
+}
+
+// FileProvider reads secrets from files, such as docker or kubernetes
+// mounted secrets, on every call so rotated files are picked up.
+type FileProvider map[string]string
+
+func (p FileProvider) Secret(ctx context.Context, key string) (Secret, error) {
+	path, ok := p[key]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no file", key)
+	}
+	return readSecretFile(path)
+}
+
+// ChainProvider returns the answer of the first provider that knows the key.
+type ChainProvider []SecretProvider
+
+func (p ChainProvider) Secret(ctx context.Context, key string) (Secret, error) {
+	var lastErr error
+	for _, provider := range p {
+		secret, err := provider.Secret(ctx, key)
+		if err == nil {
+			return secret, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("secret %s is not configured", key)
+	}
+	return "", lastErr
+}
+
+type cachedSecret struct {
+	value   Secret
+	fetched time.Time
+}
+
+// CachingProvider caches secrets from another provider for a refresh
+// interval. When a refresh fails the last known value is kept. Every value
+// it serves is registered for log redaction.
+type CachingProvider struct {
+	provider SecretProvider
+	interval time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedSecret
+}
+
+func NewCachingProvider(provider SecretProvider, interval time.Duration) *CachingProvider {
+	return &CachingProvider{
+		provider: provider,
+		interval: interval,
+		cache:    make(map[string]cachedSecret),
+	}
+}
+
+func (p *CachingProvider) Secret(ctx context.Context, key string) (Secret, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cached, ok := p.cache[key]
+	if ok && time.Since(cached.fetched) < p.interval {
+		return cached.value, nil
+	}
+
+	secret, err := p.provider.Secret(ctx, key)
+	if err != nil {
+		if ok {
+			return cached.value, nil
+		}
+		return "", err
+	}
+
+	redactor.add(secret)
+	p.cache[key] = cachedSecret{value: secret, fetched: time.Now()}
+	return secret, nil
+}
+
+// RefreshInterval is how long fetched credentials may be reused.
+func (p *CachingProvider) RefreshInterval() time.Duration {
+	return p.interval
+}
+
+// SecretProvider returns the default provider for this configuration:
+// secrets loaded from *_FILE variables are re-read from their files, the
+// others keep their startup value, cached for secrets.refresh_interval.
+func (c *Config) SecretProvider() *CachingProvider {
+	static := StaticProvider{}
+	for _, f := range secretFields(c) {
+		static[f.key] = Secret(f.value.String())
+	}
+	return NewCachingProvider(ChainProvider{FileProvider(c.secretFiles), static}, c.Secrets.RefreshInterval)
+}
+
+func readSecretFile(path string) (Secret, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		// The error only carries the path, never the content.
+		return "", fmt.Errorf("failed to read secret file %s: %w", path, err)
+	}
+	return Secret(strings.TrimRight(string(data), "\r\n")), nil
+}
@@ -0,0 +1,268 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aiu26/product-management/common/money"
+	"github.com/sirupsen/logrus"
+)
+
+// Problems is returned by Load when the configuration is invalid. It holds
+// every problem found rather than just the first one.
+type Problems []string
+
+func (p Problems) Error() string {
+	return "  - " + strings.Join(p, "\n  - ")
+}
+
+var sslModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+func (c *Config) validate(opts Options) Problems {
+	var problems Problems
+	required := func(key string, value string) {
+		if value == "" {
+			problems = append(problems, fmt.Sprintf("%s is required", key))
+		}
+	}
+	nonNegative := func(key string, value int64) {
+		if value < 0 {
+			problems = append(problems, fmt.Sprintf("%s must not be negative", key))
+		}
+	}
+	fileExists := func(key string, path string) {
+		if path == "" {
+			return
+		}
+		if _, err := os.Stat(path); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: cannot read %s", key, path))
+		}
+	}
+
+	if !opts.WithoutHost {
+		required("server.host", c.Server.Host)
+	}
+	nonNegative("server.read_timeout", int64(c.Server.ReadTimeout))
+	nonNegative("server.write_timeout", int64(c.Server.WriteTimeout))
+	nonNegative("server.idle_timeout", int64(c.Server.IdleTimeout))
+	nonNegative("server.shutdown_timeout", int64(c.Server.ShutdownTimeout))
+	if c.Server.QueryTimeout <= 0 {
+		problems = append(problems, "server.query_timeout must be positive")
+	}
+	if c.Server.MutationTimeout <= 0 {
+		problems = append(problems, "server.mutation_timeout must be positive")
+	}
+	if c.Server.MaxBodyBytes <= 0 {
+		problems = append(problems, "server.max_body_bytes must be positive")
+	}
+	if c.Server.IdempotencyTTL <= 0 {
+		problems = append(problems, "server.idempotency_ttl must be positive")
+	}
+	if c.Server.ErrorFormat != "problem" && c.Server.ErrorFormat != "legacy" {
+		problems = append(problems, "server.error_format must be problem or legacy")
+	}
+
+	for _, origin := range c.CORS.AllowedOrigins {
+		if origin == "*" && c.CORS.AllowCredentials {
+			problems = append(problems, "cors.allowed_origins cannot be * when cors.allow_credentials is set")
+		}
+	}
+	nonNegative("cors.max_age", int64(c.CORS.MaxAge))
+
+	for _, host := range c.Validation.AllowedImageHosts {
+		wildcard, isWildcard := strings.CutPrefix(host, "*")
+		if host == "" || strings.ContainsAny(host, "/:") || (isWildcard && !strings.HasPrefix(wildcard, ".")) {
+			problems = append(problems, fmt.Sprintf("validation.allowed_image_hosts entry %q must be a bare host name", host))
+		}
+	}
+
+	if !money.Supported(c.Money.DefaultCurrency) {
+		problems = append(problems, fmt.Sprintf("money.default_currency %q is not a supported ISO 4217 currency", c.Money.DefaultCurrency))
+	}
+
+	required("database.name", c.Database.Name)
+	required("database.user", c.Database.User)
+	required("database.password", c.Database.Password.Reveal())
+	required("database.host", c.Database.Host)
+	required("database.timezone", c.Database.TimeZone)
+	if c.Database.Port < 1 || c.Database.Port > 65535 {
+		problems = append(problems, "database.port must be between 1 and 65535")
+	}
+
+	validMode := false
+	for _, mode := range sslModes {
+		validMode = validMode || c.Database.SSLMode == mode
+	}
+	if !validMode {
+		problems = append(problems, fmt.Sprintf("database.sslmode must be one of %s", strings.Join(sslModes, ", ")))
+	}
+	if (c.Database.SSLMode == "verify-ca" || c.Database.SSLMode == "verify-full") && c.Database.SSLRootCert == "" {
+		problems = append(problems, fmt.Sprintf("database.sslrootcert is required with sslmode %s", c.Database.SSLMode))
+	}
+	if (c.Database.SSLCert == "") != (c.Database.SSLKey == "") {
+		problems = append(problems, "database.sslcert and database.sslkey must be provided together")
+	}
+	fileExists("database.sslrootcert", c.Database.SSLRootCert)
+	fileExists("database.sslcert", c.Database.SSLCert)
+	fileExists("database.sslkey", c.Database.SSLKey)
+
+	nonNegative("database.max_open_conns", int64(c.Database.MaxOpenConns))
+	nonNegative("database.max_idle_conns", int64(c.Database.MaxIdleConns))
+	if c.Database.MaxOpenConns > 0 && c.Database.MaxIdleConns > c.Database.MaxOpenConns {
+		problems = append(problems, "database.max_idle_conns must not exceed database.max_open_conns")
+	}
+	nonNegative("database.conn_max_lifetime", int64(c.Database.ConnMaxLifetime))
+	nonNegative("database.conn_max_idle_time", int64(c.Database.ConnMaxIdleTime))
+
+	required("redis.host", c.Redis.Host)
+	nonNegative("redis.db", int64(c.Redis.DB))
+	if c.Redis.Timeout <= 0 {
+		problems = append(problems, "redis.timeout must be positive")
+	}
+
+	required("rabbitmq.host", c.RabbitMQ.Host.Reveal())
+	required("rabbitmq.queue", c.RabbitMQ.Queue)
+	required("rabbitmq.low_stock_queue", c.RabbitMQ.LowStockQueue)
+	required("rabbitmq.events_exchange", c.RabbitMQ.EventsExchange)
+
+	if c.Secrets.RefreshInterval <= 0 {
+		problems = append(problems, "secrets.refresh_interval must be positive")
+	}
+
+	if c.Health.Timeout <= 0 {
+		problems = append(problems, "health.timeout must be positive")
+	}
+	nonNegative("health.max_consumer_lag", int64(c.Health.MaxConsumerLag))
+
+	nonNegative("pricing.schedule_interval", int64(c.Pricing.ScheduleInterval))
+	if c.Pricing.BatchSize <= 0 {
+		problems = append(problems, "pricing.batch_size must be positive")
+	}
+
+	if c.Inventory.ReservationTTL <= 0 {
+		problems = append(problems, "inventory.reservation_ttl must be positive")
+	}
+	if c.Inventory.MaxReservationTTL < c.Inventory.ReservationTTL {
+		problems = append(problems, "inventory.max_reservation_ttl must not be shorter than inventory.reservation_ttl")
+	}
+	nonNegative("inventory.expiry_interval", int64(c.Inventory.ExpiryInterval))
+	if c.Inventory.BatchSize <= 0 {
+		problems = append(problems, "inventory.batch_size must be positive")
+	}
+
+	if c.Imports.MaxBytes <= 0 {
+		problems = append(problems, "imports.max_bytes must be positive")
+	}
+	if c.Imports.MaxRows <= 0 {
+		problems = append(problems, "imports.max_rows must be positive")
+	}
+	if c.Imports.BatchSize <= 0 {
+		problems = append(problems, "imports.batch_size must be positive")
+	}
+	nonNegative("imports.poll_interval", int64(c.Imports.PollInterval))
+	if c.Imports.ClaimTimeout <= 0 {
+		problems = append(problems, "imports.claim_timeout must be positive")
+	}
+
+	if c.Exports.Timeout <= 0 {
+		problems = append(problems, "exports.timeout must be positive")
+	}
+	if c.Exports.BatchSize <= 0 {
+		problems = append(problems, "exports.batch_size must be positive")
+	}
+	nonNegative("exports.poll_interval", int64(c.Exports.PollInterval))
+	if c.Exports.ClaimTimeout <= 0 {
+		problems = append(problems, "exports.claim_timeout must be positive")
+	}
+	// S3 does not sign links valid for longer than a week.
+	if c.Exports.URLExpiry <= 0 || c.Exports.URLExpiry > 7*24*time.Hour {
+		problems = append(problems, "exports.url_expiry must be positive and at most 168h")
+	}
+
+	if c.Feeds.ProductURL != "" {
+		required("feeds.queue", c.Feeds.Queue)
+		if !strings.Contains(c.Feeds.ProductURL, "{product_id}") {
+			problems = append(problems, "feeds.product_url must contain {product_id}")
+		}
+		// Feeds link to the seller, which RSS requires.
+		if !strings.Contains(c.Feeds.SellerURL, "{user_id}") {
+			problems = append(problems, "feeds.seller_url must contain {user_id}")
+		}
+	}
+	if c.Feeds.Prefetch <= 0 {
+		problems = append(problems, "feeds.prefetch must be positive")
+	}
+	if c.Feeds.BatchSize <= 0 {
+		problems = append(problems, "feeds.batch_size must be positive")
+	}
+	if c.Feeds.Timeout <= 0 {
+		problems = append(problems, "feeds.timeout must be positive")
+	}
+	nonNegative("feeds.max_age", int64(c.Feeds.MaxAge))
+
+	if c.Batch.MaxIds <= 0 {
+		problems = append(problems, "batch.max_ids must be positive")
+	}
+	if c.Batch.MaxProducts <= 0 {
+		problems = append(problems, "batch.max_products must be positive")
+	}
+
+	required("stream.queue", c.Stream.Queue)
+	required("stream.key", c.Stream.Key)
+	if c.Stream.Prefetch <= 0 {
+		problems = append(problems, "stream.prefetch must be positive")
+	}
+	if c.Stream.MaxLen <= 0 {
+		problems = append(problems, "stream.max_len must be positive")
+	}
+	if c.Stream.Heartbeat <= 0 {
+		problems = append(problems, "stream.heartbeat must be positive")
+	}
+	// Each heartbeat pushes back the write deadline of the stream.
+	if c.Server.WriteTimeout > 0 && c.Stream.Heartbeat >= c.Server.WriteTimeout {
+		problems = append(problems, "stream.heartbeat must be shorter than server.write_timeout")
+	}
+	if c.Stream.Buffer <= 0 {
+		problems = append(problems, "stream.buffer must be positive")
+	}
+
+	if c.Purge.Retention <= 0 {
+		problems = append(problems, "purge.retention must be positive")
+	}
+	nonNegative("purge.interval", int64(c.Purge.Interval))
+	if c.Purge.BatchSize <= 0 {
+		problems = append(problems, "purge.batch_size must be positive")
+	}
+
+	switch c.Tracing.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		required("tracing.endpoint", c.Tracing.Endpoint)
+	default:
+		problems = append(problems, "tracing.exporter must be one of none, stdout, otlp")
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		problems = append(problems, "tracing.sample_ratio must be between 0 and 1")
+	}
+
+	if _, err := logrus.ParseLevel(c.Logging.Level); err != nil {
+		problems = append(problems, "logging.level must be one of trace, debug, info, warn, error, fatal, panic")
+	}
+	if c.Logging.Format != "json" && c.Logging.Format != "text" {
+		problems = append(problems, "logging.format must be json or text")
+	}
+
+	if opts.WithS3 {
+		required("aws.access_key_id", c.AWS.AccessKey.Reveal())
+		required("aws.secret_access_key", c.AWS.SecretKey.Reveal())
+		required("aws.region", c.AWS.Region)
+		required("aws.bucket_name", c.AWS.BucketName)
+	} else if c.AWS.BucketName != "" {
+		// The products service stores background exports in the bucket.
+		required("aws.region", c.AWS.Region)
+	}
+
+	return problems
+}
@@ -0,0 +1,46 @@
+package database
+
+import (
+	"context"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/plugin/opentelemetry/tracing"
+)
+
+// Open connects to Postgres with the configured pool settings. The password
+// is fetched from the secret provider for every new connection, so a rotated
+// password is used as soon as old connections reach their max lifetime.
+func Open(conf config.DatabaseConfig, secrets config.SecretProvider) (*gorm.DB, error) {
+	connConfig, err := pgx.ParseConfig(conf.DSN())
+	if err != nil {
+		return nil, config.RedactError(err)
+	}
+
+	sqlDB := stdlib.OpenDB(*connConfig, stdlib.OptionBeforeConnect(func(ctx context.Context, cc *pgx.ConnConfig) error {
+		password, err := secrets.Secret(ctx, config.DatabasePassword)
+		if err != nil {
+			return err
+		}
+		cc.Password = password.Reveal()
+		return nil
+	}))
+	sqlDB.SetMaxOpenConns(conf.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(conf.MaxIdleConns)
+	sqlDB.SetConnMaxLifetime(conf.ConnMaxLifetime)
+	sqlDB.SetConnMaxIdleTime(conf.ConnMaxIdleTime)
+
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{})
+	if err != nil {
+		return nil, config.RedactError(err)
+	}
+
+	// Query spans join the caller's trace when queries run with WithContext.
+	if err := db.Use(tracing.NewPlugin(tracing.WithoutMetrics(), tracing.WithoutQueryVariables())); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
@@ -0,0 +1,58 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aiu26/product-management/common/money"
+	"github.com/aiu26/product-management/common/types"
+	"gorm.io/gorm"
+)
+
+// MigratePrices converts products.price from the float column of older
+// databases to NUMERIC, and adds the currency column. Existing products get
+// defaultCurrency, and as floats hold no exact amounts, their prices are
+// rounded to the decimal places it allows. It must run before AutoMigrate,
+// which cannot add a NOT NULL column to a table with rows. It does nothing on
+// new or already migrated databases.
+func MigratePrices(db *gorm.DB, defaultCurrency string) error {
+	migrator := db.Migrator()
+	if !migrator.HasTable(&types.Product{}) {
+		return nil
+	}
+
+	columns, err := migrator.ColumnTypes(&types.Product{})
+	if err != nil {
+		return err
+	}
+	isFloat := false
+	for _, column := range columns {
+		if column.Name() == "price" {
+			switch strings.ToLower(column.DatabaseTypeName()) {
+			case "float4", "float8", "real", "double precision":
+				isFloat = true
+			}
+		}
+	}
+	if !isFloat {
+		return nil
+	}
+	exponent, ok := money.Exponent(defaultCurrency)
+	if !ok {
+		return fmt.Errorf("unsupported default currency %s", defaultCurrency)
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		convert := fmt.Sprintf("ALTER TABLE products ALTER COLUMN price TYPE numeric(19,4) USING round(price::numeric, %d)", exponent)
+		if err := tx.Exec(convert).Error; err != nil {
+			return fmt.Errorf("failed to convert price to numeric: %w", err)
+		}
+		if err := tx.Exec("ALTER TABLE products ADD COLUMN IF NOT EXISTS currency char(3)").Error; err != nil {
+			return fmt.Errorf("failed to add currency: %w", err)
+		}
+		if err := tx.Exec("UPDATE products SET currency = ? WHERE currency IS NULL", defaultCurrency).Error; err != nil {
+			return fmt.Errorf("failed to set currency: %w", err)
+		}
+		return tx.Exec("ALTER TABLE products ALTER COLUMN currency SET NOT NULL").Error
+	})
+}
@@ -0,0 +1,25 @@
+package health
+
+import (
+	"context"
+	"errors"
+)
+
+// closable matches *amqp.Connection and *amqp.Channel.
+type closable interface {
+	IsClosed() bool
+}
+
+// AMQP fails when the RabbitMQ connection or channel has been closed, which
+// happens on broker restarts and channel level protocol errors.
+func AMQP(conn closable, channel closable) Check {
+	return func(ctx context.Context) (Details, error) {
+		if conn.IsClosed() {
+			return nil, errors.New("connection is closed")
+		}
+		if channel.IsClosed() {
+			return nil, errors.New("channel is closed")
+		}
+		return nil, nil
+	}
+}
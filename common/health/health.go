@@ -0,0 +1,144 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aiu26/product-management/common/config"
+)
+
+// Details is extra per-dependency information included in the readiness
+// report, e.g. queue depth.
+type Details map[string]interface{}
+
+// Check reports whether a dependency is usable.
+type Check func(ctx context.Context) (Details, error)
+
+// Ping turns a plain ping function into a Check.
+func Ping(ping func(ctx context.Context) error) Check {
+	return func(ctx context.Context) (Details, error) {
+		return nil, ping(ctx)
+	}
+}
+
+type Result struct {
+	Status   string  `json:"status"`
+	Error    string  `json:"error,omitempty"`
+	Duration string  `json:"duration"`
+	Details  Details `json:"details,omitempty"`
+}
+
+type Report struct {
+	Status string            `json:"status"`
+	Uptime string            `json:"uptime,omitempty"`
+	Checks map[string]Result `json:"checks,omitempty"`
+}
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+type Checker struct {
+	timeout time.Duration
+	started time.Time
+
+	mu     sync.RWMutex
+	checks map[string]Check
+}
+
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{
+		timeout: timeout,
+		started: time.Now(),
+		checks:  make(map[string]Check),
+	}
+}
+
+func (c *Checker) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks[name] = check
+}
+
+// Run executes every check in parallel, each bounded by the checker timeout.
+func (c *Checker) Run(ctx context.Context) Report {
+	c.mu.RLock()
+	checks := make(map[string]Check, len(c.checks))
+	for name, check := range c.checks {
+		checks[name] = check
+	}
+	c.mu.RUnlock()
+
+	report := Report{Status: StatusOK, Checks: make(map[string]Result, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			result := c.run(ctx, check)
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[name] = result
+			if result.Status != StatusOK {
+				report.Status = StatusFail
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	return report
+}
+
+func (c *Checker) run(ctx context.Context, check Check) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan Result, 1)
+	go func() {
+		details, err := check(ctx)
+		result := Result{Status: StatusOK, Details: details}
+		if err != nil {
+			result.Status = StatusFail
+			result.Error = config.RedactError(err).Error()
+		}
+		done <- result
+	}()
+
+	var result Result
+	select {
+	case result = <-done:
+	case <-ctx.Done():
+		result = Result{Status: StatusFail, Error: "check timed out"}
+	}
+	result.Duration = time.Since(start).String()
+	return result
+}
+
+// Liveness reports that the process is up and serving requests. It does not
+// check dependencies, so a broken dependency never gets the process restarted.
+func (c *Checker) Liveness(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, Report{Status: StatusOK, Uptime: time.Since(c.started).Round(time.Second).String()})
+}
+
+// Readiness runs every dependency check and answers 503 if any fails.
+func (c *Checker) Readiness(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, c.Run(r.Context()))
+}
+
+func writeReport(w http.ResponseWriter, report Report) {
+	status := http.StatusOK
+	if report.Status != StatusOK {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,75 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// Setup configures the global logger's level and format.
+func Setup(conf config.LoggingConfig) error {
+	level, err := logrus.ParseLevel(conf.Level)
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(level)
+
+	switch conf.Format {
+	case FormatJSON:
+		logrus.SetFormatter(&logrus.JSONFormatter{
+			FieldMap: logrus.FieldMap{
+				logrus.FieldKeyMsg: "message",
+			},
+		})
+	case FormatText:
+		logrus.SetFormatter(&logrus.TextFormatter{
+			FullTimestamp: true,
+		})
+	default:
+		return fmt.Errorf("unknown log format %q", conf.Format)
+	}
+	return nil
+}
+
+type loggerKey struct{}
+
+// WithFields returns a context whose logger carries the given fields in
+// addition to the ones already attached.
+func WithFields(ctx context.Context, fields logrus.Fields) context.Context {
+	entry, ok := ctx.Value(loggerKey{}).(*logrus.Entry)
+	if !ok {
+		entry = logrus.NewEntry(logrus.StandardLogger())
+	}
+	return context.WithValue(ctx, loggerKey{}, entry.WithFields(fields))
+}
+
+// WithField is WithFields for a single field.
+func WithField(ctx context.Context, key string, value interface{}) context.Context {
+	return WithFields(ctx, logrus.Fields{key: value})
+}
+
+// FromContext returns the request scoped logger, including the trace and
+// span IDs when the context carries a span.
+func FromContext(ctx context.Context) *logrus.Entry {
+	entry, ok := ctx.Value(loggerKey{}).(*logrus.Entry)
+	if !ok {
+		entry = logrus.NewEntry(logrus.StandardLogger())
+	}
+
+	spanContext := trace.SpanContextFromContext(ctx)
+	if spanContext.IsValid() {
+		entry = entry.WithFields(logrus.Fields{
+			"trace_id": spanContext.TraceID().String(),
+			"span_id":  spanContext.SpanID().String(),
+		})
+	}
+	return entry.WithContext(ctx)
+}
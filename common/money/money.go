@@ -0,0 +1,68 @@
+package money
+
+import (
+	"sort"
+
+	"github.com/shopspring/decimal"
+)
+
+// exponents holds the number of minor unit digits of each supported ISO 4217
+// currency, e.g. 2 for USD cents and 0 for JPY.
+var exponents = map[string]int32{
+	"AED": 2, "AUD": 2, "BDT": 2, "BHD": 3, "BRL": 2, "CAD": 2, "CHF": 2,
+	"CLP": 0, "CNY": 2, "CZK": 2, "DKK": 2, "EGP": 2, "EUR": 2, "GBP": 2,
+	"HKD": 2, "HUF": 2, "IDR": 2, "ILS": 2, "INR": 2, "ISK": 0, "JOD": 3,
+	"JPY": 0, "KES": 2, "KRW": 0, "KWD": 3, "LKR": 2, "MXN": 2, "MYR": 2,
+	"NGN": 2, "NOK": 2, "NZD": 2, "OMR": 3, "PHP": 2, "PKR": 2, "PLN": 2,
+	"SAR": 2, "SEK": 2, "SGD": 2, "THB": 2, "TND": 3, "TRY": 2, "USD": 2,
+	"VND": 0, "ZAR": 2,
+}
+
+// Supported reports whether code is a currency prices can be given in.
+func Supported(code string) bool {
+	_, ok := exponents[code]
+	return ok
+}
+
+// Exponent returns the number of minor unit digits of a currency.
+func Exponent(code string) (int32, bool) {
+	exponent, ok := exponents[code]
+	return exponent, ok
+}
+
+// Currencies lists the supported currency codes in order.
+func Currencies() []string {
+	codes := make([]string, 0, len(exponents))
+	for code := range exponents {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// ValidPrecision reports whether amount can be expressed in the minor units
+// of currency, e.g. 19.99 USD but not 19.999 USD or 10.5 JPY.
+func ValidPrecision(amount decimal.Decimal, currency string) bool {
+	exponent, ok := exponents[currency]
+	if !ok {
+		return false
+	}
+	return amount.Equal(amount.Truncate(exponent))
+}
+
+// RateScale is the number of decimal places exchange rates are stored and
+// cross rates are rounded to.
+const RateScale = 12
+
+// CrossRate returns the rate converting currency A into currency B, given the
+// rates of both against the same base. It is rounded half away from zero to
+// RateScale places.
+func CrossRate(rateA, rateB decimal.Decimal) decimal.Decimal {
+	return rateB.DivRound(rateA, RateScale)
+}
+
+// Convert multiplies amount by rate and rounds the result half away from zero
+// to the minor unit of currency, the same rounding as PostgreSQL's round().
+func Convert(amount, rate decimal.Decimal, currency string) decimal.Decimal {
+	return amount.Mul(rate).Round(exponents[currency])
+}
@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// CredentialsProvider adapts a config.SecretProvider to the AWS SDK. The
+// credentials expire after the secret refresh interval, so the SDK's
+// credentials cache asks again and picks up rotated keys.
+type CredentialsProvider struct {
+	Secrets *config.CachingProvider
+}
+
+func (p CredentialsProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	accessKey, err := p.Secrets.Secret(ctx, config.AWSAccessKeyID)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	secretKey, err := p.Secrets.Secret(ctx, config.AWSSecretAccessKey)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+
+	return aws.Credentials{
+		AccessKeyID:     accessKey.Reveal(),
+		SecretAccessKey: secretKey.Reveal(),
+		Source:          "config.SecretProvider",
+		CanExpire:       true,
+		Expires:         time.Now().Add(p.Secrets.RefreshInterval()),
+	}, nil
+}
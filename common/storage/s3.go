@@ -0,0 +1,24 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// NewS3Client returns a client for the configured region, signing with the
+// AWS keys of the secret provider.
+func NewS3Client(ctx context.Context, conf config.AWSConfig, secrets *config.CachingProvider) (*s3.Client, error) {
+	cfg, err := awsConfig.LoadDefaultConfig(
+		ctx,
+		awsConfig.WithRegion(conf.Region),
+		awsConfig.WithCredentialsProvider(aws.NewCredentialsCache(CredentialsProvider{Secrets: secrets})),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return s3.NewFromConfig(cfg), nil
+}
@@ -1,5 +1,16 @@
 package types
 
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
 type User struct {
 	Id    int64  `json:"user_id" gorm:"primaryKey,autoIncrement,not null"`
 	Email string `json:"email" validate:"required,email" gorm:"not null"`
@@ -9,23 +20,437 @@ type Product struct {
 	Id               int64             `json:"product_id" gorm:"primaryKey,autoIncrement,not null"`
 	Name             string            `json:"product_name" validate:"required" gorm:"not null"`
 	Description      string            `json:"product_description" validate:"required" gorm:"not null"`
-	Price            float32           `json:"product_price" validate:"required,gt=0" gorm:"not null"`
+	Price            decimal.Decimal   `json:"product_price" gorm:"type:numeric(19,4);not null"`
+	Currency         string            `json:"product_currency" gorm:"type:char(3);not null"`
 	UserId           int64             `json:"user_id" gorm:"not null"`
 	User             User              `json:"-" gorm:"foreignkey:UserId;references:Id;constraint:OnDelete:CASCADE;not null"`
 	Images           []Image           `json:"images" gorm:"foreignKey:ProductId;references:Id;constraint:OnDelete:CASCADE"`
 	CompressedImages []CompressedImage `json:"compressed_images" gorm:"foreignKey:ProductId;references:Id;constraint:OnDelete:CASCADE"`
+	Variants         []Variant         `json:"variants" gorm:"foreignKey:ProductId;references:Id;constraint:OnDelete:CASCADE"`
+	// VariantOptions are the option values the variants combine, e.g. size
+	// S, M and L by colour red and blue, filled in for responses.
+	VariantOptions   map[string][]string `json:"variant_options,omitempty" gorm:"-"`
+	Categories       []Category        `json:"categories" gorm:"many2many:product_categories;constraint:OnDelete:CASCADE"`
+	Tags             []Tag             `json:"tags" gorm:"many2many:product_tags;constraint:OnDelete:CASCADE"`
+	Attributes       Attributes        `json:"attributes" gorm:"type:jsonb;not null;default:'{}';index:idx_products_attributes,type:gin"`
+	// Version is bumped on every change to the product, including new
+	// compressed images, and is served as its ETag.
+	Version          int64             `json:"version" gorm:"not null;default:1"`
+	CreatedAt        time.Time         `json:"created_at" gorm:"not null;default:CURRENT_TIMESTAMP;index"`
+	UpdatedAt        time.Time         `json:"updated_at" gorm:"not null;default:CURRENT_TIMESTAMP"`
+	DeletedAt        gorm.DeletedAt    `json:"deleted_at" gorm:"index"`
+	// Conversion is only set on responses to requests asking for prices in
+	// another currency, and never stored or cached.
+	Conversion       *Conversion       `json:"conversion,omitempty" gorm:"-"`
+}
+
+// CacheKey is the redis key a product is cached under, by both services.
+func CacheKey(productId int64) string {
+	return strconv.FormatInt(productId, 10)
+}
+
+// Variant is a SKU of a product: one combination of the options its
+// variants share, like size M in red. Price, when set, overrides the
+// product's, in the product's currency. Its images are compressed with the
+// product's.
+type Variant struct {
+	Id               int64             `json:"id" gorm:"primaryKey,autoIncrement,not null"`
+	ProductId        int64             `json:"-" gorm:"not null;uniqueIndex:idx_variants_options,priority:1"`
+	Sku              string            `json:"sku" gorm:"not null;uniqueIndex"`
+	Options          VariantOptions    `json:"options" gorm:"type:jsonb;not null;uniqueIndex:idx_variants_options,priority:2"`
+	Price            *decimal.Decimal  `json:"price" gorm:"type:numeric(19,4)"`
+	Images           []Image           `json:"images" gorm:"foreignKey:VariantId;references:Id;constraint:OnDelete:CASCADE"`
+	CompressedImages []CompressedImage `json:"compressed_images" gorm:"foreignKey:VariantId;references:Id;constraint:OnDelete:CASCADE"`
+	CreatedAt        time.Time         `json:"created_at" gorm:"not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt        time.Time         `json:"updated_at" gorm:"not null;default:CURRENT_TIMESTAMP"`
+	// Conversion is only set on converted responses, for variants with a
+	// price of their own.
+	Conversion       *Conversion       `json:"conversion,omitempty" gorm:"-"`
+}
+
+// VariantOptions maps option names to a variant's values, like size: M.
+type VariantOptions map[string]string
+
+func (o VariantOptions) MarshalJSON() ([]byte, error) {
+	if o == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(map[string]string(o))
+}
+
+func (o VariantOptions) Value() (driver.Value, error) {
+	return o.MarshalJSON()
+}
+
+func (o *VariantOptions) Scan(src interface{}) error {
+	return scanJSON(src, o)
+}
+
+// Category is a node of the category tree. Path lists the IDs from the root
+// down to the category itself, like /1/4/9/, so a subtree is every category
+// whose path starts with its root's. Breadcrumbs are the same chain with
+// names, filled in for responses.
+type Category struct {
+	Id          int64           `json:"id" gorm:"primaryKey,autoIncrement,not null"`
+	Name        string          `json:"name" gorm:"not null"`
+	Slug        string          `json:"slug" gorm:"not null;uniqueIndex"`
+	ParentId    *int64          `json:"parent_id" gorm:"index"`
+	Parent      *Category       `json:"-" gorm:"foreignKey:ParentId;references:Id;constraint:OnDelete:RESTRICT"`
+	Path        string          `json:"path" gorm:"not null;index:idx_categories_path,expression:path varchar_pattern_ops"`
+	// Attributes are the custom fields of the products in the category's
+	// subtree.
+	Attributes  AttributeSchema `json:"attributes" gorm:"type:jsonb;not null;default:'{}'"`
+	CreatedAt   time.Time       `json:"created_at" gorm:"not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt   time.Time       `json:"updated_at" gorm:"not null;default:CURRENT_TIMESTAMP"`
+	Breadcrumbs []Crumb         `json:"breadcrumbs,omitempty" gorm:"-"`
+}
+
+// Tag is a normalized product label, see tags.Normalize. It appears in JSON
+// as its bare name.
+type Tag struct {
+	Id   int64  `gorm:"primaryKey,autoIncrement,not null"`
+	Name string `gorm:"not null;uniqueIndex"`
+}
+
+func (t Tag) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.Name)
+}
+
+func (t *Tag) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &t.Name)
+}
+
+// Attributes are a product's custom fields, checked against the
+// AttributeSchema of its categories. Values are strings, float64 numbers or
+// booleans, as decoded from JSON.
+type Attributes map[string]interface{}
+
+func (a Attributes) MarshalJSON() ([]byte, error) {
+	if a == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(map[string]interface{}(a))
+}
+
+func (a Attributes) Value() (driver.Value, error) {
+	return a.MarshalJSON()
+}
+
+func (a *Attributes) Scan(src interface{}) error {
+	return scanJSON(src, a)
+}
+
+const (
+	AttributeString  = "string"
+	AttributeNumber  = "number"
+	AttributeBoolean = "boolean"
+)
+
+// AttributeSpec defines a custom field. Values, for strings only, lists the
+// allowed values; any string is allowed without it.
+type AttributeSpec struct {
+	Type     string   `json:"type" validate:"required,oneof=string number boolean"`
+	Values   []string `json:"values,omitempty" validate:"excluded_unless=Type string,max=100,unique,dive,required,max=100"`
+	Required bool     `json:"required"`
+}
+
+// AttributeSchema maps attribute names to their definitions.
+type AttributeSchema map[string]AttributeSpec
+
+func (s AttributeSchema) MarshalJSON() ([]byte, error) {
+	if s == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(map[string]AttributeSpec(s))
+}
+
+func (s AttributeSchema) Value() (driver.Value, error) {
+	return s.MarshalJSON()
+}
+
+func (s *AttributeSchema) Scan(src interface{}) error {
+	return scanJSON(src, s)
+}
+
+func scanJSON(src interface{}, dest interface{}) error {
+	switch src := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return json.Unmarshal(src, dest)
+	case string:
+		return json.Unmarshal([]byte(src), dest)
+	default:
+		return fmt.Errorf("cannot scan %T as JSON", src)
+	}
+}
+
+// Crumb is one category of a breadcrumb trail.
+type Crumb struct {
+	Id   int64  `json:"id"`
+	Name string `json:"name"`
+	Slug string `json:"slug"`
+}
+
+// Conversion is a product's price converted to another currency. RateAsOf is
+// when the oldest of the rates used was observed, and is missing when the
+// price was already in that currency.
+type Conversion struct {
+	Price    decimal.Decimal `json:"price"`
+	Currency string          `json:"currency"`
+	Rate     decimal.Decimal `json:"rate"`
+	RateAsOf *time.Time      `json:"rate_as_of,omitempty"`
 }
 
 type Image struct {
-	Id        int64  `json:"id" gorm:"primaryKey,autoIncrement,not null"`
-	Url       string `json:"url" validate:"required,url" gorm:"not null"`
-	ProductId int64  `json:"-" gorm:"not null"`
+	Id        int64          `json:"id" gorm:"primaryKey,autoIncrement,not null"`
+	Url       string         `json:"url" validate:"required,url" gorm:"not null"`
+	ProductId int64          `json:"-" gorm:"not null"`
+	VariantId *int64         `json:"-" gorm:"index"`
+	CreatedAt time.Time      `json:"created_at" gorm:"not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt time.Time      `json:"updated_at" gorm:"not null;default:CURRENT_TIMESTAMP"`
+	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
 }
 
 type CompressedImage struct {
+	Id        int64          `json:"id" gorm:"primaryKey,autoIncrement,not null"`
+	Url       string         `json:"url" validate:"required,url" gorm:"not null"`
+	ProductId int64          `json:"-" gorm:"not null"`
+	VariantId *int64         `json:"-" gorm:"index"`
+	ImageId   int64          `json:"-" gorm:"not null"`
+	Image     Image          `json:"-" gorm:"foreignKey:ImageId;references:Id;constraint:OnDelete:CASCADE"`
+	CreatedAt time.Time      `json:"created_at" gorm:"not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt time.Time      `json:"updated_at" gorm:"not null;default:CURRENT_TIMESTAMP"`
+	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
+}
+
+// ExchangeRate is how many units of Currency one unit of Base buys, as
+// observed at AsOf. Base is the default currency when the rate was set; rates
+// against another base are ignored.
+type ExchangeRate struct {
+	Currency  string          `json:"currency" gorm:"type:char(3);primaryKey"`
+	Base      string          `json:"base" gorm:"type:char(3);not null"`
+	Rate      decimal.Decimal `json:"rate" gorm:"type:numeric(24,12);not null"`
+	AsOf      time.Time       `json:"as_of" gorm:"not null"`
+	UpdatedAt time.Time       `json:"updated_at" gorm:"not null;default:CURRENT_TIMESTAMP"`
+}
+
+// PriceChange records a product's price from the moment it was set: at
+// creation, by an update, or by the scheduler starting or ending a
+// ScheduledPrice.
+type PriceChange struct {
+	Id         int64           `json:"id" gorm:"primaryKey,autoIncrement,not null"`
+	ProductId  int64           `json:"-" gorm:"not null;index:idx_price_changes_product,priority:1"`
+	Product    Product         `json:"-" gorm:"foreignKey:ProductId;references:Id;constraint:OnDelete:CASCADE"`
+	Price      decimal.Decimal `json:"price" gorm:"type:numeric(19,4);not null"`
+	Currency   string          `json:"currency" gorm:"type:char(3);not null"`
+	Actor      string          `json:"actor" gorm:"not null"`
+	RequestId  string          `json:"request_id,omitempty"`
+	ScheduleId *int64          `json:"schedule_id,omitempty"`
+	ChangedAt  time.Time       `json:"changed_at" gorm:"not null;default:CURRENT_TIMESTAMP;index:idx_price_changes_product,priority:2"`
+}
+
+const (
+	SchedulePending   = "pending"
+	ScheduleActive    = "active"
+	ScheduleCompleted = "completed"
+	ScheduleCancelled = "cancelled"
+)
+
+// ScheduledPrice is a price a product takes from StartsAt, and gives up at
+// EndsAt, if set, for the price it had before. PreviousPrice and
+// PreviousCurrency are that price, recorded when the schedule starts.
+type ScheduledPrice struct {
+	Id               int64            `json:"id" gorm:"primaryKey,autoIncrement,not null"`
+	ProductId        int64            `json:"-" gorm:"not null;index"`
+	Product          Product          `json:"-" gorm:"foreignKey:ProductId;references:Id;constraint:OnDelete:CASCADE"`
+	Price            decimal.Decimal  `json:"price" gorm:"type:numeric(19,4);not null"`
+	Currency         string           `json:"currency" gorm:"type:char(3);not null"`
+	StartsAt         time.Time        `json:"starts_at" gorm:"not null;index"`
+	EndsAt           *time.Time       `json:"ends_at" gorm:"index"`
+	Status           string           `json:"status" gorm:"type:varchar(16);not null;default:pending;index"`
+	PreviousPrice    *decimal.Decimal `json:"previous_price,omitempty" gorm:"type:numeric(19,4)"`
+	PreviousCurrency *string          `json:"previous_currency,omitempty" gorm:"type:char(3)"`
+	Actor            string           `json:"actor" gorm:"not null"`
+	CreatedAt        time.Time        `json:"created_at" gorm:"not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt        time.Time        `json:"updated_at" gorm:"not null;default:CURRENT_TIMESTAMP"`
+}
+
+// StockItem counts the units of a product, or of one of its variants, on
+// hand and held by pending reservations. A product with variants keeps its
+// stock on them; products and variants without one have none.
+type StockItem struct {
+	Id        int64    `json:"-" gorm:"primaryKey,autoIncrement,not null"`
+	ProductId int64    `json:"product_id" gorm:"not null;uniqueIndex:idx_stock_items_product,where:variant_id IS NULL"`
+	Product   Product  `json:"-" gorm:"foreignKey:ProductId;references:Id;constraint:OnDelete:CASCADE"`
+	VariantId *int64   `json:"variant_id,omitempty" gorm:"uniqueIndex"`
+	Variant   *Variant `json:"-" gorm:"foreignKey:VariantId;references:Id;constraint:OnDelete:CASCADE"`
+	OnHand    int64    `json:"on_hand" gorm:"not null;default:0"`
+	Reserved  int64    `json:"reserved" gorm:"not null;default:0;check:chk_stock_items_reserved,reserved BETWEEN 0 AND on_hand"`
+	// Available is computed by the database, so conditional updates can
+	// check it.
+	Available int64 `json:"available" gorm:"->;type:bigint GENERATED ALWAYS AS (on_hand - reserved) STORED"`
+	// LowStockThreshold is the availability at or below which a low stock
+	// event is published.
+	LowStockThreshold int64     `json:"low_stock_threshold" gorm:"not null;default:0"`
+	UpdatedAt         time.Time `json:"updated_at" gorm:"not null;default:CURRENT_TIMESTAMP"`
+}
+
+const (
+	ReservationPending   = "pending"
+	ReservationCommitted = "committed"
+	ReservationReleased  = "released"
+	ReservationExpired   = "expired"
+)
+
+// Reservation holds stock for an order until it is committed, which takes
+// the units off hand, or released, by the client or once it expires.
+type Reservation struct {
+	Id        int64             `json:"id" gorm:"primaryKey,autoIncrement,not null"`
+	Status    string            `json:"status" gorm:"type:varchar(16);not null;default:pending;index:idx_reservations_expiry,priority:1"`
+	ExpiresAt time.Time         `json:"expires_at" gorm:"not null;index:idx_reservations_expiry,priority:2"`
+	Items     []ReservationItem `json:"items" gorm:"foreignKey:ReservationId;references:Id;constraint:OnDelete:CASCADE"`
+	CreatedAt time.Time         `json:"created_at" gorm:"not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt time.Time         `json:"updated_at" gorm:"not null;default:CURRENT_TIMESTAMP"`
+}
+
+type ReservationItem struct {
+	Id            int64     `json:"-" gorm:"primaryKey,autoIncrement,not null"`
+	ReservationId int64     `json:"-" gorm:"not null;index"`
+	StockItemId   int64     `json:"-" gorm:"not null;index"`
+	StockItem     StockItem `json:"-" gorm:"foreignKey:StockItemId;references:Id;constraint:OnDelete:CASCADE"`
+	ProductId     int64     `json:"product_id" gorm:"not null"`
+	VariantId     *int64    `json:"variant_id,omitempty"`
+	Quantity      int64     `json:"quantity" gorm:"not null"`
+}
+
+const (
+	ImportPending   = "pending"
+	ImportRunning   = "running"
+	ImportCompleted = "completed"
+	ImportFailed    = "failed"
+)
+
+// ImportJob creates products from an uploaded CSV or NDJSON file in the
+// background. Processed counts the rows done so far, which Succeeded and
+// Failed split; a dry run only validates them. The upload is kept until the
+// job finishes.
+type ImportJob struct {
 	Id        int64  `json:"id" gorm:"primaryKey,autoIncrement,not null"`
-	Url       string `json:"url" validate:"required,url" gorm:"not null"`
-	ProductId int64  `json:"-" gorm:"not null"`
-	ImageId   int64  `json:"-" gorm:"not null"`
-	Image     Image  `json:"-" gorm:"foreignKey:ImageId;references:Id;constraint:OnDelete:CASCADE"`
+	Status    string `json:"status" gorm:"type:varchar(16);not null;default:pending;index"`
+	Format    string `json:"format" gorm:"type:varchar(16);not null"`
+	DryRun    bool   `json:"dry_run" gorm:"not null;default:false"`
+	Total     int    `json:"total" gorm:"not null"`
+	Processed int    `json:"processed" gorm:"not null;default:0"`
+	Succeeded int    `json:"succeeded" gorm:"not null;default:0"`
+	Failed    int    `json:"failed" gorm:"not null;default:0"`
+	// Error tells why a failed job stopped; the errors of single rows are
+	// ImportErrors.
+	Error *string `json:"error,omitempty"`
+	Data  []byte  `json:"-" gorm:"type:bytea;not null"`
+	// Language is the Accept-Language of the upload, for the row errors.
+	Language   string     `json:"-" gorm:"not null;default:''"`
+	Actor      string     `json:"-" gorm:"not null"`
+	RequestId  string     `json:"-" gorm:"not null;default:''"`
+	CreatedAt  time.Time  `json:"created_at" gorm:"not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt  time.Time  `json:"updated_at" gorm:"not null;default:CURRENT_TIMESTAMP"`
+	FinishedAt *time.Time `json:"finished_at"`
+}
+
+// ImportError lists the problems of a row of an import, keyed by field like
+// validation errors. Line is where the row starts in the upload.
+type ImportError struct {
+	Id     int64       `json:"-" gorm:"primaryKey,autoIncrement,not null"`
+	JobId  int64       `json:"-" gorm:"not null;index:idx_import_errors_job,priority:1"`
+	Job    ImportJob   `json:"-" gorm:"foreignKey:JobId;references:Id;constraint:OnDelete:CASCADE"`
+	Line   int         `json:"line" gorm:"not null;index:idx_import_errors_job,priority:2"`
+	Errors FieldErrors `json:"errors" gorm:"type:jsonb;not null"`
+}
+
+const (
+	ExportPending   = "pending"
+	ExportRunning   = "running"
+	ExportCompleted = "completed"
+	ExportFailed    = "failed"
+)
+
+// ExportJob writes the products matching the filters of a GET /products
+// query to S3 in the background. Exported counts the products written so
+// far; a job taken over by another worker starts over, and Claims counts the
+// takeovers, so the worker that lost it notices.
+type ExportJob struct {
+	Id       int64  `json:"id" gorm:"primaryKey,autoIncrement,not null"`
+	Status   string `json:"status" gorm:"type:varchar(16);not null;default:pending;index"`
+	Format   string `json:"format" gorm:"type:varchar(16);not null"`
+	Query    string `json:"query" gorm:"not null;default:''"`
+	Exported int    `json:"exported" gorm:"not null;default:0"`
+	Claims   int    `json:"-" gorm:"not null;default:0"`
+	// Error tells why a failed job stopped.
+	Error *string `json:"error,omitempty"`
+	// Key is the S3 object of a completed job, served through URL, a link
+	// that expires.
+	Key *string `json:"-"`
+	URL string  `json:"url,omitempty" gorm:"-"`
+	// Admin records whether the request was an admin's, which the
+	// include_deleted filter requires.
+	Admin      bool       `json:"-" gorm:"not null;default:false"`
+	Actor      string     `json:"-" gorm:"not null"`
+	RequestId  string     `json:"-" gorm:"not null;default:''"`
+	CreatedAt  time.Time  `json:"created_at" gorm:"not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt  time.Time  `json:"updated_at" gorm:"not null;default:CURRENT_TIMESTAMP"`
+	FinishedAt *time.Time `json:"finished_at"`
+}
+
+// Types of product events.
+const (
+	// EventProductUpdated is published when a product is created, changed,
+	// deleted or restored, or when one of its variants or stock items is.
+	EventProductUpdated = "product.updated"
+	// EventImageCompressed is published by the compression service once it
+	// stored compressed images of a product.
+	EventImageCompressed = "image.compressed"
+	// EventCompressionFailed is published by the compression service when
+	// some images of a product could not be compressed or stored.
+	EventCompressionFailed = "compression.failed"
+)
+
+// ProductEvent is published on the product events exchange after a change
+// to a product is stored. It only names the product; consumers load what
+// they need.
+type ProductEvent struct {
+	Type       string    `json:"type"`
+	ProductId  int64     `json:"product_id"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// Feed is the revision of a seller's product feeds, bumped whenever one of
+// their entries changes. It is created with the entries on the first request
+// for a feed, and product events keep it up to date from then on.
+type Feed struct {
+	UserId    int64     `gorm:"primaryKey;autoIncrement:false"`
+	Revision  int64     `gorm:"not null;default:1"`
+	UpdatedAt time.Time `gorm:"not null;default:CURRENT_TIMESTAMP"`
+}
+
+// FeedEntry holds the rendered items of a product in each feed format, so
+// serving a feed only joins them.
+type FeedEntry struct {
+	ProductId int64     `gorm:"primaryKey;autoIncrement:false"`
+	UserId    int64     `gorm:"not null;index:idx_feed_entries_user,priority:1"`
+	Google    string    `gorm:"not null"`
+	RSS       string    `gorm:"column:rss;not null"`
+	Atom      string    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null;index:idx_feed_entries_user,priority:2"`
+	UpdatedAt time.Time `gorm:"not null;default:CURRENT_TIMESTAMP"`
+}
+
+// FieldErrors maps fields to their problems.
+type FieldErrors map[string]string
+
+func (e FieldErrors) Value() (driver.Value, error) {
+	return json.Marshal(map[string]string(e))
+}
+
+func (e *FieldErrors) Scan(src interface{}) error {
+	return scanJSON(src, e)
 }
@@ -2,35 +2,56 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/database"
+	"github.com/aiu26/product-management/common/health"
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/storage"
+	"github.com/aiu26/product-management/common/tracing"
+	"github.com/aiu26/product-management/common/types"
 	"github.com/aiu26/product-management/compression/internal/compress"
+	"github.com/aiu26/product-management/compression/internal/metrics"
 	"github.com/aiu26/product-management/compression/internal/products"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	awsConfig "github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/redis/go-redis/extra/redisotel/v9"
 	"github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
-	"gorm.io/driver/postgres"
-	"gorm.io/gorm"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func main() {
-	// Logger setup
-	logrus.SetFormatter(&logrus.TextFormatter{
-		FullTimestamp : true,
-	})
+var tracer = tracing.Tracer("github.com/aiu26/product-management/compression/cmd")
 
+func main() {
 	// Config setup
 	conf := config.LoadConfig(true, true)
 
+	// Logger setup
+	if err := logging.Setup(conf.Logging); err != nil {
+		logrus.Fatalf("Failed to setup logging: %s", err.Error())
+	}
+
+	secrets := conf.SecretProvider()
+
+	// Tracing setup
+	shutdownTracing, err := tracing.Setup(context.Background(), conf.Tracing, "compression")
+	if err != nil {
+		logrus.Fatalf("Failed to setup tracing: %s", err.Error())
+	}
+
 	// Database setup
-	db, err := gorm.Open(postgres.Open(conf.SDN), &gorm.Config{})
+	db, err := database.Open(conf.Database, secrets)
 	if err != nil {
 		logrus.Fatalf("Failed to connect to database: %s", err.Error())
 	}
@@ -38,16 +59,26 @@ func main() {
 
 	// Redis setup
 	rdb := redis.NewClient(&redis.Options{
-		Addr: conf.Redis,
-		Password: "",
-		DB: 0,
+		Addr: conf.Redis.Host,
+		DB: conf.Redis.DB,
+		CredentialsProviderContext: func(ctx context.Context) (string, string, error) {
+			password, err := secrets.Secret(ctx, config.RedisPassword)
+			return "", password.Reveal(), err
+		},
 	})
+	if err := redisotel.InstrumentTracing(rdb); err != nil {
+		logrus.Fatalf("Failed to instrument redis: %s", err.Error())
+	}
 	logrus.Info("Connected to redis")
 
 	// RabbitMQ setup
-	rabbitConn, err := amqp.Dial(conf.RabbitMQHost)
+	rabbitURL, err := secrets.Secret(context.Background(), config.RabbitMQURL)
 	if err != nil {
-		logrus.Fatalf("Failed to connect to RabbitMQ: %s", err.Error())
+		logrus.Fatalf("Failed to read RabbitMQ URL: %s", err.Error())
+	}
+	rabbitConn, err := amqp.Dial(rabbitURL.Reveal())
+	if err != nil {
+		logrus.Fatalf("Failed to connect to RabbitMQ: %s", config.RedactError(err).Error())
 	}
 	defer rabbitConn.Close()
 
@@ -57,43 +88,179 @@ func main() {
 	}
 	defer channel.Close()
 
+	// Compressed images, and failures to compress them, are announced to
+	// the products service, which declares the exchange too.
+	err = channel.ExchangeDeclare(conf.RabbitMQ.EventsExchange, amqp.ExchangeFanout, true, false, false, false, nil)
+	if err != nil {
+		logrus.Fatalf("Failed to declare the product events exchange: %s", err.Error())
+	}
+
 	// S3 setup
-	cfg, err := awsConfig.LoadDefaultConfig(
-		context.TODO(),
-		awsConfig.WithRegion(conf.AWS.Region),
-		awsConfig.WithCredentialsProvider(aws.NewCredentialsCache(credentials.NewStaticCredentialsProvider(conf.AWS.AccessKey, conf.AWS.SecretKey, ""))),
-	)
+	s3Client, err := storage.NewS3Client(context.TODO(), conf.AWS, secrets)
 	if err != nil {
 		logrus.Fatalf("Failed to setup S3: %s", err.Error())
 	}
 
-	s3Client := s3.NewFromConfig(cfg)
-
 	// Listen for messages
-	messages, err := channel.Consume(conf.RabbitMQQueue, "", true, false, false, false, nil)
+	messages, err := channel.Consume(conf.RabbitMQ.Queue, "", true, false, false, false, nil)
 	if err != nil {
 		logrus.Fatalf("Failed to consume messages: %s", err.Error())
 	}
 
+	// Admin server setup
+	sqlDB, err := db.DB()
+	if err != nil {
+		logrus.Fatalf("Failed to access database pool: %s", err.Error())
+	}
+
+	checker := health.NewChecker(conf.Health.Timeout)
+	checker.Add("postgres", health.Ping(sqlDB.PingContext))
+	checker.Add("redis", health.Ping(func(ctx context.Context) error {
+		return rdb.Ping(ctx).Err()
+	}))
+	checker.Add("rabbitmq", health.AMQP(rabbitConn, channel))
+	checker.Add("consumer", func(ctx context.Context) (health.Details, error) {
+		// A separate channel, as a failed passive declare closes the channel.
+		inspect, err := rabbitConn.Channel()
+		if err != nil {
+			return nil, err
+		}
+		defer inspect.Close()
+
+		queue, err := inspect.QueueDeclarePassive(conf.RabbitMQ.Queue, true, false, false, false, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		details := health.Details{"queue": queue.Name, "lag": queue.Messages, "consumers": queue.Consumers}
+		if conf.Health.MaxConsumerLag > 0 && queue.Messages > conf.Health.MaxConsumerLag {
+			return details, fmt.Errorf("consumer lag %d exceeds %d", queue.Messages, conf.Health.MaxConsumerLag)
+		}
+		return details, nil
+	})
+
+	admin := http.NewServeMux()
+	admin.HandleFunc("GET /healthz", checker.Liveness)
+	admin.HandleFunc("GET /readyz", checker.Readiness)
+	admin.Handle("GET /metrics", promhttp.Handler())
+
+	adminServer := http.Server{
+		Addr: conf.Admin.Host,
+		Handler: admin,
+		ReadTimeout: conf.Server.ReadTimeout,
+		WriteTimeout: conf.Server.WriteTimeout,
+	}
+	go func() {
+		if err := adminServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.Errorf("Admin server failed: %s", err.Error())
+		}
+	}()
+	logrus.Infof("Starting admin server on %s", conf.Admin.Host)
+
+	// Background workers run until the shutdown cancels their context, which
+	// then waits for them.
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	var workers sync.WaitGroup
+
+	// Purge job
+	if conf.Purge.Interval > 0 {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			ticker := time.NewTicker(conf.Purge.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-workerCtx.Done():
+					return
+				case <-ticker.C:
+				}
+				cutoff := time.Now().Add(-conf.Purge.Retention)
+				_, err := products.PurgeDeleted(workerCtx, db, rdb, s3Client, conf.AWS.BucketName, conf.Redis.Timeout, cutoff, conf.Purge.BatchSize)
+				if workerCtx.Err() != nil {
+					return
+				}
+				result := metrics.ResultSuccess
+				if err != nil {
+					result = metrics.ResultError
+				}
+				metrics.PurgeRuns.WithLabelValues(result).Inc()
+			}
+		}()
+		logrus.Infof("Purging products deleted for more than %s every %s", conf.Purge.Retention, conf.Purge.Interval)
+	}
+
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 	logrus.Info("Waiting for messages")
 	for {
 		select {
 		case message := <-messages:
+			start := time.Now()
 			id := string(message.Body)
-			logrus.Infof("Received product: %s", message.Body)
+
+			// Continue the trace started by the POST /products request.
+			ctx := tracing.Extract(context.Background(), message.Headers)
+			ctx, span := tracer.Start(ctx, conf.RabbitMQ.Queue+" process", trace.WithSpanKind(trace.SpanKindConsumer))
+			span.SetAttributes(attribute.String("product.id", id))
+
+			requestId, _ := message.Headers["x-request-id"].(string)
+			ctx = logging.WithFields(ctx, logrus.Fields{
+				"delivery_tag": message.DeliveryTag,
+				"request_id": requestId,
+				"product_id": id,
+			})
+			log := logging.FromContext(ctx)
+			log.Info("Received product")
 			
-			images, _ := products.GetProductImages(db, id)
-			logrus.Infof("Compressing images: %v", images)
+			images, fetchErr := products.GetProductImages(ctx, db, id)
+			log.WithField("images", len(images)).Info("Compressing images")
 
-			compressed, _ := compress.CompressImages(images, s3Client, conf.AWS.BucketName)
-			logrus.Infof("Compressed images: %v", compressed)
+			compressed, compressErr := compress.CompressImages(ctx, images, s3Client, conf.AWS.BucketName)
+			log.WithField("compressed", len(compressed)).Info("Compressed images")
 			
-			products.StoreCompressedImages(db, rdb, id, compressed)
+			storeErr := products.StoreCompressedImages(ctx, db, rdb, conf.Redis.Timeout, id, compressed)
+			// A product with some images compressed gets both events.
+			if productId, err := strconv.ParseInt(id, 10, 64); err == nil {
+				if storeErr == nil && len(compressed) > 0 {
+					products.PublishEvent(ctx, channel, conf.RabbitMQ.EventsExchange, types.EventImageCompressed, productId, requestId)
+				}
+				if fetchErr != nil || compressErr != nil || storeErr != nil {
+					products.PublishEvent(ctx, channel, conf.RabbitMQ.EventsExchange, types.EventCompressionFailed, productId, requestId)
+				}
+			}
+			tracing.RecordError(span, errors.Join(fetchErr, compressErr, storeErr))
+			span.End()
+
+			result := metrics.ResultSuccess
+			if fetchErr != nil || compressErr != nil || storeErr != nil {
+				result = metrics.ResultError
+			}
+			metrics.Consumed.WithLabelValues(conf.RabbitMQ.Queue, result).Inc()
+			metrics.MessageDuration.Observe(time.Since(start).Seconds())
 		case <-done:
 			logrus.Info("Shutting down")
+			ctx, cancel := context.WithTimeout(context.Background(), conf.Server.ShutdownTimeout)
+			stopWorkers()
+			waitWorkers(ctx, &workers)
+			adminServer.Shutdown(ctx)
+			shutdownTracing(ctx)
+			cancel()
 			os.Exit(0)
 		}
 	}
+}
+
+// waitWorkers waits for the background workers to stop, or for ctx to end.
+func waitWorkers(ctx context.Context, workers *sync.WaitGroup) {
+	stopped := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		logrus.Warn("Background workers did not stop in time")
+	}
 }
\ No newline at end of file
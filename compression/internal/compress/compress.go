@@ -8,18 +8,29 @@ import (
 	"image/jpeg"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/tracing"
 	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/compression/internal/metrics"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = tracing.Tracer("github.com/aiu26/product-management/compression/internal/compress")
+
 type Compressed struct {
 	Url string
 	ImageId int64
+	VariantId *int64
 }
 
 func getFileNameFromURL(url string) string {
@@ -27,23 +38,133 @@ func getFileNameFromURL(url string) string {
 	return segments[len(segments)-1]
 }
 
-func compressJPEG(input io.Reader, quality int) (*bytes.Buffer, error) {
-	img, _, err := image.Decode(input)
+// startStage times one compression stage in both metrics and tracing. The
+// returned function ends the stage with its outcome.
+func startStage(ctx context.Context, stage string) (context.Context, func(error)) {
+	ctx, span := tracer.Start(ctx, "compress."+stage)
+	start := time.Now()
+	return ctx, func(err error) {
+		if err != nil {
+			metrics.StageErrors.WithLabelValues(stage).Inc()
+			tracing.RecordError(span, err)
+		} else {
+			metrics.StageDuration.WithLabelValues(stage).Observe(time.Since(start).Seconds())
+		}
+		span.End()
+	}
+}
+
+func compressJPEG(ctx context.Context, input []byte, quality int) (*bytes.Buffer, error) {
+	_, end := startStage(ctx, metrics.StageDecode)
+	img, _, err := image.Decode(bytes.NewReader(input))
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode image: %w", err)
+		err = fmt.Errorf("failed to decode image: %w", err)
+		end(err)
+		return nil, err
 	}
+	end(nil)
 
+	_, end = startStage(ctx, metrics.StageEncode)
 	buf := new(bytes.Buffer)
 	err = jpeg.Encode(buf, img, &jpeg.Options{Quality: quality})
 	if err != nil {
-		return nil, fmt.Errorf("failed to encode image: %w", err)
+		err = fmt.Errorf("failed to encode image: %w", err)
+		end(err)
+		return nil, err
 	}
+	end(nil)
 
 	return buf, nil
 }
 
+func download(ctx context.Context, url string) (data []byte, err error) {
+	ctx, end := startStage(ctx, metrics.StageDownload)
+	defer func() { end(err) }()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
 
-func CompressImages(images []types.Image, s3Client *s3.Client, bucketName string) ([]Compressed, error) {
+	data, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	metrics.BytesIn.Add(float64(len(data)))
+
+	return data, nil
+}
+
+func upload(ctx context.Context, s3Client *s3.Client, bucketName string, key string, data *bytes.Buffer) (err error) {
+	ctx, end := startStage(ctx, metrics.StageUpload)
+	defer func() { end(err) }()
+
+	_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucketName),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data.Bytes()),
+		ContentType: aws.String("image/jpeg"),
+	})
+	if err != nil {
+		return err
+	}
+	metrics.BytesOut.Add(float64(data.Len()))
+
+	return nil
+}
+
+// objectKey is the inverse of the URLs built by CompressImages.
+func objectKey(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if key == "" {
+		return "", fmt.Errorf("no object key in %s", rawURL)
+	}
+	return key, nil
+}
+
+// Delete removes compressed images from the bucket by URL. Deleting a missing
+// object succeeds, so a failed purge can simply be retried.
+func Delete(ctx context.Context, s3Client *s3.Client, bucketName string, urls []string) (err error) {
+	ctx, end := startStage(ctx, metrics.StageDelete)
+	defer func() { end(err) }()
+
+	// DeleteObjects takes at most 1000 keys per call.
+	for start := 0; start < len(urls); start += 1000 {
+		batch := urls[start:min(start+1000, len(urls))]
+		objects := make([]s3types.ObjectIdentifier, 0, len(batch))
+		for _, rawURL := range batch {
+			key, err := objectKey(rawURL)
+			if err != nil {
+				return err
+			}
+			objects = append(objects, s3types.ObjectIdentifier{Key: aws.String(key)})
+		}
+
+		out, err := s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucketName),
+			Delete: &s3types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return err
+		}
+		if len(out.Errors) > 0 {
+			first := out.Errors[0]
+			return fmt.Errorf("failed to delete %d objects, first %s: %s", len(out.Errors), aws.ToString(first.Key), aws.ToString(first.Message))
+		}
+	}
+	return nil
+}
+
+func CompressImages(ctx context.Context, images []types.Image, s3Client *s3.Client, bucketName string) ([]Compressed, error) {
 	var wg sync.WaitGroup
 	resultCh := make(chan Compressed)
 	errorCh := make(chan error)
@@ -52,41 +173,45 @@ func CompressImages(images []types.Image, s3Client *s3.Client, bucketName string
 	processImage := func(image types.Image) {
 		defer wg.Done()
 
-		resp, err := http.Get(image.Url)
+		ctx, span := tracer.Start(ctx, "compress image", trace.WithAttributes(attribute.Int64("image.id", image.Id)))
+		defer span.End()
+		log := logging.FromContext(ctx).WithFields(logrus.Fields{"image_id": image.Id, "url": image.Url})
+
+		original, err := download(ctx, image.Url)
 		if err != nil {
-			logrus.Errorf("failed to fetch image from URL %s: %s", image.Url, err.Error())
+			log.WithError(err).Error("Failed to fetch image")
+			tracing.RecordError(span, err)
 			errorCh <- err
 			return
 		}
-		defer resp.Body.Close()
 
-		compressedData, err := compressJPEG(resp.Body, 75)
+		compressedData, err := compressJPEG(ctx, original, 75)
 		if err != nil {
-			logrus.Errorf("failed to compress image from URL %s: %s", image.Url, err.Error())
+			log.WithError(err).Error("Failed to compress image")
+			tracing.RecordError(span, err)
 			errorCh <- err
 			return
 		}
-		logrus.Infof("Compressed image %s", image.Url)
+		log.Info("Compressed image")
 
 		key := fmt.Sprintf("compressed_images/%d_%s", image.Id, getFileNameFromURL(image.Url))
-		_, err = s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
-			Bucket:      aws.String(bucketName),
-			Key:         aws.String(key),
-			Body:        bytes.NewReader(compressedData.Bytes()),
-			ContentType: aws.String("image/jpeg"),
-		})
-		if err != nil {
-			logrus.Errorf("failed to upload image %s to S3: %s", image.Url, err.Error())
+		if err := upload(ctx, s3Client, bucketName, key, compressedData); err != nil {
+			log.WithError(err).Error("Failed to upload image to S3")
+			tracing.RecordError(span, err)
 			errorCh <- err
 			return
 		}
+		if len(original) > 0 {
+			metrics.Ratio.Observe(float64(compressedData.Len()) / float64(len(original)))
+		}
 
 		s3Url := fmt.Sprintf("https://%s.s3.amazonaws.com/%s", bucketName, key)
-		logrus.Infof("Uploaded compressed image %s to S3", s3Url)
+		log.WithField("s3_url", s3Url).Info("Uploaded compressed image to S3")
 
 		resultCh <- Compressed{
 			Url:     s3Url,
 			ImageId: image.Id,
+			VariantId: image.VariantId,
 		}
 	}
 
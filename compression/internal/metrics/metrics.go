@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	Consumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "compression_messages_consumed_total",
+		Help: "Messages consumed from the products queue by result (success or error).",
+	}, []string{"queue", "result"})
+
+	Published = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "compression_queue_published_total",
+		Help: "Product events published by exchange and result (success or error).",
+	}, []string{"exchange", "result"})
+
+	MessageDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "compression_message_duration_seconds",
+		Help:    "Time to fully process one product message.",
+		Buckets: prometheus.ExponentialBuckets(.05, 2, 10),
+	})
+
+	StageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "compression_stage_duration_seconds",
+		Help:    "Duration of each image compression stage (download, decode, encode, upload, store, delete).",
+		Buckets: prometheus.ExponentialBuckets(.001, 2.5, 12),
+	}, []string{"stage"})
+
+	StageErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "compression_stage_errors_total",
+		Help: "Failures by image compression stage.",
+	}, []string{"stage"})
+
+	BytesIn = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "compression_bytes_in_total",
+		Help: "Bytes of original images downloaded.",
+	})
+
+	BytesOut = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "compression_bytes_out_total",
+		Help: "Bytes of compressed images uploaded.",
+	})
+
+	Purged = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "compression_products_purged_total",
+		Help: "Soft-deleted products hard-deleted by the purge job.",
+	})
+
+	PurgeRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "compression_purge_runs_total",
+		Help: "Purge job runs by result (success or error).",
+	}, []string{"result"})
+
+	Ratio = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "compression_ratio",
+		Help:    "Compressed size divided by original size, per image.",
+		Buckets: prometheus.LinearBuckets(.1, .1, 15),
+	})
+)
+
+const (
+	StageDownload = "download"
+	StageDecode   = "decode"
+	StageEncode   = "encode"
+	StageUpload   = "upload"
+	StageStore    = "store"
+	StageDelete   = "delete"
+
+	ResultSuccess = "success"
+	ResultError   = "error"
+)
@@ -0,0 +1,53 @@
+package products
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/tracing"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/compression/internal/metrics"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// PublishEvent announces on the product events exchange that compressed
+// images of a product were stored, or that some could not be. Either way the
+// outcome is already stored, so a failure is only logged.
+func PublishEvent(ctx context.Context, channel *amqp.Channel, exchange string, eventType string, productId int64, requestId string) {
+	log := logging.FromContext(ctx).WithField("type", eventType)
+
+	body, err := json.Marshal(types.ProductEvent{Type: eventType, ProductId: productId, OccurredAt: time.Now()})
+	if err != nil {
+		log.WithError(err).Error("Failed to encode product event")
+		return
+	}
+
+	ctx, span := tracer.Start(ctx, exchange+" publish", trace.WithSpanKind(trace.SpanKindProducer))
+	span.SetAttributes(attribute.Int64("product.id", productId), attribute.String("event.type", eventType))
+	headers := amqp.Table{"x-request-id": requestId}
+	tracing.Inject(ctx, headers)
+
+	err = channel.PublishWithContext(ctx, exchange, "", false, false, amqp.Publishing{
+		ContentType: "application/json",
+		Type:        eventType,
+		Headers:     headers,
+		Body:        body,
+	})
+	tracing.RecordError(span, err)
+	span.End()
+
+	result := metrics.ResultSuccess
+	if err != nil {
+		result = metrics.ResultError
+	}
+	metrics.Published.WithLabelValues(exchange, result).Inc()
+	if err != nil {
+		log.WithError(err).Error("Failed to publish product event")
+		return
+	}
+	log.Info("Product event published")
+}
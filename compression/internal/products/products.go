@@ -5,58 +5,93 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/tracing"
 	"github.com/aiu26/product-management/common/types"
 	"github.com/aiu26/product-management/compression/internal/compress"
+	"github.com/aiu26/product-management/compression/internal/metrics"
 	"github.com/redis/go-redis/v9"
-	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
 
-func GetProductImages(db *gorm.DB, id string) ([]types.Image, error) {
+var tracer = tracing.Tracer("github.com/aiu26/product-management/compression/internal/products")
+
+// GetProductImages returns the images of a product and its variants that
+// have not been compressed yet, so adding a variant does not compress the
+// others' images again.
+func GetProductImages(ctx context.Context, db *gorm.DB, id string) ([]types.Image, error) {
+	ctx, span := tracer.Start(ctx, "fetch product images")
+	defer span.End()
+
 	var images []types.Image
 
-    if err := db.Where("product_id = ?", id).Find(&images).Error; err != nil {
-        logrus.Errorf("Failed to fetch product images for product ID %s: %s", id, err.Error())
+    compressed := db.Model(&types.CompressedImage{}).Select("image_id")
+    if err := db.WithContext(ctx).Where("product_id = ? AND id NOT IN (?)", id, compressed).Find(&images).Error; err != nil {
+        logging.FromContext(ctx).WithError(err).Error("Failed to fetch product images")
+        tracing.RecordError(span, err)
         return nil, err
     }
 
     return images, nil
 }
 
-func StoreCompressedImages(db *gorm.DB, rdb *redis.Client, id string, compressedImages []compress.Compressed) error {
+func StoreCompressedImages(ctx context.Context, db *gorm.DB, rdb *redis.Client, timeout time.Duration, id string, compressedImages []compress.Compressed) (err error) {
+    ctx, span := tracer.Start(ctx, "store compressed images")
+    defer func() {
+        tracing.RecordError(span, err)
+        span.End()
+    }()
+
+    log := logging.FromContext(ctx)
+
     productId, err := strconv.ParseInt(id, 10, 64)
     if err != nil {
-        logrus.Errorf("Failed to parse product ID %s to int64: %s", id, err.Error())
+        log.WithError(err).Error("Failed to parse product ID")
         return err
     }
 
-    err = db.Transaction(func(tx *gorm.DB) error {
+    start := time.Now()
+    err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
         for _, compressedImage := range compressedImages {
             compressedImage := types.CompressedImage{
                 Url:       compressedImage.Url,
                 ImageId:  compressedImage.ImageId,
+                VariantId: compressedImage.VariantId,
                 ProductId: productId,
             }
 
             if err := tx.Create(&compressedImage).Error; err != nil {
-                logrus.Errorf("Failed to store compressed image for product ID %s: %s", id, err.Error())
+                log.WithError(err).WithField("image_id", compressedImage.ImageId).Error("Failed to store compressed image")
                 return err
             }
         }
+
+        // New compressed images change the product's representation, so its
+        // ETag has to change too.
+        err := tx.Model(&types.Product{}).Where("id = ?", productId).UpdateColumns(map[string]interface{}{
+            "version":    gorm.Expr("version + 1"),
+            "updated_at": time.Now(),
+        }).Error
+        if err != nil {
+            log.WithError(err).Error("Failed to bump product version")
+            return err
+        }
         return nil
     })
     if err != nil {
-        logrus.Errorf("Transaction failed while storing compressed images for product ID %d: %s", productId, err.Error())
+        metrics.StageErrors.WithLabelValues(metrics.StageStore).Inc()
+        log.WithError(err).Error("Transaction failed while storing compressed images")
         return err
     }
+    metrics.StageDuration.WithLabelValues(metrics.StageStore).Observe(time.Since(start).Seconds())
 
-    ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+    cacheCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
-    if err := rdb.Del(ctx, id).Err(); err != nil {
-        logrus.Errorf("Failed to delete product from cache with product ID %d: %s", productId, err.Error())
+    if err := rdb.Del(cacheCtx, types.CacheKey(productId)).Err(); err != nil {
+        log.WithError(err).Error("Failed to delete product from cache")
         return err
     }
 
-    logrus.Infof("Compressed images stored successfully for product ID %d", productId)
+    log.WithField("compressed", len(compressedImages)).Info("Compressed images stored successfully")
     return nil
 }
@@ -0,0 +1,99 @@
+package products
+
+import (
+	"context"
+	"time"
+
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/tracing"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/compression/internal/compress"
+	"github.com/aiu26/product-management/compression/internal/metrics"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// PurgeDeleted hard-deletes products soft-deleted before cutoff, in batches,
+// along with their images and their compressed images in S3. Rows are locked
+// with SKIP LOCKED, so several workers can purge at the same time. It stops
+// between batches when ctx is done, and returns the number of products
+// purged.
+func PurgeDeleted(ctx context.Context, db *gorm.DB, rdb *redis.Client, s3Client *s3.Client, bucketName string, timeout time.Duration, cutoff time.Time, batchSize int) (purged int, err error) {
+	ctx, span := tracer.Start(ctx, "purge deleted products")
+	defer func() {
+		span.SetAttributes(attribute.Int("purged", purged))
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	for ctx.Err() == nil {
+		n, err := purgeBatch(ctx, db, rdb, s3Client, bucketName, timeout, cutoff, batchSize)
+		purged += n
+		if err != nil || n < batchSize {
+			return purged, err
+		}
+	}
+	return purged, ctx.Err()
+}
+
+func purgeBatch(ctx context.Context, db *gorm.DB, rdb *redis.Client, s3Client *s3.Client, bucketName string, timeout time.Duration, cutoff time.Time, batchSize int) (int, error) {
+	log := logging.FromContext(ctx)
+
+	var ids []int64
+	var urls []string
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		ids, urls = nil, nil
+		// A new session, so each query starts from no conditions.
+		tx = tx.Unscoped().Session(&gorm.Session{})
+		err := tx.Model(&types.Product{}).
+			Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("deleted_at < ?", cutoff).
+			Order("deleted_at").
+			Limit(batchSize).
+			Pluck("id", &ids).Error
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+
+		if err := tx.Model(&types.CompressedImage{}).Where("product_id IN ?", ids).Pluck("url", &urls).Error; err != nil {
+			return err
+		}
+
+		// Images and compressed images go with the product through ON DELETE
+		// CASCADE.
+		return tx.Delete(&types.Product{}, ids).Error
+	})
+	if err != nil {
+		log.WithError(err).Error("Failed to purge deleted products")
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	// The objects are deleted once the rows are, so the row locks are not
+	// held during the calls to S3. Objects that fail to delete stay in the
+	// bucket with nothing pointing to them.
+	if err := compress.Delete(ctx, s3Client, bucketName, urls); err != nil {
+		log.WithError(err).WithField("urls", urls).Error("Failed to delete compressed images from S3")
+	}
+
+	// Deleted products are never cached, but a stale entry may have been
+	// written just before the delete.
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = types.CacheKey(id)
+	}
+	cacheCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := rdb.Del(cacheCtx, keys...).Err(); err != nil {
+		log.WithError(err).Error("Failed to delete purged products from cache")
+	}
+
+	metrics.Purged.Add(float64(len(ids)))
+	log.WithField("product_ids", ids).Info("Purged deleted products")
+	return len(ids), nil
+}
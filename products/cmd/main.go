@@ -5,54 +5,110 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/database"
+	"github.com/aiu26/product-management/common/health"
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/storage"
+	"github.com/aiu26/product-management/common/tracing"
 	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/categories"
+	"github.com/aiu26/product-management/products/internal/events"
+	"github.com/aiu26/product-management/products/internal/feeds"
+	"github.com/aiu26/product-management/products/internal/inventory"
+	"github.com/aiu26/product-management/products/internal/metrics"
+	"github.com/aiu26/product-management/products/internal/prices"
 	"github.com/aiu26/product-management/products/internal/products"
+	"github.com/aiu26/product-management/products/internal/rates"
+	"github.com/aiu26/product-management/products/internal/stream"
 	"github.com/aiu26/product-management/products/internal/utils/request"
+	"github.com/aiu26/product-management/products/internal/utils/response"
+	"github.com/aiu26/product-management/products/internal/utils/validation"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/redis/go-redis/extra/redisotel/v9"
 	"github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
-	"gorm.io/driver/postgres"
-	"gorm.io/gorm"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 func main() {
-	// Logger setup
-	logrus.SetFormatter(&logrus.TextFormatter{
-		FullTimestamp : true,
-	})
-
 	// Config setup
 	conf := config.LoadConfig(false, false)
 
+	// Logger setup
+	if err := logging.Setup(conf.Logging); err != nil {
+		logrus.Fatalf("Failed to setup logging: %s", err.Error())
+	}
+
+	response.SetErrorFormat(conf.Server.ErrorFormat)
+
+	secrets := conf.SecretProvider()
+
+	// Tracing setup
+	shutdownTracing, err := tracing.Setup(context.Background(), conf.Tracing, "products")
+	if err != nil {
+		logrus.Fatalf("Failed to setup tracing: %s", err.Error())
+	}
+
 	// Database setup
-	db, err := gorm.Open(postgres.Open(conf.SDN), &gorm.Config{})
+	db, err := database.Open(conf.Database, secrets)
 	if err != nil {
 		logrus.Fatalf("Failed to connect to database: %s", err.Error())
 	}
 	logrus.Info("Connected to database")
 
 	// Migrate schema
+	if err := database.MigratePrices(db, conf.Money.DefaultCurrency); err != nil {
+		logrus.Fatalf("Failed to migrate prices: %s", err.Error())
+	}
 	db.AutoMigrate(&types.Product{})
+	// Before images, which reference their variant.
+	db.AutoMigrate(&types.Variant{})
 	db.AutoMigrate(&types.User{})
 	db.AutoMigrate(&types.Image{})
 	db.AutoMigrate(&types.CompressedImage{})
+	db.AutoMigrate(&types.ExchangeRate{})
+	db.AutoMigrate(&types.PriceChange{})
+	db.AutoMigrate(&types.ScheduledPrice{})
+	db.AutoMigrate(&types.Category{})
+	db.AutoMigrate(&types.Tag{})
+	db.AutoMigrate(&types.StockItem{})
+	db.AutoMigrate(&types.Reservation{})
+	db.AutoMigrate(&types.ReservationItem{})
+	db.AutoMigrate(&types.ImportJob{})
+	db.AutoMigrate(&types.ImportError{})
+	db.AutoMigrate(&types.ExportJob{})
+	db.AutoMigrate(&types.Feed{})
+	db.AutoMigrate(&types.FeedEntry{})
 
 	// Redis setup
 	rdb := redis.NewClient(&redis.Options{
-		Addr: conf.Redis,
-		Password: "",
-		DB: 0,
+		Addr: conf.Redis.Host,
+		DB: conf.Redis.DB,
+		CredentialsProviderContext: func(ctx context.Context) (string, string, error) {
+			password, err := secrets.Secret(ctx, config.RedisPassword)
+			return "", password.Reveal(), err
+		},
 	})
+	if err := redisotel.InstrumentTracing(rdb); err != nil {
+		logrus.Fatalf("Failed to instrument redis: %s", err.Error())
+	}
 	logrus.Info("Connected to redis")
 
 	// RabbitMQ setup
-	rabbitConn, err := amqp.Dial(conf.RabbitMQHost)
+	rabbitURL, err := secrets.Secret(context.Background(), config.RabbitMQURL)
+	if err != nil {
+		logrus.Fatalf("Failed to read RabbitMQ URL: %s", err.Error())
+	}
+	rabbitConn, err := amqp.Dial(rabbitURL.Reveal())
 	if err != nil {
-		logrus.Fatalf("Failed to connect to RabbitMQ: %s", err.Error())
+		logrus.Fatalf("Failed to connect to RabbitMQ: %s", config.RedactError(err).Error())
 	}
 	defer rabbitConn.Close()
 
@@ -62,26 +118,266 @@ func main() {
 	}
 	defer channel.Close()
 
-	_, err = channel.QueueDeclare(conf.RabbitMQQueue, true, false, false, false, nil)
+	_, err = channel.QueueDeclare(conf.RabbitMQ.Queue, true, false, false, false, nil)
 	if err != nil {
 		logrus.Fatalf("Failed to declare a queue: %s", err.Error())
 	}
+	_, err = channel.QueueDeclare(conf.RabbitMQ.LowStockQueue, true, false, false, false, nil)
+	if err != nil {
+		logrus.Fatalf("Failed to declare the low stock queue: %s", err.Error())
+	}
+	if err := events.Declare(channel, conf); err != nil {
+		logrus.Fatalf("Failed to declare the product events exchange: %s", err.Error())
+	}
 
 	logrus.Info("Connected to RabbitMQ")
 
+	// S3 setup, for background exports
+	var s3Client *s3.Client
+	if conf.AWS.BucketName != "" {
+		s3Client, err = storage.NewS3Client(context.TODO(), conf.AWS, secrets)
+		if err != nil {
+			logrus.Fatalf("Failed to setup S3: %s", err.Error())
+		}
+	}
+
+	// Health checks setup
+	sqlDB, err := db.DB()
+	if err != nil {
+		logrus.Fatalf("Failed to access database pool: %s", err.Error())
+	}
+
+	checker := health.NewChecker(conf.Health.Timeout)
+	checker.Add("postgres", health.Ping(sqlDB.PingContext))
+	checker.Add("redis", health.Ping(func(ctx context.Context) error {
+		return rdb.Ping(ctx).Err()
+	}))
+	checker.Add("rabbitmq", health.AMQP(rabbitConn, channel))
+
+	// Validator setup
+	validate, err := validation.New(conf.Validation)
+	if err != nil {
+		logrus.Fatalf("Failed to setup validator: %s", err.Error())
+	}
+
 	// Router setup
+	query := request.Timeout(conf.Server.QueryTimeout)
+	mutation := request.Timeout(conf.Server.MutationTimeout)
+	idempotent := request.Idempotency(rdb, conf)
+
+	// Uploads wake the import worker, which otherwise polls, and queued
+	// exports the export worker.
+	wakeImports := make(chan struct{}, 1)
+	wakeExports := make(chan struct{}, 1)
+	// Event streams are served from the events this replica reads.
+	hub := stream.NewHub(rdb, conf)
+
+	api := http.NewServeMux()
+	api.Handle("POST /products", request.Route(request.Timer(products.NewProduct(db, channel, validate, conf)), mutation, idempotent))
+	api.Handle("GET /products", request.Route(request.Timer(products.GetProducts(db, conf)), query))
+	api.Handle("GET /products:batch", request.Route(request.Timer(products.GetProductsBatch(db, rdb, conf)), query))
+	api.Handle("POST /products:batch", request.Route(request.Timer(products.NewProducts(db, channel, validate, conf)), mutation, idempotent))
+	api.Handle("GET /products/{id}", request.Route(request.Timer(products.GetProduct(db, rdb, conf)), query))
+	api.Handle("PATCH /products/{id}", request.Route(request.Timer(products.UpdateProduct(db, rdb, channel, validate, conf)), mutation))
+	api.Handle("DELETE /products/{id}", request.Route(request.Timer(products.DeleteProduct(db, rdb, channel, conf)), mutation))
+	api.Handle("POST /products/{id}/restore", request.Route(request.Timer(products.RestoreProduct(db, rdb, channel, conf)), mutation, request.RequireAdmin()))
+	api.Handle("POST /products/{id}/variants", request.Route(request.Timer(products.CreateVariant(db, rdb, channel, validate, conf)), mutation, idempotent))
+	api.Handle("PATCH /products/{id}/variants/{variant}", request.Route(request.Timer(products.UpdateVariant(db, rdb, channel, validate, conf)), mutation))
+	api.Handle("DELETE /products/{id}/variants/{variant}", request.Route(request.Timer(products.DeleteVariant(db, rdb, channel, conf)), mutation))
+	api.Handle("GET /products/{id}/events", request.Route(request.Timer(stream.ProductEvents(db, hub, conf))))
+	api.Handle("GET /users/{id}/events", request.Route(request.Timer(stream.UserEvents(db, hub, conf))))
+	api.Handle("GET /products/{id}/stock", request.Route(request.Timer(inventory.GetStock(db)), query))
+	api.Handle("PUT /products/{id}/stock", request.Route(request.Timer(inventory.SetStock(db, channel, validate, conf)), mutation))
+	api.Handle("PUT /products/{id}/variants/{variant}/stock", request.Route(request.Timer(inventory.SetStock(db, channel, validate, conf)), mutation))
+	api.Handle("POST /reservations", request.Route(request.Timer(inventory.CreateReservation(db, channel, validate, conf)), mutation, idempotent))
+	api.Handle("GET /reservations/{id}", request.Route(request.Timer(inventory.GetReservation(db)), query))
+	api.Handle("POST /reservations/{id}/commit", request.Route(request.Timer(inventory.CommitReservation(db, channel, conf)), mutation))
+	api.Handle("POST /reservations/{id}/release", request.Route(request.Timer(inventory.ReleaseReservation(db, channel, conf)), mutation))
+	api.Handle("GET /imports/{id}", request.Route(request.Timer(products.GetImport(db)), query))
+	api.Handle("GET /imports/{id}/errors", request.Route(request.Timer(products.GetImportErrors(db)), query))
+	api.Handle("GET /exports", request.Route(request.Timer(products.ExportProducts(db, conf)), request.Timeout(conf.Exports.Timeout)))
+	api.Handle("POST /exports", request.Route(request.Timer(products.CreateExport(db, s3Client, conf, wakeExports)), mutation, idempotent))
+	api.Handle("GET /exports/{id}", request.Route(request.Timer(products.GetExport(db, s3Client, conf)), query))
+	api.Handle("GET /users/{id}/feeds/{feed}", request.Route(request.Timer(feeds.GetFeed(db, conf)), request.Timeout(conf.Feeds.Timeout)))
+	api.Handle("GET /products/{id}/prices", request.Route(request.Timer(prices.GetPrices(db)), query))
+	api.Handle("POST /products/{id}/prices/schedules", request.Route(request.Timer(prices.SchedulePrice(db, validate)), mutation))
+	api.Handle("DELETE /products/{id}/prices/schedules/{schedule}", request.Route(request.Timer(prices.CancelSchedule(db)), mutation))
+	api.Handle("GET /categories", request.Route(request.Timer(categories.ListCategories(db)), query))
+	api.Handle("GET /categories/{category}", request.Route(request.Timer(categories.GetCategory(db)), query))
+	api.Handle("POST /categories", request.Route(request.Timer(categories.CreateCategory(db, validate)), mutation, request.RequireAdmin()))
+	api.Handle("PATCH /categories/{category}", request.Route(request.Timer(categories.UpdateCategory(db, rdb, validate, conf)), mutation, request.RequireAdmin()))
+	api.Handle("DELETE /categories/{category}", request.Route(request.Timer(categories.DeleteCategory(db, rdb, conf)), mutation, request.RequireAdmin()))
+	api.Handle("GET /exchange-rates", request.Route(request.Timer(rates.ListRates(db, conf)), query))
+	api.Handle("PUT /exchange-rates/{currency}", request.Route(request.Timer(rates.PutRate(db, validate, conf)), mutation, request.RequireAdmin()))
+	api.Handle("POST /exchange-rates/import", request.Route(request.Timer(rates.ImportRates(db, validate, conf)), mutation, request.RequireAdmin()))
+
+	// Probes and scrapes bypass the API middlewares to keep access logs clean.
 	router := http.NewServeMux()
-	router.HandleFunc("POST /products", request.Timer(products.NewProduct(db, channel, conf)))
-	router.HandleFunc("GET /products", request.Timer(products.GetProducts(db)))
-	router.HandleFunc("GET /products/{id}", request.Timer(products.GetProduct(db, rdb)))
+	router.HandleFunc("GET /healthz", checker.Liveness)
+	router.HandleFunc("GET /readyz", checker.Readiness)
+	router.Handle("GET /metrics", promhttp.Handler())
+	middlewares := func(maxBytes int64) []request.Middleware {
+		return []request.Middleware{
+			request.RequestID(),
+			request.AccessLog(),
+			request.Recover(),
+			request.CORS(conf.CORS),
+			request.Admin(secrets),
+			request.MaxBytes(maxBytes),
+		}
+	}
+	// Imports take uploads far larger than other requests.
+	imports := request.Route(request.Timer(products.CreateImport(db, conf, wakeImports)), mutation, idempotent)
+	router.Handle("POST /imports", request.Chain(imports, middlewares(conf.Imports.MaxBytes)...))
+	router.Handle("/", request.Chain(api, middlewares(conf.Server.MaxBodyBytes)...))
+
+	// Background workers run until the shutdown cancels their context, which
+	// then waits for them.
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	var workers sync.WaitGroup
+
+	// Price scheduler
+	if conf.Pricing.ScheduleInterval > 0 {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			ticker := time.NewTicker(conf.Pricing.ScheduleInterval)
+			defer ticker.Stop()
+			for {
+				var now time.Time
+				select {
+				case <-workerCtx.Done():
+					return
+				case now = <-ticker.C:
+				}
+				_, err := prices.ApplySchedules(workerCtx, db, rdb, channel, conf, now)
+				if workerCtx.Err() != nil {
+					return
+				}
+				result := metrics.ResultSuccess
+				if err != nil {
+					result = metrics.ResultError
+				}
+				metrics.ScheduleRuns.WithLabelValues(result).Inc()
+			}
+		}()
+		logrus.Infof("Applying scheduled prices every %s", conf.Pricing.ScheduleInterval)
+	}
+
+	// Import worker
+	if conf.Imports.PollInterval > 0 {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			products.RunImports(workerCtx, db, channel, validate, conf, wakeImports)
+		}()
+		logrus.Infof("Processing imports, polling every %s", conf.Imports.PollInterval)
+	}
+
+	// Export worker
+	if conf.Exports.PollInterval > 0 && s3Client != nil {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			products.RunExports(workerCtx, db, s3Client, conf, wakeExports)
+		}()
+		logrus.Infof("Processing exports, polling every %s", conf.Exports.PollInterval)
+	}
+
+	// Feed updates, from the product events of the shared feeds queue
+	if conf.Feeds.ProductURL != "" {
+		_, err = channel.QueueDeclare(conf.Feeds.Queue, true, false, false, false, nil)
+		if err != nil {
+			logrus.Fatalf("Failed to declare the feeds queue: %s", err.Error())
+		}
+		if err := channel.QueueBind(conf.Feeds.Queue, "", conf.RabbitMQ.EventsExchange, false, nil); err != nil {
+			logrus.Fatalf("Failed to bind the feeds queue: %s", err.Error())
+		}
+		feedChannel, feedEvents, err := events.Subscribe(rabbitConn, conf.Feeds.Queue, conf.Feeds.Prefetch)
+		if err != nil {
+			logrus.Fatalf("Failed to consume product events: %s", err.Error())
+		}
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			// Closing the channel requeues the events not yet handled.
+			defer feedChannel.Close()
+			events.Consume(workerCtx, feedEvents, conf.Feeds.Queue, metrics.FeedRefreshes, feeds.Handle(db, conf))
+		}()
+		logrus.Infof("Keeping feeds up to date, %d events at a time", conf.Feeds.Prefetch)
+	}
+
+	// Event streams: the replicas share the stream queue, appending its
+	// product events to the redis stream, and each reads the whole stream
+	// for its own clients.
+	_, err = channel.QueueDeclare(conf.Stream.Queue, true, false, false, false, nil)
+	if err != nil {
+		logrus.Fatalf("Failed to declare the stream queue: %s", err.Error())
+	}
+	if err := channel.QueueBind(conf.Stream.Queue, "", conf.RabbitMQ.EventsExchange, false, nil); err != nil {
+		logrus.Fatalf("Failed to bind the stream queue: %s", err.Error())
+	}
+	streamChannel, streamEvents, err := events.Subscribe(rabbitConn, conf.Stream.Queue, conf.Stream.Prefetch)
+	if err != nil {
+		logrus.Fatalf("Failed to consume product events: %s", err.Error())
+	}
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		defer streamChannel.Close()
+		events.Consume(workerCtx, streamEvents, conf.Stream.Queue, metrics.StreamAppends, stream.Handle(db, rdb, conf))
+	}()
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		hub.Run(workerCtx)
+	}()
+	logrus.Info("Streaming product events")
+
+	// Reservation expiry
+	if conf.Inventory.ExpiryInterval > 0 {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			ticker := time.NewTicker(conf.Inventory.ExpiryInterval)
+			defer ticker.Stop()
+			for {
+				var now time.Time
+				select {
+				case <-workerCtx.Done():
+					return
+				case now = <-ticker.C:
+				}
+				_, err := inventory.ExpireReservations(workerCtx, db, channel, conf, now)
+				if workerCtx.Err() != nil {
+					return
+				}
+				result := metrics.ResultSuccess
+				if err != nil {
+					result = metrics.ResultError
+				}
+				metrics.ExpiryRuns.WithLabelValues(result).Inc()
+			}
+		}()
+		logrus.Infof("Expiring reservations every %s", conf.Inventory.ExpiryInterval)
+	}
 
 	// Server setup
 	server := http.Server {
-		Addr: conf.Host,
-		Handler: router,
+		Addr: conf.Server.Host,
+		Handler: otelhttp.NewHandler(router, "products", otelhttp.WithFilter(func(r *http.Request) bool {
+			// Probes and scrapes would drown out real traffic.
+			return r.URL.Path != "/healthz" && r.URL.Path != "/readyz" && r.URL.Path != "/metrics"
+		})),
+		ReadTimeout: conf.Server.ReadTimeout,
+		WriteTimeout: conf.Server.WriteTimeout,
+		IdleTimeout: conf.Server.IdleTimeout,
 	}
 
-	logrus.Infof("Starting server on %s", conf.Host)
+	// Event streams would hold up the shutdown until its deadline.
+	server.RegisterOnShutdown(hub.Close)
+
+	logrus.Infof("Starting server on %s", conf.Server.Host)
 
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
@@ -94,12 +390,33 @@ func main() {
 	// Server shutdown
 	logrus.Info("Shutting down server")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), conf.Server.ShutdownTimeout)
 	defer cancel()
 
 	if err := server.Shutdown(ctx); err != nil {
 		logrus.Error("Failed to shutdown server", err.Error())
 	}
 
+	stopWorkers()
+	waitWorkers(ctx, &workers)
+
+	if err := shutdownTracing(ctx); err != nil {
+		logrus.Error("Failed to flush traces", err.Error())
+	}
+
 	logrus.Info("Server shutdown succesfully")
 }
+
+// waitWorkers waits for the background workers to stop, or for ctx to end.
+func waitWorkers(ctx context.Context, workers *sync.WaitGroup) {
+	stopped := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		logrus.Warn("Background workers did not stop in time")
+	}
+}
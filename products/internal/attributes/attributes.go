@@ -0,0 +1,167 @@
+package attributes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aiu26/product-management/common/types"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+// maxFilters bounds the attr. parameters of a request.
+const maxFilters = 20
+
+// Name is the pattern of attribute names, which filters embed in JSON paths.
+var Name = regexp.MustCompile(`^[a-z][a-z0-9_]{0,49}$`)
+
+var filterParam = regexp.MustCompile(`^attr\.([^\[\]]+)(?:\[(\w+)\])?$`)
+
+// Check returns the problems of a product's attributes against the schemas of
+// its categories, keyed by field like attributes.color. An attribute defined
+// by several schemas must satisfy each of them.
+func Check(schemas []types.AttributeSchema, attrs types.Attributes) map[string]string {
+	problems := map[string]string{}
+	defined := map[string]bool{}
+	for _, schema := range schemas {
+		for name, spec := range schema {
+			defined[name] = true
+			field := "attributes." + name
+			value, ok := attrs[name]
+			if !ok || value == nil {
+				if spec.Required {
+					problems[field] = field + " is required"
+				}
+				continue
+			}
+			if problem := checkValue(field, spec, value); problem != "" {
+				problems[field] = problem
+			}
+		}
+	}
+	for name := range attrs {
+		if !defined[name] {
+			field := "attributes." + name
+			problems[field] = field + " is not an attribute of the product's categories"
+		}
+	}
+	return problems
+}
+
+func checkValue(field string, spec types.AttributeSpec, value interface{}) string {
+	switch spec.Type {
+	case types.AttributeString:
+		s, ok := value.(string)
+		if !ok {
+			return field + " must be a string"
+		}
+		if len(spec.Values) > 0 && !contains(spec.Values, s) {
+			return fmt.Sprintf("%s must be one of [%s]", field, strings.Join(spec.Values, " "))
+		}
+	case types.AttributeNumber:
+		if _, ok := value.(float64); !ok {
+			return field + " must be a number"
+		}
+	case types.AttributeBoolean:
+		if _, ok := value.(bool); !ok {
+			return field + " must be a boolean"
+		}
+	}
+	return ""
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Prune drops the null attributes, which stand for missing ones.
+func Prune(attrs types.Attributes) types.Attributes {
+	pruned := make(types.Attributes, len(attrs))
+	for name, value := range attrs {
+		if value != nil {
+			pruned[name] = value
+		}
+	}
+	return pruned
+}
+
+// comparisons maps the operators of attr.name[op] parameters to jsonpath.
+var comparisons = map[string]string{"lt": "<", "lte": "<=", "gt": ">", "gte": ">="}
+
+// Filter applies the attr. parameters of a products query: attr.color=red
+// for equality, attr.color[in]=red,blue for any of several values, and
+// attr.weight_kg[lt|lte|gt|gte]=2 for numeric comparisons. Every condition is
+// a jsonb containment or jsonpath operator, which the GIN index on
+// attributes serves.
+func Filter(query *gorm.DB, params url.Values) (*gorm.DB, error) {
+	var keys []string
+	for key := range params {
+		if strings.HasPrefix(key, "attr.") {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) > maxFilters {
+		return nil, fmt.Errorf("at most %d attribute filters are allowed", maxFilters)
+	}
+	// Sorted, so equal requests build equal SQL.
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		match := filterParam.FindStringSubmatch(key)
+		if match == nil || !Name.MatchString(match[1]) {
+			return nil, fmt.Errorf("%s is not a valid attribute filter", key)
+		}
+		name, op := match[1], match[2]
+		for _, raw := range params[key] {
+			switch op {
+			case "", "eq":
+				query = equal(query, name, []string{raw})
+			case "in":
+				query = equal(query, name, strings.Split(raw, ","))
+			default:
+				symbol, ok := comparisons[op]
+				if !ok {
+					return nil, fmt.Errorf("%s has an unknown operator; use eq, in, lt, lte, gt or gte", key)
+				}
+				number, err := decimal.NewFromString(raw)
+				if err != nil {
+					return nil, fmt.Errorf("%s must be a number", key)
+				}
+				query = query.Where("products.attributes @@ ?::jsonpath", fmt.Sprintf(`$."%s" %s %s`, name, symbol, number.String()))
+			}
+		}
+	}
+	return query, nil
+}
+
+// equal matches the products whose attribute equals any of raws. Query
+// strings are untyped, so a raw value also matches the number or boolean it
+// spells.
+func equal(query *gorm.DB, name string, raws []string) *gorm.DB {
+	var conditions []string
+	var args []interface{}
+	for _, raw := range raws {
+		candidates := []interface{}{raw}
+		if number, err := decimal.NewFromString(raw); err == nil {
+			candidates = append(candidates, json.RawMessage(number.String()))
+		}
+		if raw == "true" || raw == "false" {
+			candidates = append(candidates, raw == "true")
+		}
+		for _, candidate := range candidates {
+			doc, _ := json.Marshal(map[string]interface{}{name: candidate})
+			conditions = append(conditions, "products.attributes @> ?::jsonb")
+			args = append(args, string(doc))
+		}
+	}
+	return query.Where(strings.Join(conditions, " OR "), args...)
+}
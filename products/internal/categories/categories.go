@@ -0,0 +1,362 @@
+package categories
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/utils/request"
+	"github.com/aiu26/product-management/products/internal/utils/response"
+	"github.com/aiu26/product-management/products/internal/utils/validation"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// errAnswered aborts a transaction whose request was already answered.
+var errAnswered = errors.New("request answered")
+
+type CategoryPayload struct {
+	Name       string                `json:"name" validate:"required,max=100"`
+	Slug       string                `json:"slug" validate:"required,max=100,slug"`
+	ParentId   *int64                `json:"parent_id" validate:"omitnil,gt=0"`
+	Attributes types.AttributeSchema `json:"attributes" validate:"max=50,dive,keys,attrname,endkeys,required"`
+}
+
+// CategoryUpdatePayload changes any of a category's fields. A parent_id of 0
+// moves the category to the root, and attributes replaces its schema.
+type CategoryUpdatePayload struct {
+	Name       *string                `json:"name" validate:"omitnil,min=1,max=100"`
+	Slug       *string                `json:"slug" validate:"omitnil,max=100,slug"`
+	ParentId   *int64                 `json:"parent_id" validate:"omitnil,gte=0"`
+	Attributes *types.AttributeSchema `json:"attributes" validate:"omitnil,max=50,dive,keys,attrname,endkeys,required"`
+}
+
+type CategoryDetails struct {
+	types.Category
+	Children []types.Category `json:"children"`
+}
+
+// ListCategories returns the whole tree, each category after its parent.
+func ListCategories(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		db := db.WithContext(r.Context())
+		categories := []types.Category{}
+		if err := db.Order("path").Find(&categories).Error; err != nil {
+			log.WithError(err).Error("Failed to fetch categories")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeCategoryFetchFailed, "Error fetching categories")
+			return
+		}
+		if err := Breadcrumbs(db, pointers(categories)); err != nil {
+			log.WithError(err).Error("Failed to fetch breadcrumbs")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeCategoryFetchFailed, "Error fetching categories")
+			return
+		}
+
+		log.WithField("count", len(categories)).Info("Categories fetched")
+		response.WriteJson(w, http.StatusOK, categories)
+	}
+}
+
+// GetCategory returns a category, by ID or slug, with its children.
+func GetCategory(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		ref := r.PathValue("category")
+		log = log.WithField("category", ref)
+
+		db := db.WithContext(r.Context())
+		category, err := Lookup(db, ref)
+		if err != nil {
+			writeFetchError(w, r, err)
+			return
+		}
+
+		details := CategoryDetails{Category: category, Children: []types.Category{}}
+		if err := db.Where("parent_id = ?", category.Id).Order("name").Find(&details.Children).Error; err != nil {
+			log.WithError(err).Error("Failed to fetch child categories")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeCategoryFetchFailed, "Error fetching category")
+			return
+		}
+		if err := Breadcrumbs(db, []*types.Category{&details.Category}); err != nil {
+			log.WithError(err).Error("Failed to fetch breadcrumbs")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeCategoryFetchFailed, "Error fetching category")
+			return
+		}
+
+		log.Info("Category fetched")
+		response.WriteJson(w, http.StatusOK, details)
+	}
+}
+
+// CreateCategory adds a category under parent_id, or at the root. Without a
+// slug, one is derived from the name.
+func CreateCategory(db *gorm.DB, validate *validation.Validator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		var payload CategoryPayload
+		if !request.Decode(w, r, &payload) {
+			return
+		}
+		if payload.Slug == "" {
+			payload.Slug = slugify(payload.Name)
+		}
+		if !valid(w, r, validate, payload) {
+			return
+		}
+
+		category := types.Category{Name: payload.Name, Slug: payload.Slug, ParentId: payload.ParentId, Attributes: payload.Attributes}
+		err := db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+			if err := lock(tx); err != nil {
+				return err
+			}
+			if taken, err := slugTaken(w, r, tx, category.Slug, 0); taken || err != nil {
+				return err
+			}
+
+			var parent *types.Category
+			if payload.ParentId != nil {
+				parent = &types.Category{}
+				if err := tx.First(parent, *payload.ParentId).Error; err != nil {
+					return parentError(w, r, err)
+				}
+			}
+
+			if err := tx.Create(&category).Error; err != nil {
+				return err
+			}
+			category.Path = childPath(parent, category.Id)
+			return tx.Model(&category).UpdateColumn("path", category.Path).Error
+		})
+		if err != nil {
+			writeUpdateError(w, r, err, "Failed to create category")
+			return
+		}
+		if err := Breadcrumbs(db.WithContext(r.Context()), []*types.Category{&category}); err != nil {
+			log.WithError(err).Error("Failed to fetch breadcrumbs")
+		}
+
+		log.WithField("category_id", category.Id).Info("Category created")
+		w.Header().Set("Location", fmt.Sprintf("/categories/%d", category.Id))
+		response.WriteJson(w, http.StatusCreated, category)
+	}
+}
+
+// UpdateCategory renames or moves a category. Moving it moves its whole
+// subtree. The products in the subtree get a new version, as their
+// breadcrumbs change.
+func UpdateCategory(db *gorm.DB, rdb *redis.Client, validate *validation.Validator, conf *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		categoryId, ok := request.PathId(w, r, "category", response.CodeInvalidCategoryId, "Invalid category id")
+		if !ok {
+			return
+		}
+		log = log.WithField("category_id", categoryId)
+
+		var payload CategoryUpdatePayload
+		if !request.Decode(w, r, &payload) || !valid(w, r, validate, payload) {
+			return
+		}
+		if payload.Name == nil && payload.Slug == nil && payload.ParentId == nil && payload.Attributes == nil {
+			log.Info("Empty update")
+			response.WriteError(w, r, http.StatusBadRequest, response.CodeInvalidRequestBody, "At least one field must be given")
+			return
+		}
+
+		var category types.Category
+		var touched []int64
+		err := db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+			if err := lock(tx); err != nil {
+				return err
+			}
+			if err := tx.First(&category, categoryId).Error; err != nil {
+				writeFetchError(w, r, err)
+				return errAnswered
+			}
+
+			updates := map[string]interface{}{"updated_at": time.Now()}
+			if payload.Name != nil {
+				updates["name"] = *payload.Name
+			}
+			if payload.Attributes != nil {
+				updates["attributes"] = *payload.Attributes
+			}
+			if payload.Slug != nil {
+				if taken, err := slugTaken(w, r, tx, *payload.Slug, category.Id); taken || err != nil {
+					return err
+				}
+				updates["slug"] = *payload.Slug
+			}
+
+			if payload.ParentId != nil {
+				var parent *types.Category
+				if *payload.ParentId != 0 {
+					parent = &types.Category{}
+					if err := tx.First(parent, *payload.ParentId).Error; err != nil {
+						return parentError(w, r, err)
+					}
+					if strings.HasPrefix(parent.Path, category.Path) {
+						log.WithField("parent_id", parent.Id).Info("Category moved under itself")
+						response.WriteError(w, r, http.StatusBadRequest, response.CodeInvalidCategoryParent, "A category cannot be moved under itself or its descendants")
+						return errAnswered
+					}
+					updates["parent_id"] = parent.Id
+				} else {
+					updates["parent_id"] = nil
+				}
+
+				path := childPath(parent, category.Id)
+				err := tx.Model(&types.Category{}).Where("path LIKE ?", category.Path+"%").
+					UpdateColumn("path", gorm.Expr("? || substr(path, ?)", path, len(category.Path)+1)).Error
+				if err != nil {
+					return err
+				}
+			}
+
+			if err := tx.Model(&category).UpdateColumns(updates).Error; err != nil {
+				return err
+			}
+			if err := tx.First(&category, categoryId).Error; err != nil {
+				return err
+			}
+
+			var err error
+			touched, err = touchProducts(tx, category.Path)
+			return err
+		})
+		if err != nil {
+			writeUpdateError(w, r, err, "Failed to update category")
+			return
+		}
+		invalidate(r.Context(), rdb, conf.Redis.Timeout, touched)
+		if err := Breadcrumbs(db.WithContext(r.Context()), []*types.Category{&category}); err != nil {
+			log.WithError(err).Error("Failed to fetch breadcrumbs")
+		}
+
+		log.WithField("products", len(touched)).Info("Category updated")
+		response.WriteJson(w, http.StatusOK, category)
+	}
+}
+
+// DeleteCategory removes a category without children, and its product
+// assignments.
+func DeleteCategory(db *gorm.DB, rdb *redis.Client, conf *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		categoryId, ok := request.PathId(w, r, "category", response.CodeInvalidCategoryId, "Invalid category id")
+		if !ok {
+			return
+		}
+		log = log.WithField("category_id", categoryId)
+
+		var touched []int64
+		err := db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+			if err := lock(tx); err != nil {
+				return err
+			}
+			var category types.Category
+			if err := tx.First(&category, categoryId).Error; err != nil {
+				writeFetchError(w, r, err)
+				return errAnswered
+			}
+
+			var children int64
+			if err := tx.Model(&types.Category{}).Where("parent_id = ?", category.Id).Count(&children).Error; err != nil {
+				return err
+			}
+			if children > 0 {
+				log.WithField("children", children).Info("Category has children")
+				response.WriteError(w, r, http.StatusConflict, response.CodeCategoryHasChildren, "Move or delete the category's children first")
+				return errAnswered
+			}
+
+			var err error
+			if touched, err = touchProducts(tx, category.Path); err != nil {
+				return err
+			}
+			// Product assignments go with the category through ON DELETE
+			// CASCADE.
+			return tx.Delete(&category).Error
+		})
+		if err != nil {
+			writeUpdateError(w, r, err, "Failed to delete category")
+			return
+		}
+		invalidate(r.Context(), rdb, conf.Redis.Timeout, touched)
+
+		log.WithField("products", len(touched)).Info("Category deleted")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func valid(w http.ResponseWriter, r *http.Request, validate *validation.Validator, payload interface{}) bool {
+	if err := validate.Struct(payload); err != nil {
+		logging.FromContext(r.Context()).WithError(err).Info("Invalid payload")
+		fields, locale := validate.Translate(err, r.Header.Get("Accept-Language"))
+		w.Header().Set("Content-Language", locale)
+		response.WriteValidationErrors(w, r, fields)
+		return false
+	}
+	return true
+}
+
+// slugTaken answers the request when another category than id has the slug.
+func slugTaken(w http.ResponseWriter, r *http.Request, tx *gorm.DB, slug string, id int64) (bool, error) {
+	var count int64
+	if err := tx.Model(&types.Category{}).Where("slug = ? AND id <> ?", slug, id).Count(&count).Error; err != nil {
+		return false, err
+	}
+	if count == 0 {
+		return false, nil
+	}
+	logging.FromContext(r.Context()).WithField("slug", slug).Info("Category slug taken")
+	response.WriteError(w, r, http.StatusConflict, response.CodeCategorySlugTaken, fmt.Sprintf("The slug %q is already used by another category", slug))
+	return true, errAnswered
+}
+
+func parentError(w http.ResponseWriter, r *http.Request, err error) error {
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	logging.FromContext(r.Context()).Info("Parent category not found")
+	response.WriteError(w, r, http.StatusBadRequest, response.CodeInvalidCategoryParent, "parent_id is not a category")
+	return errAnswered
+}
+
+func writeFetchError(w http.ResponseWriter, r *http.Request, err error) {
+	log := logging.FromContext(r.Context())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Info("Category not found")
+		response.WriteError(w, r, http.StatusNotFound, response.CodeCategoryNotFound, "Category not found")
+		return
+	}
+	log.WithError(err).Error("Failed to fetch category")
+	response.WriteError(w, r, http.StatusInternalServerError, response.CodeCategoryFetchFailed, "Error fetching category")
+}
+
+func writeUpdateError(w http.ResponseWriter, r *http.Request, err error, detail string) {
+	if errors.Is(err, errAnswered) {
+		return
+	}
+	logging.FromContext(r.Context()).WithError(err).Error(detail)
+	response.WriteError(w, r, http.StatusInternalServerError, response.CodeCategoryUpdateFailed, detail)
+}
+
+func pointers(categories []types.Category) []*types.Category {
+	ptrs := make([]*types.Category, len(categories))
+	for i := range categories {
+		ptrs[i] = &categories[i]
+	}
+	return ptrs
+}
@@ -0,0 +1,185 @@
+package categories
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// Lookup finds a category by ID, or by slug when ref is not a number.
+func Lookup(db *gorm.DB, ref string) (types.Category, error) {
+	var category types.Category
+	if id, err := strconv.ParseInt(ref, 10, 64); err == nil {
+		return category, db.First(&category, id).Error
+	}
+	return category, db.Where("slug = ?", ref).First(&category).Error
+}
+
+// Missing returns the IDs that are not categories.
+func Missing(db *gorm.DB, ids []int64) ([]int64, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	var found []int64
+	if err := db.Model(&types.Category{}).Where("id IN ?", ids).Pluck("id", &found).Error; err != nil {
+		return nil, err
+	}
+
+	exists := make(map[int64]bool, len(found))
+	for _, id := range found {
+		exists[id] = true
+	}
+	var missing []int64
+	for _, id := range ids {
+		if !exists[id] {
+			missing = append(missing, id)
+		}
+	}
+	return missing, nil
+}
+
+// Schemas returns the attribute schemas that apply to products in the given
+// categories: theirs and their ancestors'.
+func Schemas(db *gorm.DB, ids []int64) ([]types.AttributeSchema, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	var assigned []types.Category
+	if err := db.Find(&assigned, ids).Error; err != nil {
+		return nil, err
+	}
+	seen := map[int64]bool{}
+	var all []int64
+	for _, category := range assigned {
+		for _, id := range pathIds(category.Path) {
+			if !seen[id] {
+				seen[id] = true
+				all = append(all, id)
+			}
+		}
+	}
+	if len(all) == 0 {
+		return nil, nil
+	}
+
+	var categories []types.Category
+	if err := db.Select("id", "attributes").Find(&categories, all).Error; err != nil {
+		return nil, err
+	}
+	var schemas []types.AttributeSchema
+	for _, category := range categories {
+		if len(category.Attributes) > 0 {
+			schemas = append(schemas, category.Attributes)
+		}
+	}
+	return schemas, nil
+}
+
+// InSubtree is a subquery of the IDs of the products assigned to a category
+// in the subtree rooted at the category with the given path.
+func InSubtree(db *gorm.DB, path string) *gorm.DB {
+	return db.Table("product_categories").
+		Select("product_categories.product_id").
+		Joins("JOIN categories ON categories.id = product_categories.category_id").
+		Where("categories.path LIKE ?", path+"%")
+}
+
+// Breadcrumbs fills in the breadcrumbs of categories, loading every ancestor
+// they need in one query.
+func Breadcrumbs(db *gorm.DB, categories []*types.Category) error {
+	seen := map[int64]bool{}
+	var ids []int64
+	for _, category := range categories {
+		for _, id := range pathIds(category.Path) {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var ancestors []types.Category
+	if err := db.Find(&ancestors, ids).Error; err != nil {
+		return err
+	}
+	byId := make(map[int64]types.Category, len(ancestors))
+	for _, ancestor := range ancestors {
+		byId[ancestor.Id] = ancestor
+	}
+
+	for _, category := range categories {
+		category.Breadcrumbs = []types.Crumb{}
+		for _, id := range pathIds(category.Path) {
+			if ancestor, ok := byId[id]; ok {
+				category.Breadcrumbs = append(category.Breadcrumbs, types.Crumb{Id: ancestor.Id, Name: ancestor.Name, Slug: ancestor.Slug})
+			}
+		}
+	}
+	return nil
+}
+
+func pathIds(path string) []int64 {
+	var ids []int64
+	for _, part := range strings.Split(strings.Trim(path, "/"), "/") {
+		if id, err := strconv.ParseInt(part, 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func childPath(parent *types.Category, id int64) string {
+	prefix := "/"
+	if parent != nil {
+		prefix = parent.Path
+	}
+	return prefix + strconv.FormatInt(id, 10) + "/"
+}
+
+// lock serializes changes to the tree for the rest of the transaction, so
+// paths computed from a parent cannot be invalidated by a concurrent move.
+func lock(tx *gorm.DB) error {
+	return tx.Exec("SELECT pg_advisory_xact_lock(hashtext('categories'))").Error
+}
+
+// touchProducts bumps the version of the products assigned to the subtree at
+// path, whose breadcrumbs change with it, and returns their IDs.
+func touchProducts(tx *gorm.DB, path string) ([]int64, error) {
+	var ids []int64
+	err := tx.Raw("UPDATE products SET version = version + 1, updated_at = ? WHERE id IN (?) RETURNING id", time.Now(), InSubtree(tx, path)).Scan(&ids).Error
+	return ids, err
+}
+
+// invalidate removes products from the cache.
+func invalidate(ctx context.Context, rdb *redis.Client, timeout time.Duration, ids []int64) {
+	if len(ids) == 0 {
+		return
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = types.CacheKey(id)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := rdb.Del(ctx, keys...).Err(); err != nil {
+		logging.FromContext(ctx).WithError(err).Error("Failed to delete products from cache")
+	}
+}
+
+var nonSlug = regexp.MustCompile(`[^a-z0-9]+`)
+
+// slugify derives a slug from a name, e.g. "Home & Garden" gives
+// "home-garden".
+func slugify(name string) string {
+	return strings.Trim(nonSlug.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
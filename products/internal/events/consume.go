@@ -0,0 +1,110 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/tracing"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Handler handles a product event. The events it fails are requeued.
+type Handler func(ctx context.Context, event types.ProductEvent) error
+
+// requeueDelay is how long a failed event is held before it is requeued,
+// so that a failing dependency does not get it back at once.
+var requeueDelay = time.Second
+
+// Subscribe consumes queue on a channel of its own, which has at most
+// prefetch events unacknowledged. Closing the channel requeues them.
+func Subscribe(conn *amqp.Connection, queue string, prefetch int) (*amqp.Channel, <-chan amqp.Delivery, error) {
+	channel, err := conn.Channel()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := channel.Qos(prefetch, 0, false); err != nil {
+		channel.Close()
+		return nil, nil, err
+	}
+	messages, err := channel.Consume(queue, "", false, false, false, false, nil)
+	if err != nil {
+		channel.Close()
+		return nil, nil, err
+	}
+	return channel, messages, nil
+}
+
+// Consume handles the product events of messages until the channel is
+// closed or ctx is done, counting them in handled by result. Events are
+// acknowledged once handled; those that failed are requeued, and those
+// that cannot be decoded dropped.
+func Consume(ctx context.Context, messages <-chan amqp.Delivery, queue string, handled *prometheus.CounterVec, handle Handler) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+			consume(ctx, message, queue, handled, handle)
+		}
+	}
+}
+
+func consume(ctx context.Context, message amqp.Delivery, queue string, handled *prometheus.CounterVec, handle Handler) {
+	// Continue the trace of the change that published the event.
+	ctx = tracing.Extract(ctx, message.Headers)
+	ctx, span := tracer.Start(ctx, queue+" process", trace.WithSpanKind(trace.SpanKindConsumer))
+
+	requestId, _ := message.Headers["x-request-id"].(string)
+	ctx = logging.WithFields(ctx, logrus.Fields{
+		"delivery_tag": message.DeliveryTag,
+		"request_id":   requestId,
+	})
+	log := logging.FromContext(ctx)
+
+	var event types.ProductEvent
+	requeue := false
+	err := json.Unmarshal(message.Body, &event)
+	if err != nil {
+		log.WithError(err).Error("Failed to decode product event")
+	} else {
+		span.SetAttributes(attribute.Int64("product.id", event.ProductId), attribute.String("event.type", event.Type))
+		err = handle(logging.WithField(ctx, "product_id", event.ProductId), event)
+		requeue = err != nil
+	}
+	tracing.RecordError(span, err)
+	span.End()
+
+	result := metrics.ResultSuccess
+	if err != nil {
+		result = metrics.ResultError
+	}
+	handled.WithLabelValues(result).Inc()
+
+	var ackErr error
+	switch {
+	case err == nil:
+		ackErr = message.Ack(false)
+	case requeue:
+		select {
+		case <-time.After(requeueDelay):
+		case <-ctx.Done():
+		}
+		ackErr = message.Nack(false, true)
+	default:
+		ackErr = message.Nack(false, false)
+	}
+	if ackErr != nil {
+		log.WithError(ackErr).Error("Failed to acknowledge product event")
+	}
+}
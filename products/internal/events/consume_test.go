@@ -0,0 +1,99 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aiu26/product-management/common/types"
+	"github.com/prometheus/client_golang/prometheus"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// acknowledger records what became of each delivery, by tag.
+type acknowledger map[uint64]string
+
+func (a acknowledger) Ack(tag uint64, multiple bool) error {
+	a[tag] = "ack"
+	return nil
+}
+
+func (a acknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	if requeue {
+		a[tag] = "requeue"
+	} else {
+		a[tag] = "drop"
+	}
+	return nil
+}
+
+func (a acknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func newCounter() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{Name: "handled_total"}, []string{"result"})
+}
+
+func TestConsumeAcknowledges(t *testing.T) {
+	defer func(delay time.Duration) { requeueDelay = delay }(requeueDelay)
+	requeueDelay = 0
+
+	acks := acknowledger{}
+	bodies := []string{
+		`{"type": "product.updated", "product_id": 1}`,
+		`{"type": "product.updated", "product_id": 2}`,
+		`not json`,
+	}
+	messages := make(chan amqp.Delivery, len(bodies))
+	for i, body := range bodies {
+		messages <- amqp.Delivery{Acknowledger: acks, DeliveryTag: uint64(i + 1), Body: []byte(body)}
+	}
+	close(messages)
+
+	var handled []int64
+	Consume(context.Background(), messages, "events", newCounter(), func(ctx context.Context, event types.ProductEvent) error {
+		handled = append(handled, event.ProductId)
+		if event.ProductId == 2 {
+			return errors.New("database is down")
+		}
+		return nil
+	})
+
+	if len(handled) != 2 {
+		t.Errorf("handled = %v, want products 1 and 2", handled)
+	}
+	want := acknowledger{1: "ack", 2: "requeue", 3: "drop"}
+	for tag, outcome := range want {
+		if acks[tag] != outcome {
+			t.Errorf("delivery %d: %q, want %q", tag, acks[tag], outcome)
+		}
+	}
+}
+
+func TestConsumeStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	acks := acknowledger{}
+	messages := make(chan amqp.Delivery, 1)
+	messages <- amqp.Delivery{Acknowledger: acks, DeliveryTag: 1, Body: []byte(`{"type": "product.updated", "product_id": 1}`)}
+
+	// The failed event is requeued at once on shutdown, not after the delay,
+	// and the open channel is not waited on.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Consume(ctx, messages, "events", newCounter(), func(context.Context, types.ProductEvent) error {
+			cancel()
+			return errors.New("shutting down")
+		})
+	}()
+	select {
+	case <-done:
+	case <-time.After(requeueDelay / 2):
+		t.Fatal("Consume did not stop on cancel")
+	}
+	if acks[1] != "requeue" {
+		t.Errorf("delivery 1: %q, want requeue", acks[1])
+	}
+}
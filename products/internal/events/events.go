@@ -0,0 +1,67 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/tracing"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/metrics"
+	"github.com/aiu26/product-management/products/internal/utils/request"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = tracing.Tracer("github.com/aiu26/product-management/products/internal/events")
+
+// Declare declares the fanout exchange product events are published on.
+func Declare(channel *amqp.Channel, conf *config.Config) error {
+	return channel.ExchangeDeclare(conf.RabbitMQ.EventsExchange, amqp.ExchangeFanout, true, false, false, false, nil)
+}
+
+// Publish publishes an event of the given type for each product. The
+// changes are already stored, so failures are only logged.
+func Publish(ctx context.Context, channel *amqp.Channel, conf *config.Config, eventType string, productIds ...int64) {
+	for _, productId := range productIds {
+		publish(ctx, channel, conf, types.ProductEvent{Type: eventType, ProductId: productId, OccurredAt: time.Now()})
+	}
+}
+
+func publish(ctx context.Context, channel *amqp.Channel, conf *config.Config, event types.ProductEvent) {
+	log := logging.FromContext(ctx).WithField("product_id", event.ProductId)
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.WithError(err).Error("Failed to encode product event")
+		return
+	}
+
+	exchange := conf.RabbitMQ.EventsExchange
+	ctx, span := tracer.Start(ctx, exchange+" publish", trace.WithSpanKind(trace.SpanKindProducer))
+	span.SetAttributes(attribute.Int64("product.id", event.ProductId), attribute.String("event.type", event.Type))
+	headers := amqp.Table{"x-request-id": request.RequestIDFromContext(ctx)}
+	tracing.Inject(ctx, headers)
+
+	message := amqp.Publishing{
+		ContentType: "application/json",
+		Type:        event.Type,
+		Headers:     headers,
+		Body:        body,
+	}
+	err = channel.PublishWithContext(ctx, exchange, "", false, false, message)
+	tracing.RecordError(span, err)
+	span.End()
+
+	result := metrics.ResultSuccess
+	if err != nil {
+		result = metrics.ResultError
+	}
+	metrics.Published.WithLabelValues(exchange, result).Inc()
+	if err != nil {
+		log.WithError(err).WithField("type", event.Type).Error("Failed to publish product event")
+	}
+}
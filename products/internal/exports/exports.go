@@ -0,0 +1,261 @@
+package exports
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aiu26/product-management/common/types"
+	"github.com/munnerz/goautoneg"
+	"github.com/shopspring/decimal"
+)
+
+// Formats of exports.
+const (
+	CSV    = "csv"
+	NDJSON = "ndjson"
+	XLSX   = "xlsx"
+)
+
+var contentTypes = map[string]string{
+	CSV:    "text/csv",
+	NDJSON: "application/x-ndjson",
+	XLSX:   "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// Supported reports whether format is an export format.
+func Supported(format string) bool {
+	_, ok := contentTypes[format]
+	return ok
+}
+
+// ContentType is the media type of a format.
+func ContentType(format string) string {
+	return contentTypes[format]
+}
+
+// Negotiate picks the format an Accept header prefers, CSV when it has no
+// preference. It returns "" when the header accepts none of them.
+func Negotiate(accept string) string {
+	if strings.TrimSpace(accept) == "" {
+		return CSV
+	}
+	chosen := goautoneg.Negotiate(accept, []string{contentTypes[CSV], contentTypes[NDJSON], contentTypes[XLSX]})
+	for format, contentType := range contentTypes {
+		if contentType == chosen {
+			return format
+		}
+	}
+	return ""
+}
+
+// Writer writes the products of an export.
+type Writer interface {
+	Write(product *types.Product) error
+	// Flush sends what was written so far on to the underlying writer.
+	Flush() error
+	// Close finishes the export, but not the underlying writer.
+	Close() error
+}
+
+// NewWriter starts an export to w. currency is the one the products were
+// converted to, if any, which CSV and XLSX exports add columns for.
+func NewWriter(format string, w io.Writer, currency string) (Writer, error) {
+	converted := currency != ""
+	switch format {
+	case NDJSON:
+		return &ndjsonWriter{encoder: json.NewEncoder(w)}, nil
+	case XLSX:
+		return newXLSXWriter(w, converted)
+	default:
+		return newCSVWriter(w, converted)
+	}
+}
+
+// header names the CSV and XLSX columns. Those a product import reads are
+// named and formatted alike, and it skips the others, so a CSV export can be
+// imported again.
+func header(converted bool) []string {
+	columns := []string{"product_id", "user_id", "product_name", "product_description", "product_price", "product_currency"}
+	if converted {
+		columns = append(columns, "converted_price", "converted_currency")
+	}
+	return append(columns, "category_ids", "categories", "tags", "attributes", "variants", "product_images", "compressed_images", "version", "created_at", "updated_at", "deleted_at")
+}
+
+// numericColumns are the columns of numbers, which spreadsheets get as
+// such.
+var numericColumns = map[string]bool{
+	"product_id":      true,
+	"user_id":         true,
+	"product_price":   true,
+	"converted_price": true,
+	"version":         true,
+}
+
+// exportVariant is a variant in the variants column, shaped like the
+// variants of a product payload.
+type exportVariant struct {
+	Sku              string               `json:"sku"`
+	Options          types.VariantOptions `json:"options"`
+	Price            *decimal.Decimal     `json:"price"`
+	Images           []string             `json:"images"`
+	CompressedImages []string             `json:"compressed_images"`
+}
+
+// record is the row of a product: lists are separated by |, attributes and
+// variants are JSON, and times RFC 3339. Cells are escaped with
+// EscapeFormula.
+func record(product *types.Product, converted bool) []string {
+	row := []string{
+		strconv.FormatInt(product.Id, 10),
+		strconv.FormatInt(product.UserId, 10),
+		product.Name,
+		product.Description,
+		product.Price.String(),
+		product.Currency,
+	}
+	if converted {
+		if product.Conversion != nil {
+			row = append(row, product.Conversion.Price.String(), product.Conversion.Currency)
+		} else {
+			row = append(row, "", "")
+		}
+	}
+
+	categoryIds := make([]string, len(product.Categories))
+	categoryNames := make([]string, len(product.Categories))
+	for i, category := range product.Categories {
+		categoryIds[i] = strconv.FormatInt(category.Id, 10)
+		categoryNames[i] = category.Name
+	}
+	tagNames := make([]string, len(product.Tags))
+	for i, tag := range product.Tags {
+		tagNames[i] = tag.Name
+	}
+	attrs := ""
+	if len(product.Attributes) > 0 {
+		data, _ := json.Marshal(product.Attributes)
+		attrs = string(data)
+	}
+	variants := ""
+	if len(product.Variants) > 0 {
+		list := make([]exportVariant, len(product.Variants))
+		for i, variant := range product.Variants {
+			list[i] = exportVariant{
+				Sku:              variant.Sku,
+				Options:          variant.Options,
+				Price:            variant.Price,
+				Images:           imageUrls(variant.Images),
+				CompressedImages: compressedUrls(variant.CompressedImages),
+			}
+		}
+		data, _ := json.Marshal(list)
+		variants = string(data)
+	}
+	deletedAt := ""
+	if product.DeletedAt.Valid {
+		deletedAt = product.DeletedAt.Time.Format(time.RFC3339)
+	}
+
+	row = append(row,
+		strings.Join(categoryIds, "|"),
+		strings.Join(categoryNames, "|"),
+		strings.Join(tagNames, "|"),
+		attrs,
+		variants,
+		strings.Join(imageUrls(product.Images), "|"),
+		strings.Join(compressedUrls(product.CompressedImages), "|"),
+		strconv.FormatInt(product.Version, 10),
+		product.CreatedAt.Format(time.RFC3339),
+		product.UpdatedAt.Format(time.RFC3339),
+		deletedAt,
+	)
+	for i, cell := range row {
+		row[i] = EscapeFormula(cell)
+	}
+	return row
+}
+
+// formulaPrefixes are the characters a spreadsheet reads a cell starting
+// with as a formula.
+const formulaPrefixes = "=+-@"
+
+// EscapeFormula prefixes a cell a spreadsheet would take for a formula with
+// ', so that it is shown as text instead.
+func EscapeFormula(cell string) string {
+	if cell != "" && strings.ContainsRune(formulaPrefixes, rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+// UnescapeFormula undoes EscapeFormula.
+func UnescapeFormula(cell string) string {
+	if len(cell) > 1 && cell[0] == '\'' && strings.ContainsRune(formulaPrefixes, rune(cell[1])) {
+		return cell[1:]
+	}
+	return cell
+}
+
+func imageUrls(images []types.Image) []string {
+	urls := make([]string, len(images))
+	for i, image := range images {
+		urls[i] = image.Url
+	}
+	return urls
+}
+
+func compressedUrls(images []types.CompressedImage) []string {
+	urls := make([]string, len(images))
+	for i, image := range images {
+		urls[i] = image.Url
+	}
+	return urls
+}
+
+type csvWriter struct {
+	writer    *csv.Writer
+	converted bool
+}
+
+func newCSVWriter(w io.Writer, converted bool) (*csvWriter, error) {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(header(converted)); err != nil {
+		return nil, err
+	}
+	return &csvWriter{writer: writer, converted: converted}, nil
+}
+
+func (c *csvWriter) Write(product *types.Product) error {
+	return c.writer.Write(record(product, c.converted))
+}
+
+func (c *csvWriter) Flush() error {
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+func (c *csvWriter) Close() error {
+	return c.Flush()
+}
+
+// ndjsonWriter writes each product as GET /products returns it.
+type ndjsonWriter struct {
+	encoder *json.Encoder
+}
+
+func (n *ndjsonWriter) Write(product *types.Product) error {
+	return n.encoder.Encode(product)
+}
+
+func (n *ndjsonWriter) Flush() error {
+	return nil
+}
+
+func (n *ndjsonWriter) Close() error {
+	return nil
+}
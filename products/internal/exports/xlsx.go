@@ -0,0 +1,123 @@
+package exports
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"io"
+	"unicode/utf8"
+
+	"github.com/aiu26/product-management/common/types"
+)
+
+// maxCellLength is the most characters a spreadsheet cell holds; longer
+// values are cut there.
+const maxCellLength = 32767
+
+// The parts of a workbook with a single sheet, other than the sheet itself.
+var xlsxParts = []struct {
+	name    string
+	content string
+}{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+	{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Products" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`},
+}
+
+// xlsxWriter streams a workbook with one sheet. Text is written in inline
+// strings rather than a shared string table, so nothing but the current row
+// is held in memory.
+type xlsxWriter struct {
+	zip       *zip.Writer
+	sheet     *bufio.Writer
+	numeric   []bool
+	converted bool
+}
+
+func newXLSXWriter(w io.Writer, converted bool) (*xlsxWriter, error) {
+	archive := zip.NewWriter(w)
+	for _, part := range xlsxParts {
+		file, err := archive.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(file, part.content); err != nil {
+			return nil, err
+		}
+	}
+	// The sheet comes last, as it stays open while rows are added.
+	file, err := archive.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+
+	columns := header(converted)
+	x := &xlsxWriter{
+		zip:       archive,
+		sheet:     bufio.NewWriter(file),
+		numeric:   make([]bool, len(columns)),
+		converted: converted,
+	}
+	for i, column := range columns {
+		x.numeric[i] = numericColumns[column]
+	}
+	x.sheet.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	if err := x.row(columns, false); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+func (x *xlsxWriter) Write(product *types.Product) error {
+	return x.row(record(product, x.converted), true)
+}
+
+func (x *xlsxWriter) row(values []string, typed bool) error {
+	x.sheet.WriteString("<row>")
+	for i, value := range values {
+		switch {
+		case value == "":
+			x.sheet.WriteString("<c/>")
+		case typed && x.numeric[i]:
+			x.sheet.WriteString("<c><v>")
+			x.sheet.WriteString(value)
+			x.sheet.WriteString("</v></c>")
+		default:
+			x.sheet.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+			if err := xml.EscapeText(x.sheet, []byte(truncate(value))); err != nil {
+				return err
+			}
+			x.sheet.WriteString("</t></is></c>")
+		}
+	}
+	_, err := x.sheet.WriteString("</row>")
+	return err
+}
+
+func (x *xlsxWriter) Flush() error {
+	if err := x.sheet.Flush(); err != nil {
+		return err
+	}
+	return x.zip.Flush()
+}
+
+func (x *xlsxWriter) Close() error {
+	x.sheet.WriteString("</sheetData></worksheet>")
+	if err := x.sheet.Flush(); err != nil {
+		return err
+	}
+	return x.zip.Close()
+}
+
+func truncate(value string) string {
+	if len(value) <= maxCellLength || utf8.RuneCountInString(value) <= maxCellLength {
+		return value
+	}
+	return string([]rune(value)[:maxCellLength])
+}
@@ -0,0 +1,118 @@
+package feeds
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/tracing"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/events"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Handle keeps feeds up to date with product events. Replicas share the
+// feeds queue, so each event is handled once.
+func Handle(db *gorm.DB, conf *config.Config) events.Handler {
+	return func(ctx context.Context, event types.ProductEvent) error {
+		// Failed compressions change nothing a feed shows.
+		if event.Type == types.EventCompressionFailed {
+			return nil
+		}
+		return Refresh(ctx, db, conf, event.ProductId)
+	}
+}
+
+// Refresh renders the feed entry of a product again, or removes it when the
+// product is deleted, and bumps the revision of the seller's feeds when the
+// entry changed. Sellers whose feeds were never requested are skipped, as
+// their feeds are built in full on the first request.
+func Refresh(ctx context.Context, db *gorm.DB, conf *config.Config, productId int64) (err error) {
+	ctx, span := tracer.Start(ctx, "refresh feed entry")
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+	log := logging.FromContext(ctx)
+
+	changed := false
+	err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// The seller of a purged product is only known from its entry.
+		var userIds []int64
+		if err := tx.Unscoped().Model(&types.Product{}).Where("id = ?", productId).Pluck("user_id", &userIds).Error; err != nil {
+			return err
+		}
+		if len(userIds) == 0 {
+			if err := tx.Model(&types.FeedEntry{}).Where("product_id = ?", productId).Pluck("user_id", &userIds).Error; err != nil {
+				return err
+			}
+		}
+		if len(userIds) == 0 {
+			return nil
+		}
+
+		// Locking the feed serializes the refreshes of the seller's entries
+		// with builds, and the product is read after the lock, so the
+		// latest change is the one rendered.
+		var feed types.Feed
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&feed, userIds[0]).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+
+		var current []types.FeedEntry
+		if err := tx.Where("product_id = ?", productId).Find(&current).Error; err != nil {
+			return err
+		}
+		var products []types.Product
+		if err := preload(tx).Where("id = ?", productId).Find(&products).Error; err != nil {
+			return err
+		}
+
+		switch {
+		case len(products) == 0:
+			result := tx.Where("product_id = ?", productId).Delete(&types.FeedEntry{})
+			if result.Error != nil {
+				return result.Error
+			}
+			changed = result.RowsAffected > 0
+		default:
+			rendered, err := renderAll(tx, conf, products)
+			if err != nil {
+				return err
+			}
+			entry := rendered[0]
+			if len(current) > 0 && current[0].Google == entry.Google && current[0].RSS == entry.RSS && current[0].Atom == entry.Atom {
+				return nil
+			}
+			err = tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "product_id"}},
+				DoUpdates: clause.AssignmentColumns([]string{"google", "rss", "atom", "updated_at"}),
+			}).Create(&entry).Error
+			if err != nil {
+				return err
+			}
+			changed = true
+		}
+		if !changed {
+			return nil
+		}
+		return tx.Model(&feed).UpdateColumns(map[string]interface{}{
+			"revision":   gorm.Expr("revision + 1"),
+			"updated_at": time.Now(),
+		}).Error
+	})
+	if err != nil {
+		log.WithError(err).Error("Failed to refresh feed entry")
+		return err
+	}
+	if changed {
+		log.Info("Feed entry refreshed")
+	}
+	return nil
+}
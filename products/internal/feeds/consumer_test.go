@@ -0,0 +1,19 @@
+package feeds
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/testutil"
+)
+
+func TestHandleSkipsFailedCompressions(t *testing.T) {
+	// The database expects no queries, so reading one fails the test.
+	db, _ := testutil.NewDB(t)
+	err := Handle(db, &config.Config{})(context.Background(), types.ProductEvent{Type: types.EventCompressionFailed, ProductId: 3})
+	if err != nil {
+		t.Errorf("Handle() = %v, want nil", err)
+	}
+}
@@ -0,0 +1,273 @@
+package feeds
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/tracing"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/utils/request"
+	"github.com/aiu26/product-management/products/internal/utils/response"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var tracer = tracing.Tracer("github.com/aiu26/product-management/products/internal/feeds")
+
+// format is a kind of feed: the entries column it joins, and what comes
+// before and after them.
+type format struct {
+	contentType string
+	column      string
+	open        func(conf *config.Config, feed types.Feed) string
+	close       string
+}
+
+// formats maps the names feeds are served under to their format.
+var formats = map[string]format{
+	"google.xml": {
+		contentType: "application/rss+xml; charset=utf-8",
+		column:      "google",
+		open: func(conf *config.Config, feed types.Feed) string {
+			var b strings.Builder
+			b.WriteString(xml.Header)
+			b.WriteString(`<rss version="2.0" xmlns:g="http://base.google.com/ns/1.0"><channel>`)
+			channel(&b, conf, feed)
+			return b.String()
+		},
+		close: "</channel></rss>\n",
+	},
+	"rss.xml": {
+		contentType: "application/rss+xml; charset=utf-8",
+		column:      "rss",
+		open: func(conf *config.Config, feed types.Feed) string {
+			var b strings.Builder
+			b.WriteString(xml.Header)
+			b.WriteString(`<rss version="2.0" xmlns:media="http://search.yahoo.com/mrss/"><channel>`)
+			channel(&b, conf, feed)
+			return b.String()
+		},
+		close: "</channel></rss>\n",
+	},
+	"atom.xml": {
+		contentType: "application/atom+xml; charset=utf-8",
+		column:      "atom",
+		open: func(conf *config.Config, feed types.Feed) string {
+			var b strings.Builder
+			b.WriteString(xml.Header)
+			b.WriteString(`<feed xmlns="http://www.w3.org/2005/Atom">`)
+			link := sellerURL(conf, feed.UserId)
+			element(&b, "id", link)
+			element(&b, "title", conf.Feeds.Title)
+			b.WriteString(`<link rel="alternate" href="`)
+			escape(&b, link)
+			b.WriteString(`"/><author>`)
+			element(&b, "name", conf.Feeds.Title)
+			b.WriteString("</author>")
+			element(&b, "updated", feed.UpdatedAt.UTC().Format(time.RFC3339))
+			b.WriteString("\n")
+			return b.String()
+		},
+		close: "</feed>\n",
+	},
+}
+
+// channel writes the elements of an RSS channel, before its items.
+func channel(b *strings.Builder, conf *config.Config, feed types.Feed) {
+	element(b, "title", conf.Feeds.Title)
+	element(b, "link", sellerURL(conf, feed.UserId))
+	element(b, "description", fmt.Sprintf("Products of seller %d", feed.UserId))
+	element(b, "lastBuildDate", feed.UpdatedAt.UTC().Format(time.RFC1123Z))
+	b.WriteString("\n")
+}
+
+// GetFeed serves the Google Merchant Center, RSS or Atom feed of a seller's
+// products, newest first. Feeds are built on their first request, then kept
+// up to date by product events, so serving one only joins rendered entries.
+// Responses carry the feed's revision as their ETag, and may be cached for
+// feeds.max_age.
+func GetFeed(db *gorm.DB, conf *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		if conf.Feeds.ProductURL == "" {
+			log.Info("Feeds need a product link")
+			response.WriteError(w, r, http.StatusServiceUnavailable, response.CodeFeedsUnavailable, "Feeds are not configured")
+			return
+		}
+		userId, ok := request.PathId(w, r, "id", response.CodeInvalidUserId, "Invalid user id")
+		if !ok {
+			return
+		}
+		name := r.PathValue("feed")
+		f, ok := formats[name]
+		if !ok {
+			log.WithField("feed", name).Info("Feed not found")
+			response.WriteError(w, r, http.StatusNotFound, response.CodeFeedNotFound, "Feeds are google.xml, rss.xml and atom.xml")
+			return
+		}
+		log = log.WithField("user_id", userId).WithField("feed", name)
+
+		if err := build(r.Context(), db, conf, userId); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				log.Info("User not found")
+				response.WriteError(w, r, http.StatusNotFound, response.CodeUserNotFound, "User not found")
+				return
+			}
+			log.WithError(err).Error("Failed to build feed")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeFeedFailed, "Error building feed")
+			return
+		}
+
+		// The revision and the entries are read in one snapshot, so the
+		// ETag matches the content.
+		written := false
+		var feed types.Feed
+		entries := 0
+		err := db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+			if err := tx.First(&feed, userId).Error; err != nil {
+				return err
+			}
+			etag := request.ETag(feed.Revision)
+			w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(conf.Feeds.MaxAge/time.Second)))
+			if request.NotModified(r, etag, feed.UpdatedAt) {
+				request.WriteNotModified(w, etag, feed.UpdatedAt)
+				written = true
+				return nil
+			}
+
+			rows, err := tx.Model(&types.FeedEntry{}).Select(f.column).Where("user_id = ?", userId).
+				Order("created_at DESC, product_id DESC").Rows()
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			request.SetValidators(w, etag, feed.UpdatedAt)
+			w.Header().Set("Content-Type", f.contentType)
+			written = true
+			if _, err := io.WriteString(w, f.open(conf, feed)); err != nil {
+				return err
+			}
+			for rows.Next() {
+				var entry string
+				if err := rows.Scan(&entry); err != nil {
+					return err
+				}
+				if _, err := io.WriteString(w, entry); err != nil {
+					return err
+				}
+				entries++
+			}
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			_, err = io.WriteString(w, f.close)
+			return err
+		}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+		if err != nil {
+			log.WithError(err).Error("Failed to serve feed")
+			if !written {
+				w.Header().Del("Cache-Control")
+				response.WriteError(w, r, http.StatusInternalServerError, response.CodeFeedFailed, "Error serving feed")
+				return
+			}
+			// A truncated feed must not look complete.
+			panic(http.ErrAbortHandler)
+		}
+		log.WithFields(logrus.Fields{"revision": feed.Revision, "entries": entries}).Info("Feed served")
+	}
+}
+
+// build renders the entries of every product of a seller, unless their
+// feeds were built already. It returns gorm.ErrRecordNotFound when there is
+// no such user.
+func build(ctx context.Context, db *gorm.DB, conf *config.Config, userId int64) (err error) {
+	var exists int64
+	if err := db.WithContext(ctx).Model(&types.Feed{}).Where("user_id = ?", userId).Count(&exists).Error; err != nil || exists > 0 {
+		return err
+	}
+
+	ctx, span := tracer.Start(ctx, "build feed")
+	entries := 0
+	defer func() {
+		span.SetAttributes(attribute.Int64("user.id", userId), attribute.Int("entries", entries))
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&types.User{}, userId).Error; err != nil {
+			return err
+		}
+		// The new row stays locked until the entries are in, so product
+		// events for the seller wait rather than miss them; a concurrent
+		// build waits too, and then finds it.
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&types.Feed{UserId: userId, Revision: 1, UpdatedAt: time.Now()})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+
+		var products []types.Product
+		return preload(tx).Where("user_id = ?", userId).FindInBatches(&products, conf.Feeds.BatchSize, func(batch *gorm.DB, _ int) error {
+			rendered, err := renderAll(batch, conf, products)
+			if err != nil {
+				return err
+			}
+			entries += len(rendered)
+			return batch.Session(&gorm.Session{NewDB: true}).Create(&rendered).Error
+		}).Error
+	})
+}
+
+// renderAll renders the entries of products with their stock.
+func renderAll(tx *gorm.DB, conf *config.Config, products []types.Product) ([]types.FeedEntry, error) {
+	ids := make([]int64, len(products))
+	for i, product := range products {
+		ids[i] = product.Id
+	}
+	var items []types.StockItem
+	if err := tx.Session(&gorm.Session{NewDB: true}).Where("product_id IN ?", ids).Find(&items).Error; err != nil {
+		return nil, err
+	}
+	stock := make(map[int64]map[int64]int64, len(products))
+	for _, item := range items {
+		if stock[item.ProductId] == nil {
+			stock[item.ProductId] = map[int64]int64{}
+		}
+		key := int64(0)
+		if item.VariantId != nil {
+			key = *item.VariantId
+		}
+		stock[item.ProductId][key] = item.Available
+	}
+
+	entries := make([]types.FeedEntry, len(products))
+	for i := range products {
+		entries[i] = render(conf, &products[i], stock[products[i].Id])
+	}
+	return entries, nil
+}
+
+// ownImages leaves the images of a product's variants out of its own.
+func ownImages(db *gorm.DB) *gorm.DB {
+	return db.Where("variant_id IS NULL")
+}
+
+// preload loads the images and variants feed entries show.
+func preload(query *gorm.DB) *gorm.DB {
+	return query.Preload("Images", ownImages).Preload("CompressedImages", ownImages).
+		Preload("Variants", func(db *gorm.DB) *gorm.DB { return db.Order("variants.id") }).
+		Preload("Variants.Images").Preload("Variants.CompressedImages")
+}
@@ -0,0 +1,194 @@
+package feeds
+
+import (
+	"encoding/xml"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/money"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/shopspring/decimal"
+)
+
+// maxAdditionalImages is the most additional images Google Merchant Center
+// reads per item.
+const maxAdditionalImages = 10
+
+// render renders the entry of a product in each feed format. stock maps the
+// ids of its variants, or 0 for the product itself, to their availability.
+func render(conf *config.Config, product *types.Product, stock map[int64]int64) types.FeedEntry {
+	link := productURL(conf, product.Id)
+	images := imageUrls(product.Images, product.CompressedImages)
+
+	var google strings.Builder
+	if len(product.Variants) == 0 {
+		googleItem(&google, googleFields{
+			id:        strconv.FormatInt(product.Id, 10),
+			title:     product.Name,
+			link:      link,
+			images:    images,
+			price:     product.Price,
+			currency:  product.Currency,
+			available: stock[0] > 0,
+		}, product.Description)
+	}
+	// Variants are items of their own, grouped by the product.
+	for _, variant := range product.Variants {
+		price := product.Price
+		if variant.Price != nil {
+			price = *variant.Price
+		}
+		googleItem(&google, googleFields{
+			id:        variant.Sku,
+			group:     strconv.FormatInt(product.Id, 10),
+			title:     variantTitle(product.Name, variant.Options),
+			link:      link,
+			images:    append(imageUrls(variant.Images, variant.CompressedImages), images...),
+			price:     price,
+			currency:  product.Currency,
+			available: stock[variant.Id] > 0,
+		}, product.Description)
+	}
+
+	var rss strings.Builder
+	rss.WriteString("<item>")
+	element(&rss, "title", product.Name)
+	element(&rss, "link", link)
+	element(&rss, "description", product.Description)
+	rss.WriteString(`<guid isPermaLink="true">`)
+	escape(&rss, link)
+	rss.WriteString("</guid>")
+	element(&rss, "pubDate", product.CreatedAt.UTC().Format(time.RFC1123Z))
+	for _, url := range images {
+		rss.WriteString(`<media:content medium="image" url="`)
+		escape(&rss, url)
+		rss.WriteString(`"/>`)
+	}
+	rss.WriteString("</item>\n")
+
+	var atom strings.Builder
+	atom.WriteString("<entry>")
+	element(&atom, "id", link)
+	element(&atom, "title", product.Name)
+	atom.WriteString(`<link rel="alternate" href="`)
+	escape(&atom, link)
+	atom.WriteString(`"/>`)
+	for _, url := range images {
+		atom.WriteString(`<link rel="enclosure" href="`)
+		escape(&atom, url)
+		atom.WriteString(`"/>`)
+	}
+	element(&atom, "summary", product.Description)
+	element(&atom, "published", product.CreatedAt.UTC().Format(time.RFC3339))
+	element(&atom, "updated", product.UpdatedAt.UTC().Format(time.RFC3339))
+	atom.WriteString("</entry>\n")
+
+	return types.FeedEntry{
+		ProductId: product.Id,
+		UserId:    product.UserId,
+		Google:    google.String(),
+		RSS:       rss.String(),
+		Atom:      atom.String(),
+		CreatedAt: product.CreatedAt,
+	}
+}
+
+// googleFields are the fields of a Google Merchant Center item, for a
+// product or one of its variants.
+type googleFields struct {
+	id        string
+	group     string
+	title     string
+	link      string
+	images    []string
+	price     decimal.Decimal
+	currency  string
+	available bool
+}
+
+func googleItem(b *strings.Builder, f googleFields, description string) {
+	b.WriteString("<item>")
+	element(b, "g:id", f.id)
+	if f.group != "" {
+		element(b, "g:item_group_id", f.group)
+	}
+	element(b, "title", f.title)
+	element(b, "description", description)
+	element(b, "link", f.link)
+	for i, url := range f.images {
+		if i == 0 {
+			element(b, "g:image_link", url)
+			continue
+		}
+		if i > maxAdditionalImages {
+			break
+		}
+		element(b, "g:additional_image_link", url)
+	}
+	exponent, _ := money.Exponent(f.currency)
+	element(b, "g:price", f.price.StringFixed(exponent)+" "+f.currency)
+	availability := "out_of_stock"
+	if f.available {
+		availability = "in_stock"
+	}
+	element(b, "g:availability", availability)
+	element(b, "g:condition", "new")
+	b.WriteString("</item>\n")
+}
+
+// imageUrls lists the urls of images, taking the compressed version of
+// those that have one.
+func imageUrls(images []types.Image, compressed []types.CompressedImage) []string {
+	byImage := make(map[int64]string, len(compressed))
+	for _, image := range compressed {
+		byImage[image.ImageId] = image.Url
+	}
+	urls := make([]string, len(images))
+	for i, image := range images {
+		urls[i] = image.Url
+		if url, ok := byImage[image.Id]; ok {
+			urls[i] = url
+		}
+	}
+	return urls
+}
+
+// variantTitle tells variants apart by their option values, in the order of
+// the option names, like "T-shirt (red, M)" for colour and size.
+func variantTitle(name string, options types.VariantOptions) string {
+	if len(options) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		values[i] = options[key]
+	}
+	return name + " (" + strings.Join(values, ", ") + ")"
+}
+
+func productURL(conf *config.Config, productId int64) string {
+	return strings.ReplaceAll(conf.Feeds.ProductURL, "{product_id}", strconv.FormatInt(productId, 10))
+}
+
+func sellerURL(conf *config.Config, userId int64) string {
+	return strings.ReplaceAll(conf.Feeds.SellerURL, "{user_id}", strconv.FormatInt(userId, 10))
+}
+
+func element(b *strings.Builder, name string, text string) {
+	b.WriteString("<" + name + ">")
+	escape(b, text)
+	b.WriteString("</" + name + ">")
+}
+
+func escape(b *strings.Builder, text string) {
+	// Writing to a strings.Builder does not fail.
+	xml.EscapeText(b, []byte(text))
+}
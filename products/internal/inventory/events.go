@@ -0,0 +1,75 @@
+package inventory
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/tracing"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/metrics"
+	"github.com/aiu26/product-management/products/internal/utils/request"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = tracing.Tracer("github.com/aiu26/product-management/products/internal/inventory")
+
+// LowStockEvent is published when the availability of a product or variant
+// drops to its low stock threshold or below.
+type LowStockEvent struct {
+	ProductId         int64  `json:"product_id"`
+	VariantId         *int64 `json:"variant_id,omitempty"`
+	OnHand            int64  `json:"on_hand"`
+	Available         int64  `json:"available"`
+	LowStockThreshold int64  `json:"low_stock_threshold"`
+}
+
+// publishLowStock publishes the low stock event of an item. The stock change
+// is already stored, so a failure is only logged.
+func publishLowStock(ctx context.Context, channel *amqp.Channel, conf *config.Config, item types.StockItem) {
+	log := logging.FromContext(ctx).WithField("product_id", item.ProductId)
+	if item.VariantId != nil {
+		log = log.WithField("variant_id", *item.VariantId)
+	}
+
+	body, err := json.Marshal(LowStockEvent{
+		ProductId:         item.ProductId,
+		VariantId:         item.VariantId,
+		OnHand:            item.OnHand,
+		Available:         item.Available,
+		LowStockThreshold: item.LowStockThreshold,
+	})
+	if err != nil {
+		log.WithError(err).Error("Failed to encode low stock event")
+		return
+	}
+
+	queue := conf.RabbitMQ.LowStockQueue
+	ctx, span := tracer.Start(ctx, queue+" publish", trace.WithSpanKind(trace.SpanKindProducer))
+	span.SetAttributes(attribute.Int64("product.id", item.ProductId))
+	headers := amqp.Table{"x-request-id": request.RequestIDFromContext(ctx)}
+	tracing.Inject(ctx, headers)
+
+	message := amqp.Publishing{
+		ContentType: "application/json",
+		Headers:     headers,
+		Body:        body,
+	}
+	err = channel.PublishWithContext(ctx, "", queue, false, false, message)
+	tracing.RecordError(span, err)
+	span.End()
+
+	result := metrics.ResultSuccess
+	if err != nil {
+		result = metrics.ResultError
+	}
+	metrics.Published.WithLabelValues(queue, result).Inc()
+	if err != nil {
+		log.WithError(err).Error("Failed to publish low stock event")
+		return
+	}
+	log.WithField("available", item.Available).Info("Low stock event published")
+}
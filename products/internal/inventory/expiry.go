@@ -0,0 +1,84 @@
+package inventory
+
+import (
+	"context"
+	"time"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/tracing"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/events"
+	"github.com/aiu26/product-management/products/internal/metrics"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ExpireReservations releases the stock of the pending reservations whose
+// expiry has passed, in batches. Reservations are locked with SKIP LOCKED,
+// so every replica can run it, and one being committed or released is left
+// alone. Products back in stock are announced with product events. It
+// returns the number of reservations expired.
+func ExpireReservations(ctx context.Context, db *gorm.DB, channel *amqp.Channel, conf *config.Config, now time.Time) (expired int, err error) {
+	ctx, span := tracer.Start(ctx, "expire reservations")
+	defer func() {
+		span.SetAttributes(attribute.Int("expired", expired))
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	for {
+		n, err := expireBatch(ctx, db, channel, conf, now)
+		expired += n
+		if err != nil {
+			return expired, err
+		}
+		if n < conf.Inventory.BatchSize {
+			return expired, nil
+		}
+	}
+}
+
+func expireBatch(ctx context.Context, db *gorm.DB, channel *amqp.Channel, conf *config.Config, now time.Time) (int, error) {
+	log := logging.FromContext(ctx)
+
+	var ids, restocked []int64
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		ids, restocked = nil, nil
+		err := tx.Model(&types.Reservation{}).Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND expires_at <= ?", types.ReservationPending, now).
+			Order("expires_at, id").
+			Limit(conf.Inventory.BatchSize).
+			Pluck("id", &ids).Error
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+
+		// The items of the whole batch are released together, so stock
+		// items are still taken in the order of their ids.
+		var items []types.ReservationItem
+		if err := tx.Where("reservation_id IN ?", ids).Find(&items).Error; err != nil {
+			return err
+		}
+		restocked, err = unreserve(tx, items, false, now)
+		if err != nil {
+			return err
+		}
+		return tx.Model(&types.Reservation{}).Where("id IN ?", ids).UpdateColumns(map[string]interface{}{
+			"status":     types.ReservationExpired,
+			"updated_at": now,
+		}).Error
+	})
+	if err != nil {
+		log.WithError(err).Error("Failed to expire reservations")
+		return 0, err
+	}
+	if len(ids) > 0 {
+		metrics.Reservations.WithLabelValues(metrics.ReservationExpired).Add(float64(len(ids)))
+		log.WithField("reservation_ids", ids).Info("Reservations expired")
+	}
+	events.Publish(ctx, channel, conf, types.EventProductUpdated, restocked...)
+	return len(ids), nil
+}
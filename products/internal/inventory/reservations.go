@@ -0,0 +1,392 @@
+package inventory
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/events"
+	"github.com/aiu26/product-management/products/internal/metrics"
+	"github.com/aiu26/product-management/products/internal/utils/request"
+	"github.com/aiu26/product-management/products/internal/utils/response"
+	"github.com/aiu26/product-management/products/internal/utils/validation"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type ReservationItemPayload struct {
+	ProductId int64  `json:"product_id" validate:"required"`
+	VariantId *int64 `json:"variant_id"`
+	Quantity  int64  `json:"quantity" validate:"required,min=1,max=1000000"`
+}
+
+type ReservationPayload struct {
+	Items []ReservationItemPayload `json:"items" validate:"required,min=1,max=100,dive"`
+	// TTLSeconds defaults to the configured reservation TTL.
+	TTLSeconds int64 `json:"ttl_seconds" validate:"min=0"`
+}
+
+// stockKey identifies the stock item of a product, or of one of its
+// variants.
+type stockKey struct {
+	productId int64
+	variantId int64
+}
+
+func keyOf(productId int64, variantId *int64) stockKey {
+	if variantId == nil {
+		return stockKey{productId: productId}
+	}
+	return stockKey{productId: productId, variantId: *variantId}
+}
+
+func (k stockKey) String() string {
+	if k.variantId == 0 {
+		return fmt.Sprintf("product %d", k.productId)
+	}
+	return fmt.Sprintf("variant %d of product %d", k.variantId, k.productId)
+}
+
+// CreateReservation holds stock for a set of items until the reservation is
+// committed, released or expires. Either every item is reserved or none is:
+// each stock item is taken with a conditional update on its availability,
+// in the order of their ids, so concurrent reservations can neither oversell
+// nor deadlock.
+func CreateReservation(db *gorm.DB, channel *amqp.Channel, validate *validation.Validator, conf *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		var payload ReservationPayload
+		if !request.Decode(w, r, &payload) {
+			return
+		}
+		if err := validate.Struct(payload); err != nil {
+			log.WithError(err).Info("Invalid payload")
+			fields, locale := validate.Translate(err, r.Header.Get("Accept-Language"))
+			w.Header().Set("Content-Language", locale)
+			response.WriteValidationErrors(w, r, fields)
+			return
+		}
+		// Comparing seconds before converting them keeps a huge ttl_seconds
+		// from overflowing into a negative duration.
+		maxSeconds := int64(conf.Inventory.MaxReservationTTL / time.Second)
+		if payload.TTLSeconds > maxSeconds {
+			log.WithField("ttl_seconds", payload.TTLSeconds).Info("Reservation TTL too long")
+			response.WriteValidationErrors(w, r, map[string]string{"ttl_seconds": fmt.Sprintf("ttl_seconds must not exceed %d", maxSeconds)})
+			return
+		}
+		ttl := conf.Inventory.ReservationTTL
+		if payload.TTLSeconds > 0 {
+			ttl = time.Duration(payload.TTLSeconds) * time.Second
+		}
+
+		// Items of the same product or variant are reserved together.
+		quantities := map[stockKey]int64{}
+		var keys []stockKey
+		var productIds []int64
+		for _, item := range payload.Items {
+			key := keyOf(item.ProductId, item.VariantId)
+			if _, ok := quantities[key]; !ok {
+				keys = append(keys, key)
+				productIds = append(productIds, item.ProductId)
+			}
+			quantities[key] += item.Quantity
+		}
+
+		var reservation types.Reservation
+		var low []types.StockItem
+		var soldOut []int64
+		err := db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+			low, soldOut = nil, nil
+			stock, err := stockItems(w, r, tx, payload.Items, productIds)
+			if err != nil {
+				return err
+			}
+
+			reserved := make([]types.StockItem, 0, len(keys))
+			for _, key := range keys {
+				item, ok := stock[key]
+				if !ok {
+					writeInsufficient(w, r, key)
+					return errAnswered
+				}
+				reserved = append(reserved, item)
+			}
+			sort.Slice(reserved, func(i, j int) bool { return reserved[i].Id < reserved[j].Id })
+
+			now := time.Now()
+			reservation = types.Reservation{Status: types.ReservationPending, ExpiresAt: now.Add(ttl)}
+			for _, item := range reserved {
+				key := keyOf(item.ProductId, item.VariantId)
+				quantity := quantities[key]
+				result := tx.Model(&item).Clauses(clause.Returning{}).Where("available >= ?", quantity).UpdateColumns(map[string]interface{}{
+					"reserved":   gorm.Expr("reserved + ?", quantity),
+					"updated_at": now,
+				})
+				if result.Error != nil {
+					return result.Error
+				}
+				if result.RowsAffected == 0 {
+					writeInsufficient(w, r, key)
+					return errAnswered
+				}
+				if crossed(item.Available+quantity, item) {
+					low = append(low, item)
+				}
+				if toggled(item.Available+quantity, item.Available) {
+					soldOut = append(soldOut, item.ProductId)
+				}
+				reservation.Items = append(reservation.Items, types.ReservationItem{
+					StockItemId: item.Id,
+					ProductId:   item.ProductId,
+					VariantId:   item.VariantId,
+					Quantity:    quantity,
+				})
+			}
+			return tx.Create(&reservation).Error
+		})
+		if err != nil {
+			if errors.Is(err, errAnswered) {
+				return
+			}
+			log.WithError(err).Error("Failed to reserve stock")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeStockUpdateFailed, "Failed to reserve stock")
+			return
+		}
+		metrics.Reservations.WithLabelValues(metrics.ReservationReserved).Inc()
+		log = log.WithField("reservation_id", reservation.Id)
+
+		for _, item := range low {
+			publishLowStock(r.Context(), channel, conf, item)
+		}
+		events.Publish(r.Context(), channel, conf, types.EventProductUpdated, soldOut...)
+
+		log.WithField("expires_at", reservation.ExpiresAt).Info("Stock reserved")
+		w.Header().Set("Location", fmt.Sprintf("/reservations/%d", reservation.Id))
+		response.WriteJson(w, http.StatusCreated, reservation)
+	}
+}
+
+// stockItems returns the stock items of the requested products and
+// variants. It answers the request when an item names a product that does
+// not exist, a variant of another product, or a product with variants but no
+// variant.
+func stockItems(w http.ResponseWriter, r *http.Request, tx *gorm.DB, items []ReservationItemPayload, productIds []int64) (map[stockKey]types.StockItem, error) {
+	var products []types.Product
+	if err := tx.Select("id").Where("id IN ?", productIds).Find(&products).Error; err != nil {
+		return nil, err
+	}
+	var variants []types.Variant
+	if err := tx.Select("id", "product_id").Where("product_id IN ?", productIds).Find(&variants).Error; err != nil {
+		return nil, err
+	}
+	exists := make(map[int64]bool, len(products))
+	for _, product := range products {
+		exists[product.Id] = true
+	}
+	variantsOf := map[int64]map[int64]bool{}
+	for _, variant := range variants {
+		if variantsOf[variant.ProductId] == nil {
+			variantsOf[variant.ProductId] = map[int64]bool{}
+		}
+		variantsOf[variant.ProductId][variant.Id] = true
+	}
+
+	problems := map[string]string{}
+	for i, item := range items {
+		switch {
+		case !exists[item.ProductId]:
+			field := fmt.Sprintf("items[%d].product_id", i)
+			problems[field] = fmt.Sprintf("%s: product %d does not exist", field, item.ProductId)
+		case item.VariantId == nil && len(variantsOf[item.ProductId]) > 0:
+			field := fmt.Sprintf("items[%d].variant_id", i)
+			problems[field] = fmt.Sprintf("%s is required, as product %d has variants", field, item.ProductId)
+		case item.VariantId != nil && !variantsOf[item.ProductId][*item.VariantId]:
+			field := fmt.Sprintf("items[%d].variant_id", i)
+			problems[field] = fmt.Sprintf("%s: variant %d is not a variant of product %d", field, *item.VariantId, item.ProductId)
+		}
+	}
+	if len(problems) > 0 {
+		logging.FromContext(r.Context()).WithField("items", problems).Info("Invalid reservation items")
+		response.WriteValidationErrors(w, r, problems)
+		return nil, errAnswered
+	}
+
+	var found []types.StockItem
+	if err := tx.Where("product_id IN ?", productIds).Find(&found).Error; err != nil {
+		return nil, err
+	}
+	stock := make(map[stockKey]types.StockItem, len(found))
+	for _, item := range found {
+		stock[keyOf(item.ProductId, item.VariantId)] = item
+	}
+	return stock, nil
+}
+
+func writeInsufficient(w http.ResponseWriter, r *http.Request, key stockKey) {
+	metrics.Reservations.WithLabelValues(metrics.ReservationRejected).Inc()
+	logging.FromContext(r.Context()).WithField("item", key.String()).Info("Insufficient stock")
+	response.WriteError(w, r, http.StatusConflict, response.CodeInsufficientStock, fmt.Sprintf("Not enough stock of %s", key))
+}
+
+// GetReservation returns a reservation with its items. A pending one past
+// its expiry is reported as expired, even before its stock is released.
+func GetReservation(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		reservationId, ok := request.PathId(w, r, "id", response.CodeInvalidReservationId, "Invalid reservation id")
+		if !ok {
+			return
+		}
+		log = log.WithField("reservation_id", reservationId)
+
+		var reservation types.Reservation
+		if err := db.WithContext(r.Context()).Preload("Items", byId).First(&reservation, reservationId).Error; err != nil {
+			writeReservationError(w, r, err)
+			return
+		}
+		if reservation.Status == types.ReservationPending && !reservation.ExpiresAt.After(time.Now()) {
+			reservation.Status = types.ReservationExpired
+		}
+
+		log.WithField("status", reservation.Status).Info("Reservation fetched")
+		response.WriteJson(w, http.StatusOK, reservation)
+	}
+}
+
+// CommitReservation takes the reserved units off hand, once the order is
+// placed. Committing a committed reservation again changes nothing.
+func CommitReservation(db *gorm.DB, channel *amqp.Channel, conf *config.Config) http.HandlerFunc {
+	return closeReservation(db, channel, conf, types.ReservationCommitted)
+}
+
+// ReleaseReservation returns the reserved units to the available stock.
+// Releasing a released or expired reservation again changes nothing.
+func ReleaseReservation(db *gorm.DB, channel *amqp.Channel, conf *config.Config) http.HandlerFunc {
+	return closeReservation(db, channel, conf, types.ReservationReleased)
+}
+
+func closeReservation(db *gorm.DB, channel *amqp.Channel, conf *config.Config, status string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		reservationId, ok := request.PathId(w, r, "id", response.CodeInvalidReservationId, "Invalid reservation id")
+		if !ok {
+			return
+		}
+		log = log.WithField("reservation_id", reservationId)
+
+		var reservation types.Reservation
+		changed := false
+		var restocked []int64
+		err := db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+			changed = false
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&reservation, reservationId).Error; err != nil {
+				writeReservationError(w, r, err)
+				return errAnswered
+			}
+			if err := tx.Where("reservation_id = ?", reservationId).Order("id").Find(&reservation.Items).Error; err != nil {
+				return err
+			}
+
+			now := time.Now()
+			switch {
+			case reservation.Status == status, status == types.ReservationReleased && reservation.Status == types.ReservationExpired:
+				return nil
+			case reservation.Status != types.ReservationPending:
+				log.WithField("status", reservation.Status).Info("Reservation closed")
+				response.WriteError(w, r, http.StatusConflict, response.CodeReservationClosed, fmt.Sprintf("The reservation is already %s", reservation.Status))
+				return errAnswered
+			case status == types.ReservationCommitted && !reservation.ExpiresAt.After(now):
+				log.Info("Reservation expired")
+				response.WriteError(w, r, http.StatusConflict, response.CodeReservationExpired, "The reservation expired and its stock is no longer held")
+				return errAnswered
+			}
+
+			var err error
+			restocked, err = unreserve(tx, reservation.Items, status == types.ReservationCommitted, now)
+			if err != nil {
+				return err
+			}
+			reservation.Status = status
+			reservation.UpdatedAt = now
+			changed = true
+			return tx.Model(&reservation).UpdateColumns(map[string]interface{}{"status": status, "updated_at": now}).Error
+		})
+		if err != nil {
+			if !errors.Is(err, errAnswered) {
+				log.WithError(err).Error("Failed to close reservation")
+				response.WriteError(w, r, http.StatusInternalServerError, response.CodeStockUpdateFailed, "Failed to close reservation")
+			}
+			return
+		}
+		if changed {
+			action := metrics.ReservationReleased
+			if status == types.ReservationCommitted {
+				action = metrics.ReservationCommitted
+			}
+			metrics.Reservations.WithLabelValues(action).Inc()
+			events.Publish(r.Context(), channel, conf, types.EventProductUpdated, restocked...)
+		}
+
+		log.WithField("status", reservation.Status).Info("Reservation closed")
+		response.WriteJson(w, http.StatusOK, reservation)
+	}
+}
+
+// unreserve gives up the units reserved by items, taking them off hand too
+// when the reservation is committed. Stock items are updated in the order of
+// their ids, like reservations take them. It returns the products that are
+// back in stock, which committing never leaves any.
+func unreserve(tx *gorm.DB, items []types.ReservationItem, commit bool, now time.Time) ([]int64, error) {
+	quantities := map[int64]int64{}
+	var ids []int64
+	for _, item := range items {
+		if _, ok := quantities[item.StockItemId]; !ok {
+			ids = append(ids, item.StockItemId)
+		}
+		quantities[item.StockItemId] += item.Quantity
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var restocked []int64
+	for _, id := range ids {
+		updates := map[string]interface{}{
+			"reserved":   gorm.Expr("reserved - ?", quantities[id]),
+			"updated_at": now,
+		}
+		if commit {
+			updates["on_hand"] = gorm.Expr("on_hand - ?", quantities[id])
+		}
+		var item types.StockItem
+		if err := tx.Model(&item).Clauses(clause.Returning{}).Where("id = ?", id).UpdateColumns(updates).Error; err != nil {
+			return nil, err
+		}
+		if !commit && toggled(item.Available-quantities[id], item.Available) {
+			restocked = append(restocked, item.ProductId)
+		}
+	}
+	return restocked, nil
+}
+
+func byId(db *gorm.DB) *gorm.DB {
+	return db.Order("id")
+}
+
+func writeReservationError(w http.ResponseWriter, r *http.Request, err error) {
+	log := logging.FromContext(r.Context())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Info("Reservation not found")
+		response.WriteError(w, r, http.StatusNotFound, response.CodeReservationNotFound, "Reservation not found")
+		return
+	}
+	log.WithError(err).Error("Failed to fetch reservation")
+	response.WriteError(w, r, http.StatusInternalServerError, response.CodeStockUpdateFailed, "Error fetching reservation")
+}
@@ -0,0 +1,80 @@
+package inventory
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/products/internal/testutil"
+	"github.com/aiu26/product-management/products/internal/utils/response"
+	"github.com/aiu26/product-management/products/internal/utils/validation"
+	"gorm.io/gorm"
+)
+
+func reserve(t *testing.T, db *gorm.DB, ttlSeconds int64) *httptest.ResponseRecorder {
+	t.Helper()
+	validate, err := validation.New(config.ValidationConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &config.Config{}
+	conf.Inventory.ReservationTTL = 15 * time.Minute
+	conf.Inventory.MaxReservationTTL = time.Hour
+
+	body := fmt.Sprintf(`{"items": [{"product_id": 7, "quantity": 1}], "ttl_seconds": %d}`, ttlSeconds)
+	r := httptest.NewRequest(http.MethodPost, "/reservations", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	CreateReservation(db, nil, validate, conf)(w, r)
+	return w
+}
+
+func TestCreateReservationTTL(t *testing.T) {
+	tests := []struct {
+		name       string
+		ttlSeconds int64
+		accepted   bool
+	}{
+		{"default", 0, true},
+		{"within the limit", 600, true},
+		{"at the limit", 3600, true},
+		{"over the limit", 3601, false},
+		// Converted to a duration, it would overflow into a negative TTL.
+		{"overflowing", math.MaxInt64 / 1000, false},
+		{"largest", math.MaxInt64, false},
+		{"negative", -1, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, mock := testutil.NewDB(t)
+			if test.accepted {
+				// A reservation whose TTL is accepted goes on to the
+				// database, which is down.
+				mock.ExpectBegin().WillReturnError(errors.New("database is down"))
+			}
+			w := reserve(t, db, test.ttlSeconds)
+			if test.accepted {
+				if w.Code != http.StatusInternalServerError {
+					t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusInternalServerError, w.Body)
+				}
+				return
+			}
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+			}
+			var problem response.Problem
+			if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := problem.Errors["ttl_seconds"]; !ok {
+				t.Errorf("errors = %v, want one for ttl_seconds", problem.Errors)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package inventory
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/events"
+	"github.com/aiu26/product-management/products/internal/utils/request"
+	"github.com/aiu26/product-management/products/internal/utils/response"
+	"github.com/aiu26/product-management/products/internal/utils/validation"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// errAnswered aborts a transaction whose request was already answered.
+var errAnswered = errors.New("request answered")
+
+// Stock is the stock of a product: its own, or its variants' when it has
+// some.
+type Stock struct {
+	ProductId int64             `json:"product_id"`
+	Available int64             `json:"available"`
+	Items     []types.StockItem `json:"items"`
+}
+
+type StockPayload struct {
+	OnHand            *int64 `json:"on_hand" validate:"required,min=0"`
+	LowStockThreshold int64  `json:"low_stock_threshold" validate:"min=0"`
+}
+
+// GetStock returns the stock of a product.
+func GetStock(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		productId, ok := request.PathId(w, r, "id", response.CodeInvalidProductId, "Invalid product id")
+		if !ok {
+			return
+		}
+		log = log.WithField("product_id", productId)
+
+		db := db.WithContext(r.Context())
+		var product types.Product
+		if err := db.First(&product, productId).Error; err != nil {
+			response.WriteProductFetchError(w, r, err)
+			return
+		}
+
+		var variants int64
+		if err := db.Model(&types.Variant{}).Where("product_id = ?", productId).Count(&variants).Error; err != nil {
+			response.WriteProductFetchError(w, r, err)
+			return
+		}
+		query := db.Where("product_id = ?", productId)
+		if variants > 0 {
+			query = query.Where("variant_id IS NOT NULL")
+		}
+		stock := Stock{ProductId: productId, Items: []types.StockItem{}}
+		if err := query.Order("id").Find(&stock.Items).Error; err != nil {
+			response.WriteProductFetchError(w, r, err)
+			return
+		}
+		for _, item := range stock.Items {
+			stock.Available += item.Available
+		}
+
+		log.WithField("available", stock.Available).Info("Stock fetched")
+		response.WriteJson(w, http.StatusOK, stock)
+	}
+}
+
+// SetStock sets the units on hand and the low stock threshold of a product,
+// or of one of its variants when routed with a variant. A product with
+// variants keeps its stock on them, and units on hand cannot drop below the
+// reserved ones.
+func SetStock(db *gorm.DB, channel *amqp.Channel, validate *validation.Validator, conf *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		productId, ok := request.PathId(w, r, "id", response.CodeInvalidProductId, "Invalid product id")
+		if !ok {
+			return
+		}
+		log = log.WithField("product_id", productId)
+		var variantId *int64
+		if r.PathValue("variant") != "" {
+			id, ok := request.PathId(w, r, "variant", response.CodeInvalidVariantId, "Invalid variant id")
+			if !ok {
+				return
+			}
+			variantId = &id
+			log = log.WithField("variant_id", id)
+		}
+
+		var payload StockPayload
+		if !request.Decode(w, r, &payload) {
+			return
+		}
+		if err := validate.Struct(payload); err != nil {
+			log.WithError(err).Info("Invalid payload")
+			fields, locale := validate.Translate(err, r.Header.Get("Accept-Language"))
+			w.Header().Set("Content-Language", locale)
+			response.WriteValidationErrors(w, r, fields)
+			return
+		}
+
+		var item types.StockItem
+		var before int64
+		err := db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+			// Locking the product serializes the creation of its stock items.
+			var product types.Product
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&product, productId).Error; err != nil {
+				response.WriteProductFetchError(w, r, err)
+				return errAnswered
+			}
+
+			query := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("product_id = ?", productId)
+			if variantId != nil {
+				var variant types.Variant
+				if err := tx.Where("product_id = ?", productId).First(&variant, *variantId).Error; err != nil {
+					if !errors.Is(err, gorm.ErrRecordNotFound) {
+						return err
+					}
+					log.Info("Variant not found")
+					response.WriteError(w, r, http.StatusNotFound, response.CodeVariantNotFound, "Variant not found")
+					return errAnswered
+				}
+				query = query.Where("variant_id = ?", *variantId)
+			} else {
+				var variants int64
+				if err := tx.Model(&types.Variant{}).Where("product_id = ?", productId).Count(&variants).Error; err != nil {
+					return err
+				}
+				if variants > 0 {
+					log.Info("Product stock kept on variants")
+					response.WriteError(w, r, http.StatusConflict, response.CodeStockOnVariants, "The product has variants, whose stock must be set instead")
+					return errAnswered
+				}
+				query = query.Where("variant_id IS NULL")
+			}
+
+			err := query.First(&item).Error
+			switch {
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				item = types.StockItem{ProductId: productId, VariantId: variantId, OnHand: *payload.OnHand, LowStockThreshold: payload.LowStockThreshold}
+				if err := tx.Create(&item).Error; err != nil {
+					return err
+				}
+			case err != nil:
+				return err
+			default:
+				if *payload.OnHand < item.Reserved {
+					log.WithField("reserved", item.Reserved).Info("Stock reserved")
+					response.WriteError(w, r, http.StatusConflict, response.CodeStockReserved, fmt.Sprintf("%d units are reserved, so at least as many must be on hand", item.Reserved))
+					return errAnswered
+				}
+				before = item.Available
+				err := tx.Model(&item).UpdateColumns(map[string]interface{}{
+					"on_hand":             *payload.OnHand,
+					"low_stock_threshold": payload.LowStockThreshold,
+					"updated_at":          time.Now(),
+				}).Error
+				if err != nil {
+					return err
+				}
+			}
+			// Available is computed by the database.
+			return tx.First(&item, item.Id).Error
+		})
+		if err != nil {
+			if !errors.Is(err, errAnswered) {
+				log.WithError(err).Error("Failed to set stock")
+				response.WriteError(w, r, http.StatusInternalServerError, response.CodeStockUpdateFailed, "Failed to set stock")
+			}
+			return
+		}
+
+		if crossed(before, item) {
+			publishLowStock(r.Context(), channel, conf, item)
+		}
+		if toggled(before, item.Available) {
+			events.Publish(r.Context(), channel, conf, types.EventProductUpdated, productId)
+		}
+
+		log.WithField("available", item.Available).Info("Stock set")
+		response.WriteJson(w, http.StatusOK, item)
+	}
+}
+
+// InStock limits a products query to the products with available stock, or
+// to those without any. A product with variants is in stock when one of its
+// variants is.
+func InStock(query *gorm.DB, inStock bool) *gorm.DB {
+	exists := "EXISTS (SELECT 1 FROM stock_items WHERE stock_items.product_id = products.id AND stock_items.available > 0" +
+		" AND (stock_items.variant_id IS NOT NULL OR NOT EXISTS (SELECT 1 FROM variants WHERE variants.product_id = products.id)))"
+	if !inStock {
+		exists = "NOT " + exists
+	}
+	return query.Where(exists)
+}
+
+// crossed reports whether a change took an item's availability from above
+// its low stock threshold to at or below it.
+func crossed(before int64, item types.StockItem) bool {
+	return before > item.LowStockThreshold && item.Available <= item.LowStockThreshold
+}
+
+// toggled reports whether a change took an item in or out of stock, which
+// product events announce; other stock changes leave products as they are.
+func toggled(before int64, after int64) bool {
+	return (before > 0) != (after > 0)
+}
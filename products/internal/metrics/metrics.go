@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "products_http_request_duration_seconds",
+		Help:    "Duration of HTTP requests by route, method and status code.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"route", "method", "status"})
+
+	RequestsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "products_http_requests_in_flight",
+		Help: "Number of HTTP requests being served.",
+	})
+
+	CacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "products_cache_requests_total",
+		Help: "Product cache lookups by result (hit, miss or error).",
+	}, []string{"result"})
+
+	CacheWrites = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "products_cache_writes_total",
+		Help: "Product cache writes by result (success or error).",
+	}, []string{"result"})
+
+	Published = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "products_queue_published_total",
+		Help: "Messages published by queue and result (success or error).",
+	}, []string{"queue", "result"})
+
+	IdempotentRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "products_idempotent_requests_total",
+		Help: "Requests carrying an Idempotency-Key by outcome (new, replayed, conflict, in_progress or error).",
+	}, []string{"route", "outcome"})
+
+	ScheduledPrices = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "products_scheduled_prices_total",
+		Help: "Scheduled price changes processed by action (started, ended, overridden, missed or cancelled).",
+	}, []string{"action"})
+
+	ScheduleRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "products_schedule_runs_total",
+		Help: "Runs of the price scheduler by result (success or error).",
+	}, []string{"result"})
+
+	Reservations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "products_reservations_total",
+		Help: "Stock reservations by action (reserved, rejected, committed, released or expired).",
+	}, []string{"action"})
+
+	ExpiryRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "products_reservation_expiry_runs_total",
+		Help: "Runs of the reservation expiry job by result (success or error).",
+	}, []string{"result"})
+
+	ImportRows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "products_import_rows_total",
+		Help: "Rows of product imports by outcome (created, validated in a dry run, or invalid).",
+	}, []string{"outcome"})
+
+	ImportJobs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "products_import_jobs_total",
+		Help: "Finished product imports by status (completed or failed).",
+	}, []string{"status"})
+
+	ExportedProducts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "products_exported_products_total",
+		Help: "Products written by exports, streamed or in the background, by format.",
+	}, []string{"format"})
+
+	ExportJobs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "products_export_jobs_total",
+		Help: "Finished background exports by status (completed or failed).",
+	}, []string{"status"})
+
+	FeedRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "products_feed_refreshes_total",
+		Help: "Product events handled to keep feeds up to date, by result (success or error).",
+	}, []string{"result"})
+
+	StreamAppends = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "products_stream_appends_total",
+		Help: "Product events appended to the event stream, by result (success or error).",
+	}, []string{"result"})
+
+	StreamSubscribers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "products_stream_subscribers",
+		Help: "Open event streams, by kind (product or user).",
+	}, []string{"kind"})
+)
+
+const (
+	ResultHit     = "hit"
+	ResultMiss    = "miss"
+	ResultSuccess = "success"
+	ResultError   = "error"
+
+	OutcomeNew        = "new"
+	OutcomeReplayed   = "replayed"
+	OutcomeConflict   = "conflict"
+	OutcomeInProgress = "in_progress"
+
+	ScheduleStarted    = "started"
+	ScheduleEnded      = "ended"
+	ScheduleOverridden = "overridden"
+	ScheduleMissed     = "missed"
+	ScheduleCancelled  = "cancelled"
+
+	ReservationReserved  = "reserved"
+	ReservationRejected  = "rejected"
+	ReservationCommitted = "committed"
+	ReservationReleased  = "released"
+	ReservationExpired   = "expired"
+
+	ImportCreated   = "created"
+	ImportValidated = "validated"
+	ImportInvalid   = "invalid"
+)
@@ -0,0 +1,254 @@
+package prices
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/money"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/utils/request"
+	"github.com/aiu26/product-management/products/internal/utils/response"
+	"github.com/aiu26/product-management/products/internal/utils/validation"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// historyLimit is the number of most recent price changes GetPrices returns.
+const historyLimit = 100
+
+type Prices struct {
+	ProductId int64           `json:"product_id"`
+	Price     decimal.Decimal `json:"price"`
+	Currency  string          `json:"currency"`
+	// WasPrice is the price before the schedule currently running, for
+	// "was/now" displays. It is only set while a sale with an end runs.
+	WasPrice  *decimal.Decimal       `json:"was_price,omitempty"`
+	History   []types.PriceChange    `json:"history"`
+	Schedules []types.ScheduledPrice `json:"schedules"`
+}
+
+// GetPrices returns a product's current price with its latest changes and
+// its schedules, newest first.
+func GetPrices(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		productId, ok := request.PathId(w, r, "id", response.CodeInvalidProductId, "Invalid product id")
+		if !ok {
+			return
+		}
+		log = log.WithField("product_id", productId)
+
+		db := db.WithContext(r.Context())
+		var product types.Product
+		if err := db.First(&product, productId).Error; err != nil {
+			response.WriteProductFetchError(w, r, err)
+			return
+		}
+
+		prices := Prices{ProductId: product.Id, Price: product.Price, Currency: product.Currency}
+		if err := db.Where("product_id = ?", productId).Order("changed_at DESC, id DESC").Limit(historyLimit).Find(&prices.History).Error; err != nil {
+			log.WithError(err).Error("Failed to fetch price history")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductFetchFailed, "Error fetching prices")
+			return
+		}
+		if err := db.Where("product_id = ?", productId).Order("starts_at DESC, id DESC").Find(&prices.Schedules).Error; err != nil {
+			log.WithError(err).Error("Failed to fetch scheduled prices")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductFetchFailed, "Error fetching prices")
+			return
+		}
+
+		for _, schedule := range prices.Schedules {
+			if schedule.Status == types.ScheduleActive && schedule.PreviousCurrency != nil && *schedule.PreviousCurrency == product.Currency && schedule.Price.Equal(product.Price) {
+				prices.WasPrice = schedule.PreviousPrice
+			}
+		}
+
+		log.WithField("changes", len(prices.History)).Info("Prices fetched")
+		response.WriteJson(w, http.StatusOK, prices)
+	}
+}
+
+type SchedulePayload struct {
+	Price    decimal.Decimal `json:"price" validate:"required,money=Currency"`
+	Currency string          `json:"currency" validate:"required,currency"`
+	StartsAt time.Time       `json:"starts_at" validate:"required,gt"`
+	EndsAt   *time.Time      `json:"ends_at" validate:"omitnil,gtfield=StartsAt"`
+}
+
+// SchedulePrice schedules a price change. The currency defaults to the
+// product's. A schedule's window may not overlap another pending or active
+// one of the same product; a schedule without an end is a permanent change,
+// and only its start counts.
+func SchedulePrice(db *gorm.DB, validate *validation.Validator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		productId, ok := request.PathId(w, r, "id", response.CodeInvalidProductId, "Invalid product id")
+		if !ok {
+			return
+		}
+		log = log.WithField("product_id", productId)
+
+		var payload SchedulePayload
+		if !request.Decode(w, r, &payload) {
+			return
+		}
+
+		schedule := types.ScheduledPrice{ProductId: productId, Status: types.SchedulePending, Actor: request.Actor(r.Context())}
+		err := db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+			// Locking the product serializes schedules of the same product,
+			// so two overlapping ones cannot both pass the check below.
+			var product types.Product
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&product, productId).Error; err != nil {
+				response.WriteProductFetchError(w, r, err)
+				return err
+			}
+			if payload.Currency == "" {
+				payload.Currency = product.Currency
+			}
+			if err := validate.Struct(payload); err != nil {
+				log.WithError(err).Info("Invalid payload")
+				fields, locale := validate.Translate(err, r.Header.Get("Accept-Language"))
+				w.Header().Set("Content-Language", locale)
+				response.WriteValidationErrors(w, r, fields)
+				return err
+			}
+			if payload.Currency != product.Currency {
+				variant, err := UnfitVariant(tx, productId, payload.Currency)
+				if err != nil {
+					log.WithError(err).Error("Failed to fetch variants")
+					response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductFetchFailed, "Error fetching product")
+					return err
+				}
+				if variant != nil {
+					log.WithField("sku", variant.Sku).Info("Variant price does not fit currency")
+					response.WriteValidationErrors(w, r, map[string]string{
+						"currency": fmt.Sprintf("currency cannot hold the price %s of variant %s", variant.Price, variant.Sku),
+					})
+					return errors.New("variant price does not fit currency")
+				}
+			}
+
+			end := payload.StartsAt.Add(time.Microsecond)
+			if payload.EndsAt != nil {
+				end = *payload.EndsAt
+			}
+			var overlapping types.ScheduledPrice
+			err := tx.Where("product_id = ? AND status IN ?", productId, []string{types.SchedulePending, types.ScheduleActive}).
+				Where("starts_at < ? AND COALESCE(ends_at, starts_at + interval '1 microsecond') > ?", end, payload.StartsAt).
+				First(&overlapping).Error
+			if err == nil {
+				log.WithField("schedule_id", overlapping.Id).Info("Overlapping price schedule")
+				response.WriteError(w, r, http.StatusConflict, response.CodeScheduleOverlap, fmt.Sprintf("The schedule overlaps schedule %d", overlapping.Id))
+				return errors.New("overlapping schedule")
+			}
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				log.WithError(err).Error("Failed to check price schedules")
+				response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductUpdateFailed, "Failed to schedule price")
+				return err
+			}
+
+			schedule.Price = payload.Price
+			schedule.Currency = payload.Currency
+			schedule.StartsAt = payload.StartsAt
+			schedule.EndsAt = payload.EndsAt
+			if err := tx.Create(&schedule).Error; err != nil {
+				log.WithError(err).Error("Failed to create price schedule")
+				response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductUpdateFailed, "Failed to schedule price")
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+
+		log.WithField("schedule_id", schedule.Id).Info("Price scheduled")
+		w.Header().Set("Location", fmt.Sprintf("/products/%d/prices", productId))
+		response.WriteJson(w, http.StatusCreated, schedule)
+	}
+}
+
+// CancelSchedule cancels a pending schedule. An active one is ended instead:
+// its end is moved to now, and the scheduler restores the previous price on
+// its next run.
+func CancelSchedule(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		productId, ok := request.PathId(w, r, "id", response.CodeInvalidProductId, "Invalid product id")
+		if !ok {
+			return
+		}
+		scheduleId, ok := request.PathId(w, r, "schedule", response.CodeInvalidScheduleId, "Invalid schedule id")
+		if !ok {
+			return
+		}
+		log = log.WithField("product_id", productId).WithField("schedule_id", scheduleId)
+
+		var schedule types.ScheduledPrice
+		err := db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+			err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("product_id = ?", productId).First(&schedule, scheduleId).Error
+			if err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					log.Info("Price schedule not found")
+					response.WriteError(w, r, http.StatusNotFound, response.CodeScheduleNotFound, "Price schedule not found")
+					return err
+				}
+				log.WithError(err).Error("Failed to fetch price schedule")
+				response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductFetchFailed, "Error fetching price schedule")
+				return err
+			}
+
+			now := time.Now()
+			updates := map[string]interface{}{"updated_at": now}
+			switch schedule.Status {
+			case types.SchedulePending:
+				schedule.Status = types.ScheduleCancelled
+				updates["status"] = schedule.Status
+			case types.ScheduleActive:
+				schedule.EndsAt = &now
+				updates["ends_at"] = now
+			default:
+				log.WithField("status", schedule.Status).Info("Price schedule already finished")
+				response.WriteError(w, r, http.StatusConflict, response.CodeScheduleFinished, fmt.Sprintf("The schedule is already %s", schedule.Status))
+				return errors.New("schedule finished")
+			}
+			schedule.UpdatedAt = now
+
+			if err := tx.Model(&schedule).UpdateColumns(updates).Error; err != nil {
+				log.WithError(err).Error("Failed to cancel price schedule")
+				response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductUpdateFailed, "Failed to cancel price schedule")
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+
+		log.WithField("status", schedule.Status).Info("Price schedule cancelled")
+		response.WriteJson(w, http.StatusOK, schedule)
+	}
+}
+
+// UnfitVariant returns a variant of the product whose price has more decimal
+// places than currency allows, or nil. Variant prices are in the product's
+// currency, so a new currency has to fit them all.
+func UnfitVariant(tx *gorm.DB, productId int64, currency string) (*types.Variant, error) {
+	var priced []types.Variant
+	if err := tx.Where("product_id = ? AND price IS NOT NULL", productId).Find(&priced).Error; err != nil {
+		return nil, err
+	}
+	for i := range priced {
+		if !money.ValidPrecision(*priced[i].Price, currency) {
+			return &priced[i], nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,225 @@
+package prices
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/tracing"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/events"
+	"github.com/aiu26/product-management/products/internal/metrics"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/redis/go-redis/v9"
+	"github.com/shopspring/decimal"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var tracer = tracing.Tracer("github.com/aiu26/product-management/products/internal/prices")
+
+// ActorScheduler is the actor of the price changes made by ApplySchedules.
+const ActorScheduler = "scheduler"
+
+// phase selects the schedules due for one kind of transition, and applies
+// it to one of them, reporting whether the product's price changed.
+type phase struct {
+	status string
+	due    string
+	apply  func(tx *gorm.DB, schedule types.ScheduledPrice, now time.Time) (bool, error)
+}
+
+// Ending first lets a schedule start when the one before it ends.
+var phases = []phase{
+	{status: types.ScheduleActive, due: "ends_at", apply: endSchedule},
+	{status: types.SchedulePending, due: "starts_at", apply: startSchedule},
+}
+
+// ApplySchedules ends the active schedules whose end has passed, then starts
+// the pending ones whose start has passed, in batches. Schedules are locked
+// with SKIP LOCKED, so every replica can run it. Repriced products are
+// removed from the cache and announced with product events. It returns the
+// number of schedules processed.
+func ApplySchedules(ctx context.Context, db *gorm.DB, rdb *redis.Client, channel *amqp.Channel, conf *config.Config, now time.Time) (applied int, err error) {
+	ctx, span := tracer.Start(ctx, "apply scheduled prices")
+	defer func() {
+		span.SetAttributes(attribute.Int("applied", applied))
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	for _, p := range phases {
+		for {
+			n, err := applyBatch(ctx, db, rdb, channel, conf, now, p)
+			applied += n
+			if err != nil {
+				return applied, err
+			}
+			if n < conf.Pricing.BatchSize {
+				break
+			}
+		}
+	}
+	return applied, nil
+}
+
+func applyBatch(ctx context.Context, db *gorm.DB, rdb *redis.Client, channel *amqp.Channel, conf *config.Config, now time.Time, p phase) (int, error) {
+	log := logging.FromContext(ctx)
+
+	var schedules []types.ScheduledPrice
+	var repriced []string
+	var productIds []int64
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		repriced, productIds = nil, nil
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND "+p.due+" <= ?", p.status, now).
+			Order(p.due + ", id").
+			Limit(conf.Pricing.BatchSize).
+			Find(&schedules).Error
+		if err != nil {
+			return err
+		}
+
+		for _, schedule := range schedules {
+			changed, err := p.apply(tx, schedule, now)
+			if err != nil {
+				return err
+			}
+			if changed {
+				repriced = append(repriced, types.CacheKey(schedule.ProductId))
+				productIds = append(productIds, schedule.ProductId)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Error("Failed to apply scheduled prices")
+		return 0, err
+	}
+	if len(repriced) == 0 {
+		return len(schedules), nil
+	}
+
+	cacheCtx, cancel := context.WithTimeout(ctx, conf.Redis.Timeout)
+	defer cancel()
+	if err := rdb.Del(cacheCtx, repriced...).Err(); err != nil {
+		log.WithError(err).Error("Failed to delete repriced products from cache")
+	}
+	events.Publish(ctx, channel, conf, types.EventProductUpdated, productIds...)
+
+	log.WithField("product_ids", repriced).Info("Scheduled prices applied")
+	return len(schedules), nil
+}
+
+// startSchedule gives the product the scheduled price, remembering the price
+// it replaces. A schedule whose end passed before it could start is
+// completed without changing the price, and one without an end is completed
+// right away, as there is no price to restore. A schedule whose currency
+// cannot hold the price of a variant is cancelled.
+func startSchedule(tx *gorm.DB, schedule types.ScheduledPrice, now time.Time) (bool, error) {
+	if schedule.EndsAt != nil && !schedule.EndsAt.After(now) {
+		metrics.ScheduledPrices.WithLabelValues(metrics.ScheduleMissed).Inc()
+		return false, finish(tx, schedule, types.ScheduleCompleted, nil)
+	}
+
+	product, err := lockProduct(tx, schedule.ProductId)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		metrics.ScheduledPrices.WithLabelValues(metrics.ScheduleCancelled).Inc()
+		return false, finish(tx, schedule, types.ScheduleCancelled, nil)
+	}
+	if err != nil {
+		return false, err
+	}
+	// Variants may have been given prices the currency cannot hold since
+	// the schedule was made.
+	if schedule.Currency != product.Currency {
+		variant, err := UnfitVariant(tx, schedule.ProductId, schedule.Currency)
+		if err != nil {
+			return false, err
+		}
+		if variant != nil {
+			logging.FromContext(tx.Statement.Context).WithField("schedule_id", schedule.Id).WithField("sku", variant.Sku).Warn("Cancelling price schedule whose currency cannot hold a variant price")
+			metrics.ScheduledPrices.WithLabelValues(metrics.ScheduleCancelled).Inc()
+			return false, finish(tx, schedule, types.ScheduleCancelled, nil)
+		}
+	}
+
+	status := types.ScheduleActive
+	if schedule.EndsAt == nil {
+		status = types.ScheduleCompleted
+	}
+	err = finish(tx, schedule, status, map[string]interface{}{
+		"previous_price":    product.Price,
+		"previous_currency": product.Currency,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	metrics.ScheduledPrices.WithLabelValues(metrics.ScheduleStarted).Inc()
+	return true, reprice(tx, schedule, schedule.Price, schedule.Currency, now)
+}
+
+// endSchedule gives the product back the price it had before the schedule
+// started, unless its price was changed in the meantime: a later change wins
+// over the end of a sale.
+func endSchedule(tx *gorm.DB, schedule types.ScheduledPrice, now time.Time) (bool, error) {
+	if err := finish(tx, schedule, types.ScheduleCompleted, nil); err != nil {
+		return false, err
+	}
+
+	product, err := lockProduct(tx, schedule.ProductId)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if schedule.PreviousPrice == nil || schedule.PreviousCurrency == nil || !product.Price.Equal(schedule.Price) || product.Currency != schedule.Currency {
+		metrics.ScheduledPrices.WithLabelValues(metrics.ScheduleOverridden).Inc()
+		return false, nil
+	}
+
+	metrics.ScheduledPrices.WithLabelValues(metrics.ScheduleEnded).Inc()
+	return true, reprice(tx, schedule, *schedule.PreviousPrice, *schedule.PreviousCurrency, now)
+}
+
+func lockProduct(tx *gorm.DB, id int64) (types.Product, error) {
+	var product types.Product
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&product, id).Error
+	return product, err
+}
+
+func finish(tx *gorm.DB, schedule types.ScheduledPrice, status string, updates map[string]interface{}) error {
+	if updates == nil {
+		updates = map[string]interface{}{}
+	}
+	updates["status"] = status
+	updates["updated_at"] = time.Now()
+	return tx.Model(&types.ScheduledPrice{}).Where("id = ?", schedule.Id).UpdateColumns(updates).Error
+}
+
+// reprice sets a product's price on behalf of a schedule and records the
+// change. Like any other change it bumps the product's version.
+func reprice(tx *gorm.DB, schedule types.ScheduledPrice, price decimal.Decimal, currency string, now time.Time) error {
+	err := tx.Model(&types.Product{}).Where("id = ?", schedule.ProductId).UpdateColumns(map[string]interface{}{
+		"price":      price,
+		"currency":   currency,
+		"version":    gorm.Expr("version + 1"),
+		"updated_at": now,
+	}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Create(&types.PriceChange{
+		ProductId:  schedule.ProductId,
+		Price:      price,
+		Currency:   currency,
+		Actor:      ActorScheduler,
+		ScheduleId: &schedule.Id,
+		ChangedAt:  now,
+	}).Error
+}
@@ -0,0 +1,411 @@
+package products
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/attributes"
+	"github.com/aiu26/product-management/products/internal/categories"
+	"github.com/aiu26/product-management/products/internal/events"
+	"github.com/aiu26/product-management/products/internal/metrics"
+	"github.com/aiu26/product-management/products/internal/rates"
+	"github.com/aiu26/product-management/products/internal/tags"
+	"github.com/aiu26/product-management/products/internal/utils/request"
+	"github.com/aiu26/product-management/products/internal/utils/response"
+	"github.com/aiu26/product-management/products/internal/utils/validation"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// insertBatchSize is the most rows bulk inserts put in one statement.
+const insertBatchSize = 100
+
+// GetProductsBatch fetches the products listed by the ids parameter, in
+// that order, like GetProduct does one. Cached products are read with one
+// MGET and the others loaded with one query; ids of products that do not
+// exist are listed under not_found.
+func GetProductsBatch(db *gorm.DB, rdb *redis.Client, conf *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		ids, err := parseIds(r.URL.Query().Get("ids"), conf.Batch.MaxIds)
+		if err != nil {
+			log.WithError(err).Info("Invalid ids parameter")
+			response.WriteError(w, r, http.StatusBadRequest, response.CodeInvalidProductIds, fmt.Sprintf("ids must be 1 to %d product ids, comma separated", conf.Batch.MaxIds))
+			return
+		}
+
+		include, ok := includeDeleted(w, r)
+		if !ok {
+			return
+		}
+		var converter *rates.Converter
+		if currency := r.URL.Query().Get("currency"); currency != "" {
+			converter, ok = newConverter(w, r, db, conf, currency)
+			if !ok {
+				return
+			}
+		}
+
+		found := make(map[int64]types.Product, len(ids))
+		misses := ids
+		if !include {
+			misses = cachedProducts(r.Context(), rdb, conf, ids, found)
+		}
+
+		if len(misses) > 0 {
+			query := db.WithContext(r.Context())
+			if include {
+				query = query.Unscoped()
+			}
+			var loaded []types.Product
+			if err := preload(query).Where("id IN ?", misses).Find(&loaded).Error; err != nil {
+				log.WithError(err).Error("Failed to fetch products")
+				response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductFetchFailed, "Error fetching products")
+				return
+			}
+			ptrs := make([]*types.Product, len(loaded))
+			for i := range loaded {
+				ptrs[i] = &loaded[i]
+			}
+			if err := breadcrumbs(db.WithContext(r.Context()), ptrs...); err != nil {
+				log.WithError(err).Error("Failed to fetch category breadcrumbs")
+				response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductFetchFailed, "Error fetching products")
+				return
+			}
+			for _, product := range loaded {
+				found[product.Id] = product
+			}
+			cacheProducts(r.Context(), rdb, conf, loaded)
+		}
+
+		products := make([]types.Product, 0, len(found))
+		notFound := []int64{}
+		for _, id := range ids {
+			product, ok := found[id]
+			if !ok {
+				notFound = append(notFound, id)
+				continue
+			}
+			if converter != nil && !converter.Convert(&product) {
+				log.WithField("currency", converter.Currency).WithField("product_id", id).Info("No exchange rate for product")
+				response.WriteError(w, r, http.StatusUnprocessableEntity, response.CodeRateNotFound, fmt.Sprintf("No exchange rate from %s to %s", product.Currency, converter.Currency))
+				return
+			}
+			products = append(products, product)
+		}
+
+		log.WithField("count", len(products)).WithField("not_found", len(notFound)).Info("Products fetched")
+		response.WriteJson(w, http.StatusOK, map[string]interface{}{
+			"products":  products,
+			"not_found": notFound,
+		})
+	}
+}
+
+// parseIds reads a comma separated list of at most max product ids,
+// dropping repeated ones.
+func parseIds(raw string, max int) ([]int64, error) {
+	if raw == "" {
+		return nil, errors.New("ids is missing")
+	}
+	parts := strings.Split(raw, ",")
+	ids := make([]int64, 0, len(parts))
+	seen := make(map[int64]bool, len(parts))
+	for _, part := range parts {
+		id, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if id <= 0 {
+			return nil, fmt.Errorf("%d is not a product id", id)
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > max {
+		return nil, fmt.Errorf("%d ids asked for", len(ids))
+	}
+	return ids, nil
+}
+
+// cachedProducts reads the cached products of ids into found, and returns
+// the ids that must be loaded from the database. A cache that cannot be
+// read only makes every id a miss.
+func cachedProducts(ctx context.Context, rdb *redis.Client, conf *config.Config, ids []int64, found map[int64]types.Product) []int64 {
+	log := logging.FromContext(ctx)
+	ctx, cancel := context.WithTimeout(ctx, conf.Redis.Timeout)
+	defer cancel()
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = types.CacheKey(id)
+	}
+	values, err := rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		metrics.CacheRequests.WithLabelValues(metrics.ResultError).Add(float64(len(ids)))
+		log.WithError(err).Error("Failed to fetch products from cache")
+		return ids
+	}
+
+	var misses []int64
+	for i, value := range values {
+		val, ok := value.(string)
+		if !ok {
+			metrics.CacheRequests.WithLabelValues(metrics.ResultMiss).Inc()
+			misses = append(misses, ids[i])
+			continue
+		}
+		var product types.Product
+		if err := json.Unmarshal([]byte(val), &product); err != nil {
+			metrics.CacheRequests.WithLabelValues(metrics.ResultError).Inc()
+			log.WithError(err).WithField("product_id", ids[i]).Error("Failed to unmarshal product from cache")
+			misses = append(misses, ids[i])
+			continue
+		}
+		if product.Currency == "" {
+			// Cached before prices had a currency; read it again.
+			metrics.CacheRequests.WithLabelValues(metrics.ResultMiss).Inc()
+			misses = append(misses, ids[i])
+			continue
+		}
+		metrics.CacheRequests.WithLabelValues(metrics.ResultHit).Inc()
+		found[ids[i]] = product
+	}
+	log.WithField("hits", len(ids)-len(misses)).WithField("misses", len(misses)).Info("Products fetched from cache")
+	return misses
+}
+
+// cacheProducts caches the products that are not deleted, in one round
+// trip.
+func cacheProducts(ctx context.Context, rdb *redis.Client, conf *config.Config, products []types.Product) {
+	log := logging.FromContext(ctx)
+	ctx, cancel := context.WithTimeout(ctx, conf.Redis.Timeout)
+	defer cancel()
+
+	pipe := rdb.Pipeline()
+	for _, product := range products {
+		if product.DeletedAt.Valid {
+			continue
+		}
+		productJson, err := json.Marshal(product)
+		if err != nil {
+			log.WithError(err).WithField("product_id", product.Id).Error("Failed to marshal product")
+			continue
+		}
+		pipe.Set(ctx, types.CacheKey(product.Id), productJson, 0)
+	}
+	if pipe.Len() == 0 {
+		return
+	}
+	cmds, err := pipe.Exec(ctx)
+	for _, cmd := range cmds {
+		result := metrics.ResultSuccess
+		if cmd.Err() != nil {
+			result = metrics.ResultError
+		}
+		metrics.CacheWrites.WithLabelValues(result).Inc()
+	}
+	if err != nil {
+		log.WithError(err).Error("Failed to cache products")
+		return
+	}
+	log.WithField("count", len(cmds)).Info("Products cached")
+}
+
+// BatchPayload holds the products of POST /products:batch, each like the
+// body of POST /products.
+type BatchPayload struct {
+	Products []json.RawMessage `json:"products"`
+}
+
+// BatchResult is the outcome of one product of a batch: the created
+// product, or the problem POST /products would have answered with.
+type BatchResult struct {
+	Index   int               `json:"index"`
+	Status  int               `json:"status"`
+	Product *types.Product    `json:"product,omitempty"`
+	Error   *response.Problem `json:"error,omitempty"`
+}
+
+// NewProducts creates the products of a batch, each on its own like
+// NewProduct, so one that fails does not stop the others. It answers 201
+// when all were created and 207 otherwise, with a result for each product
+// in the order they were sent.
+func NewProducts(db *gorm.DB, channel *amqp.Channel, validate *validation.Validator, conf *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		var payload BatchPayload
+		if !request.Decode(w, r, &payload) {
+			return
+		}
+		if len(payload.Products) == 0 || len(payload.Products) > conf.Batch.MaxProducts {
+			log.WithField("count", len(payload.Products)).Info("Invalid batch size")
+			response.WriteValidationErrors(w, r, map[string]string{
+				"products": fmt.Sprintf("products must hold 1 to %d products", conf.Batch.MaxProducts),
+			})
+			return
+		}
+
+		status := http.StatusCreated
+		results := make([]BatchResult, len(payload.Products))
+		created := 0
+		for i, raw := range payload.Products {
+			results[i] = createProduct(w, r, db, channel, validate, conf, i, raw)
+			if results[i].Error != nil {
+				status = http.StatusMultiStatus
+			} else {
+				created++
+			}
+		}
+
+		log.WithField("created", created).WithField("failed", len(results)-created).Info("Product batch created")
+		response.WriteJson(w, status, map[string]interface{}{"results": results})
+	}
+}
+
+// createProduct creates the product at index of a batch.
+func createProduct(w http.ResponseWriter, r *http.Request, db *gorm.DB, channel *amqp.Channel, validate *validation.Validator, conf *config.Config, index int, raw json.RawMessage) BatchResult {
+	ctx := logging.WithField(r.Context(), "index", index)
+	r = r.WithContext(ctx)
+	log := logging.FromContext(ctx)
+	failed := func(problem response.Problem) BatchResult {
+		problem = response.Complete(r, problem)
+		return BatchResult{Index: index, Status: problem.Status, Error: &problem}
+	}
+
+	var payload ProductPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		log.WithError(err).Info("Failed to decode product")
+		return failed(response.Problem{Status: http.StatusBadRequest, Code: response.CodeInvalidRequestBody, Detail: "Invalid product"})
+	}
+	problem, err := checkProduct(w, r, db.WithContext(ctx), validate, conf, &payload)
+	if err != nil {
+		return failed(response.Problem{Status: http.StatusInternalServerError, Code: response.CodeProductCreateFailed, Detail: "Failed to create product"})
+	}
+	if problem != nil {
+		return failed(*problem)
+	}
+
+	var product types.Product
+	err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		product, err = insertProduct(tx, r, payload)
+		return err
+	})
+	if skuConflict(err) {
+		log.WithError(err).Info("SKU taken")
+		return failed(response.Problem{Status: http.StatusConflict, Code: response.CodeVariantSkuTaken, Detail: "A SKU is already used by another variant"})
+	}
+	if err != nil {
+		return failed(response.Problem{Status: http.StatusInternalServerError, Code: response.CodeProductCreateFailed, Detail: "Failed to create product"})
+	}
+	log = log.WithField("product_id", product.Id)
+
+	// The product is stored either way, so failing it here would only get
+	// it created twice by a retry.
+	if err := publish(ctx, channel, conf, product.Id); err != nil {
+		log.WithError(err).Error("Failed to publish product creation message")
+	} else {
+		log.Info("Product creation message published")
+	}
+	events.Publish(ctx, channel, conf, types.EventProductUpdated, product.Id)
+
+	log.Info("Product created")
+	return BatchResult{Index: index, Status: http.StatusCreated, Product: &product}
+}
+
+// normalize fills in the defaults of a new product and normalizes its tags,
+// ahead of its validation.
+func normalize(payload *ProductPayload, conf *config.Config) {
+	if payload.ProductCurrency == "" {
+		payload.ProductCurrency = conf.Money.DefaultCurrency
+	}
+	payload.Tags = tags.Normalize(payload.Tags)
+	for i := range payload.Variants {
+		payload.Variants[i].Currency = payload.ProductCurrency
+	}
+}
+
+// checkProduct applies the checks of a new product, of POST /products or a
+// batch, returning the problem to answer with, if any, and setting the
+// language of validation errors on w. It returns an error, logged, when a
+// check could not be made.
+func checkProduct(w http.ResponseWriter, r *http.Request, db *gorm.DB, validate *validation.Validator, conf *config.Config, payload *ProductPayload) (*response.Problem, error) {
+	log := logging.FromContext(r.Context())
+	invalid := func(fields map[string]string) *response.Problem {
+		return &response.Problem{Status: http.StatusBadRequest, Code: response.CodeValidationFailed, Detail: "The product failed validation", Errors: fields}
+	}
+
+	normalize(payload, conf)
+	if err := validate.Struct(payload); err != nil {
+		log.WithError(err).Info("Invalid payload")
+		fields, locale := validate.Translate(err, r.Header.Get("Accept-Language"))
+		w.Header().Set("Content-Language", locale)
+		return invalid(fields), nil
+	}
+
+	log = log.WithField("user_id", payload.UserId)
+	if err := db.First(&types.User{}, payload.UserId).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.WithError(err).Error("Failed to fetch user")
+			return nil, err
+		}
+		log.Info("User not found")
+		return &response.Problem{Status: http.StatusBadRequest, Code: response.CodeUserNotFound, Detail: "Invalid user_id"}, nil
+	}
+
+	missing, err := categories.Missing(db, payload.CategoryIds)
+	if err != nil {
+		log.WithError(err).Error("Failed to fetch categories")
+		return nil, err
+	}
+	if len(missing) > 0 {
+		log.WithField("category_ids", missing).Info("Unknown categories")
+		return &response.Problem{Status: http.StatusBadRequest, Code: response.CodeInvalidCategory, Detail: fmt.Sprintf("category_ids contains unknown categories: %v", missing)}, nil
+	}
+
+	payload.Attributes = attributes.Prune(payload.Attributes)
+	schemas, err := categories.Schemas(db, payload.CategoryIds)
+	if err != nil {
+		log.WithError(err).Error("Failed to fetch attribute schemas")
+		return nil, err
+	}
+	if problems := attributes.Check(schemas, payload.Attributes); len(problems) > 0 {
+		log.WithField("attributes", problems).Info("Invalid attributes")
+		return invalid(problems), nil
+	}
+
+	if problems, _ := variantProblems(nil, payload.Variants, "variants"); len(problems) > 0 {
+		log.WithField("variants", problems).Info("Invalid variants")
+		return invalid(problems), nil
+	}
+	if len(payload.Variants) == 0 {
+		return nil, nil
+	}
+	skus := make([]string, len(payload.Variants))
+	for i, variant := range payload.Variants {
+		skus[i] = variant.Sku
+	}
+	var taken []string
+	if err := db.Model(&types.Variant{}).Where("sku IN ?", skus).Pluck("sku", &taken).Error; err != nil {
+		log.WithError(err).Error("Failed to check SKUs")
+		return nil, err
+	}
+	if len(taken) > 0 {
+		log.WithField("skus", taken).Info("SKU taken")
+		return &response.Problem{Status: http.StatusConflict, Code: response.CodeVariantSkuTaken, Detail: fmt.Sprintf("SKU %s is already used", strings.Join(taken, ", "))}, nil
+	}
+	return nil, nil
+}
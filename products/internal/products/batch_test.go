@@ -0,0 +1,43 @@
+package products
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/testutil"
+)
+
+func TestGetProductsBatchIncludeDeleted(t *testing.T) {
+	db, mock := testutil.NewDB(t)
+	mock.ExpectQuery(`SELECT * FROM "products" WHERE id IN ($1,$2)`).WithArgs(7, 8).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "version", "deleted_at"}).AddRow(7, 3, time.Now()))
+	expectAssociations(mock, []int64{7}, laptops)
+	expectBreadcrumbs(mock)
+
+	conf := testConfig()
+	conf.Batch.MaxIds = 10
+	r := httptest.NewRequest(http.MethodGet, "/products/batch?ids=7,8&include_deleted=true", nil)
+	w := asAdmin(GetProductsBatch(db, testutil.NewRedis(t), conf), r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var body struct {
+		Products []types.Product `json:"products"`
+		NotFound []int64         `json:"not_found"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Products) != 1 || body.Products[0].Id != 7 || !body.Products[0].DeletedAt.Valid {
+		t.Fatalf("products = %+v, want deleted product 7", body.Products)
+	}
+	assertBreadcrumbs(t, body.Products[0])
+	if len(body.NotFound) != 1 || body.NotFound[0] != 8 {
+		t.Errorf("not_found = %v, want [8]", body.NotFound)
+	}
+}
@@ -0,0 +1,194 @@
+package products
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/exports"
+	"github.com/aiu26/product-management/products/internal/metrics"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// errExportTaken stops a worker whose export was taken over by another one.
+var errExportTaken = errors.New("export taken over")
+
+// RunExports processes background exports every poll interval, and right
+// away when one is queued, until ctx is done. Like imports, jobs are claimed
+// with SKIP LOCKED, and one that stops making progress is taken over after
+// the claim timeout.
+func RunExports(ctx context.Context, db *gorm.DB, s3Client *s3.Client, conf *config.Config, wake <-chan struct{}) {
+	ticker := time.NewTicker(conf.Exports.PollInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			job, err := claimExport(ctx, db, conf)
+			if err != nil {
+				logging.FromContext(ctx).WithError(err).Error("Failed to claim export")
+				break
+			}
+			if job == nil {
+				break
+			}
+			runExport(ctx, db, s3Client, conf, job)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-wake:
+		}
+	}
+}
+
+// claimExport marks the oldest pending or abandoned export as running, and
+// returns it, or nil when there is none.
+func claimExport(ctx context.Context, db *gorm.DB, conf *config.Config) (*types.ExportJob, error) {
+	now := time.Now()
+	var job types.ExportJob
+	result := db.WithContext(ctx).Raw(`UPDATE export_jobs SET status = ?, exported = 0, claims = claims + 1, updated_at = ? WHERE id = (
+		SELECT id FROM export_jobs WHERE status = ? OR (status = ? AND updated_at < ?)
+		ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED
+	) RETURNING *`, types.ExportRunning, now, types.ExportPending, types.ExportRunning, now.Add(-conf.Exports.ClaimTimeout)).Scan(&job)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return nil, result.Error
+	}
+	return &job, nil
+}
+
+// runExport writes the products of a job to a temporary file and uploads it.
+// A job whose filters no longer apply, like one on a deleted category,
+// fails; one left unfinished by another error is retried once its claim
+// times out.
+func runExport(ctx context.Context, db *gorm.DB, s3Client *s3.Client, conf *config.Config, job *types.ExportJob) {
+	log := logging.FromContext(ctx).WithFields(logrus.Fields{"export_id": job.Id, "format": job.Format})
+	ctx = logging.WithField(ctx, "export_id", job.Id)
+	log.Info("Export started")
+
+	params, err := url.ParseQuery(job.Query)
+	if err != nil {
+		failExport(ctx, db, job, err.Error())
+		return
+	}
+	filter, ferr := filterProducts(ctx, db, conf, params, job.Admin)
+	if ferr != nil {
+		if ferr.status >= 500 {
+			log.WithError(ferr.err).Error("Failed to apply export filters")
+			return
+		}
+		failExport(ctx, db, job, ferr.detail)
+		return
+	}
+
+	file, err := os.CreateTemp("", fmt.Sprintf("export-%d-*.%s", job.Id, job.Format))
+	if err != nil {
+		log.WithError(err).Error("Failed to create export file")
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	buffered := bufio.NewWriter(file)
+	out, err := exports.NewWriter(job.Format, buffered, filter.currency())
+	if err != nil {
+		log.WithError(err).Error("Failed to start export")
+		return
+	}
+	exported, err := exportProducts(ctx, db, filter, out, conf.Exports.BatchSize, func(exported int) error {
+		// Progress also keeps the claim alive.
+		result := db.WithContext(ctx).Model(&types.ExportJob{}).
+			Where("id = ? AND status = ? AND claims = ?", job.Id, types.ExportRunning, job.Claims).
+			UpdateColumns(map[string]interface{}{"exported": exported, "updated_at": time.Now()})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errExportTaken
+		}
+		return nil
+	})
+	if err == nil {
+		err = out.Close()
+	}
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if errors.Is(err, errExportTaken) {
+		log.Info("Export taken over by another worker")
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("Failed to export products")
+		return
+	}
+	metrics.ExportedProducts.WithLabelValues(job.Format).Add(float64(exported))
+
+	if _, err := file.Seek(0, 0); err != nil {
+		log.WithError(err).Error("Failed to read export file")
+		return
+	}
+	key := fmt.Sprintf("%sproducts-%d.%s", conf.Exports.Prefix, job.Id, job.Format)
+	_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:             aws.String(conf.AWS.BucketName),
+		Key:                aws.String(key),
+		Body:               file,
+		ContentType:        aws.String(exports.ContentType(job.Format)),
+		ContentDisposition: aws.String(fmt.Sprintf(`attachment; filename="products-%d.%s"`, job.Id, job.Format)),
+	})
+	if err != nil {
+		log.WithError(err).Error("Failed to upload export")
+		return
+	}
+
+	now := time.Now()
+	result := db.WithContext(ctx).Model(&types.ExportJob{}).
+		Where("id = ? AND status = ? AND claims = ?", job.Id, types.ExportRunning, job.Claims).
+		UpdateColumns(map[string]interface{}{
+			"status":      types.ExportCompleted,
+			"exported":    exported,
+			"key":         key,
+			"finished_at": now,
+			"updated_at":  now,
+		})
+	if result.Error != nil {
+		log.WithError(result.Error).Error("Failed to finish export")
+		return
+	}
+	if result.RowsAffected == 0 {
+		log.Info("Export taken over by another worker")
+		return
+	}
+	metrics.ExportJobs.WithLabelValues(types.ExportCompleted).Inc()
+	log.WithFields(logrus.Fields{"exported": exported, "key": key}).Info("Export completed")
+}
+
+// failExport stops a job that cannot succeed.
+func failExport(ctx context.Context, db *gorm.DB, job *types.ExportJob, reason string) {
+	log := logging.FromContext(ctx)
+	now := time.Now()
+	err := db.WithContext(ctx).Model(&types.ExportJob{}).
+		Where("id = ? AND status = ? AND claims = ?", job.Id, types.ExportRunning, job.Claims).
+		UpdateColumns(map[string]interface{}{
+			"status":      types.ExportFailed,
+			"error":       reason,
+			"finished_at": now,
+			"updated_at":  now,
+		}).Error
+	if err != nil {
+		log.WithError(err).Error("Failed to finish export")
+		return
+	}
+	metrics.ExportJobs.WithLabelValues(types.ExportFailed).Inc()
+	log.WithField("reason", reason).Info("Export failed")
+}
@@ -0,0 +1,279 @@
+package products
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/tracing"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/exports"
+	"github.com/aiu26/product-management/products/internal/metrics"
+	"github.com/aiu26/product-management/products/internal/utils/request"
+	"github.com/aiu26/product-management/products/internal/utils/response"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+)
+
+// ExportProducts streams the products matching the filters of GET /products
+// as CSV, NDJSON or XLSX, chosen by the format parameter or the Accept
+// header. Unlike GET /products it does not require user_id. Products are
+// read from a cursor a batch at a time, so exports of any size take little
+// memory.
+func ExportProducts(db *gorm.DB, conf *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			if format = exports.Negotiate(r.Header.Get("Accept")); format == "" {
+				log.WithField("accept", r.Header.Get("Accept")).Info("No acceptable export format")
+				response.WriteError(w, r, http.StatusNotAcceptable, response.CodeUnsupportedExportFormat, "Exports are text/csv, application/x-ndjson or application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+				return
+			}
+		} else if !exports.Supported(format) {
+			log.WithField("format", format).Info("Unsupported export format")
+			response.WriteError(w, r, http.StatusBadRequest, response.CodeUnsupportedExportFormat, "format must be csv, ndjson or xlsx")
+			return
+		}
+
+		filter, ferr := filterProducts(r.Context(), db, conf, r.URL.Query(), request.IsAdmin(r.Context()))
+		if ferr != nil {
+			ferr.write(w, r)
+			return
+		}
+		log = log.WithFields(filter.fields).WithField("format", format)
+
+		w.Header().Set("Content-Type", exports.ContentType(format))
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="products.%s"`, format))
+		out, err := exports.NewWriter(format, w, filter.currency())
+		if err != nil {
+			log.WithError(err).Error("Failed to start export")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeExportFailed, "Error exporting products")
+			return
+		}
+
+		// Nothing reaches the client before the first batch is flushed, so
+		// until then a failure can still be answered with an error.
+		controller := http.NewResponseController(w)
+		flushed := false
+		exported, err := exportProducts(r.Context(), db, filter, out, conf.Exports.BatchSize, func(int) error {
+			if err := out.Flush(); err != nil {
+				return err
+			}
+			// An export that keeps writing is not cut off by the server's
+			// write timeout.
+			if conf.Server.WriteTimeout > 0 {
+				controller.SetWriteDeadline(time.Now().Add(conf.Server.WriteTimeout))
+			}
+			flushed = true
+			return controller.Flush()
+		})
+		if err == nil {
+			err = out.Close()
+		}
+		metrics.ExportedProducts.WithLabelValues(format).Add(float64(exported))
+		if err != nil {
+			log.WithError(err).WithField("exported", exported).Error("Failed to export products")
+			if !flushed {
+				w.Header().Del("Content-Disposition")
+				response.WriteError(w, r, http.StatusInternalServerError, response.CodeExportFailed, "Error exporting products")
+				return
+			}
+			// A truncated export must not look complete.
+			panic(http.ErrAbortHandler)
+		}
+		log.WithField("exported", exported).Info("Products exported")
+	}
+}
+
+// CreateExport queues a background export of the products matching the
+// filters of GET /products, in the format of the format parameter, CSV by
+// default. The finished export is stored in S3.
+func CreateExport(db *gorm.DB, s3Client *s3.Client, conf *config.Config, wake chan<- struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		if s3Client == nil {
+			log.Info("Background exports need an S3 bucket")
+			response.WriteError(w, r, http.StatusServiceUnavailable, response.CodeExportsUnavailable, "Background exports are not configured")
+			return
+		}
+
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = exports.CSV
+		}
+		if !exports.Supported(format) {
+			log.WithField("format", format).Info("Unsupported export format")
+			response.WriteError(w, r, http.StatusBadRequest, response.CodeUnsupportedExportFormat, "format must be csv, ndjson or xlsx")
+			return
+		}
+
+		// The filters are applied again when the job runs; checking them
+		// now rejects bad ones before the job is queued.
+		admin := request.IsAdmin(r.Context())
+		if _, ferr := filterProducts(r.Context(), db, conf, r.URL.Query(), admin); ferr != nil {
+			ferr.write(w, r)
+			return
+		}
+
+		job := types.ExportJob{
+			Status:    types.ExportPending,
+			Format:    format,
+			Query:     r.URL.RawQuery,
+			Admin:     admin,
+			Actor:     request.Actor(r.Context()),
+			RequestId: request.RequestIDFromContext(r.Context()),
+		}
+		if err := db.WithContext(r.Context()).Create(&job).Error; err != nil {
+			log.WithError(err).Error("Failed to create export")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeExportCreateFailed, "Failed to create export")
+			return
+		}
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+
+		log.WithFields(logrus.Fields{"export_id": job.Id, "format": format}).Info("Export queued")
+		w.Header().Set("Location", fmt.Sprintf("/exports/%d", job.Id))
+		response.WriteJson(w, http.StatusAccepted, job)
+	}
+}
+
+// GetExport returns a background export with its progress, and once it is
+// completed a link to download it that expires after exports.url_expiry.
+func GetExport(db *gorm.DB, s3Client *s3.Client, conf *config.Config) http.HandlerFunc {
+	var presigner *s3.PresignClient
+	if s3Client != nil {
+		presigner = s3.NewPresignClient(s3Client)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		var job types.ExportJob
+		id, ok := request.PathId(w, r, "id", response.CodeInvalidExportId, "Invalid export id")
+		if !ok {
+			return
+		}
+		if err := db.WithContext(r.Context()).First(&job, id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				log.Info("Export not found")
+				response.WriteError(w, r, http.StatusNotFound, response.CodeExportNotFound, "Export not found")
+				return
+			}
+			log.WithError(err).Error("Failed to fetch export")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeExportFetchFailed, "Error fetching export")
+			return
+		}
+		log = log.WithField("export_id", job.Id)
+
+		if job.Key != nil && presigner != nil {
+			link, err := presigner.PresignGetObject(r.Context(), &s3.GetObjectInput{
+				Bucket: aws.String(conf.AWS.BucketName),
+				Key:    job.Key,
+			}, s3.WithPresignExpires(conf.Exports.URLExpiry))
+			if err != nil {
+				log.WithError(err).Error("Failed to sign export link")
+				response.WriteError(w, r, http.StatusInternalServerError, response.CodeExportFetchFailed, "Error fetching export")
+				return
+			}
+			job.URL = link.URL
+		}
+
+		log.Info("Export fetched")
+		response.WriteJson(w, http.StatusOK, job)
+	}
+}
+
+// currency is the one the filter converts prices to, if any.
+func (f productFilter) currency() string {
+	if f.converter == nil {
+		return ""
+	}
+	return f.converter.Currency
+}
+
+// exportProducts writes the products of filter to out in its order. Their
+// IDs are read from a cursor, a batch at a time, and each batch is loaded
+// with everything the product JSON embeds in the same snapshot. progress is
+// called after each batch with the number of products written so far. It
+// returns that number.
+func exportProducts(ctx context.Context, db *gorm.DB, filter productFilter, out exports.Writer, batchSize int, progress func(int) error) (exported int, err error) {
+	ctx, span := tracer.Start(ctx, "export products")
+	defer func() {
+		span.SetAttributes(attribute.Int("exported", exported))
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	var ids []int64
+	stmt := filter.query.Session(&gorm.Session{DryRun: true}).Model(&types.Product{}).Order(filter.order).Pluck("products.id", &ids).Statement
+
+	err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// gorm would rewrite the placeholders of the built query, so the
+		// cursor is declared on the transaction itself.
+		if _, err := tx.Statement.ConnPool.ExecContext(ctx, "DECLARE product_export NO SCROLL CURSOR FOR "+stmt.SQL.String(), stmt.Vars...); err != nil {
+			return err
+		}
+
+		load := tx
+		if filter.unscoped {
+			// A new session, so the batches do not pile up their conditions.
+			load = tx.Unscoped().Session(&gorm.Session{})
+		}
+		for {
+			var ids []int64
+			if err := tx.Raw(fmt.Sprintf("FETCH FORWARD %d FROM product_export", batchSize)).Scan(&ids).Error; err != nil {
+				return err
+			}
+			if len(ids) == 0 {
+				return nil
+			}
+
+			var products []types.Product
+			if err := preload(load).Where("id IN ?", ids).Find(&products).Error; err != nil {
+				return err
+			}
+			byId := make(map[int64]*types.Product, len(products))
+			for i := range products {
+				byId[products[i].Id] = &products[i]
+			}
+			ordered := make([]*types.Product, 0, len(products))
+			for _, id := range ids {
+				if product, ok := byId[id]; ok {
+					ordered = append(ordered, product)
+				}
+			}
+			if err := breadcrumbs(tx, ordered...); err != nil {
+				return err
+			}
+			for _, product := range ordered {
+				if filter.converter != nil {
+					filter.converter.Convert(product)
+				}
+				if err := out.Write(product); err != nil {
+					return err
+				}
+			}
+
+			exported += len(ordered)
+			if err := progress(exported); err != nil {
+				return err
+			}
+			if len(ids) < batchSize {
+				return nil
+			}
+		}
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	return exported, err
+}
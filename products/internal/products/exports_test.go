@@ -0,0 +1,118 @@
+package products
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/products/internal/exports"
+	"github.com/aiu26/product-management/products/internal/testutil"
+	"github.com/aiu26/product-management/products/internal/utils/request"
+)
+
+func TestExportProductsInBatches(t *testing.T) {
+	db, mock := testutil.NewDB(t)
+	mock.ExpectBegin()
+	mock.ExpectExec(`DECLARE product_export NO SCROLL CURSOR FOR SELECT "products"."id" FROM "products" WHERE user_id = $1 ORDER BY products.id`).
+		WithArgs(5).WillReturnResult(sqlmock.NewResult(0, 0))
+	// Each batch is loaded by its own IDs only, deleted products included.
+	mock.ExpectQuery(`FETCH FORWARD 2 FROM product_export`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+	mock.ExpectQuery(`SELECT * FROM "products" WHERE id IN ($1,$2)`).WithArgs(1, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id"}).AddRow(2, 5).AddRow(1, 5))
+	expectAssociations(mock, []int64{2, 1})
+	mock.ExpectQuery(`FETCH FORWARD 2 FROM product_export`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectQuery(`SELECT * FROM "products" WHERE id IN ($1)`).WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "deleted_at"}).AddRow(3, 5, time.Now()))
+	expectAssociations(mock, []int64{3})
+	mock.ExpectCommit()
+
+	var buf bytes.Buffer
+	out, err := exports.NewWriter(exports.NDJSON, &buf, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter := productFilter{query: db.Unscoped().Where("user_id = ?", 5), order: "products.id", unscoped: true}
+	var progress []int
+	exported, err := exportProducts(context.Background(), db, filter, out, 2, func(n int) error {
+		progress = append(progress, n)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exported != 3 {
+		t.Errorf("exported = %d, want 3", exported)
+	}
+	if want := []int{2, 3}; !reflect.DeepEqual(progress, want) {
+		t.Errorf("progress = %v, want %v", progress, want)
+	}
+
+	// Products come in the order of the cursor.
+	var ids []int64
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var product struct {
+			Id int64 `json:"product_id"`
+		}
+		if err := decoder.Decode(&product); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, product.Id)
+	}
+	if want := []int64{1, 2, 3}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("exported ids = %v, want %v", ids, want)
+	}
+}
+
+func TestExportProductsWithoutWriteTimeout(t *testing.T) {
+	db, mock := testutil.NewDB(t)
+	mock.ExpectBegin()
+	mock.ExpectExec(`DECLARE product_export NO SCROLL CURSOR FOR SELECT "products"."id" FROM "products" WHERE user_id = $1 ORDER BY id`).
+		WithArgs(5).WillReturnResult(sqlmock.NewResult(0, 0))
+	for _, id := range []int64{1, 2} {
+		mock.ExpectQuery(`FETCH FORWARD 1 FROM product_export`).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(id))
+		mock.ExpectQuery(`SELECT * FROM "products" WHERE id IN ($1)`).WithArgs(id).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "user_id"}).AddRow(id, 5))
+		expectAssociations(mock, []int64{id})
+	}
+	mock.ExpectQuery(`FETCH FORWARD 1 FROM product_export`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectCommit()
+
+	// A write timeout of 0 is none, which must not become a deadline that
+	// has already passed.
+	conf := &config.Config{}
+	conf.Exports.BatchSize = 1
+	server := httptest.NewServer(request.Admin(config.StaticProvider{config.AdminToken: "secret"})(ExportProducts(db, conf)))
+	defer server.Close()
+
+	r, err := http.NewRequest(http.MethodGet, server.URL+"/products/export?format=ndjson&user_id=5&include_deleted=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading the export: %v", err)
+	}
+	if lines := strings.Count(string(body), "\n"); lines != 2 {
+		t.Errorf("exported %d products, want 2: %s", lines, body)
+	}
+}
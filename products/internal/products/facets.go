@@ -0,0 +1,186 @@
+package products
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/rates"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+// facetTagLimit is the number of most used tags the tags facet returns.
+const facetTagLimit = 50
+
+// maxPriceBuckets bounds the price_buckets parameter.
+const maxPriceBuckets = 20
+
+var defaultPriceBuckets = []decimal.Decimal{
+	decimal.NewFromInt(10), decimal.NewFromInt(25), decimal.NewFromInt(50), decimal.NewFromInt(100),
+	decimal.NewFromInt(250), decimal.NewFromInt(500), decimal.NewFromInt(1000),
+}
+
+type TagCount struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+// PriceBucket counts the prices from Min, included, to Max, excluded. The
+// first bucket has no Min and the last no Max.
+type PriceBucket struct {
+	Min   *decimal.Decimal `json:"min"`
+	Max   *decimal.Decimal `json:"max"`
+	Count int64            `json:"count"`
+}
+
+type PriceFacet struct {
+	Currency string        `json:"currency"`
+	Buckets  []PriceBucket `json:"buckets"`
+}
+
+// CategoryCount counts the products in a category's subtree, like the
+// category filter matches them.
+type CategoryCount struct {
+	Id       int64  `json:"id"`
+	Name     string `json:"name"`
+	Slug     string `json:"slug"`
+	ParentId *int64 `json:"parent_id"`
+	Count    int64  `json:"count"`
+}
+
+type Facets struct {
+	Total      int64           `json:"total"`
+	Tags       []TagCount      `json:"tags"`
+	Price      PriceFacet      `json:"price"`
+	Categories []CategoryCount `json:"categories"`
+}
+
+type facetRow struct {
+	Facet    string
+	Id       sql.NullInt64
+	Name     sql.NullString
+	Slug     sql.NullString
+	ParentId sql.NullInt64
+	Count    int64
+}
+
+// facetsQuery counts the products of the filtered CTE by tag, price bucket
+// and category, each branch tagged with its facet, so all facets come back
+// in one round trip.
+const facetsQuery = `WITH filtered AS (?)
+SELECT 'total' AS facet, NULL::bigint AS id, NULL::text AS name, NULL::text AS slug, NULL::bigint AS parent_id, count(*) AS count
+FROM filtered
+UNION ALL
+(SELECT 'tag', NULL, tags.name, NULL, NULL, count(*)
+FROM filtered
+JOIN product_tags ON product_tags.product_id = filtered.id
+JOIN tags ON tags.id = product_tags.tag_id
+GROUP BY tags.name
+ORDER BY count(*) DESC, tags.name
+LIMIT ?)
+UNION ALL
+SELECT 'price', width_bucket(filtered.price, ?::numeric[]), NULL, NULL, NULL, count(*)
+FROM filtered
+WHERE filtered.price IS NOT NULL
+GROUP BY 2
+UNION ALL
+SELECT 'category', ancestors.id, ancestors.name, ancestors.slug, ancestors.parent_id, count(DISTINCT filtered.id)
+FROM filtered
+JOIN product_categories ON product_categories.product_id = filtered.id
+JOIN categories ON categories.id = product_categories.category_id
+JOIN categories AS ancestors ON categories.path LIKE ancestors.path || '%'
+GROUP BY ancestors.id`
+
+// parsePriceBuckets reads the price_buckets parameter: increasing positive
+// bucket edges, comma separated.
+func parsePriceBuckets(raw string) ([]decimal.Decimal, error) {
+	if raw == "" {
+		return defaultPriceBuckets, nil
+	}
+	parts := strings.Split(raw, ",")
+	if len(parts) > maxPriceBuckets {
+		return nil, errors.New("too many price buckets")
+	}
+	edges := make([]decimal.Decimal, len(parts))
+	for i, part := range parts {
+		edge, err := decimal.NewFromString(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		if !edge.IsPositive() || (i > 0 && !edge.GreaterThan(edges[i-1])) {
+			return nil, errors.New("price buckets must be positive and increasing")
+		}
+		edges[i] = edge
+	}
+	return edges, nil
+}
+
+// facets counts the products matched by filtered, a products query with every
+// filter applied. Prices are bucketed in the converter's currency; without
+// one, in the default currency, leaving out the prices that do not convert.
+func facets(db *gorm.DB, filtered *gorm.DB, converter *rates.Converter, fallback *rates.Converter, edges []decimal.Decimal) (Facets, error) {
+	if converter == nil {
+		converter = fallback
+		filtered = converter.LeftJoin(filtered)
+	}
+	filtered = filtered.Model(&types.Product{}).Select("products.id, " + converter.Price() + " AS price")
+
+	literal := make([]string, len(edges))
+	for i, edge := range edges {
+		literal[i] = edge.String()
+	}
+
+	var rows []facetRow
+	if err := db.Raw(facetsQuery, filtered, facetTagLimit, "{"+strings.Join(literal, ",")+"}").Scan(&rows).Error; err != nil {
+		return Facets{}, err
+	}
+
+	result := Facets{
+		Tags:       []TagCount{},
+		Price:      PriceFacet{Currency: converter.Currency, Buckets: make([]PriceBucket, len(edges)+1)},
+		Categories: []CategoryCount{},
+	}
+	for i := range result.Price.Buckets {
+		if i > 0 {
+			result.Price.Buckets[i].Min = &edges[i-1]
+		}
+		if i < len(edges) {
+			result.Price.Buckets[i].Max = &edges[i]
+		}
+	}
+	for _, row := range rows {
+		switch row.Facet {
+		case "total":
+			result.Total = row.Count
+		case "tag":
+			result.Tags = append(result.Tags, TagCount{Name: row.Name.String, Count: row.Count})
+		case "price":
+			if i := int(row.Id.Int64); i >= 0 && i < len(result.Price.Buckets) {
+				result.Price.Buckets[i].Count = row.Count
+			}
+		case "category":
+			category := CategoryCount{Id: row.Id.Int64, Name: row.Name.String, Slug: row.Slug.String, Count: row.Count}
+			if row.ParentId.Valid {
+				category.ParentId = &row.ParentId.Int64
+			}
+			result.Categories = append(result.Categories, category)
+		}
+	}
+
+	sort.Slice(result.Tags, func(i, j int) bool {
+		if result.Tags[i].Count != result.Tags[j].Count {
+			return result.Tags[i].Count > result.Tags[j].Count
+		}
+		return result.Tags[i].Name < result.Tags[j].Name
+	})
+	sort.Slice(result.Categories, func(i, j int) bool {
+		if result.Categories[i].Count != result.Categories[j].Count {
+			return result.Categories[i].Count > result.Categories[j].Count
+		}
+		return result.Categories[i].Name < result.Categories[j].Name
+	})
+	return result, nil
+}
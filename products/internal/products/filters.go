@@ -0,0 +1,224 @@
+package products
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/money"
+	"github.com/aiu26/product-management/products/internal/attributes"
+	"github.com/aiu26/product-management/products/internal/categories"
+	"github.com/aiu26/product-management/products/internal/inventory"
+	"github.com/aiu26/product-management/products/internal/rates"
+	"github.com/aiu26/product-management/products/internal/tags"
+	"github.com/aiu26/product-management/products/internal/utils/response"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// productFilter is a products query with the filters of a GET /products
+// request applied, and the order its sort parameter asks for.
+type productFilter struct {
+	query     *gorm.DB
+	order     string
+	converter *rates.Converter
+	// unscoped is set when deleted products are included.
+	unscoped bool
+	// fields describe the filters for the logs.
+	fields logrus.Fields
+}
+
+// filterError is a filter parameter that was rejected, or could not be
+// applied, with the answer the request gets.
+type filterError struct {
+	status  int
+	code    string
+	detail  string
+	message string
+	err     error
+}
+
+func (e *filterError) Error() string {
+	return e.detail
+}
+
+// write logs the error and answers the request with it.
+func (e *filterError) write(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(r.Context())
+	if e.err != nil {
+		log = log.WithError(e.err)
+	}
+	if e.status >= http.StatusInternalServerError {
+		log.Error(e.message)
+	} else {
+		log.Info(e.message)
+	}
+	response.WriteError(w, r, e.status, e.code, e.detail)
+}
+
+func badFilter(code string, detail string, message string, err error) *filterError {
+	return &filterError{status: http.StatusBadRequest, code: code, detail: detail, message: message, err: err}
+}
+
+// filterProducts applies the filters of GET /products in params to a
+// products query. Unlike GetProducts it does not require user_id. admin
+// tells whether include_deleted may be set.
+func filterProducts(ctx context.Context, db *gorm.DB, conf *config.Config, params url.Values, admin bool) (productFilter, *filterError) {
+	query := db.WithContext(ctx)
+	fields := logrus.Fields{}
+
+	if raw := params.Get("user_id"); raw != "" {
+		userId, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return productFilter{}, badFilter(response.CodeInvalidUserId, "Invalid user_id parameter", "Invalid user_id parameter", err)
+		}
+		query = query.Where("user_id = ?", userId)
+		fields["user_id"] = userId
+	}
+
+	include, ferr := parseIncludeDeleted(params.Get("include_deleted"), admin)
+	if ferr != nil {
+		return productFilter{}, ferr
+	}
+	if include {
+		query = query.Unscoped()
+	}
+	fields["include_deleted"] = include
+
+	sort := params.Get("sort")
+	order, ok := sortOrders[sort]
+	if !ok {
+		return productFilter{}, badFilter(response.CodeInvalidSort, "sort must be one of created_at, -created_at, updated_at or -updated_at", "Invalid sort parameter", nil)
+	}
+	fields["sort"] = sort
+
+	// Price filters apply to prices converted to the requested currency,
+	// or to the default one.
+	currency := params.Get("currency")
+	minPriceStr := params.Get("min_price")
+	maxPriceStr := params.Get("max_price")
+	if currency == "" && (minPriceStr != "" || maxPriceStr != "") {
+		currency = conf.Money.DefaultCurrency
+	}
+	var converter *rates.Converter
+	if currency != "" {
+		converter, ferr = loadConverter(ctx, db, conf, currency)
+		if ferr != nil {
+			return productFilter{}, ferr
+		}
+		query = converter.Join(query)
+	}
+	fields["currency"] = currency
+
+	// Products with variants match when one of their variants does.
+	var minPrice decimal.Decimal
+	var minBound, maxBound *decimal.Decimal
+	if minPriceStr != "" {
+		var err error
+		minPrice, err = decimal.NewFromString(minPriceStr)
+		if err != nil {
+			return productFilter{}, badFilter(response.CodeInvalidMinPrice, "Invalid min_price parameter", "Invalid min_price parameter", err)
+		}
+		minBound = &minPrice
+	}
+	if maxPriceStr != "" {
+		maxPrice, err := decimal.NewFromString(maxPriceStr)
+		if err != nil {
+			return productFilter{}, badFilter(response.CodeInvalidMaxPrice, "Invalid max_price parameter", "Invalid max_price parameter", err)
+		}
+		if minPriceStr != "" && minPrice.GreaterThan(maxPrice) {
+			return productFilter{}, badFilter(response.CodeInvalidPriceRange, "min_price must not be greater than max_price", "Invalid price range", nil)
+		}
+		maxBound = &maxPrice
+	}
+	query = priceWithin(query, converter, minBound, maxBound)
+	fields["min_price"] = minPriceStr
+	fields["max_price"] = maxPriceStr
+
+	productName := params.Get("product_name")
+	if productName != "" {
+		query = query.Where("name ILIKE ?", "%"+productName+"%")
+	}
+	fields["product_name"] = productName
+
+	// A category matches the products of its whole subtree.
+	categoryRef := params.Get("category")
+	if categoryRef != "" {
+		category, err := categories.Lookup(db.WithContext(ctx), categoryRef)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return productFilter{}, badFilter(response.CodeInvalidCategory, "category must be the ID or slug of a category", "Unknown category parameter", nil)
+			}
+			return productFilter{}, &filterError{http.StatusInternalServerError, response.CodeCategoryFetchFailed, "Error fetching category", "Failed to fetch category", err}
+		}
+		query = query.Where("products.id IN (?)", categories.InSubtree(db.WithContext(ctx), category.Path))
+	}
+	fields["category"] = categoryRef
+
+	var tagNames []string
+	if raw := params.Get("tags"); raw != "" {
+		for _, name := range tags.Normalize(strings.Split(raw, ",")) {
+			if name != "" {
+				tagNames = append(tagNames, name)
+			}
+		}
+	}
+	tagMatch := params.Get("tag_match")
+	if tagMatch != "" && tagMatch != "any" && tagMatch != "all" {
+		return productFilter{}, badFilter(response.CodeInvalidTagMatch, "tag_match must be any or all", "Invalid tag_match parameter", nil)
+	}
+	if len(tagNames) > 0 {
+		query = query.Where("products.id IN (?)", tags.Matching(db.WithContext(ctx), tagNames, tagMatch != "any"))
+	}
+	fields["tags"] = tagNames
+
+	query, err := attributes.Filter(query, params)
+	if err != nil {
+		return productFilter{}, badFilter(response.CodeInvalidAttributeFilter, err.Error(), "Invalid attribute filter", err)
+	}
+
+	if raw := params.Get("in_stock"); raw != "" {
+		inStock, err := strconv.ParseBool(raw)
+		if err != nil {
+			return productFilter{}, badFilter(response.CodeInvalidInStock, "in_stock must be true or false", "Invalid in_stock parameter", err)
+		}
+		query = inventory.InStock(query, inStock)
+	}
+
+	return productFilter{query: query, order: order, converter: converter, unscoped: include, fields: fields}, nil
+}
+
+// parseIncludeDeleted reads the include_deleted parameter, which only admins
+// may set.
+func parseIncludeDeleted(raw string, admin bool) (bool, *filterError) {
+	if raw == "" {
+		return false, nil
+	}
+	include, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, badFilter(response.CodeInvalidIncludeDeleted, "include_deleted must be true or false", "Invalid include_deleted parameter", err)
+	}
+	if include && !admin {
+		return false, &filterError{http.StatusForbidden, response.CodeAdminRequired, "include_deleted requires the admin token", "include_deleted requires the admin token", nil}
+	}
+	return include, nil
+}
+
+// loadConverter validates a currency parameter and loads the rates into a
+// converter for it.
+func loadConverter(ctx context.Context, db *gorm.DB, conf *config.Config, currency string) (*rates.Converter, *filterError) {
+	if !money.Supported(currency) {
+		return nil, badFilter(response.CodeInvalidCurrency, "currency must be a supported ISO 4217 currency code", "Invalid currency parameter", nil)
+	}
+	converter, err := rates.NewConverter(ctx, db, conf.Money.DefaultCurrency, currency)
+	if err != nil {
+		return nil, &filterError{http.StatusInternalServerError, response.CodeRateFetchFailed, "Error fetching exchange rates", "Failed to fetch exchange rates", err}
+	}
+	return converter, nil
+}
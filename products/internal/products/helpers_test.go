@@ -0,0 +1,91 @@
+package products
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/utils/request"
+	"github.com/aiu26/product-management/products/internal/utils/response"
+)
+
+func testConfig() *config.Config {
+	conf := &config.Config{}
+	conf.Redis.Timeout = time.Second
+	return conf
+}
+
+// expectAssociations expects the preloads of products with no images, tags
+// or variants. The first product is in categories, the others in none.
+func expectAssociations(mock sqlmock.Sqlmock, productIds []int64, categories ...types.Category) {
+	ids := make([]driver.Value, len(productIds))
+	for i, id := range productIds {
+		ids[i] = id
+	}
+	links := sqlmock.NewRows([]string{"product_id", "category_id"})
+	rows := sqlmock.NewRows([]string{"id", "name", "slug", "path"})
+	categoryIds := make([]driver.Value, len(categories))
+	for i, category := range categories {
+		links.AddRow(productIds[0], category.Id)
+		rows.AddRow(category.Id, category.Name, category.Slug, category.Path)
+		categoryIds[i] = category.Id
+	}
+	mock.ExpectQuery(`SELECT * FROM "product_categories" WHERE ` + in(`"product_categories"."product_id"`, len(ids))).
+		WithArgs(ids...).WillReturnRows(links)
+	if len(categories) > 0 {
+		mock.ExpectQuery(`SELECT * FROM "categories" WHERE ` + in(`"categories"."id"`, len(categoryIds)) + ` ORDER BY categories.path`).
+			WithArgs(categoryIds...).WillReturnRows(rows)
+	}
+	mock.ExpectQuery(`SELECT * FROM "compressed_images" WHERE variant_id IS NULL AND ` + in(`"compressed_images"."product_id"`, len(ids))).
+		WithArgs(ids...).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery(`SELECT * FROM "images" WHERE variant_id IS NULL AND ` + in(`"images"."product_id"`, len(ids))).
+		WithArgs(ids...).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery(`SELECT * FROM "product_tags" WHERE ` + in(`"product_tags"."product_id"`, len(ids))).
+		WithArgs(ids...).WillReturnRows(sqlmock.NewRows([]string{"product_id", "tag_id"}))
+	mock.ExpectQuery(`SELECT * FROM "variants" WHERE ` + in(`"variants"."product_id"`, len(ids)) + ` ORDER BY variants.id`).
+		WithArgs(ids...).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+}
+
+// in is the condition gorm writes for column matching n values.
+func in(column string, n int) string {
+	if n == 1 {
+		return column + " = $1"
+	}
+	return column + " IN (" + placeholders(n) + ")"
+}
+
+// placeholders lists the first n postgres placeholders, like $1,$2.
+func placeholders(n int) string {
+	list := make([]string, n)
+	for i := range list {
+		list[i] = fmt.Sprintf("$%d", i+1)
+	}
+	return strings.Join(list, ",")
+}
+
+func assertCode(t *testing.T, w *httptest.ResponseRecorder, code string) {
+	t.Helper()
+	var problem response.Problem
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+		t.Fatal(err)
+	}
+	if problem.Code != code {
+		t.Errorf("code = %s, want %s", problem.Code, code)
+	}
+}
+
+// asAdmin serves r with h as a request carrying the admin token.
+func asAdmin(h http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	request.Admin(config.StaticProvider{config.AdminToken: "secret"})(h).ServeHTTP(w, r)
+	return w
+}
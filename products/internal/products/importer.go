@@ -0,0 +1,438 @@
+package products
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/attributes"
+	"github.com/aiu26/product-management/products/internal/categories"
+	"github.com/aiu26/product-management/products/internal/events"
+	"github.com/aiu26/product-management/products/internal/metrics"
+	"github.com/aiu26/product-management/products/internal/tags"
+	"github.com/aiu26/product-management/products/internal/utils/validation"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// errImportTaken stops a worker whose import was taken over by another one.
+var errImportTaken = errors.New("import taken over")
+
+// RunImports processes import jobs every poll interval, and right away when
+// an upload wakes it, until ctx is done. Jobs are claimed with SKIP LOCKED,
+// so every replica can run it, and a job that stops making progress, like
+// one whose worker died, is taken over after the claim timeout.
+func RunImports(ctx context.Context, db *gorm.DB, channel *amqp.Channel, validate *validation.Validator, conf *config.Config, wake <-chan struct{}) {
+	ticker := time.NewTicker(conf.Imports.PollInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			job, err := claimImport(ctx, db, conf)
+			if err != nil {
+				logging.FromContext(ctx).WithError(err).Error("Failed to claim import")
+				break
+			}
+			if job == nil {
+				break
+			}
+			runImport(ctx, db, channel, validate, conf, job)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-wake:
+		}
+	}
+}
+
+// claimImport marks the oldest pending or abandoned import as running, and
+// returns it, or nil when there is none.
+func claimImport(ctx context.Context, db *gorm.DB, conf *config.Config) (*types.ImportJob, error) {
+	now := time.Now()
+	var job types.ImportJob
+	result := db.WithContext(ctx).Raw(`UPDATE import_jobs SET status = ?, updated_at = ? WHERE id = (
+		SELECT id FROM import_jobs WHERE status = ? OR (status = ? AND updated_at < ?)
+		ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED
+	) RETURNING *`, types.ImportRunning, now, types.ImportPending, types.ImportRunning, now.Add(-conf.Imports.ClaimTimeout)).Scan(&job)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return nil, result.Error
+	}
+	return &job, nil
+}
+
+// runImport processes the rows of a job from where it stands, one batch per
+// transaction, and queues the created products for compression. A job left
+// unfinished by an error is resumed once its claim times out.
+func runImport(ctx context.Context, db *gorm.DB, channel *amqp.Channel, validate *validation.Validator, conf *config.Config, job *types.ImportJob) {
+	log := logging.FromContext(ctx).WithFields(logrus.Fields{"import_id": job.Id, "dry_run": job.DryRun})
+	log.WithField("processed", job.Processed).Info("Import started")
+
+	rows, err := parseImport(job.Format, job.Data)
+	if err != nil {
+		reason := err.Error()
+		log.WithError(err).Error("Failed to parse import")
+		if err := finishImport(ctx, db, job, types.ImportFailed, &reason); err != nil {
+			log.WithError(err).Error("Failed to finish import")
+		}
+		return
+	}
+
+	// skus maps the SKUs of the rows that passed so far to their lines.
+	// Created ones are in the database too, but those of a dry run are not.
+	skus, err := processedSkus(ctx, db, job, rows)
+	if err != nil {
+		log.WithError(err).Error("Failed to read processed rows")
+		return
+	}
+	for job.Processed < len(rows) {
+		end := min(job.Processed+conf.Imports.BatchSize, len(rows))
+		created, err := importBatch(ctx, db, validate, conf, job, rows[job.Processed:end], skus)
+		if errors.Is(err, errImportTaken) {
+			log.Info("Import taken over by another worker")
+			return
+		}
+		if err != nil {
+			log.WithError(err).Error("Failed to import batch")
+			return
+		}
+
+		for _, productId := range created {
+			if err := publish(ctx, channel, conf, productId); err != nil {
+				log.WithError(err).WithField("product_id", productId).Error("Failed to publish product creation message")
+			}
+		}
+		events.Publish(ctx, channel, conf, types.EventProductUpdated, created...)
+	}
+
+	if err := finishImport(ctx, db, job, types.ImportCompleted, nil); err != nil {
+		log.WithError(err).Error("Failed to finish import")
+		return
+	}
+	log.WithFields(logrus.Fields{"succeeded": job.Succeeded, "failed": job.Failed}).Info("Import completed")
+}
+
+// processedSkus maps the SKUs of the rows a resumed job already passed to
+// their lines, which are the processed rows without import errors.
+func processedSkus(ctx context.Context, db *gorm.DB, job *types.ImportJob, rows []importRow) (map[string]int, error) {
+	skus := map[string]int{}
+	if job.Processed == 0 {
+		return skus, nil
+	}
+	var lines []int
+	if err := db.WithContext(ctx).Model(&types.ImportError{}).Where("job_id = ?", job.Id).Pluck("line", &lines).Error; err != nil {
+		return nil, err
+	}
+	failed := map[int]bool{}
+	for _, line := range lines {
+		failed[line] = true
+	}
+	for _, row := range rows[:min(job.Processed, len(rows))] {
+		if !failed[row.line] {
+			for _, variant := range row.payload.Variants {
+				skus[variant.Sku] = row.line
+			}
+		}
+	}
+	return skus, nil
+}
+
+// importBatch validates rows and, unless the job is a dry run, creates the
+// valid ones. Their problems and the job's progress are stored in the same
+// transaction, so a resumed job neither skips nor repeats rows. It returns
+// the IDs of the created products.
+func importBatch(ctx context.Context, db *gorm.DB, validate *validation.Validator, conf *config.Config, job *types.ImportJob, rows []importRow, skus map[string]int) ([]int64, error) {
+	log := logging.FromContext(ctx).WithField("import_id", job.Id)
+
+	var created []int64
+	var report []types.ImportError
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		created, report = nil, nil
+
+		// Locking the job first makes a worker that lost it wait for the
+		// one that took it over, and then give up.
+		result := tx.Model(&types.ImportJob{}).
+			Where("id = ? AND status = ? AND processed = ?", job.Id, types.ImportRunning, job.Processed).
+			UpdateColumn("updated_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errImportTaken
+		}
+
+		if err := checkRows(tx, validate, conf, job, rows, skus); err != nil {
+			return err
+		}
+		var valid []*importRow
+		for i := range rows {
+			if len(rows[i].problems) == 0 {
+				valid = append(valid, &rows[i])
+			}
+		}
+
+		if !job.DryRun && len(valid) > 0 {
+			tx.SavePoint("batch")
+			ids, err := insertProducts(tx, job, valid)
+			if err != nil {
+				// One bad row fails the whole insert; find it by inserting
+				// the rows one at a time.
+				log.WithError(err).Warn("Failed to insert import batch, retrying row by row")
+				tx.RollbackTo("batch")
+				ids = nil
+				for _, row := range valid {
+					tx.SavePoint("row")
+					rowIds, err := insertProducts(tx, job, []*importRow{row})
+					if err != nil {
+						log.WithError(err).WithField("line", row.line).Warn("Failed to insert import row")
+						tx.RollbackTo("row")
+						row.fail("row", "The product could not be created")
+						continue
+					}
+					ids = append(ids, rowIds...)
+				}
+			}
+			created = ids
+		}
+
+		for _, row := range rows {
+			if len(row.problems) > 0 {
+				report = append(report, types.ImportError{JobId: job.Id, Line: row.line, Errors: row.problems})
+			}
+		}
+		if len(report) > 0 {
+			if err := tx.Create(&report).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&types.ImportJob{}).Where("id = ?", job.Id).UpdateColumns(map[string]interface{}{
+			"processed":  gorm.Expr("processed + ?", len(rows)),
+			"succeeded":  gorm.Expr("succeeded + ?", len(rows)-len(report)),
+			"failed":     gorm.Expr("failed + ?", len(report)),
+			"updated_at": time.Now(),
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		if len(row.problems) == 0 {
+			for _, variant := range row.payload.Variants {
+				skus[variant.Sku] = row.line
+			}
+		}
+	}
+	job.Processed += len(rows)
+	job.Succeeded += len(rows) - len(report)
+	job.Failed += len(report)
+
+	outcome := metrics.ImportCreated
+	if job.DryRun {
+		outcome = metrics.ImportValidated
+	}
+	metrics.ImportRows.WithLabelValues(outcome).Add(float64(len(rows) - len(report)))
+	metrics.ImportRows.WithLabelValues(metrics.ImportInvalid).Add(float64(len(report)))
+	return created, nil
+}
+
+// checkRows applies the checks of checkProduct to the rows of a batch,
+// failing the rows that break them. Users, categories and SKUs are looked up
+// once for the whole batch.
+func checkRows(tx *gorm.DB, validate *validation.Validator, conf *config.Config, job *types.ImportJob, rows []importRow, skus map[string]int) error {
+	var userIds, categoryIds []int64
+	for i := range rows {
+		row := &rows[i]
+		if len(row.problems) > 0 {
+			continue
+		}
+		payload := &row.payload
+		normalize(payload, conf)
+		if err := validate.Struct(payload); err != nil {
+			row.problems, _ = validate.Translate(err, job.Language)
+			continue
+		}
+		userIds = append(userIds, payload.UserId)
+		categoryIds = append(categoryIds, payload.CategoryIds...)
+	}
+
+	var users []int64
+	if len(userIds) > 0 {
+		if err := tx.Model(&types.User{}).Where("id IN ?", userIds).Pluck("id", &users).Error; err != nil {
+			return err
+		}
+	}
+	missing, err := categories.Missing(tx, categoryIds)
+	if err != nil {
+		return err
+	}
+
+	schemas := map[string][]types.AttributeSchema{}
+	inBatch := map[string]int{}
+	var batchSkus []string
+	for i := range rows {
+		row := &rows[i]
+		if len(row.problems) > 0 {
+			continue
+		}
+		payload := &row.payload
+		if !slices.Contains(users, payload.UserId) {
+			row.fail("user_id", "user_id is not a known user")
+		}
+		var unknown []int64
+		for _, id := range payload.CategoryIds {
+			if slices.Contains(missing, id) {
+				unknown = append(unknown, id)
+			}
+		}
+		if len(unknown) > 0 {
+			row.fail("category_ids", fmt.Sprintf("category_ids contains unknown categories: %v", unknown))
+		}
+		if len(row.problems) > 0 {
+			continue
+		}
+
+		payload.Attributes = attributes.Prune(payload.Attributes)
+		key := fmt.Sprint(payload.CategoryIds)
+		if _, ok := schemas[key]; !ok {
+			if schemas[key], err = categories.Schemas(tx, payload.CategoryIds); err != nil {
+				return err
+			}
+		}
+		for field, problem := range attributes.Check(schemas[key], payload.Attributes) {
+			row.fail(field, problem)
+		}
+
+		problems, _ := variantProblems(nil, payload.Variants, "variants")
+		for field, problem := range problems {
+			row.fail(field, problem)
+		}
+		for j, variant := range payload.Variants {
+			line, ok := skus[variant.Sku]
+			if !ok {
+				line, ok = inBatch[variant.Sku]
+			}
+			if ok {
+				row.fail(fmt.Sprintf("variants[%d].sku", j), fmt.Sprintf("SKU %s is already used on line %d", variant.Sku, line))
+			}
+		}
+		if len(row.problems) > 0 {
+			continue
+		}
+		for _, variant := range payload.Variants {
+			inBatch[variant.Sku] = row.line
+			batchSkus = append(batchSkus, variant.Sku)
+		}
+	}
+
+	if len(batchSkus) == 0 {
+		return nil
+	}
+	var taken []string
+	if err := tx.Model(&types.Variant{}).Where("sku IN ?", batchSkus).Pluck("sku", &taken).Error; err != nil {
+		return err
+	}
+	for i := range rows {
+		row := &rows[i]
+		if len(row.problems) > 0 {
+			continue
+		}
+		for j, variant := range row.payload.Variants {
+			if slices.Contains(taken, variant.Sku) {
+				row.fail(fmt.Sprintf("variants[%d].sku", j), fmt.Sprintf("SKU %s is already used", variant.Sku))
+			}
+		}
+	}
+	return nil
+}
+
+// insertProducts creates the products of rows, with everything NewProduct
+// stores, using one statement per table where it can.
+func insertProducts(tx *gorm.DB, job *types.ImportJob, rows []*importRow) ([]int64, error) {
+	products := make([]types.Product, len(rows))
+	for i, row := range rows {
+		products[i] = types.Product{
+			Name:        row.payload.ProductName,
+			Description: row.payload.ProductDescription,
+			Price:       row.payload.ProductPrice,
+			Currency:    row.payload.ProductCurrency,
+			UserId:      row.payload.UserId,
+			Attributes:  row.payload.Attributes,
+		}
+	}
+	if err := tx.Create(&products).Error; err != nil {
+		return nil, err
+	}
+
+	ids := make([]int64, len(products))
+	changes := make([]types.PriceChange, len(products))
+	var images []types.Image
+	var assigned []map[string]interface{}
+	for i, product := range products {
+		ids[i] = product.Id
+		changes[i] = types.PriceChange{
+			ProductId: product.Id,
+			Price:     product.Price,
+			Currency:  product.Currency,
+			Actor:     job.Actor,
+			RequestId: job.RequestId,
+			ChangedAt: product.UpdatedAt,
+		}
+		for _, url := range rows[i].payload.ProductImages {
+			images = append(images, types.Image{Url: url, ProductId: product.Id})
+		}
+		for _, categoryId := range rows[i].payload.CategoryIds {
+			assigned = append(assigned, map[string]interface{}{"product_id": product.Id, "category_id": categoryId})
+		}
+	}
+	if err := tx.Create(&changes).Error; err != nil {
+		return nil, err
+	}
+	if len(images) > 0 {
+		if err := tx.Create(&images).Error; err != nil {
+			return nil, err
+		}
+	}
+	if len(assigned) > 0 {
+		if err := tx.Table("product_categories").Create(assigned).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	for i, row := range rows {
+		if err := tags.Assign(tx, ids[i], row.payload.Tags); err != nil {
+			return nil, err
+		}
+		for _, variant := range row.payload.Variants {
+			if _, err := createVariant(tx, ids[i], variant); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ids, nil
+}
+
+// finishImport gives a job its final status, and drops its upload.
+func finishImport(ctx context.Context, db *gorm.DB, job *types.ImportJob, status string, reason *string) error {
+	now := time.Now()
+	err := db.WithContext(ctx).Model(&types.ImportJob{}).Where("id = ? AND status = ?", job.Id, types.ImportRunning).UpdateColumns(map[string]interface{}{
+		"status":      status,
+		"error":       reason,
+		"data":        []byte{},
+		"finished_at": now,
+		"updated_at":  now,
+	}).Error
+	if err != nil {
+		return err
+	}
+	job.Status = status
+	metrics.ImportJobs.WithLabelValues(status).Inc()
+	return nil
+}
@@ -0,0 +1,47 @@
+package products
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/testutil"
+)
+
+func TestProcessedSkus(t *testing.T) {
+	rows := []importRow{
+		{line: 2, payload: ProductPayload{Variants: []VariantPayload{{Sku: "MUG-RED"}, {Sku: "MUG-BLUE"}}}},
+		{line: 3, payload: ProductPayload{Variants: []VariantPayload{{Sku: "CAP-RED"}}}},
+		{line: 5, payload: ProductPayload{Variants: []VariantPayload{{Sku: "CAP-BLUE"}}}},
+		{line: 6, payload: ProductPayload{Variants: []VariantPayload{{Sku: "HAT-RED"}}}},
+	}
+
+	t.Run("new job", func(t *testing.T) {
+		db, _ := testutil.NewDB(t)
+		skus, err := processedSkus(context.Background(), db, &types.ImportJob{Id: 4, DryRun: true}, rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(skus) != 0 {
+			t.Errorf("skus = %v, want none", skus)
+		}
+	})
+
+	t.Run("resumed dry run", func(t *testing.T) {
+		db, mock := testutil.NewDB(t)
+		// Line 3 failed; line 6 is not processed yet.
+		mock.ExpectQuery(`SELECT "line" FROM "import_errors" WHERE job_id = $1`).WithArgs(4).
+			WillReturnRows(sqlmock.NewRows([]string{"line"}).AddRow(3))
+
+		skus, err := processedSkus(context.Background(), db, &types.ImportJob{Id: 4, DryRun: true, Processed: 3}, rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]int{"MUG-RED": 2, "MUG-BLUE": 2, "CAP-BLUE": 5}
+		if !reflect.DeepEqual(skus, want) {
+			t.Errorf("skus = %v, want %v", skus, want)
+		}
+	})
+}
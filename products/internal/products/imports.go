@@ -0,0 +1,345 @@
+package products
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/exports"
+	"github.com/aiu26/product-management/products/internal/utils/request"
+	"github.com/aiu26/product-management/products/internal/utils/response"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	importCSV    = "csv"
+	importNDJSON = "ndjson"
+)
+
+// importFormats maps the media types of uploads to import formats.
+var importFormats = map[string]string{
+	"text/csv":             importCSV,
+	"application/x-ndjson": importNDJSON,
+	"application/jsonl":    importNDJSON,
+}
+
+// importColumns are the CSV columns, named like the fields of
+// ProductPayload. Lists are separated by |, and attributes and variants are
+// JSON.
+var importColumns = []string{"user_id", "product_name", "product_description", "product_price", "product_currency", "product_images", "category_ids", "tags", "attributes", "variants"}
+
+var requiredColumns = []string{"user_id", "product_name", "product_description", "product_price", "product_images"}
+
+// exportColumns are the columns of CSV exports that imports do not read, so
+// that an export can be imported again.
+var exportColumns = []string{"product_id", "converted_price", "converted_currency", "categories", "compressed_images", "version", "created_at", "updated_at", "deleted_at"}
+
+// importRow is a product of an upload, with the problems found so far.
+type importRow struct {
+	line     int
+	payload  ProductPayload
+	problems map[string]string
+}
+
+func (row *importRow) fail(field string, problem string) {
+	if row.problems == nil {
+		row.problems = map[string]string{}
+	}
+	row.problems[field] = problem
+}
+
+// CreateImport accepts a CSV or NDJSON upload of products, in the format
+// given by the format parameter or the Content-Type, and queues it as an
+// import job. Only the structure of the upload is checked here; the rows are
+// validated while the job runs, and with dry_run=true not created.
+func CreateImport(db *gorm.DB, conf *config.Config, wake chan<- struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			format = importFormats[mediaType]
+		}
+		if format != importCSV && format != importNDJSON {
+			log.WithField("format", format).Info("Unsupported import format")
+			response.WriteError(w, r, http.StatusUnsupportedMediaType, response.CodeUnsupportedImportFormat, "Uploads must be text/csv or application/x-ndjson, or name their format with format=csv or format=ndjson")
+			return
+		}
+
+		dryRun := false
+		if raw := r.URL.Query().Get("dry_run"); raw != "" {
+			var err error
+			if dryRun, err = strconv.ParseBool(raw); err != nil {
+				log.WithError(err).Info("Invalid dry_run parameter")
+				response.WriteError(w, r, http.StatusBadRequest, response.CodeInvalidDryRun, "dry_run must be true or false")
+				return
+			}
+		}
+
+		data, ok := request.ReadBody(w, r)
+		if !ok {
+			return
+		}
+		rows, err := parseImport(format, data)
+		if err == nil && len(rows) > conf.Imports.MaxRows {
+			err = fmt.Errorf("an import may hold at most %d products", conf.Imports.MaxRows)
+		}
+		if err != nil {
+			log.WithError(err).Info("Invalid import")
+			response.WriteError(w, r, http.StatusBadRequest, response.CodeInvalidImport, err.Error())
+			return
+		}
+
+		job := types.ImportJob{
+			Status:    types.ImportPending,
+			Format:    format,
+			DryRun:    dryRun,
+			Total:     len(rows),
+			Data:      data,
+			Language:  r.Header.Get("Accept-Language"),
+			Actor:     request.Actor(r.Context()),
+			RequestId: request.RequestIDFromContext(r.Context()),
+		}
+		if err := db.WithContext(r.Context()).Create(&job).Error; err != nil {
+			log.WithError(err).Error("Failed to create import")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeImportCreateFailed, "Failed to create import")
+			return
+		}
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+
+		log.WithFields(logrus.Fields{"import_id": job.Id, "rows": job.Total, "dry_run": dryRun}).Info("Import queued")
+		w.Header().Set("Location", fmt.Sprintf("/imports/%d", job.Id))
+		response.WriteJson(w, http.StatusAccepted, job)
+	}
+}
+
+// GetImport returns an import job with its progress.
+func GetImport(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := findImport(w, r, db)
+		if !ok {
+			return
+		}
+		logging.FromContext(r.Context()).WithField("import_id", job.Id).Info("Import fetched")
+		response.WriteJson(w, http.StatusOK, job)
+	}
+}
+
+// GetImportErrors returns the problems of the rows of an import that failed
+// so far, in the order of the upload.
+func GetImportErrors(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		job, ok := findImport(w, r, db)
+		if !ok {
+			return
+		}
+		log = log.WithField("import_id", job.Id)
+
+		report := []types.ImportError{}
+		if err := db.WithContext(r.Context()).Where("job_id = ?", job.Id).Order("line").Find(&report).Error; err != nil {
+			log.WithError(err).Error("Failed to fetch import errors")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeImportFetchFailed, "Error fetching import errors")
+			return
+		}
+
+		log.WithField("errors", len(report)).Info("Import errors fetched")
+		response.WriteJson(w, http.StatusOK, report)
+	}
+}
+
+func findImport(w http.ResponseWriter, r *http.Request, db *gorm.DB) (types.ImportJob, bool) {
+	log := logging.FromContext(r.Context())
+
+	var job types.ImportJob
+	id, ok := request.PathId(w, r, "id", response.CodeInvalidImportId, "Invalid import id")
+	if !ok {
+		return job, false
+	}
+	if err := db.WithContext(r.Context()).Omit("data").First(&job, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Info("Import not found")
+			response.WriteError(w, r, http.StatusNotFound, response.CodeImportNotFound, "Import not found")
+			return job, false
+		}
+		log.WithError(err).Error("Failed to fetch import")
+		response.WriteError(w, r, http.StatusInternalServerError, response.CodeImportFetchFailed, "Error fetching import")
+		return job, false
+	}
+	return job, true
+}
+
+// parseImport reads the rows of an upload. Rows that cannot be read into a
+// payload carry their problems; an upload that cannot be read at all is an
+// error.
+func parseImport(format string, data []byte) ([]importRow, error) {
+	var rows []importRow
+	var err error
+	if format == importCSV {
+		rows, err = parseCSV(data)
+	} else {
+		rows, err = parseNDJSON(data)
+	}
+	if err == nil && len(rows) == 0 {
+		err = errors.New("the upload holds no products")
+	}
+	return rows, err
+}
+
+func parseCSV(data []byte) ([]importRow, error) {
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\ufeff"))))
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %w", err)
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if slices.Contains(exportColumns, name) {
+			continue
+		}
+		if !slices.Contains(importColumns, name) {
+			return nil, fmt.Errorf("unknown CSV column %q; the columns are %s", name, strings.Join(importColumns, ", "))
+		}
+		if _, ok := columns[name]; ok {
+			return nil, fmt.Errorf("the CSV column %s is repeated", name)
+		}
+		columns[name] = i
+	}
+	var missing []string
+	for _, name := range requiredColumns {
+		if _, ok := columns[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("the CSV header must name the %s columns", strings.Join(missing, ", "))
+	}
+
+	var rows []importRow
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		}
+		var parseErr *csv.ParseError
+		if err != nil && !(errors.As(err, &parseErr) && errors.Is(parseErr.Err, csv.ErrFieldCount)) {
+			return nil, fmt.Errorf("invalid CSV: %w", err)
+		}
+		line, _ := reader.FieldPos(0)
+		row := importRow{line: line}
+		if err != nil {
+			row.fail("row", fmt.Sprintf("The row has %d fields, but the header %d", len(record), len(header)))
+		} else {
+			row.payload = csvPayload(&row, record, columns)
+		}
+		rows = append(rows, row)
+	}
+}
+
+// csvPayload reads a CSV record into a payload, failing the row on values
+// that do not parse. Empty cells are left to the validator.
+func csvPayload(row *importRow, record []string, columns map[string]int) ProductPayload {
+	cell := func(name string) string {
+		if i, ok := columns[name]; ok {
+			return exports.UnescapeFormula(record[i])
+		}
+		return ""
+	}
+	list := func(name string) []string {
+		var values []string
+		for _, value := range strings.Split(cell(name), "|") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+		return values
+	}
+
+	payload := ProductPayload{
+		ProductName:        cell("product_name"),
+		ProductDescription: cell("product_description"),
+		ProductCurrency:    strings.ToUpper(strings.TrimSpace(cell("product_currency"))),
+		ProductImages:      list("product_images"),
+		Tags:               list("tags"),
+	}
+	if raw := strings.TrimSpace(cell("user_id")); raw != "" {
+		userId, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			row.fail("user_id", "user_id must be an integer")
+		}
+		payload.UserId = userId
+	}
+	if raw := strings.TrimSpace(cell("product_price")); raw != "" {
+		price, err := decimal.NewFromString(raw)
+		if err != nil {
+			row.fail("product_price", "product_price must be a decimal number")
+		}
+		payload.ProductPrice = price
+	}
+	for _, raw := range list("category_ids") {
+		id, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			row.fail("category_ids", "category_ids must be integers separated by |")
+			break
+		}
+		payload.CategoryIds = append(payload.CategoryIds, id)
+	}
+	if raw := strings.TrimSpace(cell("attributes")); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &payload.Attributes); err != nil {
+			row.fail("attributes", "attributes must be a JSON object")
+		}
+	}
+	if raw := strings.TrimSpace(cell("variants")); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &payload.Variants); err != nil {
+			row.fail("variants", "variants must be a JSON array of variants")
+		}
+	}
+	return payload
+}
+
+func parseNDJSON(data []byte) ([]importRow, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+
+	var rows []importRow
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		row := importRow{line: line}
+		if err := json.Unmarshal(text, &row.payload); err != nil {
+			row.payload = ProductPayload{}
+			row.fail("row", "The line is not a valid product: "+err.Error())
+		}
+		rows = append(rows, row)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("invalid NDJSON: %w", err)
+	}
+	return rows, nil
+}
@@ -0,0 +1,81 @@
+package products
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/exports"
+	"github.com/shopspring/decimal"
+)
+
+func TestParseCSVExport(t *testing.T) {
+	for _, currency := range []string{"", "EUR"} {
+		t.Run("currency="+currency, func(t *testing.T) {
+			product := types.Product{
+				Id:          7,
+				UserId:      5,
+				Name:        "Mug",
+				Description: "=HYPERLINK(\"https://example.com\")",
+				Price:       decimal.RequireFromString("12.5"),
+				Currency:    "USD",
+				Images:      []types.Image{{Url: "https://images.example.com/mug.jpg"}},
+				Categories:  []types.Category{{Id: 3, Name: "Kitchen"}},
+				Tags:        []types.Tag{{Name: "@red"}},
+				Version:     2,
+				CreatedAt:   time.Now(),
+				UpdatedAt:   time.Now(),
+			}
+			var buf bytes.Buffer
+			out, err := exports.NewWriter(exports.CSV, &buf, currency)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := out.Write(&product); err != nil {
+				t.Fatal(err)
+			}
+			if err := out.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Cells a spreadsheet would run as formulas are escaped, and
+			// unescaped again by the import.
+			if !bytes.Contains(buf.Bytes(), []byte(`'=HYPERLINK`)) || !bytes.Contains(buf.Bytes(), []byte(`'@red`)) {
+				t.Errorf("export %q does not escape formulas", buf.String())
+			}
+
+			rows, err := parseCSV(buf.Bytes())
+			if err != nil {
+				t.Fatalf("parseCSV() of an export: %v", err)
+			}
+			if len(rows) != 1 {
+				t.Fatalf("rows = %d, want 1", len(rows))
+			}
+			row := rows[0]
+			if len(row.problems) > 0 {
+				t.Fatalf("problems = %v", row.problems)
+			}
+			payload := row.payload
+			if payload.UserId != 5 || payload.ProductName != "Mug" || !payload.ProductPrice.Equal(product.Price) || payload.ProductCurrency != "USD" {
+				t.Errorf("payload = %+v, want the exported product", payload)
+			}
+			if len(payload.CategoryIds) != 1 || payload.CategoryIds[0] != 3 {
+				t.Errorf("category_ids = %v, want [3]", payload.CategoryIds)
+			}
+			if payload.ProductDescription != product.Description {
+				t.Errorf("product_description = %q, want %q", payload.ProductDescription, product.Description)
+			}
+			if len(payload.ProductImages) != 1 || len(payload.Tags) != 1 || payload.Tags[0] != "@red" {
+				t.Errorf("images = %v, tags = %v", payload.ProductImages, payload.Tags)
+			}
+		})
+	}
+}
+
+func TestParseCSVUnknownColumn(t *testing.T) {
+	data := "user_id,product_name,product_description,product_price,product_images,colour\n5,Mug,A mug,12.5,https://images.example.com/mug.jpg,red\n"
+	if _, err := parseCSV([]byte(data)); err == nil {
+		t.Error("parseCSV() accepted an unknown column")
+	}
+}
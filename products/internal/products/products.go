@@ -4,224 +4,910 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/tracing"
 	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/attributes"
+	"github.com/aiu26/product-management/products/internal/categories"
+	"github.com/aiu26/product-management/products/internal/events"
+	"github.com/aiu26/product-management/products/internal/metrics"
+	"github.com/aiu26/product-management/products/internal/prices"
+	"github.com/aiu26/product-management/products/internal/rates"
+	"github.com/aiu26/product-management/products/internal/tags"
+	"github.com/aiu26/product-management/products/internal/utils/request"
 	"github.com/aiu26/product-management/products/internal/utils/response"
-	"github.com/go-playground/validator"
+	"github.com/aiu26/product-management/products/internal/utils/validation"
 	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/redis/go-redis/v9"
-	"github.com/sirupsen/logrus"
+	"github.com/shopspring/decimal"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/gorm"
 )
 
+var tracer = tracing.Tracer("github.com/aiu26/product-management/products/internal/products")
+
 type ProductPayload struct {
-	UserId int64 `json:"user_id" validate:"required"`
-	ProductName string `json:"product_name" validate:"required"`
-	ProductDescription string `json:"product_description" validate:"required"`
-	ProductPrice float32 `json:"product_price" validate:"required,gt=0"`
-	ProductImages []string `json:"product_images" validate:"required"`
+	UserId int64 `json:"user_id" validate:"required,gt=0"`
+	ProductName string `json:"product_name" validate:"required,max=200"`
+	ProductDescription string `json:"product_description" validate:"required,max=5000"`
+	ProductPrice decimal.Decimal `json:"product_price" validate:"required,money=ProductCurrency"`
+	ProductCurrency string `json:"product_currency" validate:"required,currency"`
+	ProductImages []string `json:"product_images" validate:"required,min=1,max=10,dive,required,url,max=2048,imagehost"`
+	CategoryIds []int64 `json:"category_ids" validate:"max=20,unique,dive,gt=0"`
+	Tags []string `json:"tags" validate:"max=20,dive,required,max=50"`
+	// Attributes are checked against the schemas of the product's categories.
+	Attributes types.Attributes `json:"attributes" validate:"max=50"`
+	Variants []VariantPayload `json:"variants" validate:"max=100,dive"`
 }
 
-func NewProduct(db *gorm.DB, channel *amqp.Channel, conf *config.Config) http.HandlerFunc {
+func NewProduct(db *gorm.DB, channel *amqp.Channel, validate *validation.Validator, conf *config.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
 		var payload ProductPayload
-		err := json.NewDecoder(r.Body).Decode(&payload)
+		if !request.Decode(w, r, &payload) {
+			return
+		}
+		db := db.WithContext(r.Context())
+		problem, err := checkProduct(w, r, db, validate, conf, &payload)
 		if err != nil {
-			logrus.Infof("Failed to decode request body: %s", err.Error())
-			response.WriteError(w, http.StatusBadRequest, "Invalid request")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductCreateFailed, "Failed to create product")
+			return
+		}
+		if problem != nil {
+			response.WriteProblem(w, r, *problem)
 			return
 		}
+		log = log.WithField("user_id", payload.UserId)
 
-		err = validator.New().Struct(payload)
+		var product types.Product
+		err = db.Transaction(func(tx *gorm.DB) error {
+			product, err = insertProduct(tx, r, payload)
+			return err
+		})
+		if skuConflict(err) {
+			log.WithError(err).Info("SKU taken")
+			response.WriteError(w, r, http.StatusConflict, response.CodeVariantSkuTaken, "A SKU is already used by another variant")
+			return
+		}
 		if err != nil {
-			logrus.Infof("Invalid payload: %s", err.Error())
-			response.WriteValidationErrors(w, err, payload)
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductCreateFailed, "Failed to create product")
 			return
 		}
+		log = log.WithField("product_id", product.Id)
 
-		if err := db.First(&types.User{}, payload.UserId).Error; err != nil {
-			logrus.Infof("User not found: %s", err.Error())
-			response.WriteError(w, http.StatusBadRequest, "Invalid user_id")
+		if err := publish(r.Context(), channel, conf, product.Id); err != nil {
+			log.WithError(err).Error("Failed to publish product creation message")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductCreateFailed, "Failed to create product")
 			return
 		}
-		
-		product := types.Product{
-			Name: payload.ProductName,
-			Description: payload.ProductDescription,
-			Price: payload.ProductPrice,
-			UserId: payload.UserId,
+		log.Info("Product creation message published")
+		events.Publish(r.Context(), channel, conf, types.EventProductUpdated, product.Id)
+
+		log.Info("Product created")
+		w.Header().Set("Location", fmt.Sprintf("/products/%d", product.Id))
+		writeProduct(w, r, http.StatusCreated, product)
+	}
+}
+
+// insertProduct stores a product with its price, images, categories, tags
+// and variants, and loads it back the way GetProduct shows it. Failures are
+// logged, for the caller to answer.
+func insertProduct(tx *gorm.DB, r *http.Request, payload ProductPayload) (types.Product, error) {
+	log := logging.FromContext(r.Context())
+
+	product := types.Product{
+		Name:        payload.ProductName,
+		Description: payload.ProductDescription,
+		Price:       payload.ProductPrice,
+		Currency:    payload.ProductCurrency,
+		UserId:      payload.UserId,
+		Attributes:  payload.Attributes,
+	}
+	if err := tx.Create(&product).Error; err != nil {
+		log.WithError(err).Error("Failed to create product")
+		return product, err
+	}
+	if err := tx.Create(priceChange(r, product)).Error; err != nil {
+		log.WithError(err).Error("Failed to record product price")
+		return product, err
+	}
+
+	images := make([]types.Image, len(payload.ProductImages))
+	for i, url := range payload.ProductImages {
+		images[i] = types.Image{Url: url, ProductId: product.Id}
+	}
+	if err := tx.CreateInBatches(&images, insertBatchSize).Error; err != nil {
+		log.WithError(err).Error("Failed to create product images")
+		return product, err
+	}
+
+	if err := assignCategories(tx, product.Id, payload.CategoryIds); err != nil {
+		log.WithError(err).Error("Failed to assign product categories")
+		return product, err
+	}
+	if err := tags.Assign(tx, product.Id, payload.Tags); err != nil {
+		log.WithError(err).Error("Failed to tag product")
+		return product, err
+	}
+	for _, variant := range payload.Variants {
+		if _, err := createVariant(tx, product.Id, variant); err != nil {
+			log.WithError(err).WithField("sku", variant.Sku).Error("Failed to create product variant")
+			return product, err
 		}
-		
-		err = db.Transaction(func(tx *gorm.DB) error {
-			if err := tx.Create(&product).Error; err != nil {
-				logrus.Errorf("Failed to create product: %s", err.Error())
-				response.WriteError(w, http.StatusInternalServerError, "Failed to create product")
-				return err
+	}
+
+	if err := tx.Preload("Images", ownImages).Preload("Variants", byId).Preload("Variants.Images").Preload("Categories", byPath).Preload("Tags", byName).Find(&product).Error; err != nil {
+		log.WithError(err).Error("Failed to load product images")
+		return product, err
+	}
+	if err := breadcrumbs(tx, &product); err != nil {
+		log.WithError(err).Error("Failed to load category breadcrumbs")
+		return product, err
+	}
+	return product, nil
+}
+
+// sortOrders maps the sort parameter of GetProducts to an ORDER BY clause.
+// The id breaks ties, so pages stay stable.
+var sortOrders = map[string]string{
+	"":            "id",
+	"created_at":  "created_at, id",
+	"-created_at": "created_at DESC, id DESC",
+	"updated_at":  "updated_at, id",
+	"-updated_at": "updated_at DESC, id DESC",
+}
+
+func GetProducts(db *gorm.DB, conf *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		if r.URL.Query().Get("user_id") == "" {
+			log.Info("Missing user_id parameter")
+			response.WriteError(w, r, http.StatusBadRequest, response.CodeMissingUserId, "Missing user_id parameter")
+			return
+		}
+
+		filter, ferr := filterProducts(r.Context(), db, conf, r.URL.Query(), request.IsAdmin(r.Context()))
+		if ferr != nil {
+			ferr.write(w, r)
+			return
+		}
+		query, converter := filter.query, filter.converter
+
+		withFacets := false
+		if raw := r.URL.Query().Get("facets"); raw != "" {
+			var err error
+			if withFacets, err = strconv.ParseBool(raw); err != nil {
+				log.WithError(err).Info("Invalid facets parameter")
+				response.WriteError(w, r, http.StatusBadRequest, response.CodeInvalidFacets, "facets must be true or false")
+				return
 			}
-			
-			for _, image := range payload.ProductImages {
-				productImage := types.Image{
-					Url: image,
-					ProductId: product.Id,
-				}
-				if err := tx.Create(&productImage).Error; err != nil {
-					logrus.Errorf("Failed to create product image: %s", err.Error())
-					response.WriteError(w, http.StatusInternalServerError, "Failed to create product")
-					return err
-				}
+		}
+		edges, err := parsePriceBuckets(r.URL.Query().Get("price_buckets"))
+		if err != nil {
+			log.WithError(err).Info("Invalid price_buckets parameter")
+			response.WriteError(w, r, http.StatusBadRequest, response.CodeInvalidFacets, fmt.Sprintf("price_buckets must be up to %d increasing positive numbers, comma separated", maxPriceBuckets))
+			return
+		}
+		var fallback *rates.Converter
+		if withFacets && converter == nil {
+			var ok bool
+			if fallback, ok = newConverter(w, r, db, conf, conf.Money.DefaultCurrency); !ok {
+				return
 			}
+		}
 
-			if err := tx.Preload("Images").Find(&product).Error; err != nil {
-				logrus.Errorf("Failed to load product images: %s", err.Error())
-				response.WriteError(w, http.StatusInternalServerError, "Failed to create product")
-				return err
+		// The filtered query is used twice, for the products and the facets.
+		query = query.Session(&gorm.Session{})
+
+		var products []types.Product
+		if err := preload(query).Order(filter.order).Find(&products).Error; err != nil {
+			log.WithError(err).Error("Failed to fetch products")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductFetchFailed, "Error fetching products")
+			return
+		}
+		ptrs := make([]*types.Product, len(products))
+		for i := range products {
+			ptrs[i] = &products[i]
+		}
+		if err := breadcrumbs(db.WithContext(r.Context()), ptrs...); err != nil {
+			log.WithError(err).Error("Failed to fetch category breadcrumbs")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductFetchFailed, "Error fetching products")
+			return
+		}
+		if converter != nil {
+			for i := range products {
+				converter.Convert(&products[i])
 			}
+		}
+		
+		log.WithFields(filter.fields).WithField("count", len(products)).Info("Products fetched")
 
-			return nil
-		})
+		if !withFacets {
+			response.WriteJson(w, http.StatusOK, products)
+			return
+		}
+		result, err := facets(db.WithContext(r.Context()), query, converter, fallback, edges)
 		if err != nil {
+			log.WithError(err).Error("Failed to count facets")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductFetchFailed, "Error fetching products")
 			return
 		}
+		response.WriteJson(w, http.StatusOK, map[string]interface{}{
+			"products": products,
+			"facets":   result,
+		})
+	}
+}
+
+func GetProduct(db *gorm.DB, rdb *redis.Client, conf *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		productIdStr := r.PathValue("id")
 
-		message := amqp.Publishing{
-			ContentType: "text/plain",
-			Body: []byte(strconv.FormatInt(product.Id, 10)),
+		if productIdStr == ""{
+			log.Info("Missing product id")
+			response.WriteError(w, r, http.StatusBadRequest, response.CodeInvalidProductId, "Missing product id")
+			return
 		}
-		err = channel.Publish("", conf.RabbitMQQueue, false, false, message)
+
+		productId, err := strconv.ParseInt(productIdStr, 10, 64)
 		if err != nil {
-			logrus.Errorf("Failed to publish product creation message: %s", err.Error())
-			response.WriteError(w, http.StatusInternalServerError, "Failed to create product")
+			log.WithError(err).Info("Invalid product id")
+			response.WriteError(w, r, http.StatusBadRequest, response.CodeInvalidProductId, "Invalid product id")
 			return
 		}
-		logrus.Infof("Product creation message published")
+		log = log.WithField("product_id", productId)
+
+		// Deleted products are never cached, so admins asking for them go
+		// straight to the database.
+		include, ok := includeDeleted(w, r)
+		if !ok {
+			return
+		}
+
+		var converter *rates.Converter
+		if currency := r.URL.Query().Get("currency"); currency != "" {
+			converter, ok = newConverter(w, r, db, conf, currency)
+			if !ok {
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), conf.Redis.Timeout)
+		defer cancel()
+		if !include {
+			val, err := rdb.Get(ctx, types.CacheKey(productId)).Result()
+			if !errors.Is(err, redis.Nil) {
+				if err != nil {
+					metrics.CacheRequests.WithLabelValues(metrics.ResultError).Inc()
+					log.WithError(err).Error("Failed to fetch product from cache")
+				} else {
+					var product types.Product
+					if err := json.Unmarshal([]byte(val), &product); err != nil {
+						metrics.CacheRequests.WithLabelValues(metrics.ResultError).Inc()
+						log.WithError(err).Error("Failed to unmarshal product from cache")
+					} else if product.Currency == "" {
+						// Cached before prices had a currency; read it again.
+						metrics.CacheRequests.WithLabelValues(metrics.ResultMiss).Inc()
+						log.Info("Stale product in cache")
+					} else {
+						metrics.CacheRequests.WithLabelValues(metrics.ResultHit).Inc()
+						log.Info("Product fetched from cache")
+						writeConverted(w, r, converter, product)
+						return
+					}
+				}
+			} else {
+				metrics.CacheRequests.WithLabelValues(metrics.ResultMiss).Inc()
+				log.Info("Product not found in cache")
+			}
+		}
 
-		logrus.Infof("Product created: %d", product.Id)
-		response.WriteJson(w, http.StatusCreated, product)
+		query := db.WithContext(r.Context())
+		if include {
+			query = query.Unscoped()
+		}
+		var product types.Product
+		if err := preload(query).First(&product, productId).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				log.Info("Product not found")
+				response.WriteError(w, r, http.StatusNotFound, response.CodeProductNotFound, "Product not found")
+				return
+			} else {
+				log.WithError(err).Error("Failed to fetch product")
+				response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductFetchFailed, "Error fetching product")
+				return
+			}
+		}
+
+		if err := breadcrumbs(db.WithContext(r.Context()), &product); err != nil {
+			log.WithError(err).Error("Failed to fetch category breadcrumbs")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductFetchFailed, "Error fetching product")
+			return
+		}
+
+		if !product.DeletedAt.Valid {
+			productJson, err := json.Marshal(product)
+			if err != nil {
+				log.WithError(err).Error("Failed to marshal product")
+			} else if err := rdb.Set(ctx, types.CacheKey(productId), productJson, 0).Err(); err != nil {
+				metrics.CacheWrites.WithLabelValues(metrics.ResultError).Inc()
+				log.WithError(err).Error("Failed to cache product")
+			} else {
+				metrics.CacheWrites.WithLabelValues(metrics.ResultSuccess).Inc()
+				log.Info("Product cached")
+			}
+		}
+
+		log.Info("Product fetched")
+		writeConverted(w, r, converter, product)
 	}
 }
 
-func GetProducts(db *gorm.DB) http.HandlerFunc {
+type ProductUpdatePayload struct {
+	ProductName *string `json:"product_name" validate:"omitnil,min=1,max=200"`
+	ProductDescription *string `json:"product_description" validate:"omitnil,min=1,max=5000"`
+	ProductPrice *decimal.Decimal `json:"product_price" validate:"omitnil,money=ProductCurrency"`
+	ProductCurrency *string `json:"product_currency" validate:"omitnil,currency"`
+	// CategoryIds replaces the product's categories; [] removes them all.
+	CategoryIds *[]int64 `json:"category_ids" validate:"omitnil,max=20,unique,dive,gt=0"`
+	// Tags replaces the product's tags; [] removes them all.
+	Tags *[]string `json:"tags" validate:"omitnil,max=20,dive,required,max=50"`
+	// Attributes replaces the product's attributes, and is checked against
+	// the schemas of the categories it ends up in.
+	Attributes *types.Attributes `json:"attributes" validate:"omitnil,max=50"`
+}
+
+// pricing is validated when an update changes only one of price and
+// currency, to check the result against the other, stored one.
+type pricing struct {
+	ProductPrice decimal.Decimal `json:"product_price" validate:"money=ProductCurrency"`
+	ProductCurrency string `json:"product_currency" validate:"currency"`
+}
+
+// UpdateProduct changes a product's fields. The client must send the ETag it
+// last saw in If-Match, so concurrent edits cannot overwrite each other.
+func UpdateProduct(db *gorm.DB, rdb *redis.Client, channel *amqp.Channel, validate *validation.Validator, conf *config.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userIdStr := r.URL.Query().Get("user_id")
-		if userIdStr == "" {
-			logrus.Infof("Missing user_id parameter")
-			response.WriteError(w, http.StatusBadRequest, "Missing user_id parameter")
+		log := logging.FromContext(r.Context())
+
+		productIdStr := r.PathValue("id")
+		productId, err := strconv.ParseInt(productIdStr, 10, 64)
+		if err != nil {
+			log.WithError(err).Info("Invalid product id")
+			response.WriteError(w, r, http.StatusBadRequest, response.CodeInvalidProductId, "Invalid product id")
 			return
 		}
+		log = log.WithField("product_id", productId)
 
-		userId, err := strconv.ParseInt(userIdStr, 10, 64)
-		if err != nil {
-			logrus.Infof("Invalid user_id parameter: %s", err.Error())
-			response.WriteError(w, http.StatusBadRequest,  "Invalid user_id parameter")
+		etags, ok := request.IfMatch(r)
+		if !ok {
+			log.Info("Missing If-Match header")
+			response.WriteError(w, r, http.StatusPreconditionRequired, response.CodePreconditionRequired, "If-Match must be set to the product's current ETag")
 			return
 		}
-		
-		query := db.Preload("Images").Preload("CompressedImages").Where("user_id = ?", userId)
 
-		minPriceStr := r.URL.Query().Get("min_price")
-		if minPriceStr != "" {
-			minPrice, err := strconv.ParseFloat(minPriceStr, 64)
-			if err != nil {
-				logrus.Infof("Invalid min_price parameter: %s", err.Error())
-				response.WriteError(w, http.StatusBadRequest, "Invalid min_price parameter")
+		var payload ProductUpdatePayload
+		if !request.Decode(w, r, &payload) {
+			return
+		}
+		if payload.Tags != nil {
+			names := tags.Normalize(*payload.Tags)
+			payload.Tags = &names
+		}
+		if err := validate.Struct(payload); err != nil {
+			log.WithError(err).Info("Invalid payload")
+			fields, locale := validate.Translate(err, r.Header.Get("Accept-Language"))
+			w.Header().Set("Content-Language", locale)
+			response.WriteValidationErrors(w, r, fields)
+			return
+		}
+
+		db := db.WithContext(r.Context())
+		var current types.Product
+		repricing := (payload.ProductPrice == nil) != (payload.ProductCurrency == nil)
+		if repricing || payload.Attributes != nil || payload.CategoryIds != nil {
+			if err := db.Preload("Categories").First(&current, productId).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					log.Info("Product not found")
+					response.WriteError(w, r, http.StatusNotFound, response.CodeProductNotFound, "Product not found")
+					return
+				}
+				log.WithError(err).Error("Failed to fetch product")
+				response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductFetchFailed, "Error fetching product")
 				return
 			}
-			query = query.Where("price >= ?", minPrice)
 		}
-		
-		maxPriceStr := r.URL.Query().Get("max_price")
-		if maxPriceStr != "" {
-			maxPrice, err := strconv.ParseFloat(maxPriceStr, 64)
+		if repricing {
+			// If-Match below makes sure the stored value is still the one
+			// checked here when the update is applied.
+			check := pricing{ProductPrice: current.Price, ProductCurrency: current.Currency}
+			if payload.ProductPrice != nil {
+				check.ProductPrice = *payload.ProductPrice
+			} else {
+				check.ProductCurrency = *payload.ProductCurrency
+			}
+			if err := validate.Struct(check); err != nil {
+				log.WithError(err).Info("Invalid price for currency")
+				fields, locale := validate.Translate(err, r.Header.Get("Accept-Language"))
+				w.Header().Set("Content-Language", locale)
+				response.WriteValidationErrors(w, r, fields)
+				return
+			}
+		}
+		if payload.ProductCurrency != nil {
+			variant, err := prices.UnfitVariant(db, productId, *payload.ProductCurrency)
 			if err != nil {
-				logrus.Infof("Invalid max_price parameter: %s", err.Error())
-				response.WriteError(w, http.StatusBadRequest, "Invalid max_price parameter")
+				log.WithError(err).Error("Failed to fetch variants")
+				response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductFetchFailed, "Error fetching product")
+				return
+			}
+			if variant != nil {
+				log.WithField("sku", variant.Sku).Info("Variant price does not fit currency")
+				response.WriteValidationErrors(w, r, map[string]string{
+					"product_currency": fmt.Sprintf("product_currency cannot hold the price %s of variant %s", variant.Price, variant.Sku),
+				})
 				return
 			}
-			query = query.Where("price <= ?", maxPrice)
 		}
 
-		productName := r.URL.Query().Get("product_name")
-		if productName != "" {
-			query = query.Where("name ILIKE ?", "%"+productName+"%")
+		updates := map[string]interface{}{}
+		if payload.ProductName != nil {
+			updates["name"] = *payload.ProductName
 		}
-		
-		var products []types.Product
-		if err := query.Find(&products).Error; err != nil {
-			logrus.Errorf("Failed to fetch products: %s", err.Error())
-			response.WriteError(w, http.StatusInternalServerError, "Error fetching products")
+		if payload.ProductDescription != nil {
+			updates["description"] = *payload.ProductDescription
+		}
+		if payload.ProductPrice != nil {
+			updates["price"] = *payload.ProductPrice
+		}
+		if payload.ProductCurrency != nil {
+			updates["currency"] = *payload.ProductCurrency
+		}
+		if payload.Attributes != nil {
+			updates["attributes"] = attributes.Prune(*payload.Attributes)
+		}
+		if len(updates) == 0 && payload.CategoryIds == nil && payload.Tags == nil {
+			log.Info("Empty update")
+			response.WriteError(w, r, http.StatusBadRequest, response.CodeInvalidRequestBody, "At least one field must be given")
 			return
 		}
-		
-		logrus.Infof("Fetched %d products for user_id %d with filters min_price=%s, max_price=%s", len(products), userId, minPriceStr, maxPriceStr)
-		response.WriteJson(w, http.StatusOK, products)
+		updates["version"] = gorm.Expr("version + 1")
+		updates["updated_at"] = time.Now()
+
+		if payload.CategoryIds != nil && !knownCategories(w, r, db, *payload.CategoryIds) {
+			return
+		}
+		if payload.Attributes != nil || payload.CategoryIds != nil {
+			// Either change can break the attributes, so the result is
+			// checked; If-Match makes sure it is what gets stored.
+			categoryIds := make([]int64, len(current.Categories))
+			for i, category := range current.Categories {
+				categoryIds[i] = category.Id
+			}
+			if payload.CategoryIds != nil {
+				categoryIds = *payload.CategoryIds
+			}
+			attrs := current.Attributes
+			if payload.Attributes != nil {
+				attrs = updates["attributes"].(types.Attributes)
+			}
+			if !validAttributes(w, r, db, categoryIds, attrs) {
+				return
+			}
+		}
+
+		var result *gorm.DB
+		err = db.Transaction(func(tx *gorm.DB) error {
+			result = matchVersions(tx.Model(&types.Product{}).Where("id = ?", productId), etags).UpdateColumns(updates)
+			if result.Error != nil || result.RowsAffected == 0 {
+				return result.Error
+			}
+
+			if payload.CategoryIds != nil {
+				if err := tx.Exec("DELETE FROM product_categories WHERE product_id = ?", productId).Error; err != nil {
+					return err
+				}
+				if err := assignCategories(tx, productId, *payload.CategoryIds); err != nil {
+					return err
+				}
+			}
+			if payload.Tags != nil {
+				if err := tx.Exec("DELETE FROM product_tags WHERE product_id = ?", productId).Error; err != nil {
+					return err
+				}
+				if err := tags.Assign(tx, productId, *payload.Tags); err != nil {
+					return err
+				}
+			}
+			if payload.ProductPrice == nil && payload.ProductCurrency == nil {
+				return nil
+			}
+
+			var product types.Product
+			if err := tx.First(&product, productId).Error; err != nil {
+				return err
+			}
+			return tx.Create(priceChange(r, product)).Error
+		})
+		if err != nil {
+			log.WithError(err).Error("Failed to update product")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductUpdateFailed, "Failed to update product")
+			return
+		}
+
+		var product types.Product
+		if err := preload(db).First(&product, productId).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				log.Info("Product not found")
+				response.WriteError(w, r, http.StatusNotFound, response.CodeProductNotFound, "Product not found")
+				return
+			}
+			log.WithError(err).Error("Failed to fetch product")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductFetchFailed, "Error fetching product")
+			return
+		}
+		if err := breadcrumbs(db, &product); err != nil {
+			log.WithError(err).Error("Failed to fetch category breadcrumbs")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductFetchFailed, "Error fetching product")
+			return
+		}
+
+		if result.RowsAffected == 0 {
+			log.WithField("version", product.Version).Info("Product version does not match If-Match")
+			request.SetValidators(w, request.ETag(product.Version), product.UpdatedAt)
+			response.WriteError(w, r, http.StatusPreconditionFailed, response.CodePreconditionFailed, "The product was changed since it was read; fetch it again and retry")
+			return
+		}
+
+		invalidate(r.Context(), rdb, conf, productId)
+		events.Publish(r.Context(), channel, conf, types.EventProductUpdated, productId)
+
+		log.WithField("version", product.Version).Info("Product updated")
+		writeProduct(w, r, http.StatusOK, product)
 	}
 }
 
-func GetProduct(db *gorm.DB, rdb *redis.Client) http.HandlerFunc {
+// DeleteProduct soft-deletes a product. It stays restorable until the purge
+// job removes it after purge.retention.
+func DeleteProduct(db *gorm.DB, rdb *redis.Client, channel *amqp.Channel, conf *config.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
 		productIdStr := r.PathValue("id")
+		productId, err := strconv.ParseInt(productIdStr, 10, 64)
+		if err != nil {
+			log.WithError(err).Info("Invalid product id")
+			response.WriteError(w, r, http.StatusBadRequest, response.CodeInvalidProductId, "Invalid product id")
+			return
+		}
+		log = log.WithField("product_id", productId)
 
-		if productIdStr == ""{
-			logrus.Infof("Missing product id")
-			response.WriteError(w, http.StatusBadRequest, "Missing product id")
+		etags, ok := request.IfMatch(r)
+		if !ok {
+			log.Info("Missing If-Match header")
+			response.WriteError(w, r, http.StatusPreconditionRequired, response.CodePreconditionRequired, "If-Match must be set to the product's current ETag")
 			return
 		}
 
-		productId, err := strconv.ParseInt(productIdStr, 10, 64)
-		if err != nil {
-			logrus.Infof("Invalid product id: %s", err.Error())
-			response.WriteError(w, http.StatusBadRequest,  "Invalid product id")
+		now := time.Now()
+		db := db.WithContext(r.Context())
+		result := matchVersions(db.Model(&types.Product{}).Where("id = ?", productId), etags).UpdateColumns(map[string]interface{}{
+			"deleted_at": now,
+			"updated_at": now,
+			"version":    gorm.Expr("version + 1"),
+		})
+		if result.Error != nil {
+			log.WithError(result.Error).Error("Failed to delete product")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductUpdateFailed, "Failed to delete product")
 			return
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-		defer cancel()
-		val, err := rdb.Get(ctx, productIdStr).Result()
-		if !errors.Is(err, redis.Nil) {
-			if err != nil {
-				logrus.Errorf("Failed to fetch product from cache: %s", err.Error())
-			} else {
-				var product types.Product
-				if err := json.Unmarshal([]byte(val), &product); err != nil {
-					logrus.Errorf("Failed to unmarshal product from cache: %s", err.Error())
-				} else {
-					logrus.Infof("Product fetched from cache")
-					response.WriteJson(w, http.StatusOK, product)
+		if result.RowsAffected == 0 {
+			var product types.Product
+			if err := db.First(&product, productId).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					log.Info("Product not found")
+					response.WriteError(w, r, http.StatusNotFound, response.CodeProductNotFound, "Product not found")
 					return
 				}
+				log.WithError(err).Error("Failed to fetch product")
+				response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductFetchFailed, "Error fetching product")
+				return
 			}
-		} else {
-			logrus.Infof("Product not found in cache")
+			log.WithField("version", product.Version).Info("Product version does not match If-Match")
+			request.SetValidators(w, request.ETag(product.Version), product.UpdatedAt)
+			response.WriteError(w, r, http.StatusPreconditionFailed, response.CodePreconditionFailed, "The product was changed since it was read; fetch it again and retry")
+			return
 		}
-		
-		
+
+		invalidate(r.Context(), rdb, conf, productId)
+		events.Publish(r.Context(), channel, conf, types.EventProductUpdated, productId)
+
+		log.Info("Product deleted")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// RestoreProduct undoes a soft delete. It is an admin operation, and like
+// other changes requires the product's current ETag in If-Match.
+func RestoreProduct(db *gorm.DB, rdb *redis.Client, channel *amqp.Channel, conf *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		productIdStr := r.PathValue("id")
+		productId, err := strconv.ParseInt(productIdStr, 10, 64)
+		if err != nil {
+			log.WithError(err).Info("Invalid product id")
+			response.WriteError(w, r, http.StatusBadRequest, response.CodeInvalidProductId, "Invalid product id")
+			return
+		}
+		log = log.WithField("product_id", productId)
+
+		etags, ok := request.IfMatch(r)
+		if !ok {
+			log.Info("Missing If-Match header")
+			response.WriteError(w, r, http.StatusPreconditionRequired, response.CodePreconditionRequired, "If-Match must be set to the product's current ETag")
+			return
+		}
+
+		// A new session, so the restore and the reads after it do not share
+		// their conditions.
+		db := db.WithContext(r.Context()).Unscoped().Session(&gorm.Session{})
+		result := matchVersions(db.Model(&types.Product{}).Where("id = ? AND deleted_at IS NOT NULL", productId), etags).UpdateColumns(map[string]interface{}{
+			"deleted_at": nil,
+			"updated_at": time.Now(),
+			"version":    gorm.Expr("version + 1"),
+		})
+		if result.Error != nil {
+			log.WithError(result.Error).Error("Failed to restore product")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductUpdateFailed, "Failed to restore product")
+			return
+		}
+
 		var product types.Product
-		if err := db.Preload("Images").Preload("CompressedImages").First(&product, productId).Error; err != nil {
+		if err := preload(db).First(&product, productId).Error; err != nil {
 			if errors.Is(err, gorm.ErrRecordNotFound) {
-				logrus.Infof("Product not found")
-				response.WriteError(w, http.StatusNotFound, "Product not found")
+				log.Info("Product not found")
+				response.WriteError(w, r, http.StatusNotFound, response.CodeProductNotFound, "Product not found")
 				return
-			} else {
-				logrus.Errorf("Failed to fetch product: %s", err.Error())
-				response.WriteError(w, http.StatusInternalServerError, "Error fetching product")
+			}
+			log.WithError(err).Error("Failed to fetch product")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductFetchFailed, "Error fetching product")
+			return
+		}
+		if err := breadcrumbs(db, &product); err != nil {
+			log.WithError(err).Error("Failed to fetch category breadcrumbs")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductFetchFailed, "Error fetching product")
+			return
+		}
+
+		if result.RowsAffected == 0 {
+			if !product.DeletedAt.Valid {
+				log.Info("Product is not deleted")
+				response.WriteError(w, r, http.StatusConflict, response.CodeProductNotDeleted, "Product is not deleted")
 				return
 			}
+			log.WithField("version", product.Version).Info("Product version does not match If-Match")
+			request.SetValidators(w, request.ETag(product.Version), product.UpdatedAt)
+			response.WriteError(w, r, http.StatusPreconditionFailed, response.CodePreconditionFailed, "The product was changed since it was read; fetch it again and retry")
+			return
 		}
-		
-		productJson, err := json.Marshal(product)
-		if err != nil {
-			logrus.Errorf("Failed to marshal product: %s", err.Error())
-		} else if err := rdb.Set(ctx, productIdStr, productJson, 0).Err(); err != nil {
-			logrus.Errorf("Failed to cache product: %s", err.Error())
-		} else {
-			logrus.Infof("Product cached")
+
+		invalidate(r.Context(), rdb, conf, productId)
+		events.Publish(r.Context(), channel, conf, types.EventProductUpdated, productId)
+
+		log.WithField("version", product.Version).Info("Product restored")
+		writeProduct(w, r, http.StatusOK, product)
+	}
+}
+
+// matchVersions limits an update to the product versions listed in If-Match.
+// An unparsable ETag matches nothing.
+func matchVersions(query *gorm.DB, etags []string) *gorm.DB {
+	if slices.Contains(etags, "*") {
+		return query
+	}
+
+	versions := []int64{0}
+	for _, etag := range etags {
+		if version, err := strconv.ParseInt(strings.Trim(etag, `"`), 10, 64); err == nil {
+			versions = append(versions, version)
+		}
+	}
+	return query.Where("version IN ?", versions)
+}
+
+// byPath orders preloaded categories from the root down.
+func byPath(db *gorm.DB) *gorm.DB {
+	return db.Order("categories.path")
+}
+
+// byName orders preloaded tags alphabetically.
+func byName(db *gorm.DB) *gorm.DB {
+	return db.Order("tags.name")
+}
+
+// byId orders preloaded variants by creation.
+func byId(db *gorm.DB) *gorm.DB {
+	return db.Order("variants.id")
+}
+
+// ownImages leaves the images of a product's variants out of its own.
+func ownImages(db *gorm.DB) *gorm.DB {
+	return db.Where("variant_id IS NULL")
+}
+
+// preload loads everything the product JSON embeds, except the category
+// breadcrumbs and variant options, which breadcrumbs fills in.
+func preload(query *gorm.DB) *gorm.DB {
+	return query.Preload("Images", ownImages).Preload("CompressedImages", ownImages).
+		Preload("Variants", byId).Preload("Variants.Images").Preload("Variants.CompressedImages").
+		Preload("Categories", byPath).Preload("Tags", byName)
+}
+
+// breadcrumbs fills in the breadcrumbs of the products' categories, and their
+// variant options.
+func breadcrumbs(db *gorm.DB, products ...*types.Product) error {
+	variantOptions(products...)
+	var all []*types.Category
+	for _, product := range products {
+		for i := range product.Categories {
+			all = append(all, &product.Categories[i])
 		}
+	}
+	return categories.Breadcrumbs(db, all)
+}
+
+// knownCategories answers the request when some of ids are not categories.
+func knownCategories(w http.ResponseWriter, r *http.Request, db *gorm.DB, ids []int64) bool {
+	log := logging.FromContext(r.Context())
+
+	missing, err := categories.Missing(db, ids)
+	if err != nil {
+		log.WithError(err).Error("Failed to fetch categories")
+		response.WriteError(w, r, http.StatusInternalServerError, response.CodeCategoryFetchFailed, "Error fetching categories")
+		return false
+	}
+	if len(missing) > 0 {
+		log.WithField("category_ids", missing).Info("Unknown categories")
+		response.WriteError(w, r, http.StatusBadRequest, response.CodeInvalidCategory, fmt.Sprintf("category_ids contains unknown categories: %v", missing))
+		return false
+	}
+	return true
+}
+
+// validAttributes answers the request when attrs do not match the schemas of
+// the categories.
+func validAttributes(w http.ResponseWriter, r *http.Request, db *gorm.DB, categoryIds []int64, attrs types.Attributes) bool {
+	log := logging.FromContext(r.Context())
+
+	schemas, err := categories.Schemas(db, categoryIds)
+	if err != nil {
+		log.WithError(err).Error("Failed to fetch attribute schemas")
+		response.WriteError(w, r, http.StatusInternalServerError, response.CodeCategoryFetchFailed, "Error fetching categories")
+		return false
+	}
+	if problems := attributes.Check(schemas, attrs); len(problems) > 0 {
+		log.WithField("attributes", problems).Info("Invalid attributes")
+		response.WriteValidationErrors(w, r, problems)
+		return false
+	}
+	return true
+}
+
+func assignCategories(tx *gorm.DB, productId int64, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	rows := make([]map[string]interface{}, len(ids))
+	for i, id := range ids {
+		rows[i] = map[string]interface{}{"product_id": productId, "category_id": id}
+	}
+	return tx.Table("product_categories").Create(rows).Error
+}
+
+// priceChange records the price a request gave a product.
+func priceChange(r *http.Request, product types.Product) *types.PriceChange {
+	return &types.PriceChange{
+		ProductId: product.Id,
+		Price:     product.Price,
+		Currency:  product.Currency,
+		Actor:     request.Actor(r.Context()),
+		RequestId: request.RequestIDFromContext(r.Context()),
+		ChangedAt: product.UpdatedAt,
+	}
+}
+
+func invalidate(ctx context.Context, rdb *redis.Client, conf *config.Config, productId int64) {
+	ctx, cancel := context.WithTimeout(ctx, conf.Redis.Timeout)
+	defer cancel()
+	if err := rdb.Del(ctx, types.CacheKey(productId)).Err(); err != nil {
+		logging.FromContext(ctx).WithError(err).Error("Failed to delete product from cache")
+	}
+}
+
+// publish queues a product for the compression service, which compresses
+// the images of the product and its variants that are not compressed yet.
+func publish(ctx context.Context, channel *amqp.Channel, conf *config.Config, productId int64) error {
+	ctx, span := tracer.Start(ctx, conf.RabbitMQ.Queue+" publish", trace.WithSpanKind(trace.SpanKindProducer))
+	span.SetAttributes(attribute.Int64("product.id", productId))
+	headers := amqp.Table{"x-request-id": request.RequestIDFromContext(ctx)}
+	tracing.Inject(ctx, headers)
+
+	message := amqp.Publishing{
+		ContentType: "text/plain",
+		Headers:     headers,
+		Body:        []byte(strconv.FormatInt(productId, 10)),
+	}
+	err := channel.PublishWithContext(ctx, "", conf.RabbitMQ.Queue, false, false, message)
+	tracing.RecordError(span, err)
+	span.End()
+
+	result := metrics.ResultSuccess
+	if err != nil {
+		result = metrics.ResultError
+	}
+	metrics.Published.WithLabelValues(conf.RabbitMQ.Queue, result).Inc()
+	return err
+}
+
+// includeDeleted reads the include_deleted parameter, which only admins may
+// set. It answers the request itself when the parameter is rejected.
+func includeDeleted(w http.ResponseWriter, r *http.Request) (bool, bool) {
+	include, ferr := parseIncludeDeleted(r.URL.Query().Get("include_deleted"), request.IsAdmin(r.Context()))
+	if ferr != nil {
+		ferr.write(w, r)
+		return false, false
+	}
+	return include, true
+}
+
+// newConverter validates the currency parameter and loads the rates into it.
+// It answers the request itself when that fails.
+func newConverter(w http.ResponseWriter, r *http.Request, db *gorm.DB, conf *config.Config, currency string) (*rates.Converter, bool) {
+	converter, ferr := loadConverter(r.Context(), db, conf, currency)
+	if ferr != nil {
+		ferr.write(w, r)
+		return nil, false
+	}
+	return converter, true
+}
+
+// writeConverted writes a product fetched by GetProduct, converted when the
+// request asked for a currency. Converted prices change with the rates
+// rather than the product's version, so they are sent without validators.
+func writeConverted(w http.ResponseWriter, r *http.Request, converter *rates.Converter, product types.Product) {
+	if converter == nil {
+		writeProduct(w, r, http.StatusOK, product)
+		return
+	}
+	if !converter.Convert(&product) {
+		logging.FromContext(r.Context()).WithField("currency", converter.Currency).Info("No exchange rate for product")
+		response.WriteError(w, r, http.StatusUnprocessableEntity, response.CodeRateNotFound, fmt.Sprintf("No exchange rate from %s to %s", product.Currency, converter.Currency))
+		return
+	}
+	response.WriteJson(w, http.StatusOK, product)
+}
 
-		logrus.Infof("Product fetched")
-		response.WriteJson(w, http.StatusOK, product)
+func writeProduct(w http.ResponseWriter, r *http.Request, status int, product types.Product) {
+	etag := request.ETag(product.Version)
+	if r.Method == http.MethodGet && request.NotModified(r, etag, product.UpdatedAt) {
+		request.WriteNotModified(w, etag, product.UpdatedAt)
+		return
 	}
+	request.SetValidators(w, etag, product.UpdatedAt)
+	response.WriteJson(w, status, product)
 }
@@ -0,0 +1,123 @@
+package products
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/testutil"
+	"github.com/aiu26/product-management/products/internal/utils/response"
+	"gorm.io/gorm"
+)
+
+const restoreSQL = `UPDATE "products" SET "deleted_at"=$1,"updated_at"=$2,"version"=version + 1 WHERE (id = $3 AND deleted_at IS NOT NULL) AND version IN ($4,$5)`
+
+// The product is read again after the restore, without the restore's
+// conditions, whether it matched or not.
+const readProductSQL = `SELECT * FROM "products" WHERE "products"."id" = $1 ORDER BY "products"."id" LIMIT $2`
+
+func restore(t *testing.T, db *gorm.DB, etag string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/products/7/restore", nil)
+	r.SetPathValue("id", "7")
+	r.Header.Set("If-Match", etag)
+	w := httptest.NewRecorder()
+	RestoreProduct(db, testutil.NewRedis(t), nil, testConfig())(w, r)
+	return w
+}
+
+func TestRestoreProductNotDeleted(t *testing.T) {
+	db, mock := testutil.NewDB(t)
+	mock.ExpectBegin()
+	mock.ExpectExec(restoreSQL).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	mock.ExpectQuery(readProductSQL).WithArgs(7, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "version", "deleted_at"}).AddRow(7, 3, nil))
+	expectAssociations(mock, []int64{7})
+
+	w := restore(t, db, `"3"`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusConflict, w.Body)
+	}
+	assertCode(t, w, response.CodeProductNotDeleted)
+}
+
+func TestRestoreProductVersionMismatch(t *testing.T) {
+	db, mock := testutil.NewDB(t)
+	mock.ExpectBegin()
+	mock.ExpectExec(restoreSQL).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	mock.ExpectQuery(readProductSQL).WithArgs(7, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "version", "deleted_at"}).AddRow(7, 4, time.Now()))
+	expectAssociations(mock, []int64{7})
+
+	w := restore(t, db, `"3"`)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusPreconditionFailed, w.Body)
+	}
+	if etag := w.Header().Get("ETag"); etag != `"4"` {
+		t.Errorf("ETag = %s, want \"4\"", etag)
+	}
+}
+
+func TestRestoreProductGone(t *testing.T) {
+	db, mock := testutil.NewDB(t)
+	mock.ExpectBegin()
+	mock.ExpectExec(restoreSQL).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	mock.ExpectQuery(readProductSQL).WithArgs(7, 1).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	w := restore(t, db, `"3"`)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusNotFound, w.Body)
+	}
+}
+
+var laptops = types.Category{Id: 3, Name: "Laptops", Slug: "laptops", Path: "/1/3/"}
+
+// expectBreadcrumbs expects the ancestors of laptops to be read on their own,
+// without the conditions or preloads of the product read.
+func expectBreadcrumbs(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(`SELECT * FROM "categories" WHERE "categories"."id" IN ($1,$2)`).WithArgs(1, 3).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "slug", "path"}).
+			AddRow(1, "Computers", "computers", "/1/").
+			AddRow(3, "Laptops", "laptops", "/1/3/"))
+}
+
+func assertBreadcrumbs(t *testing.T, product types.Product) {
+	t.Helper()
+	if len(product.Categories) != 1 {
+		t.Fatalf("categories = %+v, want laptops", product.Categories)
+	}
+	crumbs := product.Categories[0].Breadcrumbs
+	if len(crumbs) != 2 || crumbs[0].Slug != "computers" || crumbs[1].Slug != "laptops" {
+		t.Errorf("breadcrumbs = %+v, want computers > laptops", crumbs)
+	}
+}
+
+func TestGetProductIncludeDeleted(t *testing.T) {
+	db, mock := testutil.NewDB(t)
+	mock.ExpectQuery(readProductSQL).WithArgs(7, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "version", "deleted_at"}).AddRow(7, 3, time.Now()))
+	expectAssociations(mock, []int64{7}, laptops)
+	expectBreadcrumbs(mock)
+
+	r := httptest.NewRequest(http.MethodGet, "/products/7?include_deleted=true", nil)
+	r.SetPathValue("id", "7")
+	w := asAdmin(GetProduct(db, testutil.NewRedis(t), testConfig()), r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var product types.Product
+	if err := json.Unmarshal(w.Body.Bytes(), &product); err != nil {
+		t.Fatal(err)
+	}
+	if !product.DeletedAt.Valid {
+		t.Error("deleted_at is not set")
+	}
+	assertBreadcrumbs(t, product)
+}
@@ -0,0 +1,504 @@
+package products
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/events"
+	"github.com/aiu26/product-management/products/internal/rates"
+	"github.com/aiu26/product-management/products/internal/utils/request"
+	"github.com/aiu26/product-management/products/internal/utils/response"
+	"github.com/aiu26/product-management/products/internal/utils/validation"
+	"github.com/jackc/pgx/v5/pgconn"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/redis/go-redis/v9"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxVariants bounds the variants of a product.
+const maxVariants = 100
+
+// errAnswered aborts a transaction whose request was already answered.
+var errAnswered = errors.New("request answered")
+
+type VariantPayload struct {
+	Sku     string            `json:"sku" validate:"required,max=64,sku"`
+	Options map[string]string `json:"options" validate:"min=1,max=5,dive,keys,attrname,endkeys,required,max=100"`
+	Price   *decimal.Decimal  `json:"price" validate:"omitnil,money=Currency"`
+	Images  []string          `json:"images" validate:"max=10,dive,required,url,max=2048,imagehost"`
+	// Currency is the product's, which Price is in.
+	Currency string `json:"-"`
+}
+
+// VariantUpdatePayload changes any of a variant's fields. Images cannot be
+// changed, like a product's.
+type VariantUpdatePayload struct {
+	Sku     *string            `json:"sku" validate:"omitnil,max=64,sku"`
+	Options *map[string]string `json:"options" validate:"omitnil,min=1,max=5,dive,keys,attrname,endkeys,required,max=100"`
+	Price   *decimal.Decimal   `json:"price" validate:"omitnil,excluded_with=InheritPrice,money=Currency"`
+	// InheritPrice drops the variant's price, so it sells at the product's.
+	InheritPrice bool   `json:"inherit_price"`
+	Currency     string `json:"-"`
+}
+
+// CreateVariant adds a variant to a product, and queues its images for
+// compression.
+func CreateVariant(db *gorm.DB, rdb *redis.Client, channel *amqp.Channel, validate *validation.Validator, conf *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		productId, _, ok := variantPath(w, r, false)
+		if !ok {
+			return
+		}
+		log = log.WithField("product_id", productId)
+
+		var payload VariantPayload
+		if !request.Decode(w, r, &payload) {
+			return
+		}
+
+		var variant types.Variant
+		err := db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+			product, err := lockProduct(w, r, tx, productId)
+			if err != nil {
+				return err
+			}
+			payload.Currency = product.Currency
+			if !validVariant(w, r, validate, payload) {
+				return errAnswered
+			}
+
+			var existing []types.Variant
+			if err := tx.Where("product_id = ?", productId).Find(&existing).Error; err != nil {
+				return err
+			}
+			if len(existing) >= maxVariants {
+				log.Info("Too many variants")
+				response.WriteValidationErrors(w, r, map[string]string{"variants": fmt.Sprintf("A product can have at most %d variants", maxVariants)})
+				return errAnswered
+			}
+			if !matchingVariants(w, r, existing, []VariantPayload{payload}, "") {
+				return errAnswered
+			}
+			if taken, err := skusTaken(w, r, tx, []string{payload.Sku}, 0); taken || err != nil {
+				return err
+			}
+
+			if variant, err = createVariant(tx, productId, payload); err != nil {
+				return err
+			}
+			return touchProduct(tx, productId)
+		})
+		if err != nil {
+			writeVariantError(w, r, err, "Failed to create variant")
+			return
+		}
+		invalidate(r.Context(), rdb, conf, productId)
+		events.Publish(r.Context(), channel, conf, types.EventProductUpdated, productId)
+		log = log.WithField("variant_id", variant.Id)
+
+		if len(payload.Images) > 0 {
+			if err := publish(r.Context(), channel, conf, productId); err != nil {
+				log.WithError(err).Error("Failed to publish variant creation message")
+				response.WriteError(w, r, http.StatusInternalServerError, response.CodeVariantUpdateFailed, "Failed to create variant")
+				return
+			}
+			log.Info("Variant creation message published")
+		}
+
+		if err := db.WithContext(r.Context()).Preload("Images").Preload("CompressedImages").First(&variant, variant.Id).Error; err != nil {
+			log.WithError(err).Error("Failed to fetch variant")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductFetchFailed, "Error fetching variant")
+			return
+		}
+
+		log.Info("Variant created")
+		w.Header().Set("Location", fmt.Sprintf("/products/%d/variants/%d", productId, variant.Id))
+		response.WriteJson(w, http.StatusCreated, variant)
+	}
+}
+
+// UpdateVariant changes a variant's SKU, options or price.
+func UpdateVariant(db *gorm.DB, rdb *redis.Client, channel *amqp.Channel, validate *validation.Validator, conf *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		productId, variantId, ok := variantPath(w, r, true)
+		if !ok {
+			return
+		}
+		log = log.WithFields(logrus.Fields{"product_id": productId, "variant_id": variantId})
+
+		var payload VariantUpdatePayload
+		if !request.Decode(w, r, &payload) {
+			return
+		}
+		if payload.Sku == nil && payload.Options == nil && payload.Price == nil && !payload.InheritPrice {
+			log.Info("Empty update")
+			response.WriteError(w, r, http.StatusBadRequest, response.CodeInvalidRequestBody, "At least one field must be given")
+			return
+		}
+
+		var variant types.Variant
+		err := db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+			product, err := lockProduct(w, r, tx, productId)
+			if err != nil {
+				return err
+			}
+			payload.Currency = product.Currency
+			if !validVariant(w, r, validate, payload) {
+				return errAnswered
+			}
+			if err := findVariant(w, r, tx, productId, variantId, &variant); err != nil {
+				return err
+			}
+
+			updates := map[string]interface{}{"updated_at": time.Now()}
+			if payload.Options != nil {
+				var others []types.Variant
+				if err := tx.Where("product_id = ? AND id <> ?", productId, variantId).Find(&others).Error; err != nil {
+					return err
+				}
+				if !matchingVariants(w, r, others, []VariantPayload{{Sku: variant.Sku, Options: *payload.Options}}, "") {
+					return errAnswered
+				}
+				updates["options"] = types.VariantOptions(*payload.Options)
+			}
+			if payload.Sku != nil {
+				if taken, err := skusTaken(w, r, tx, []string{*payload.Sku}, variantId); taken || err != nil {
+					return err
+				}
+				updates["sku"] = *payload.Sku
+			}
+			if payload.Price != nil {
+				updates["price"] = *payload.Price
+			}
+			if payload.InheritPrice {
+				updates["price"] = nil
+			}
+
+			if err := tx.Model(&variant).UpdateColumns(updates).Error; err != nil {
+				return err
+			}
+			return touchProduct(tx, productId)
+		})
+		if err != nil {
+			writeVariantError(w, r, err, "Failed to update variant")
+			return
+		}
+		invalidate(r.Context(), rdb, conf, productId)
+		events.Publish(r.Context(), channel, conf, types.EventProductUpdated, productId)
+
+		if err := db.WithContext(r.Context()).Preload("Images").Preload("CompressedImages").First(&variant, variantId).Error; err != nil {
+			log.WithError(err).Error("Failed to fetch variant")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductFetchFailed, "Error fetching variant")
+			return
+		}
+
+		log.Info("Variant updated")
+		response.WriteJson(w, http.StatusOK, variant)
+	}
+}
+
+// DeleteVariant removes a variant and its images. Their compressed copies
+// stay in S3.
+func DeleteVariant(db *gorm.DB, rdb *redis.Client, channel *amqp.Channel, conf *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		productId, variantId, ok := variantPath(w, r, true)
+		if !ok {
+			return
+		}
+		log = log.WithFields(logrus.Fields{"product_id": productId, "variant_id": variantId})
+
+		err := db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+			if _, err := lockProduct(w, r, tx, productId); err != nil {
+				return err
+			}
+			var variant types.Variant
+			if err := findVariant(w, r, tx, productId, variantId, &variant); err != nil {
+				return err
+			}
+			// Images go with the variant through ON DELETE CASCADE.
+			if err := tx.Delete(&variant).Error; err != nil {
+				return err
+			}
+			return touchProduct(tx, productId)
+		})
+		if err != nil {
+			writeVariantError(w, r, err, "Failed to delete variant")
+			return
+		}
+		invalidate(r.Context(), rdb, conf, productId)
+		events.Publish(r.Context(), channel, conf, types.EventProductUpdated, productId)
+
+		log.Info("Variant deleted")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// createVariant stores a variant of a product with its images.
+func createVariant(tx *gorm.DB, productId int64, payload VariantPayload) (types.Variant, error) {
+	variant := types.Variant{
+		ProductId: productId,
+		Sku:       payload.Sku,
+		Options:   payload.Options,
+		Price:     payload.Price,
+	}
+	if err := tx.Create(&variant).Error; err != nil {
+		return variant, err
+	}
+	images := make([]types.Image, len(payload.Images))
+	for i, url := range payload.Images {
+		images[i] = types.Image{Url: url, ProductId: productId, VariantId: &variant.Id}
+	}
+	if err := tx.CreateInBatches(&images, insertBatchSize).Error; err != nil {
+		return variant, err
+	}
+	return variant, nil
+}
+
+// matchingVariants answers the request when variants added to a product do
+// not fit with each other and the existing ones, see variantProblems.
+func matchingVariants(w http.ResponseWriter, r *http.Request, existing []types.Variant, added []VariantPayload, prefix string) bool {
+	log := logging.FromContext(r.Context())
+
+	problems, clash := variantProblems(existing, added, prefix)
+	if clash != "" {
+		log.WithField("sku", clash).Info("Variant options taken")
+		response.WriteError(w, r, http.StatusConflict, response.CodeVariantExists, fmt.Sprintf("Variant %s already has these options", clash))
+		return false
+	}
+	if len(problems) > 0 {
+		log.WithField("variants", problems).Info("Invalid variants")
+		response.WriteValidationErrors(w, r, problems)
+		return false
+	}
+	return true
+}
+
+// variantProblems checks that variants added to a product fit with each
+// other and the existing ones: all must have the same option names, and no
+// two the same SKU or options. prefix locates the added variants in the
+// payload, like variants[2]., or is empty for a single one, which can only
+// clash with an existing variant: the SKU of that variant is returned
+// instead of a problem.
+func variantProblems(existing []types.Variant, added []VariantPayload, prefix string) (map[string]string, string) {
+	var names string
+	if len(existing) > 0 {
+		names = optionNames(existing[0].Options)
+	} else if len(added) > 0 {
+		names = optionNames(added[0].Options)
+	}
+	taken := make(map[string]string, len(existing)+len(added))
+	for _, variant := range existing {
+		taken[combination(variant.Options)] = variant.Sku
+	}
+
+	problems := map[string]string{}
+	skus := map[string]bool{}
+	for i, variant := range added {
+		field := func(name string) string {
+			if prefix == "" {
+				return name
+			}
+			return fmt.Sprintf("%s[%d].%s", prefix, i, name)
+		}
+		if got := optionNames(variant.Options); got != names {
+			problems[field("options")] = fmt.Sprintf("%s must set exactly the options %s, like the product's other variants", field("options"), names)
+			continue
+		}
+		if skus[variant.Sku] {
+			problems[field("sku")] = fmt.Sprintf("%s %q is used by another variant", field("sku"), variant.Sku)
+		}
+		skus[variant.Sku] = true
+
+		key := combination(variant.Options)
+		if sku, ok := taken[key]; ok {
+			if prefix == "" {
+				return nil, sku
+			}
+			problems[field("options")] = fmt.Sprintf("%s are the same as variant %s's", field("options"), sku)
+		}
+		taken[key] = variant.Sku
+	}
+	return problems, ""
+}
+
+// optionNames lists the names of options, sorted.
+func optionNames(options map[string]string) string {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// combination identifies a set of option values; encoding/json sorts the
+// keys.
+func combination(options map[string]string) string {
+	key, _ := json.Marshal(options)
+	return string(key)
+}
+
+// skusTaken answers the request when variants other than except already use
+// one of skus.
+func skusTaken(w http.ResponseWriter, r *http.Request, tx *gorm.DB, skus []string, except int64) (bool, error) {
+	var taken []string
+	if err := tx.Model(&types.Variant{}).Where("sku IN ? AND id <> ?", skus, except).Pluck("sku", &taken).Error; err != nil {
+		return false, err
+	}
+	if len(taken) == 0 {
+		return false, nil
+	}
+	logging.FromContext(r.Context()).WithField("skus", taken).Info("SKU taken")
+	response.WriteError(w, r, http.StatusConflict, response.CodeVariantSkuTaken, fmt.Sprintf("SKU %s is already used", strings.Join(taken, ", ")))
+	return true, errAnswered
+}
+
+// skuIndex is the unique index on the SKUs of variants.
+const skuIndex = "idx_variants_sku"
+
+// skuConflict tells whether err is another variant taking one of the SKUs
+// after skusTaken checked them.
+func skuConflict(err error) bool {
+	var pgErr *pgconn.PgError
+	// 23505 is unique_violation.
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == skuIndex
+}
+
+// lockProduct locks a product for the rest of the transaction, which
+// serializes changes to its variants.
+func lockProduct(w http.ResponseWriter, r *http.Request, tx *gorm.DB, productId int64) (types.Product, error) {
+	log := logging.FromContext(r.Context())
+
+	var product types.Product
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&product, productId).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Info("Product not found")
+			response.WriteError(w, r, http.StatusNotFound, response.CodeProductNotFound, "Product not found")
+			return product, errAnswered
+		}
+		log.WithError(err).Error("Failed to fetch product")
+		response.WriteError(w, r, http.StatusInternalServerError, response.CodeProductFetchFailed, "Error fetching product")
+		return product, errAnswered
+	}
+	return product, nil
+}
+
+func findVariant(w http.ResponseWriter, r *http.Request, tx *gorm.DB, productId int64, variantId int64, variant *types.Variant) error {
+	if err := tx.Where("product_id = ?", productId).First(variant, variantId).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		logging.FromContext(r.Context()).Info("Variant not found")
+		response.WriteError(w, r, http.StatusNotFound, response.CodeVariantNotFound, "Variant not found")
+		return errAnswered
+	}
+	return nil
+}
+
+// touchProduct bumps the version of a product whose variants changed.
+func touchProduct(tx *gorm.DB, productId int64) error {
+	return tx.Model(&types.Product{}).Where("id = ?", productId).UpdateColumns(map[string]interface{}{
+		"version":    gorm.Expr("version + 1"),
+		"updated_at": time.Now(),
+	}).Error
+}
+
+func variantPath(w http.ResponseWriter, r *http.Request, withVariant bool) (int64, int64, bool) {
+	productId, ok := request.PathId(w, r, "id", response.CodeInvalidProductId, "Invalid product id")
+	if !ok {
+		return 0, 0, false
+	}
+	if !withVariant {
+		return productId, 0, true
+	}
+	variantId, ok := request.PathId(w, r, "variant", response.CodeInvalidVariantId, "Invalid variant id")
+	if !ok {
+		return 0, 0, false
+	}
+	return productId, variantId, true
+}
+
+func validVariant(w http.ResponseWriter, r *http.Request, validate *validation.Validator, payload interface{}) bool {
+	if err := validate.Struct(payload); err != nil {
+		logging.FromContext(r.Context()).WithError(err).Info("Invalid payload")
+		fields, locale := validate.Translate(err, r.Header.Get("Accept-Language"))
+		w.Header().Set("Content-Language", locale)
+		response.WriteValidationErrors(w, r, fields)
+		return false
+	}
+	return true
+}
+
+func writeVariantError(w http.ResponseWriter, r *http.Request, err error, detail string) {
+	if errors.Is(err, errAnswered) {
+		return
+	}
+	logging.FromContext(r.Context()).WithError(err).Error(detail)
+	response.WriteError(w, r, http.StatusInternalServerError, response.CodeVariantUpdateFailed, detail)
+}
+
+// variantOptions fills in the option values the products' variants combine,
+// in the order the variants introduce them.
+func variantOptions(products ...*types.Product) {
+	for _, product := range products {
+		if len(product.Variants) == 0 {
+			continue
+		}
+		options := map[string][]string{}
+		seen := map[string]bool{}
+		for _, variant := range product.Variants {
+			for name, value := range variant.Options {
+				if key := name + "=" + value; !seen[key] {
+					seen[key] = true
+					options[name] = append(options[name], value)
+				}
+			}
+		}
+		product.VariantOptions = options
+	}
+}
+
+// priceWithin limits a products query joined by converter to the products
+// with a price within the bounds, either of which may be nil: their own when
+// they have no variants, or else any of their variants', which default to
+// the product's.
+func priceWithin(query *gorm.DB, converter *rates.Converter, min *decimal.Decimal, max *decimal.Decimal) *gorm.DB {
+	var own, variant []string
+	var ownArgs, variantArgs []interface{}
+	for _, bound := range []struct {
+		op    string
+		value *decimal.Decimal
+	}{{">=", min}, {"<=", max}} {
+		if bound.value == nil {
+			continue
+		}
+		own = append(own, converter.Price()+" "+bound.op+" ?")
+		ownArgs = append(ownArgs, *bound.value)
+		variant = append(variant, converter.PriceOf("COALESCE(variants.price, products.price)")+" "+bound.op+" ?")
+		variantArgs = append(variantArgs, *bound.value)
+	}
+	if len(own) == 0 {
+		return query
+	}
+
+	variants := "EXISTS (SELECT 1 FROM variants WHERE variants.product_id = products.id"
+	condition := fmt.Sprintf("(NOT %s) AND %s) OR %s AND %s)", variants, strings.Join(own, " AND "), variants, strings.Join(variant, " AND "))
+	return query.Where(condition, append(ownArgs, variantArgs...)...)
+}
@@ -0,0 +1,31 @@
+package products
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestSkuConflict(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"sku taken", &pgconn.PgError{Code: "23505", ConstraintName: skuIndex}, true},
+		{"wrapped", fmt.Errorf("insert variants: %w", &pgconn.PgError{Code: "23505", ConstraintName: skuIndex}), true},
+		{"other index", &pgconn.PgError{Code: "23505", ConstraintName: "idx_variants_options"}, false},
+		{"other error", &pgconn.PgError{Code: "23503", ConstraintName: skuIndex}, false},
+		{"not postgres", errors.New("connection reset"), false},
+		{"no error", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := skuConflict(test.err); got != test.want {
+				t.Errorf("skuConflict() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package rates
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aiu26/product-management/common/money"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+type quote struct {
+	rate decimal.Decimal
+	asOf *time.Time
+}
+
+// Converter converts prices into one currency with the rates stored when it
+// was created.
+type Converter struct {
+	Currency string
+	quotes   map[string]quote
+}
+
+// NewConverter loads the rates quoted against base and derives the cross rate
+// from every currency into currency. Prices already in currency convert at 1;
+// prices in a currency without a rate, or into a currency without one, do not
+// convert.
+func NewConverter(ctx context.Context, db *gorm.DB, base string, currency string) (*Converter, error) {
+	var rows []types.ExchangeRate
+	if err := db.WithContext(ctx).Where("base = ?", base).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	against := map[string]quote{base: {rate: decimal.NewFromInt(1)}}
+	for _, row := range rows {
+		asOf := row.AsOf
+		against[row.Currency] = quote{rate: row.Rate, asOf: &asOf}
+	}
+
+	c := &Converter{Currency: currency, quotes: map[string]quote{currency: {rate: decimal.NewFromInt(1)}}}
+	to, ok := against[currency]
+	if !ok {
+		return c, nil
+	}
+	for code, from := range against {
+		if code == currency {
+			continue
+		}
+		c.quotes[code] = quote{rate: money.CrossRate(from.rate, to.rate), asOf: older(from.asOf, to.asOf)}
+	}
+	return c, nil
+}
+
+// older returns the earlier of two rate timestamps, where nil is the base
+// currency, which has no timestamp.
+func older(a, b *time.Time) *time.Time {
+	if a == nil || (b != nil && b.Before(*a)) {
+		return b
+	}
+	return a
+}
+
+// Convert sets the Conversion of the product and of its variants with a
+// price of their own, and reports whether its currency could be converted.
+func (c *Converter) Convert(product *types.Product) bool {
+	q, ok := c.quotes[product.Currency]
+	if !ok {
+		return false
+	}
+	product.Conversion = c.conversion(product.Price, q)
+	for i := range product.Variants {
+		if price := product.Variants[i].Price; price != nil {
+			product.Variants[i].Conversion = c.conversion(*price, q)
+		}
+	}
+	return true
+}
+
+func (c *Converter) conversion(price decimal.Decimal, q quote) *types.Conversion {
+	return &types.Conversion{
+		Price:    money.Convert(price, q.rate, c.Currency),
+		Currency: c.Currency,
+		Rate:     q.rate,
+		RateAsOf: q.asOf,
+	}
+}
+
+// Join limits a products query to the products Convert can convert, and
+// makes Price usable in it.
+func (c *Converter) Join(query *gorm.DB) *gorm.DB {
+	return c.join(query, "JOIN")
+}
+
+// LeftJoin makes Price usable in a products query without limiting it;
+// Price is NULL for the products Convert cannot convert.
+func (c *Converter) LeftJoin(query *gorm.DB) *gorm.DB {
+	return c.join(query, "LEFT JOIN")
+}
+
+func (c *Converter) join(query *gorm.DB, kind string) *gorm.DB {
+	codes := make([]string, 0, len(c.quotes))
+	for code := range c.quotes {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	values := make([]string, len(codes))
+	args := make([]interface{}, 0, 2*len(codes))
+	for i, code := range codes {
+		values[i] = "(?::char(3), ?::numeric)"
+		args = append(args, code, c.quotes[code].rate)
+	}
+	return query.Joins(kind+" (VALUES "+strings.Join(values, ", ")+") AS fx(currency, rate) ON fx.currency = products.currency", args...)
+}
+
+// Price is the SQL expression of the converted price in a query passed
+// through Join. It rounds like Convert, so filters agree with the prices
+// returned.
+func (c *Converter) Price() string {
+	return c.PriceOf("products.price")
+}
+
+// PriceOf is Price for another amount in the product's currency, like a
+// variant's price.
+func (c *Converter) PriceOf(amount string) string {
+	exponent, _ := money.Exponent(c.Currency)
+	return fmt.Sprintf("round(%s * fx.rate, %d)", amount, exponent)
+}
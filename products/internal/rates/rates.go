@@ -0,0 +1,225 @@
+package rates
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/utils/request"
+	"github.com/aiu26/product-management/products/internal/utils/response"
+	"github.com/aiu26/product-management/products/internal/utils/validation"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type RatePayload struct {
+	Currency string          `json:"currency" validate:"required,currency"`
+	Rate     decimal.Decimal `json:"rate" validate:"rate"`
+	AsOf     *time.Time      `json:"as_of"`
+}
+
+// ListRates returns the rates quoted against the default currency.
+func ListRates(db *gorm.DB, conf *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		rates := []types.ExchangeRate{}
+		if err := db.WithContext(r.Context()).Where("base = ?", conf.Money.DefaultCurrency).Order("currency").Find(&rates).Error; err != nil {
+			log.WithError(err).Error("Failed to fetch exchange rates")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeRateFetchFailed, "Error fetching exchange rates")
+			return
+		}
+
+		log.WithField("count", len(rates)).Info("Exchange rates fetched")
+		response.WriteJson(w, http.StatusOK, rates)
+	}
+}
+
+// PutRate sets the rate of the {currency} path segment. A rate observed
+// before the stored one is rejected, so a late update cannot replace a newer
+// rate.
+func PutRate(db *gorm.DB, validate *validation.Validator, conf *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		var payload RatePayload
+		if !request.Decode(w, r, &payload) {
+			return
+		}
+		payload.Currency = r.PathValue("currency")
+		log = log.WithField("currency", payload.Currency)
+
+		if err := validate.Struct(payload); err != nil {
+			log.WithError(err).Info("Invalid payload")
+			fields, locale := validate.Translate(err, r.Header.Get("Accept-Language"))
+			w.Header().Set("Content-Language", locale)
+			response.WriteValidationErrors(w, r, fields)
+			return
+		}
+		if payload.Currency == conf.Money.DefaultCurrency {
+			log.Info("Rate of the default currency")
+			response.WriteError(w, r, http.StatusBadRequest, response.CodeInvalidCurrency, "The default currency always has a rate of 1")
+			return
+		}
+
+		rate := exchangeRate(payload, conf)
+		db := db.WithContext(r.Context())
+		result := upsert(db, []types.ExchangeRate{rate})
+		if result.Error != nil {
+			log.WithError(result.Error).Error("Failed to store exchange rate")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeRateUpdateFailed, "Failed to store exchange rate")
+			return
+		}
+
+		if err := db.First(&rate, "currency = ?", rate.Currency).Error; err != nil {
+			log.WithError(err).Error("Failed to fetch exchange rate")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeRateFetchFailed, "Error fetching exchange rate")
+			return
+		}
+		if result.RowsAffected == 0 {
+			log.WithField("as_of", rate.AsOf).Info("A newer exchange rate is stored")
+			response.WriteError(w, r, http.StatusConflict, response.CodeRateOutdated, fmt.Sprintf("A rate observed at %s is already stored", rate.AsOf.Format(time.RFC3339)))
+			return
+		}
+
+		log.Info("Exchange rate stored")
+		response.WriteJson(w, http.StatusOK, rate)
+	}
+}
+
+// ImportRates stores the rates of a CSV body with a header row naming the
+// currency and rate columns, and optionally as_of. Either every row is
+// stored or, when any row is invalid, none is. Rows older than the stored
+// rate are skipped.
+func ImportRates(db *gorm.DB, validate *validation.Validator, conf *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		reader := csv.NewReader(r.Body)
+		reader.TrimLeadingSpace = true
+		records, err := reader.ReadAll()
+		if err != nil {
+			log.WithError(err).Info("Failed to read CSV body")
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				response.WriteError(w, r, http.StatusRequestEntityTooLarge, response.CodeRequestTooLarge, fmt.Sprintf("Request body must not exceed %d bytes", maxBytesErr.Limit))
+				return
+			}
+			response.WriteError(w, r, http.StatusBadRequest, response.CodeInvalidRequestBody, "Invalid CSV: "+err.Error())
+			return
+		}
+		if len(records) < 2 {
+			log.Info("Empty CSV body")
+			response.WriteError(w, r, http.StatusBadRequest, response.CodeInvalidRequestBody, "The CSV must have a header row and at least one rate")
+			return
+		}
+
+		columns := map[string]int{}
+		for i, name := range records[0] {
+			columns[strings.ToLower(strings.TrimSpace(name))] = i
+		}
+		currencyCol, hasCurrency := columns["currency"]
+		rateCol, hasRate := columns["rate"]
+		asOfCol, hasAsOf := columns["as_of"]
+		if !hasCurrency || !hasRate {
+			log.Info("Missing CSV columns")
+			response.WriteError(w, r, http.StatusBadRequest, response.CodeInvalidRequestBody, "The CSV header must name the currency and rate columns")
+			return
+		}
+
+		fields := map[string]string{}
+		seen := map[string]int{}
+		rates := make([]types.ExchangeRate, 0, len(records)-1)
+		for i, record := range records[1:] {
+			// Lines are numbered as in the file, the header being line 1.
+			prefix := fmt.Sprintf("line[%d].", i+2)
+
+			payload := RatePayload{Currency: strings.ToUpper(record[currencyCol])}
+			if payload.Rate, err = decimal.NewFromString(record[rateCol]); err != nil {
+				fields[prefix+"rate"] = "rate must be a decimal number"
+				continue
+			}
+			if hasAsOf && record[asOfCol] != "" {
+				asOf, err := time.Parse(time.RFC3339, record[asOfCol])
+				if err != nil {
+					fields[prefix+"as_of"] = "as_of must be an RFC 3339 time"
+					continue
+				}
+				payload.AsOf = &asOf
+			}
+
+			if err := validate.Struct(payload); err != nil {
+				rowFields, _ := validate.Translate(err, r.Header.Get("Accept-Language"))
+				for field, message := range rowFields {
+					fields[prefix+field] = message
+				}
+				continue
+			}
+			if payload.Currency == conf.Money.DefaultCurrency {
+				fields[prefix+"currency"] = "The default currency always has a rate of 1"
+				continue
+			}
+			if line, ok := seen[payload.Currency]; ok {
+				fields[prefix+"currency"] = fmt.Sprintf("currency is already set on line %d", line)
+				continue
+			}
+			seen[payload.Currency] = i + 2
+
+			rates = append(rates, exchangeRate(payload, conf))
+		}
+		if len(fields) > 0 {
+			log.WithField("invalid", len(fields)).Info("Invalid exchange rates")
+			response.WriteValidationErrors(w, r, fields)
+			return
+		}
+
+		result := upsert(db.WithContext(r.Context()), rates)
+		if result.Error != nil {
+			log.WithError(result.Error).Error("Failed to import exchange rates")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeRateUpdateFailed, "Failed to import exchange rates")
+			return
+		}
+
+		imported := int(result.RowsAffected)
+		log.WithField("imported", imported).Info("Exchange rates imported")
+		response.WriteJson(w, http.StatusOK, map[string]int{
+			"imported": imported,
+			"skipped":  len(rates) - imported,
+		})
+	}
+}
+
+func exchangeRate(payload RatePayload, conf *config.Config) types.ExchangeRate {
+	now := time.Now()
+	rate := types.ExchangeRate{
+		Currency:  payload.Currency,
+		Base:      conf.Money.DefaultCurrency,
+		Rate:      payload.Rate,
+		AsOf:      now,
+		UpdatedAt: now,
+	}
+	if payload.AsOf != nil {
+		rate.AsOf = *payload.AsOf
+	}
+	return rate
+}
+
+// upsert stores rates in a single statement, keeping stored rates observed
+// after the new ones. Rates against another base, left over from a change of
+// the default currency, are always replaced.
+func upsert(db *gorm.DB, rates []types.ExchangeRate) *gorm.DB {
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "currency"}},
+		DoUpdates: clause.AssignmentColumns([]string{"base", "rate", "as_of", "updated_at"}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Expr{SQL: "exchange_rates.as_of <= excluded.as_of OR exchange_rates.base <> excluded.base"},
+		}},
+	}).Create(&rates)
+}
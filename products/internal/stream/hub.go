@@ -0,0 +1,299 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/tracing"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/events"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+var tracer = tracing.Tracer("github.com/aiu26/product-management/products/internal/stream")
+
+const (
+	// readBlock is how long one read of the stream waits for events. A read
+	// is not cut short when the hub stops, so it also bounds how long
+	// stopping takes.
+	readBlock = time.Second
+	// retryDelay is how long the hub waits after failing to read the stream.
+	retryDelay = time.Second
+)
+
+// Event is a product event of the stream, with the seller of its product.
+// Id is the id of its stream entry, which orders events across replicas.
+type Event struct {
+	Id string `json:"-"`
+	types.ProductEvent
+	UserId int64 `json:"user_id,omitempty"`
+}
+
+// Handle adds product events to the event stream, with the seller of their
+// product. Replicas share the stream queue, so each event is added once.
+func Handle(db *gorm.DB, rdb *redis.Client, conf *config.Config) events.Handler {
+	return func(ctx context.Context, event types.ProductEvent) error {
+		return appendEvent(ctx, db, rdb, conf, event)
+	}
+}
+
+func appendEvent(ctx context.Context, db *gorm.DB, rdb *redis.Client, conf *config.Config, event types.ProductEvent) error {
+	log := logging.FromContext(ctx)
+
+	// Purged products have no seller left, so their events only reach the
+	// product's streams.
+	var userIds []int64
+	if err := db.WithContext(ctx).Unscoped().Model(&types.Product{}).Where("id = ?", event.ProductId).Pluck("user_id", &userIds).Error; err != nil {
+		log.WithError(err).Error("Failed to fetch product seller")
+		return err
+	}
+	var userId int64
+	if len(userIds) > 0 {
+		userId = userIds[0]
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, conf.Redis.Timeout)
+	defer cancel()
+	err := rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: conf.Stream.Key,
+		MaxLen: conf.Stream.MaxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"type":        event.Type,
+			"product_id":  event.ProductId,
+			"user_id":     userId,
+			"occurred_at": event.OccurredAt.Format(time.RFC3339Nano),
+		},
+	}).Err()
+	if err != nil {
+		log.WithError(err).Error("Failed to append product event")
+		return err
+	}
+	return nil
+}
+
+// subscriber is an open event stream, for the events of a product or of the
+// products of a seller.
+type subscriber struct {
+	productId int64
+	userId    int64
+	events    chan Event
+}
+
+func (s *subscriber) wants(event Event) bool {
+	if s.productId != 0 {
+		return event.ProductId == s.productId
+	}
+	return event.UserId == s.userId
+}
+
+// Hub reads the event stream and hands its events to the open streams of
+// this replica. Every replica reads the whole stream.
+type Hub struct {
+	rdb  *redis.Client
+	conf *config.Config
+
+	mu          sync.Mutex
+	subscribers map[*subscriber]bool
+	closed      bool
+}
+
+func NewHub(rdb *redis.Client, conf *config.Config) *Hub {
+	return &Hub{rdb: rdb, conf: conf, subscribers: map[*subscriber]bool{}}
+}
+
+// Run reads the events appended to the stream from now on, until ctx is
+// done.
+func (h *Hub) Run(ctx context.Context) {
+	log := logging.FromContext(ctx)
+
+	last := ""
+	for ctx.Err() == nil {
+		// Reading from the latest entry rather than with $ misses nothing
+		// appended between two reads.
+		if last == "" {
+			entries, err := h.rdb.XRevRangeN(ctx, h.conf.Stream.Key, "+", "-", 1).Result()
+			if err != nil {
+				log.WithError(err).Error("Failed to read event stream")
+				sleep(ctx, retryDelay)
+				continue
+			}
+			last = "0-0"
+			if len(entries) > 0 {
+				last = entries[0].ID
+			}
+		}
+
+		streams, err := h.rdb.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{h.conf.Stream.Key, last},
+			Count:   100,
+			Block:   readBlock,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.WithError(err).Error("Failed to read event stream")
+				sleep(ctx, retryDelay)
+			}
+			continue
+		}
+		for _, stream := range streams {
+			for _, message := range stream.Messages {
+				last = message.ID
+				event, err := parseEvent(message)
+				if err != nil {
+					log.WithError(err).WithField("event_id", message.ID).Error("Failed to decode stream event")
+					continue
+				}
+				h.dispatch(event)
+			}
+		}
+	}
+}
+
+// dispatch hands an event to the streams that want it. A stream too slow to
+// take it is closed; its client reconnects and resumes with Last-Event-ID.
+func (h *Hub) dispatch(event Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subscribers {
+		if !sub.wants(event) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			delete(h.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// subscribe opens a stream for the events of a product, or of the products
+// of a seller when productId is 0. The events channel is closed when the
+// hub drops the stream.
+func (h *Hub) subscribe(productId int64, userId int64) *subscriber {
+	sub := &subscriber{productId: productId, userId: userId, events: make(chan Event, h.conf.Stream.Buffer)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(sub.events)
+		return sub
+	}
+	h.subscribers[sub] = true
+	return sub
+}
+
+func (h *Hub) unsubscribe(sub *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers[sub] {
+		delete(h.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// Close ends every open stream, and those opened later, so that they do not
+// hold up the shutdown of the server.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for sub := range h.subscribers {
+		close(sub.events)
+	}
+	clear(h.subscribers)
+}
+
+// replay reads the events a stream wants that were appended after the one
+// with id lastId. reset tells that the stream no longer holds that event, so
+// some may have been trimmed before they could be replayed.
+func (h *Hub) replay(ctx context.Context, sub *subscriber, lastId string) (events []Event, reset bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, h.conf.Redis.Timeout)
+	defer cancel()
+
+	messages, err := h.rdb.XRange(ctx, h.conf.Stream.Key, lastId, "+").Result()
+	if err != nil {
+		return nil, false, err
+	}
+	if len(messages) > 0 && messages[0].ID != lastId {
+		reset = true
+	}
+	for _, message := range messages {
+		if message.ID == lastId {
+			continue
+		}
+		event, err := parseEvent(message)
+		if err != nil {
+			logging.FromContext(ctx).WithError(err).WithField("event_id", message.ID).Error("Failed to decode stream event")
+			continue
+		}
+		if sub.wants(event) {
+			events = append(events, event)
+		}
+	}
+	return events, reset, nil
+}
+
+func parseEvent(message redis.XMessage) (Event, error) {
+	field := func(name string) string {
+		value, _ := message.Values[name].(string)
+		return value
+	}
+	event := Event{Id: message.ID}
+	event.Type = field("type")
+	var err error
+	if event.ProductId, err = strconv.ParseInt(field("product_id"), 10, 64); err != nil {
+		return event, fmt.Errorf("invalid product_id: %w", err)
+	}
+	if event.UserId, err = strconv.ParseInt(field("user_id"), 10, 64); err != nil {
+		return event, fmt.Errorf("invalid user_id: %w", err)
+	}
+	if event.OccurredAt, err = time.Parse(time.RFC3339Nano, field("occurred_at")); err != nil {
+		return event, fmt.Errorf("invalid occurred_at: %w", err)
+	}
+	return event, nil
+}
+
+// parseId splits a stream entry id, like 1714564800000-0, into its time
+// and sequence number.
+func parseId(id string) (uint64, uint64, bool) {
+	ms, seq, ok := strings.Cut(id, "-")
+	if !ok {
+		return 0, 0, false
+	}
+	msValue, err := strconv.ParseUint(ms, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	seqValue, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return msValue, seqValue, true
+}
+
+// after tells whether the stream entry id a comes after b. Both must be
+// valid.
+func after(a string, b string) bool {
+	aMs, aSeq, _ := parseId(a)
+	bMs, bSeq, _ := parseId(b)
+	return aMs > bMs || aMs == bMs && aSeq > bSeq
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
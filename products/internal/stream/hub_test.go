@@ -0,0 +1,105 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/testutil"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+const sellerSQL = `SELECT "user_id" FROM "products" WHERE id = $1`
+
+func streamConfig() *config.Config {
+	conf := &config.Config{}
+	conf.Redis.Timeout = time.Second
+	conf.Stream.Key = "product_events"
+	conf.Stream.MaxLen = 100
+	return conf
+}
+
+func TestHandleAppendsWithSeller(t *testing.T) {
+	db, mock := testutil.NewDB(t)
+	mock.ExpectQuery(sellerSQL).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(5))
+	mock.ExpectQuery(sellerSQL).WithArgs(2).WillReturnError(errors.New("database is down"))
+	server := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer rdb.Close()
+
+	handle := Handle(db, rdb, streamConfig())
+	occurredAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := handle(context.Background(), types.ProductEvent{Type: types.EventProductUpdated, ProductId: 1, OccurredAt: occurredAt}); err != nil {
+		t.Fatal(err)
+	}
+	if err := handle(context.Background(), types.ProductEvent{Type: types.EventProductUpdated, ProductId: 2, OccurredAt: occurredAt}); err == nil {
+		t.Error("an event whose seller cannot be read was appended")
+	}
+
+	entries, err := server.Stream("product_events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("stream holds %d events, want 1", len(entries))
+	}
+	event, err := parseEvent(redis.XMessage{ID: entries[0].ID, Values: values(entries[0].Values)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.ProductId != 1 || event.UserId != 5 {
+		t.Errorf("event = %+v, want product 1 of seller 5", event)
+	}
+}
+
+func TestHandleFailsWhenStreamIsDown(t *testing.T) {
+	db, mock := testutil.NewDB(t)
+	mock.ExpectQuery(sellerSQL).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(5))
+	server := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr(), MaxRetries: -1})
+	defer rdb.Close()
+	server.Close()
+
+	err := Handle(db, rdb, streamConfig())(context.Background(), types.ProductEvent{Type: types.EventProductUpdated, ProductId: 1, OccurredAt: time.Now()})
+	if err == nil {
+		t.Error("an event the stream did not take was handled")
+	}
+}
+
+func TestHubRunStops(t *testing.T) {
+	server := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer rdb.Close()
+	conf := &config.Config{}
+	conf.Stream.Key = "product_events"
+	hub := NewHub(rdb, conf)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		hub.Run(ctx)
+		close(stopped)
+	}()
+	// Let it block on a read.
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(readBlock + time.Second):
+		t.Fatal("Run did not stop")
+	}
+}
+
+// values turns the field list of a miniredis stream entry into a map.
+func values(fields []string) map[string]interface{} {
+	m := map[string]interface{}{}
+	for i := 0; i+1 < len(fields); i += 2 {
+		m[fields[i]] = fields[i+1]
+	}
+	return m
+}
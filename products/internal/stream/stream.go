@@ -0,0 +1,168 @@
+package stream
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/common/types"
+	"github.com/aiu26/product-management/products/internal/metrics"
+	"github.com/aiu26/product-management/products/internal/utils/request"
+	"github.com/aiu26/product-management/products/internal/utils/response"
+	"gorm.io/gorm"
+)
+
+const (
+	kindProduct = "product"
+	kindUser    = "user"
+)
+
+// ProductEvents streams the events of a product as Server-Sent Events:
+// product.updated, image.compressed and compression.failed.
+func ProductEvents(db *gorm.DB, hub *Hub, conf *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		productId, ok := request.PathId(w, r, "id", response.CodeInvalidProductId, "Invalid product id")
+		if !ok {
+			return
+		}
+		log = log.WithField("product_id", productId)
+		if err := db.WithContext(r.Context()).First(&types.Product{}, productId).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				log.Info("Product not found")
+				response.WriteError(w, r, http.StatusNotFound, response.CodeProductNotFound, "Product not found")
+				return
+			}
+			log.WithError(err).Error("Failed to fetch product")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeStreamFailed, "Error opening event stream")
+			return
+		}
+
+		serve(w, r, hub, conf, kindProduct, hub.subscribe(productId, 0))
+	}
+}
+
+// UserEvents streams the events of every product of a seller, like
+// ProductEvents.
+func UserEvents(db *gorm.DB, hub *Hub, conf *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logging.FromContext(r.Context())
+
+		userId, ok := request.PathId(w, r, "id", response.CodeInvalidUserId, "Invalid user id")
+		if !ok {
+			return
+		}
+		log = log.WithField("user_id", userId)
+		if err := db.WithContext(r.Context()).First(&types.User{}, userId).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				log.Info("User not found")
+				response.WriteError(w, r, http.StatusNotFound, response.CodeUserNotFound, "User not found")
+				return
+			}
+			log.WithError(err).Error("Failed to fetch user")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeStreamFailed, "Error opening event stream")
+			return
+		}
+
+		serve(w, r, hub, conf, kindUser, hub.subscribe(0, userId))
+	}
+}
+
+// serve writes the events of sub until the client goes away or the hub
+// drops the stream. A client sending Last-Event-ID first gets the events it
+// missed, or a reset event when they are no longer kept.
+func serve(w http.ResponseWriter, r *http.Request, hub *Hub, conf *config.Config, kind string, sub *subscriber) {
+	log := logging.FromContext(r.Context())
+	defer hub.unsubscribe(sub)
+
+	// Subscribing before reading the missed events leaves no gap between
+	// them and the live ones.
+	lastId := r.Header.Get("Last-Event-ID")
+	var missed []Event
+	reset := false
+	if lastId != "" {
+		if _, _, ok := parseId(lastId); !ok {
+			log.WithField("last_event_id", lastId).Info("Invalid Last-Event-ID")
+			response.WriteError(w, r, http.StatusBadRequest, response.CodeInvalidLastEventId, "Last-Event-ID must be the id of an event")
+			return
+		}
+		var err error
+		if missed, reset, err = hub.replay(r.Context(), sub, lastId); err != nil {
+			log.WithError(err).Error("Failed to read missed events")
+			response.WriteError(w, r, http.StatusInternalServerError, response.CodeStreamFailed, "Error reading missed events")
+			return
+		}
+	}
+
+	metrics.StreamSubscribers.WithLabelValues(kind).Inc()
+	defer metrics.StreamSubscribers.WithLabelValues(kind).Dec()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Proxies must pass events on as they come.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	controller := http.NewResponseController(w)
+	write := func(chunk string) error {
+		// A stream that keeps writing is not cut off by the server's write
+		// timeout; heartbeats keep idle ones writing.
+		if conf.Server.WriteTimeout > 0 {
+			controller.SetWriteDeadline(time.Now().Add(conf.Server.WriteTimeout))
+		}
+		if _, err := io.WriteString(w, chunk); err != nil {
+			return err
+		}
+		return controller.Flush()
+	}
+
+	var err error
+	if reset {
+		err = write("event: reset\ndata: {}\n\n")
+	} else {
+		err = write(": connected\n\n")
+	}
+	for _, event := range missed {
+		if err != nil {
+			break
+		}
+		err = write(format(event))
+		lastId = event.Id
+	}
+	log.WithField("replayed", len(missed)).Info("Event stream opened")
+
+	heartbeat := time.NewTicker(conf.Stream.Heartbeat)
+	defer heartbeat.Stop()
+	for err == nil {
+		select {
+		case <-r.Context().Done():
+			log.Info("Event stream closed by client")
+			return
+		case event, ok := <-sub.events:
+			if !ok {
+				log.Info("Event stream dropped")
+				return
+			}
+			// Events read before the missed ones may come again.
+			if lastId != "" && !after(event.Id, lastId) {
+				continue
+			}
+			err = write(format(event))
+		case <-heartbeat.C:
+			err = write(": heartbeat\n\n")
+		}
+	}
+	log.WithError(err).Info("Failed to write event")
+}
+
+func format(event Event) string {
+	// Encoding an event does not fail.
+	data, _ := json.Marshal(event)
+	return fmt.Sprintf("id: %s\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data)
+}
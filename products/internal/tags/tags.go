@@ -0,0 +1,66 @@
+package tags
+
+import (
+	"strings"
+
+	"github.com/aiu26/product-management/common/types"
+	"golang.org/x/text/unicode/norm"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Normalize turns labels into tag names: Unicode NFC, lower case, trimmed,
+// with runs of whitespace collapsed to a single space. Duplicates are
+// dropped, keeping the first occurrence; empty names are kept, for the
+// validator to reject.
+func Normalize(labels []string) []string {
+	seen := make(map[string]bool, len(labels))
+	names := make([]string, 0, len(labels))
+	for _, label := range labels {
+		name := strings.Join(strings.Fields(strings.ToLower(norm.NFC.String(label))), " ")
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Assign gives a product the named tags, creating the ones that do not exist
+// yet.
+func Assign(tx *gorm.DB, productId int64, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	created := make([]types.Tag, len(names))
+	for i, name := range names {
+		created[i] = types.Tag{Name: name}
+	}
+	if err := tx.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "name"}}, DoNothing: true}).Create(&created).Error; err != nil {
+		return err
+	}
+
+	var ids []int64
+	if err := tx.Model(&types.Tag{}).Where("name IN ?", names).Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	rows := make([]map[string]interface{}, len(ids))
+	for i, id := range ids {
+		rows[i] = map[string]interface{}{"product_id": productId, "tag_id": id}
+	}
+	return tx.Table("product_tags").Create(rows).Error
+}
+
+// Matching is a subquery of the IDs of the products with any of the named
+// tags, or with all of them when all is set.
+func Matching(db *gorm.DB, names []string, all bool) *gorm.DB {
+	query := db.Table("product_tags").
+		Select("product_tags.product_id").
+		Joins("JOIN tags ON tags.id = product_tags.tag_id").
+		Where("tags.name IN ?", names)
+	if all {
+		query = query.Group("product_tags.product_id").Having("count(*) = ?", len(names))
+	}
+	return query
+}
@@ -0,0 +1,74 @@
+package request
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ETag is the strong entity tag of a resource at the given version.
+func ETag(version int64) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// SetValidators adds the ETag and Last-Modified headers of a resource.
+func SetValidators(w http.ResponseWriter, etag string, modified time.Time) {
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+}
+
+func etagList(header string) []string {
+	var etags []string
+	for _, etag := range strings.Split(header, ",") {
+		if etag = strings.TrimSpace(etag); etag != "" {
+			etags = append(etags, etag)
+		}
+	}
+	return etags
+}
+
+// NotModified reports whether a GET can be answered with 304. If-None-Match
+// uses weak comparison and takes precedence over If-Modified-Since.
+func NotModified(r *http.Request, etag string, modified time.Time) bool {
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		for _, candidate := range etagList(header) {
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modified.IsZero() {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(since)
+}
+
+// WriteNotModified answers 304 with the resource's validators.
+func WriteNotModified(w http.ResponseWriter, etag string, modified time.Time) {
+	SetValidators(w, etag, modified)
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// IfMatch returns the entity tags listed in If-Match, and whether the header
+// was sent at all. "*" matches any current version. Weak tags never match,
+// as If-Match uses strong comparison.
+func IfMatch(r *http.Request) ([]string, bool) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return nil, false
+	}
+
+	var etags []string
+	for _, etag := range etagList(header) {
+		if !strings.HasPrefix(etag, "W/") {
+			etags = append(etags, etag)
+		}
+	}
+	return etags, true
+}
@@ -0,0 +1,189 @@
+package request
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/products/internal/metrics"
+	"github.com/aiu26/product-management/products/internal/utils/response"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	ReplayedHeader       = "Idempotent-Replayed"
+)
+
+// replayedHeaders are the response headers stored alongside the body.
+var replayedHeaders = []string{"Content-Type", "Content-Language", "Location", "ETag", "Last-Modified"}
+
+// idempotencyRecord is stored in Redis under the key. Until the first request
+// finishes it only holds the request hash, and expires after a lease so a
+// crashed request does not block its key forever.
+type idempotencyRecord struct {
+	Hash   string      `json:"hash"`
+	Done   bool        `json:"done"`
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// bodyRecorder passes the response through while keeping a copy of it.
+type bodyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *bodyRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *bodyRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *bodyRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Idempotency makes retries of a mutation safe. The first request with a
+// given Idempotency-Key runs normally and its response is kept for
+// server.idempotency_ttl; retries with the same body get that response
+// replayed, retries with a different body get a 409, and a retry that arrives
+// while the first request is still running gets a 409 asking to retry later.
+// Server errors are not kept, so the client can retry them. Requests without
+// the header are not affected.
+func Idempotency(rdb *redis.Client, conf *config.Config) Middleware {
+	lease := conf.Server.MutationTimeout + conf.Redis.Timeout
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(IdempotencyKeyHeader)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			log := logging.FromContext(r.Context()).WithField("idempotency_key", key)
+			outcome := func(outcome string) {
+				metrics.IdempotentRequests.WithLabelValues(r.Pattern, outcome).Inc()
+			}
+
+			if !validRequestID(key) {
+				response.WriteError(w, r, http.StatusBadRequest, response.CodeInvalidIdempotencyKey, "Idempotency-Key must be 1 to 128 printable ASCII characters")
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				log.WithError(err).Info("Failed to read request body")
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					response.WriteError(w, r, http.StatusRequestEntityTooLarge, response.CodeRequestTooLarge, fmt.Sprintf("Request body must not exceed %d bytes", maxBytesErr.Limit))
+					return
+				}
+				response.WriteError(w, r, http.StatusBadRequest, response.CodeInvalidRequestBody, "Invalid request")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			sum := sha256.Sum256(body)
+			hash := hex.EncodeToString(sum[:])
+			// Keys are scoped to the route, so the same key can be used
+			// against different endpoints.
+			redisKey := "idempotency:" + r.Pattern + ":" + key
+
+			ctx, cancel := context.WithTimeout(r.Context(), conf.Redis.Timeout)
+			defer cancel()
+			claim, _ := json.Marshal(idempotencyRecord{Hash: hash})
+			claimed, err := rdb.SetNX(ctx, redisKey, claim, lease).Result()
+			if err != nil {
+				outcome(metrics.ResultError)
+				log.WithError(err).Error("Failed to claim idempotency key")
+				response.WriteError(w, r, http.StatusServiceUnavailable, response.CodeIdempotencyUnavailable, "Idempotency key could not be checked, retry later")
+				return
+			}
+
+			if !claimed {
+				var stored idempotencyRecord
+				val, err := rdb.Get(ctx, redisKey).Bytes()
+				if err == nil {
+					err = json.Unmarshal(val, &stored)
+				}
+				if err != nil {
+					// redis.Nil means the key expired in between, which a
+					// retry resolves.
+					outcome(metrics.ResultError)
+					log.WithError(err).Error("Failed to load idempotency record")
+					response.WriteError(w, r, http.StatusServiceUnavailable, response.CodeIdempotencyUnavailable, "Idempotency key could not be checked, retry later")
+					return
+				}
+
+				switch {
+				case stored.Hash != hash:
+					outcome(metrics.OutcomeConflict)
+					log.Info("Idempotency key reused with a different body")
+					response.WriteError(w, r, http.StatusConflict, response.CodeIdempotencyKeyReused, "Idempotency-Key was already used with a different request body")
+				case !stored.Done:
+					outcome(metrics.OutcomeInProgress)
+					log.Info("Request with idempotency key still in progress")
+					w.Header().Set("Retry-After", "1")
+					response.WriteError(w, r, http.StatusConflict, response.CodeIdempotencyKeyInProgress, "A request with this Idempotency-Key is still being processed")
+				default:
+					outcome(metrics.OutcomeReplayed)
+					log.Info("Replaying stored response")
+					for name, values := range stored.Header {
+						w.Header()[name] = values
+					}
+					w.Header().Set(ReplayedHeader, "true")
+					w.WriteHeader(stored.Status)
+					w.Write(stored.Body)
+				}
+				return
+			}
+			outcome(metrics.OutcomeNew)
+
+			recorder := &bodyRecorder{ResponseWriter: w}
+			next.ServeHTTP(recorder, r)
+
+			// The request context may be done by now, but the outcome must
+			// still be recorded.
+			ctx, cancel = context.WithTimeout(context.WithoutCancel(r.Context()), conf.Redis.Timeout)
+			defer cancel()
+			if recorder.status == 0 || recorder.status >= http.StatusInternalServerError {
+				if err := rdb.Del(ctx, redisKey).Err(); err != nil {
+					log.WithError(err).Error("Failed to release idempotency key")
+				}
+				return
+			}
+
+			stored := idempotencyRecord{Hash: hash, Done: true, Status: recorder.status, Header: http.Header{}}
+			for _, name := range replayedHeaders {
+				if values := w.Header().Values(name); len(values) > 0 {
+					stored.Header[name] = values
+				}
+			}
+			stored.Body = recorder.body.Bytes()
+			val, _ := json.Marshal(stored)
+			if err := rdb.Set(ctx, redisKey, val, conf.Server.IdempotencyTTL).Err(); err != nil {
+				log.WithError(err).Error("Failed to store idempotent response")
+			}
+		})
+	}
+}
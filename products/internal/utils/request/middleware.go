@@ -0,0 +1,159 @@
+package request
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/products/internal/utils/response"
+	"github.com/sirupsen/logrus"
+)
+
+// Middleware wraps a handler with cross-cutting behaviour.
+type Middleware func(http.Handler) http.Handler
+
+// Chain applies middlewares so that the first one is the outermost.
+func Chain(h http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// Route applies per-route middlewares to a handler func, for use with
+// router.Handle.
+func Route(h http.HandlerFunc, middlewares ...Middleware) http.Handler {
+	return Chain(h, middlewares...)
+}
+
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// RequestIDFromContext returns the ID assigned by the RequestID middleware.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestID keeps the caller's X-Request-ID, or generates one, and echoes it
+// on the response and in the request context.
+func RequestID() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(RequestIDHeader)
+			if !validRequestID(id) {
+				id = newRequestID()
+			}
+			w.Header().Set(RequestIDHeader, id)
+
+			ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+			ctx = logging.WithField(ctx, "request_id", id)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// Recover turns a panicking handler into a 500 problem response instead of a
+// dropped connection.
+func Recover() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			recorder := newStatusRecorder(w)
+			defer func() {
+				recovered := recover()
+				if recovered == nil {
+					return
+				}
+				if recovered == http.ErrAbortHandler {
+					panic(recovered)
+				}
+
+				logging.FromContext(r.Context()).WithFields(logrus.Fields{
+					"panic": recovered,
+					"stack": string(debug.Stack()),
+				}).Error("Handler panicked")
+				if !recorder.wroteHeader {
+					response.WriteError(recorder, r, http.StatusInternalServerError, response.CodeInternalError, "Internal server error")
+				}
+			}()
+			next.ServeHTTP(recorder, r)
+		})
+	}
+}
+
+// MaxBytes limits the request body size. Reading past the limit fails with
+// *http.MaxBytesError.
+func MaxBytes(limit int64) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Timeout sets a deadline on the request context, which database and cache
+// calls honour. If the handler gives up without answering, the client gets a
+// 504.
+func Timeout(d time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+
+			recorder := newStatusRecorder(w)
+			next.ServeHTTP(recorder, r.WithContext(ctx))
+
+			if !recorder.wroteHeader && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				response.WriteError(recorder, r, http.StatusGatewayTimeout, response.CodeRequestTimeout, "Request timed out")
+			}
+		})
+	}
+}
+
+// AccessLog writes one structured line per request.
+func AccessLog() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			recorder := newStatusRecorder(w)
+			start := time.Now()
+			next.ServeHTTP(recorder, r)
+
+			// The router sets r.Pattern on this request once it has matched.
+			logging.FromContext(r.Context()).WithFields(logrus.Fields{
+				"route":       r.Pattern,
+				"method":      r.Method,
+				"path":        r.URL.Path,
+				"status":      recorder.status,
+				"bytes":       recorder.bytes,
+				"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+				"remote_addr": r.RemoteAddr,
+				"user_agent":  r.UserAgent(),
+			}).Info("Request handled")
+		})
+	}
+}
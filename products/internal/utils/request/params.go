@@ -0,0 +1,59 @@
+package request
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/products/internal/utils/response"
+)
+
+// PathId reads the ID of the path value name, answering 400 with code and
+// detail when it is not a number.
+func PathId(w http.ResponseWriter, r *http.Request, name string, code string, detail string) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue(name), 10, 64)
+	if err != nil {
+		logging.FromContext(r.Context()).WithError(err).Info(detail)
+		response.WriteError(w, r, http.StatusBadRequest, code, detail)
+		return 0, false
+	}
+	return id, true
+}
+
+// Decode reads the JSON request body into payload, answering the request
+// when it cannot.
+func Decode(w http.ResponseWriter, r *http.Request, payload interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(payload); err != nil {
+		logging.FromContext(r.Context()).WithError(err).Info("Failed to decode request body")
+		writeBodyError(w, r, err)
+		return false
+	}
+	return true
+}
+
+// ReadBody reads the whole request body, answering the request when it
+// cannot.
+func ReadBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		logging.FromContext(r.Context()).WithError(err).Info("Failed to read request body")
+		writeBodyError(w, r, err)
+		return nil, false
+	}
+	return data, true
+}
+
+// writeBodyError answers a request whose body could not be read: 413 when
+// it is too large, 400 otherwise.
+func writeBodyError(w http.ResponseWriter, r *http.Request, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		response.WriteError(w, r, http.StatusRequestEntityTooLarge, response.CodeRequestTooLarge, fmt.Sprintf("Request body must not exceed %d bytes", maxBytesErr.Limit))
+		return
+	}
+	response.WriteError(w, r, http.StatusBadRequest, response.CodeInvalidRequestBody, "Invalid request")
+}
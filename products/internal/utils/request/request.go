@@ -2,16 +2,64 @@ package request
 
 import (
 	"net/http"
+	"strconv"
 	"time"
 
-	"github.com/sirupsen/logrus"
+	"github.com/aiu26/product-management/common/logging"
+	"github.com/aiu26/product-management/products/internal/metrics"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	return &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Timer records the route's latency histogram, names the request span after
+// the route pattern and adds the route to the request logger.
 func Timer(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		logrus.Info(r.Method, r.URL.Path)
+		span := trace.SpanFromContext(r.Context())
+		span.SetName(r.Pattern)
+		span.SetAttributes(semconv.HTTPRoute(r.Pattern))
+
+		metrics.RequestsInFlight.Inc()
+		defer metrics.RequestsInFlight.Dec()
+
+		r = r.WithContext(logging.WithField(r.Context(), "route", r.Pattern))
+
+		recorder := newStatusRecorder(w)
 		start := time.Now()
-		h(w, r)
-		logrus.Infof("Request took %s", time.Since(start))
+		h(recorder, r)
+		duration := time.Since(start)
+
+		// r.Pattern keeps the route label bounded, e.g. "GET /products/{id}".
+		metrics.RequestDuration.WithLabelValues(r.Pattern, r.Method, strconv.Itoa(recorder.status)).Observe(duration.Seconds())
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,179 @@
+package response
+
+// Error codes are part of the API contract: clients match on them, so they
+// must never be renamed. Each one is documented in docs/errors.md.
+const (
+	CodeInternalError           = "INTERNAL_ERROR"
+	CodeRequestTimeout          = "REQUEST_TIMEOUT"
+	CodeInvalidRequestBody      = "INVALID_REQUEST_BODY"
+	CodeRequestTooLarge         = "REQUEST_TOO_LARGE"
+	CodeValidationFailed        = "VALIDATION_FAILED"
+	CodeMissingUserId           = "MISSING_USER_ID"
+	CodeInvalidUserId           = "INVALID_USER_ID"
+	CodeUserNotFound            = "USER_NOT_FOUND"
+	CodeInvalidMinPrice         = "INVALID_MIN_PRICE"
+	CodeInvalidMaxPrice         = "INVALID_MAX_PRICE"
+	CodeInvalidPriceRange       = "INVALID_PRICE_RANGE"
+	CodeInvalidCurrency         = "INVALID_CURRENCY"
+	CodeInvalidProductId        = "INVALID_PRODUCT_ID"
+	CodeInvalidProductIds       = "INVALID_PRODUCT_IDS"
+	CodeProductNotFound         = "PRODUCT_NOT_FOUND"
+	CodeProductCreateFailed     = "PRODUCT_CREATE_FAILED"
+	CodeProductFetchFailed      = "PRODUCT_FETCH_FAILED"
+	CodeProductUpdateFailed     = "PRODUCT_UPDATE_FAILED"
+	CodePreconditionRequired    = "PRECONDITION_REQUIRED"
+	CodePreconditionFailed      = "PRECONDITION_FAILED"
+	CodeProductNotDeleted       = "PRODUCT_NOT_DELETED"
+	CodeInvalidIncludeDeleted   = "INVALID_INCLUDE_DELETED"
+	CodeInvalidSort             = "INVALID_SORT"
+	CodeAdminRequired           = "ADMIN_REQUIRED"
+	CodeInvalidCategoryId       = "INVALID_CATEGORY_ID"
+	CodeInvalidCategory         = "INVALID_CATEGORY"
+	CodeInvalidCategoryParent   = "INVALID_CATEGORY_PARENT"
+	CodeCategoryNotFound        = "CATEGORY_NOT_FOUND"
+	CodeCategoryHasChildren     = "CATEGORY_HAS_CHILDREN"
+	CodeCategorySlugTaken       = "CATEGORY_SLUG_TAKEN"
+	CodeCategoryFetchFailed     = "CATEGORY_FETCH_FAILED"
+	CodeCategoryUpdateFailed    = "CATEGORY_UPDATE_FAILED"
+	CodeInvalidTagMatch         = "INVALID_TAG_MATCH"
+	CodeInvalidFacets           = "INVALID_FACETS"
+	CodeInvalidAttributeFilter  = "INVALID_ATTRIBUTE_FILTER"
+	CodeInvalidScheduleId       = "INVALID_SCHEDULE_ID"
+	CodeScheduleNotFound        = "SCHEDULE_NOT_FOUND"
+	CodeScheduleOverlap         = "SCHEDULE_OVERLAP"
+	CodeScheduleFinished        = "SCHEDULE_FINISHED"
+	CodeRateNotFound            = "RATE_NOT_FOUND"
+	CodeRateOutdated            = "RATE_OUTDATED"
+	CodeRateFetchFailed         = "RATE_FETCH_FAILED"
+	CodeRateUpdateFailed        = "RATE_UPDATE_FAILED"
+	CodeInvalidVariantId        = "INVALID_VARIANT_ID"
+	CodeVariantNotFound         = "VARIANT_NOT_FOUND"
+	CodeVariantExists           = "VARIANT_EXISTS"
+	CodeVariantSkuTaken         = "VARIANT_SKU_TAKEN"
+	CodeVariantUpdateFailed     = "VARIANT_UPDATE_FAILED"
+	CodeInvalidInStock          = "INVALID_IN_STOCK"
+	CodeStockOnVariants         = "STOCK_ON_VARIANTS"
+	CodeStockReserved           = "STOCK_RESERVED"
+	CodeStockUpdateFailed       = "STOCK_UPDATE_FAILED"
+	CodeInsufficientStock       = "INSUFFICIENT_STOCK"
+	CodeInvalidReservationId    = "INVALID_RESERVATION_ID"
+	CodeReservationNotFound     = "RESERVATION_NOT_FOUND"
+	CodeReservationExpired      = "RESERVATION_EXPIRED"
+	CodeReservationClosed       = "RESERVATION_CLOSED"
+	CodeUnsupportedImportFormat = "UNSUPPORTED_IMPORT_FORMAT"
+	CodeInvalidDryRun           = "INVALID_DRY_RUN"
+	CodeInvalidImport           = "INVALID_IMPORT"
+	CodeInvalidImportId         = "INVALID_IMPORT_ID"
+	CodeImportNotFound          = "IMPORT_NOT_FOUND"
+	CodeImportCreateFailed      = "IMPORT_CREATE_FAILED"
+	CodeImportFetchFailed       = "IMPORT_FETCH_FAILED"
+	CodeUnsupportedExportFormat = "UNSUPPORTED_EXPORT_FORMAT"
+	CodeExportFailed            = "EXPORT_FAILED"
+	CodeExportsUnavailable      = "EXPORTS_UNAVAILABLE"
+	CodeInvalidExportId         = "INVALID_EXPORT_ID"
+	CodeExportNotFound          = "EXPORT_NOT_FOUND"
+	CodeExportCreateFailed      = "EXPORT_CREATE_FAILED"
+	CodeExportFetchFailed       = "EXPORT_FETCH_FAILED"
+	CodeFeedsUnavailable        = "FEEDS_UNAVAILABLE"
+	CodeFeedNotFound            = "FEED_NOT_FOUND"
+	CodeFeedFailed              = "FEED_FAILED"
+	CodeInvalidLastEventId      = "INVALID_LAST_EVENT_ID"
+	CodeStreamFailed            = "STREAM_FAILED"
+
+	CodeInvalidIdempotencyKey    = "INVALID_IDEMPOTENCY_KEY"
+	CodeIdempotencyKeyReused     = "IDEMPOTENCY_KEY_REUSED"
+	CodeIdempotencyKeyInProgress = "IDEMPOTENCY_KEY_IN_PROGRESS"
+	CodeIdempotencyUnavailable   = "IDEMPOTENCY_UNAVAILABLE"
+)
+
+var titles = map[string]string{
+	CodeInternalError:           "Internal server error",
+	CodeRequestTimeout:          "Request timed out",
+	CodeInvalidRequestBody:      "Invalid request body",
+	CodeRequestTooLarge:         "Request body too large",
+	CodeValidationFailed:        "Validation failed",
+	CodeMissingUserId:           "Missing user ID",
+	CodeInvalidUserId:           "Invalid user ID",
+	CodeUserNotFound:            "User not found",
+	CodeInvalidMinPrice:         "Invalid minimum price",
+	CodeInvalidMaxPrice:         "Invalid maximum price",
+	CodeInvalidPriceRange:       "Invalid price range",
+	CodeInvalidCurrency:         "Invalid currency",
+	CodeInvalidProductId:        "Invalid product ID",
+	CodeInvalidProductIds:       "Invalid product IDs",
+	CodeProductNotFound:         "Product not found",
+	CodeProductCreateFailed:     "Product could not be created",
+	CodeProductFetchFailed:      "Product could not be fetched",
+	CodeProductUpdateFailed:     "Product could not be updated",
+	CodePreconditionRequired:    "Precondition required",
+	CodePreconditionFailed:      "Precondition failed",
+	CodeProductNotDeleted:       "Product is not deleted",
+	CodeInvalidIncludeDeleted:   "Invalid include_deleted parameter",
+	CodeInvalidSort:             "Invalid sort parameter",
+	CodeAdminRequired:           "Admin token required",
+	CodeInvalidCategoryId:       "Invalid category ID",
+	CodeInvalidCategory:         "Invalid category",
+	CodeInvalidCategoryParent:   "Invalid parent category",
+	CodeCategoryNotFound:        "Category not found",
+	CodeCategoryHasChildren:     "Category has children",
+	CodeCategorySlugTaken:       "Category slug taken",
+	CodeCategoryFetchFailed:     "Categories could not be fetched",
+	CodeCategoryUpdateFailed:    "Categories could not be updated",
+	CodeInvalidTagMatch:         "Invalid tag_match parameter",
+	CodeInvalidFacets:           "Invalid facets parameter",
+	CodeInvalidAttributeFilter:  "Invalid attribute filter",
+	CodeInvalidScheduleId:       "Invalid schedule ID",
+	CodeScheduleNotFound:        "Price schedule not found",
+	CodeScheduleOverlap:         "Price schedules overlap",
+	CodeScheduleFinished:        "Price schedule already finished",
+	CodeRateNotFound:            "Exchange rate not found",
+	CodeRateOutdated:            "Exchange rate outdated",
+	CodeRateFetchFailed:         "Exchange rates could not be fetched",
+	CodeRateUpdateFailed:        "Exchange rates could not be stored",
+	CodeInvalidVariantId:        "Invalid variant ID",
+	CodeVariantNotFound:         "Variant not found",
+	CodeVariantExists:           "Variant already exists",
+	CodeVariantSkuTaken:         "SKU taken",
+	CodeVariantUpdateFailed:     "Variant could not be changed",
+	CodeInvalidInStock:          "Invalid in_stock parameter",
+	CodeStockOnVariants:         "Stock is kept on variants",
+	CodeStockReserved:           "Stock is reserved",
+	CodeStockUpdateFailed:       "Stock could not be changed",
+	CodeInsufficientStock:       "Insufficient stock",
+	CodeInvalidReservationId:    "Invalid reservation ID",
+	CodeReservationNotFound:     "Reservation not found",
+	CodeReservationExpired:      "Reservation expired",
+	CodeReservationClosed:       "Reservation closed",
+	CodeUnsupportedImportFormat: "Unsupported import format",
+	CodeInvalidDryRun:           "Invalid dry_run parameter",
+	CodeInvalidImport:           "Invalid import",
+	CodeInvalidImportId:         "Invalid import ID",
+	CodeImportNotFound:          "Import not found",
+	CodeImportCreateFailed:      "Import could not be created",
+	CodeImportFetchFailed:       "Import could not be fetched",
+	CodeUnsupportedExportFormat: "Unsupported export format",
+	CodeExportFailed:            "Export failed",
+	CodeExportsUnavailable:      "Background exports unavailable",
+	CodeInvalidExportId:         "Invalid export ID",
+	CodeExportNotFound:          "Export not found",
+	CodeExportCreateFailed:      "Export could not be created",
+	CodeExportFetchFailed:       "Export could not be fetched",
+	CodeFeedsUnavailable:        "Feeds unavailable",
+	CodeFeedNotFound:            "Feed not found",
+	CodeFeedFailed:              "Feed could not be served",
+	CodeInvalidLastEventId:      "Invalid Last-Event-ID",
+	CodeStreamFailed:            "Event stream failed",
+
+	CodeInvalidIdempotencyKey:    "Invalid idempotency key",
+	CodeIdempotencyKeyReused:     "Idempotency key reused",
+	CodeIdempotencyKeyInProgress: "Request with this idempotency key in progress",
+	CodeIdempotencyUnavailable:   "Idempotency store unavailable",
+}
+
+// Title returns the short, human readable summary of an error code.
+func Title(code string) string {
+	if title, ok := titles[code]; ok {
+		return title
+	}
+	return "Error"
+}
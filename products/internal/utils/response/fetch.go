@@ -0,0 +1,22 @@
+package response
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/aiu26/product-management/common/logging"
+	"gorm.io/gorm"
+)
+
+// WriteProductFetchError answers a request whose product could not be read:
+// 404 when it does not exist, 500 otherwise.
+func WriteProductFetchError(w http.ResponseWriter, r *http.Request, err error) {
+	log := logging.FromContext(r.Context())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Info("Product not found")
+		WriteError(w, r, http.StatusNotFound, CodeProductNotFound, "Product not found")
+		return
+	}
+	log.WithError(err).Error("Failed to fetch product")
+	WriteError(w, r, http.StatusInternalServerError, CodeProductFetchFailed, "Error fetching product")
+}
@@ -2,44 +2,101 @@ package response
 
 import (
 	"encoding/json"
-	"fmt"
+	"mime"
 	"net/http"
-	"reflect"
+	"strings"
+)
+
+const (
+	ErrorFormatProblem = "problem"
+	ErrorFormatLegacy  = "legacy"
 
-	"github.com/go-playground/validator"
+	problemContentType = "application/problem+json"
+	problemTypeBase    = "https://github.com/aiu26/product-management/blob/main/docs/errors.md#"
 )
 
+// errorFormat is set once at startup. In legacy mode errors keep the
+// original {"error": ...} / {"errors": {...}} shape, unless the client asks
+// for application/problem+json.
+var errorFormat = ErrorFormatProblem
+
+func SetErrorFormat(format string) {
+	errorFormat = format
+}
+
+// Problem is an RFC 7807 problem details object. Code is a stable, machine
+// readable identifier; Errors holds field level validation messages.
+type Problem struct {
+	Type     string            `json:"type"`
+	Title    string            `json:"title"`
+	Status   int               `json:"status"`
+	Detail   string            `json:"detail,omitempty"`
+	Instance string            `json:"instance,omitempty"`
+	Code     string            `json:"code"`
+	Errors   map[string]string `json:"errors,omitempty"`
+}
+
 func WriteJson(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(data)
 }
 
-func WriteError(w http.ResponseWriter, status int, message interface{}) {
-	errKey := "error"
-	if reflect.TypeOf(message).Kind() == reflect.Map {
-		errKey = "errors"
+func wantsProblem(r *http.Request) bool {
+	if errorFormat != ErrorFormatLegacy {
+		return true
+	}
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err == nil && mediaType == problemContentType {
+			return true
+		}
 	}
-	WriteJson(w, status, map[string]interface{}{errKey: message})
-}
-
-func WriteValidationErrors(w http.ResponseWriter, errors error, args interface{}) {
-	valErrors := errors.(validator.ValidationErrors)
-	errRes := make(map[string]string)
-	for _, err := range valErrors {
-		fieldName := err.Field()
-		field, _ := reflect.TypeOf(args).FieldByName(fieldName)
-		fmt.Println(field)
-		fieldJSONName, _ := field.Tag.Lookup("json")
-
-		switch err.ActualTag() {
-		case "required":
-			errRes[fieldJSONName] = fmt.Sprintf("%s is required", fieldJSONName)
-		case "gt":
-			errRes[fieldJSONName] = fmt.Sprintf("%s must be greater than %s", fieldJSONName, err.Param())
-		default:
-			errRes[fieldJSONName] = fmt.Sprintf("%s is not valid", fieldJSONName)
+	return false
+}
+
+func WriteProblem(w http.ResponseWriter, r *http.Request, problem Problem) {
+	if !wantsProblem(r) {
+		if len(problem.Errors) > 0 {
+			WriteJson(w, problem.Status, map[string]interface{}{"errors": problem.Errors})
+		} else {
+			WriteJson(w, problem.Status, map[string]interface{}{"error": problem.Detail})
 		}
+		return
 	}
-	WriteError(w, http.StatusBadRequest, errRes)
-}
\ No newline at end of file
+
+	problem = Complete(r, problem)
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// Complete fills in the type, title and instance of a problem from its code
+// and the request, for problems sent inside other responses.
+func Complete(r *http.Request, problem Problem) Problem {
+	if problem.Type == "" {
+		problem.Type = problemTypeBase + strings.ToLower(problem.Code)
+	}
+	if problem.Title == "" {
+		problem.Title = Title(problem.Code)
+	}
+	if problem.Instance == "" {
+		problem.Instance = r.URL.RequestURI()
+	}
+	return problem
+}
+
+func WriteError(w http.ResponseWriter, r *http.Request, status int, code string, detail string) {
+	WriteProblem(w, r, Problem{Status: status, Code: code, Detail: detail})
+}
+
+// WriteValidationErrors answers 400 with one message per invalid field,
+// keyed by the field's JSON name.
+func WriteValidationErrors(w http.ResponseWriter, r *http.Request, fields map[string]string) {
+	WriteProblem(w, r, Problem{
+		Status: http.StatusBadRequest,
+		Code:   CodeValidationFailed,
+		Detail: "The request body failed validation",
+		Errors: fields,
+	})
+}
@@ -0,0 +1,257 @@
+package validation
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/aiu26/product-management/common/config"
+	"github.com/aiu26/product-management/common/money"
+	"github.com/aiu26/product-management/products/internal/attributes"
+	"github.com/go-playground/locales"
+	"github.com/go-playground/locales/en"
+	"github.com/go-playground/locales/es"
+	"github.com/go-playground/locales/fr"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	en_translations "github.com/go-playground/validator/v10/translations/en"
+	es_translations "github.com/go-playground/validator/v10/translations/es"
+	fr_translations "github.com/go-playground/validator/v10/translations/fr"
+	"github.com/shopspring/decimal"
+	"golang.org/x/text/language"
+)
+
+// catalog holds a supported locale with its built-in validator messages and
+// the messages for the custom tags. {0} is the field, {1} the tag parameter.
+type catalog struct {
+	locale       locales.Translator
+	register     func(*validator.Validate, ut.Translator) error
+	translations map[string]string
+}
+
+// The first catalog is the fallback.
+var catalogs = []catalog{
+	{
+		locale:   en.New(),
+		register: en_translations.RegisterDefaultTranslations,
+		translations: map[string]string{
+			"currency":  "{0} must be a supported ISO 4217 currency code",
+			"money":     "{0} must be a positive amount with no more decimal places than its currency allows",
+			"rate":      "{0} must be a positive number below 1000000000000 with at most 12 decimal places",
+			"imagehost": "{0} must be an http or https URL on an allowed image host",
+			"slug":      "{0} must only contain lowercase letters, digits and single hyphens between them, with at least one letter",
+			"attrname":  "{0} must start with a lowercase letter followed by up to 49 lowercase letters, digits or underscores",
+			"sku":       "{0} must start with a letter or digit followed by letters, digits, dots, hyphens or underscores",
+		},
+	},
+	{
+		locale:   es.New(),
+		register: es_translations.RegisterDefaultTranslations,
+		translations: map[string]string{
+			"currency":  "{0} debe ser un código de moneda ISO 4217 admitido",
+			"money":     "{0} debe ser un importe positivo sin más decimales de los que permite su moneda",
+			"rate":      "{0} debe ser un número positivo menor que 1000000000000 con 12 decimales como máximo",
+			"imagehost": "{0} debe ser una URL http o https de un servidor de imágenes permitido",
+			"slug":      "{0} solo puede contener letras minúsculas, dígitos y guiones simples entre ellos, con al menos una letra",
+			"attrname":  "{0} debe empezar por una letra minúscula seguida de hasta 49 letras minúsculas, dígitos o guiones bajos",
+			"sku":       "{0} debe empezar por una letra o un dígito seguido de letras, dígitos, puntos, guiones o guiones bajos",
+		},
+	},
+	{
+		locale:   fr.New(),
+		register: fr_translations.RegisterDefaultTranslations,
+		translations: map[string]string{
+			"currency":  "{0} doit être un code de devise ISO 4217 pris en charge",
+			"money":     "{0} doit être un montant positif sans plus de décimales que sa devise n'en autorise",
+			"rate":      "{0} doit être un nombre positif inférieur à 1000000000000 avec au plus 12 décimales",
+			"imagehost": "{0} doit être une URL http ou https d'un hôte d'images autorisé",
+			"slug":      "{0} ne doit contenir que des lettres minuscules, des chiffres et des tirets simples entre eux, dont au moins une lettre",
+			"attrname":  "{0} doit commencer par une lettre minuscule suivie d'au plus 49 lettres minuscules, chiffres ou tirets bas",
+			"sku":       "{0} doit commencer par une lettre ou un chiffre suivi de lettres, chiffres, points, tirets ou tirets bas",
+		},
+	},
+}
+
+// Validator wraps a single validator.Validate, which caches struct metadata
+// and is safe for concurrent use, together with its translations.
+type Validator struct {
+	validate *validator.Validate
+	uni      *ut.UniversalTranslator
+	hosts    []string
+}
+
+func New(conf config.ValidationConfig) (*Validator, error) {
+	v := &Validator{validate: validator.New(validator.WithRequiredStructEnabled())}
+	for _, host := range conf.AllowedImageHosts {
+		v.hosts = append(v.hosts, strings.ToLower(host))
+	}
+
+	// Report fields by their JSON names, e.g. product_images[2].
+	v.validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	if err := v.validate.RegisterValidation("currency", currency); err != nil {
+		return nil, err
+	}
+	if err := v.validate.RegisterValidation("money", amount); err != nil {
+		return nil, err
+	}
+	if err := v.validate.RegisterValidation("rate", rate); err != nil {
+		return nil, err
+	}
+	if err := v.validate.RegisterValidation("slug", slug); err != nil {
+		return nil, err
+	}
+	if err := v.validate.RegisterValidation("attrname", attrName); err != nil {
+		return nil, err
+	}
+	if err := v.validate.RegisterValidation("sku", sku); err != nil {
+		return nil, err
+	}
+	if err := v.validate.RegisterValidation("imagehost", v.imageHost); err != nil {
+		return nil, err
+	}
+
+	fallback := catalogs[0].locale
+	v.uni = ut.New(fallback, fallback)
+	for _, lang := range catalogs {
+		if lang.locale != fallback {
+			if err := v.uni.AddTranslator(lang.locale, true); err != nil {
+				return nil, err
+			}
+		}
+		trans, _ := v.uni.GetTranslator(lang.locale.Locale())
+		if err := lang.register(v.validate, trans); err != nil {
+			return nil, err
+		}
+		for tag, text := range lang.translations {
+			err := v.validate.RegisterTranslation(tag, trans, func(trans ut.Translator) error {
+				return trans.Add(tag, text, true)
+			}, func(trans ut.Translator, fe validator.FieldError) string {
+				message, _ := trans.T(fe.Tag(), fe.Field(), fe.Param())
+				return message
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
+func (v *Validator) Struct(s interface{}) error {
+	return v.validate.Struct(s)
+}
+
+// Translate turns validation errors into field messages in the best language
+// from an Accept-Language header, falling back to English. It also returns
+// the locale used, for Content-Language.
+func (v *Validator) Translate(err error, acceptLanguage string) (map[string]string, string) {
+	var bases []string
+	tags, _, _ := language.ParseAcceptLanguage(acceptLanguage)
+	for _, tag := range tags {
+		base, _ := tag.Base()
+		bases = append(bases, base.String())
+	}
+	trans, _ := v.uni.FindTranslator(bases...)
+
+	messages := make(map[string]string)
+	var valErrors validator.ValidationErrors
+	if errors.As(err, &valErrors) {
+		for _, fe := range valErrors {
+			// Nested fields are keyed by their path below the payload, like
+			// attributes[color].type.
+			_, field, _ := strings.Cut(fe.Namespace(), ".")
+			messages[field] = fe.Translate(trans)
+		}
+	}
+	return messages, trans.Locale()
+}
+
+func currency(fl validator.FieldLevel) bool {
+	return money.Supported(fl.Field().String())
+}
+
+// maxAmount is the bound of the numeric(19,4) price column.
+var maxAmount = decimal.New(1, 15)
+
+// amount accepts a positive decimal.Decimal that fits the price column. The
+// parameter names the sibling field holding its currency; when that holds a
+// supported currency, the amount may not have more decimal places than the
+// currency's minor unit.
+func amount(fl validator.FieldLevel) bool {
+	value, ok := fl.Field().Interface().(decimal.Decimal)
+	if !ok || !value.IsPositive() || !value.LessThan(maxAmount) {
+		return false
+	}
+
+	field, kind, _, found := fl.GetStructFieldOKAdvanced2(fl.Parent(), fl.Param())
+	if !found || kind != reflect.String || !money.Supported(field.String()) {
+		return true
+	}
+	return money.ValidPrecision(value, field.String())
+}
+
+// maxRate is the bound of the numeric(24,12) exchange rate column.
+var maxRate = decimal.New(1, 12)
+
+// rate accepts a positive decimal.Decimal that fits the exchange rate column
+// without rounding.
+func rate(fl validator.FieldLevel) bool {
+	value, ok := fl.Field().Interface().(decimal.Decimal)
+	return ok && value.IsPositive() && value.LessThan(maxRate) && value.Equal(value.Truncate(money.RateScale))
+}
+
+var (
+	slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+	slugLetter  = regexp.MustCompile(`[a-z]`)
+)
+
+// slug accepts URL-friendly identifiers like home-garden. A slug needs a
+// letter, as categories are looked up by ID when the reference is a number.
+func slug(fl validator.FieldLevel) bool {
+	value := fl.Field().String()
+	return slugPattern.MatchString(value) && slugLetter.MatchString(value)
+}
+
+// attrName accepts the names of custom product attributes, like weight_kg.
+func attrName(fl validator.FieldLevel) bool {
+	return attributes.Name.MatchString(fl.Field().String())
+}
+
+var skuPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// sku accepts stock keeping unit codes like TSHIRT-RED-M.
+func sku(fl validator.FieldLevel) bool {
+	return skuPattern.MatchString(fl.Field().String())
+}
+
+// imageHost accepts http(s) URLs whose host is in the configured allow list.
+// An entry like *.example.com allows any subdomain of example.com.
+func (v *Validator) imageHost(fl validator.FieldLevel) bool {
+	u, err := url.Parse(fl.Field().String())
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return false
+	}
+	if len(v.hosts) == 0 {
+		return true
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range v.hosts {
+		if suffix, ok := strings.CutPrefix(allowed, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}